@@ -14,19 +14,104 @@ type Operation string
 
 const (
 	// OpSetPerm represents the setting of ACLs on an entity.
-	// Required fields: Entity, ACL
+	// Required fields: Entity, ACL, Channel
 	OpSetPerm Operation = "set-perm"
 
 	// OpPromulgate, OpUnpromulgate represent the promulgation on an entity.
 	// Required fields: Entity
 	OpPromulgate   Operation = "promulgate"
 	OpUnpromulgate Operation = "unpromulgate"
+
+	// OpUploadEntity represents the upload of a charm or bundle archive.
+	// Required fields: Entity
+	OpUploadEntity Operation = "upload-entity"
+
+	// OpDeleteEntity represents the deletion of a charm or bundle.
+	// Required fields: Entity
+	OpDeleteEntity Operation = "delete-entity"
+
+	// OpPublish represents the publishing of an entity to a channel.
+	// Required fields: Entity, Channel, NewValue
+	// Optional fields: OldValue (the entity previously published
+	// to the channel)
+	OpPublish Operation = "publish"
+
+	// OpSetExtraInfo, OpSetCommonInfo represent the setting of
+	// extra-info and common-info values. The old and new values
+	// hold maps from key to value.
+	// Required fields: Entity, NewValue
+	// Optional fields: OldValue
+	OpSetExtraInfo  Operation = "set-extra-info"
+	OpSetCommonInfo Operation = "set-common-info"
+
+	// OpSetReleaseNotes represents the setting of the release notes
+	// of an entity.
+	// Required fields: Entity
+	// Optional fields: OldValue, NewValue
+	OpSetReleaseNotes Operation = "set-release-notes"
+
+	// OpUploadResource represents the upload of a resource revision.
+	// Required fields: Entity, Resource
+	OpUploadResource Operation = "upload-resource"
+
+	// OpDeleteResource represents the deletion of a resource revision.
+	// Required fields: Entity, Resource
+	OpDeleteResource Operation = "delete-resource"
+
+	// OpUploadOCIBlob represents the upload of a blob for an OCI
+	// image resource.
+	// Required fields: Entity, Resource, NewValue (the blob digest)
+	OpUploadOCIBlob Operation = "upload-oci-blob"
+
+	// OpCreateUpload represents the creation of a multipart upload.
+	// Required fields: NewValue (the upload id)
+	OpCreateUpload Operation = "create-upload"
+
+	// OpCreateAccessToken represents the creation of a personal
+	// access token.
+	// Required fields: NewValue (the token, without its secret value)
+	OpCreateAccessToken Operation = "create-access-token"
+
+	// OpRevokeAccessToken represents the revocation of a personal
+	// access token.
+	// Required fields: OldValue (the token, without its secret value)
+	OpRevokeAccessToken Operation = "revoke-access-token"
+
+	// OpSetGroup represents a change to the members of a group
+	// managed by the charm store.
+	// Required fields: NewValue (the group)
+	OpSetGroup Operation = "set-group"
+
+	// OpRemoveGroup represents the removal of a group managed
+	// by the charm store.
+	// Required fields: OldValue (the group)
+	OpRemoveGroup Operation = "remove-group"
+
+	// OpSetOrg represents the creation of, or a change to, an
+	// organisation, including changes to its members and default
+	// ACL.
+	// Required fields: NewValue (the organisation)
+	OpSetOrg Operation = "set-org"
+
+	// OpRemoveOrg represents the removal of an organisation.
+	// Required fields: OldValue (the organisation)
+	OpRemoveOrg Operation = "remove-org"
+
+	// OpTransferEntity represents the transfer of a charm or bundle
+	// to another namespace.
+	// Required fields: Entity (the old base URL), NewValue (the new
+	// base URL)
+	OpTransferEntity Operation = "transfer-entity"
 )
 
 // ACL represents an access control list.
 type ACL struct {
-	Read  []string `json:"read,omitempty"`
-	Write []string `json:"write,omitempty"`
+	Read    []string `json:"read,omitempty"`
+	Write   []string `json:"write,omitempty"`
+	Upload  []string `json:"upload,omitempty"`
+	Publish []string `json:"publish,omitempty"`
+	SetPerm []string `json:"set-perm,omitempty"`
+	Delete  []string `json:"delete,omitempty"`
 }
 
 // Entry represents an audit log entry.
@@ -36,4 +121,61 @@ type Entry struct {
 	Op     Operation  `json:"op"`
 	Entity *charm.URL `json:"entity,omitempty"`
 	ACL    *ACL       `json:"acl,omitempty"`
+
+	// Channel holds the channel affected by the operation.
+	Channel string `json:"channel,omitempty"`
+
+	// Resource holds the resource affected by the operation, in the
+	// form "name" or "name/revision".
+	Resource string `json:"resource,omitempty"`
+
+	// OldValue and NewValue hold the values before and after
+	// the operation, where relevant.
+	OldValue interface{} `json:"old-value,omitempty"`
+	NewValue interface{} `json:"new-value,omitempty"`
+
+	// RemoteAddr holds the network address of the requester.
+	RemoteAddr string `json:"remote-addr,omitempty"`
+
+	// AuthMethod holds the method used to authenticate the
+	// requester, for example "basic" or "macaroon".
+	AuthMethod string `json:"auth-method,omitempty"`
+
+	// Seq holds the position of the entry in the audit log.
+	// PrevHash holds the hash of the previous entry in the
+	// log and Hash holds the hash of this entry, including
+	// PrevHash, so that the entries form a hash chain. These
+	// fields are set when the entry is stored.
+	Seq      int64  `json:"seq,omitempty"`
+	PrevHash string `json:"prev-hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Verification holds the result of verifying the integrity
+// of the audit log.
+type Verification struct {
+	// Entries holds the number of entries checked.
+	Entries int64 `json:"entries"`
+
+	// Checkpoints holds the number of signed checkpoints checked.
+	Checkpoints int `json:"checkpoints"`
+
+	// LastSeq and LastHash hold the sequence number and hash
+	// of the last entry in the log.
+	LastSeq  int64  `json:"last-seq,omitempty"`
+	LastHash string `json:"last-hash,omitempty"`
+
+	// Breaks holds any integrity failures found. The audit log
+	// is intact only if this is empty.
+	Breaks []Break `json:"breaks,omitempty"`
+}
+
+// Break describes an integrity failure found in the audit log.
+type Break struct {
+	// Seq holds the sequence number of the entry at which
+	// the failure was found.
+	Seq int64 `json:"seq"`
+
+	// Reason describes the failure.
+	Reason string `json:"reason"`
 }
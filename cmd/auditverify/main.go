@@ -0,0 +1,95 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The auditverify command verifies the integrity of the charm store
+// audit log hash chain and its signed checkpoints.
+package main // import "gopkg.in/juju/charmstore.v5-unstable/cmd/auditverify"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/config"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+)
+
+var logger = loggo.GetLogger("auditverify")
+
+var loggingConfig = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
+
+// errBroken is returned by run when the audit log
+// fails verification.
+var errBroken = errgo.New("audit log verification failed")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	logger.Debugf("reading config file %q", confPath)
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	pool, err := charmstore.NewPool(session.DB(dbName), nil, nil, charmstore.ServerParams{
+		AuditCheckpointKey: conf.AuditCheckpointKey,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+
+	if len(conf.AuditCheckpointKey) == 0 {
+		fmt.Println("warning: no audit-checkpoint-key configured; checkpoints will not be verified")
+	}
+	v, err := store.VerifyAuditLog()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	fmt.Printf("checked %d entries and %d checkpoints\n", v.Entries, v.Checkpoints)
+	if v.LastSeq > 0 {
+		fmt.Printf("last entry %d has hash %s\n", v.LastSeq, v.LastHash)
+	}
+	for _, b := range v.Breaks {
+		fmt.Printf("entry %d: %s\n", b.Seq, b.Reason)
+	}
+	if len(v.Breaks) > 0 {
+		return errBroken
+	}
+	return nil
+}
@@ -23,6 +23,7 @@ import (
 	"gopkg.in/juju/charmstore.v5-unstable/config"
 	"gopkg.in/juju/charmstore.v5-unstable/elasticsearch"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/ratelimit"
 )
 
 var (
@@ -106,7 +107,25 @@ func serve(confPath string) error {
 		MinUploadPartSize:       conf.MinUploadPartSize,
 		MaxUploadPartSize:       conf.MaxUploadPartSize,
 		MaxUploadParts:          conf.MaxUploadParts,
+		ResourceRetentionCount:  conf.ResourceRetention,
 		RunBlobStoreGC:          true,
+		AuditCheckpointKey:      conf.AuditCheckpointKey,
+		AuditCheckpointInterval: conf.AuditCheckpointInterval,
+		GroupCacheMaxAge:        conf.GroupCacheMaxAge.Duration,
+		EntityCacheMaxAge:       conf.EntityCacheMaxAge.Duration,
+		OIDCIssuer:              conf.OIDCIssuer,
+		OIDCClientID:            conf.OIDCClientID,
+		OIDCJWKSURL:             conf.OIDCJWKSURL,
+		OIDCKeys:                conf.OIDCKeys,
+		OIDCUsernameClaim:       conf.OIDCUsernameClaim,
+		OIDCGroupsClaim:         conf.OIDCGroupsClaim,
+		OIDCGroupPrefix:         conf.OIDCGroupPrefix,
+		ReadRateLimit:           rateLimit(conf.ReadRateLimit),
+		WriteRateLimit:          rateLimit(conf.WriteRateLimit),
+		DownloadRateLimit:       rateLimit(conf.DownloadRateLimit),
+		TrustedProxies:          conf.TrustedProxies,
+		RunStatsCompaction:      true,
+		StatsHourlyRetention:    conf.StatsHourlyRetention.Duration,
 	}
 	switch conf.BlobStore {
 	case config.MongoDBBlobStore:
@@ -126,6 +145,15 @@ func serve(confPath string) error {
 		return errgo.Newf("unknown blob store type")
 	}
 
+	switch conf.GroupProvider {
+	case config.IdentityGroupProvider:
+		// This is the default. No need for a custom function.
+	case config.MongoDBGroupProvider:
+		cfg.NewGroupProvider = charmstore.NewMongoGroupProvider
+	default:
+		return errgo.Newf("unknown group provider type")
+	}
+
 	if conf.AuditLogFile != "" {
 		cfg.AuditLogger = &lumberjack.Logger{
 			Filename: conf.AuditLogFile,
@@ -163,6 +191,13 @@ func addPublicKey(ring *bakery.PublicKeyRing, loc string, key *bakery.PublicKey)
 	return ring.AddPublicKeyForLocation(loc, false, pubKey)
 }
 
+func rateLimit(l config.RateLimit) ratelimit.Limit {
+	return ratelimit.Limit{
+		Rate:  l.Rate,
+		Burst: l.Burst,
+	}
+}
+
 var mgoLogger = loggo.GetLogger("mgo")
 
 func init() {
@@ -6,8 +6,10 @@
 package config // import "gopkg.in/juju/charmstore.v5-unstable/config"
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -43,6 +45,7 @@ type Config struct {
 	MinUploadPartSize int64             `yaml:"min-upload-part-size"`
 	MaxUploadPartSize int64             `yaml:"max-upload-part-size"`
 	MaxUploadParts    int               `yaml:"max-upload-parts"`
+	ResourceRetention int               `yaml:"resource-retention,omitempty"`
 	BlobStore         BlobStoreType     `yaml:"blobstore"`
 	SwiftAuthURL      string            `yaml:"swift-auth-url"`
 	SwiftEndpointURL  string            `yaml:"swift-endpoint-url"`
@@ -52,6 +55,68 @@ type Config struct {
 	SwiftRegion       string            `yaml:"swift-region"`
 	SwiftTenant       string            `yaml:"swift-tenant"`
 	SwiftAuthMode     *SwiftAuthMode    `yaml:"swift-authmode"`
+
+	// AuditCheckpointKey holds the key used to sign checkpoints
+	// of the audit log hash chain. AuditCheckpointInterval holds
+	// the number of audit log entries between checkpoints.
+	AuditCheckpointKey      SecretKey `yaml:"audit-checkpoint-key,omitempty"`
+	AuditCheckpointInterval int       `yaml:"audit-checkpoint-interval,omitempty"`
+
+	// GroupProvider holds where the groups that users are members
+	// of are obtained from. GroupCacheMaxAge holds the maximum
+	// length of time that the groups of a user are cached for.
+	GroupProvider    GroupProviderType `yaml:"group-provider,omitempty"`
+	GroupCacheMaxAge DurationString    `yaml:"group-cache-max-age,omitempty"`
+
+	// EntityCacheMaxAge holds the maximum length of time that
+	// entities are cached for between requests. Entities are not
+	// cached between requests when it is zero.
+	EntityCacheMaxAge DurationString `yaml:"entity-cache-max-age,omitempty"`
+
+	// OIDCIssuer holds the issuer of OpenID Connect ID tokens that
+	// are accepted to authenticate requests; OIDCClientID must
+	// also be set when it is. The key set used to verify tokens is
+	// discovered from the issuer unless OIDCJWKSURL or OIDCKeys
+	// (a JSON Web Key Set) is set.
+	OIDCIssuer        string `yaml:"oidc-issuer,omitempty"`
+	OIDCClientID      string `yaml:"oidc-client-id,omitempty"`
+	OIDCJWKSURL       string `yaml:"oidc-jwks-url,omitempty"`
+	OIDCKeys          string `yaml:"oidc-keys,omitempty"`
+	OIDCUsernameClaim string `yaml:"oidc-username-claim,omitempty"`
+	OIDCGroupsClaim   string `yaml:"oidc-groups-claim,omitempty"`
+
+	// OIDCGroupPrefix holds the prefix added to the names of the
+	// groups asserted by ID tokens. It defaults to the host name of
+	// OIDCIssuer followed by a colon.
+	OIDCGroupPrefix string `yaml:"oidc-group-prefix,omitempty"`
+
+	// ReadRateLimit, WriteRateLimit and DownloadRateLimit hold
+	// the rate limits applied to each user or client address
+	// for each kind of request. Requests are not limited when
+	// the rate is zero.
+	ReadRateLimit     RateLimit `yaml:"read-rate-limit,omitempty"`
+	WriteRateLimit    RateLimit `yaml:"write-rate-limit,omitempty"`
+	DownloadRateLimit RateLimit `yaml:"download-rate-limit,omitempty"`
+
+	// TrustedProxies holds the IP addresses or CIDR networks of
+	// the reverse proxies whose X-Forwarded-For headers are
+	// trusted to hold the address of the client.
+	TrustedProxies []string `yaml:"trusted-proxies,omitempty"`
+
+	// StatsHourlyRetention holds the length of time that
+	// statistics counters are kept with hourly granularity
+	// before being rolled up into daily counters.
+	StatsHourlyRetention DurationString `yaml:"stats-hourly-retention,omitempty"`
+}
+
+// RateLimit holds the parameters of a rate limit.
+type RateLimit struct {
+	// Rate holds the average number of requests allowed per second.
+	Rate float64 `yaml:"rate"`
+
+	// Burst holds the maximum number of requests allowed
+	// in a burst.
+	Burst int `yaml:"burst"`
 }
 
 type BlobStoreType string
@@ -61,6 +126,17 @@ const (
 	SwiftBlobStore   BlobStoreType = "swift"
 )
 
+type GroupProviderType string
+
+const (
+	// IdentityGroupProvider obtains groups from the identity manager.
+	IdentityGroupProvider GroupProviderType = "identity"
+
+	// MongoDBGroupProvider uses the groups managed by the charm
+	// store itself, which are stored in MongoDB.
+	MongoDBGroupProvider GroupProviderType = "mongodb"
+)
+
 // SwiftAuthMode implements unmarshaling for
 // an identity.AuthMode.
 type SwiftAuthMode struct {
@@ -115,6 +191,31 @@ func (c *Config) validate() error {
 	default:
 		return errgo.Newf("invalid blob store type %q", c.BlobStore)
 	}
+	if c.GroupProvider == "" {
+		c.GroupProvider = IdentityGroupProvider
+	}
+	switch c.GroupProvider {
+	case IdentityGroupProvider, MongoDBGroupProvider:
+	default:
+		return errgo.Newf("invalid group provider %q", c.GroupProvider)
+	}
+	if c.OIDCIssuer != "" {
+		needString("oidc-client-id", c.OIDCClientID)
+	}
+	for name, limit := range map[string]RateLimit{
+		"read-rate-limit":     c.ReadRateLimit,
+		"write-rate-limit":    c.WriteRateLimit,
+		"download-rate-limit": c.DownloadRateLimit,
+	} {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return errgo.Newf("invalid %s (negative value)", name)
+		}
+	}
+	for _, addr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+			return errgo.Newf("invalid trusted proxy %q", addr)
+		}
+	}
 	if len(missing) != 0 {
 		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
 	}
@@ -158,3 +259,16 @@ func (dp *DurationString) UnmarshalText(data []byte) error {
 	dp.Duration = d
 	return nil
 }
+
+// SecretKey holds a secret key that unmarshals from
+// a base64-encoded string.
+type SecretKey []byte
+
+func (k *SecretKey) UnmarshalText(data []byte) error {
+	key, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return errgo.Notef(err, "cannot decode key")
+	}
+	*k = key
+	return nil
+}
@@ -59,6 +59,27 @@ swift-bucket: bucket
 swift-region: somewhere
 swift-tenant: a-tenant
 swift-authmode: userpass
+audit-checkpoint-key: c2VjcmV0IGtleQ==
+audit-checkpoint-interval: 500
+group-provider: mongodb
+group-cache-max-age: 30s
+entity-cache-max-age: 5m
+oidc-issuer: https://accounts.example.com
+oidc-client-id: charmstore
+oidc-jwks-url: https://accounts.example.com/keys
+oidc-username-claim: preferred_username
+oidc-groups-claim: roles
+oidc-group-prefix: 'example:'
+trusted-proxies:
+  - 10.0.0.0/8
+  - 192.168.1.1
+read-rate-limit:
+  rate: 10
+  burst: 50
+download-rate-limit:
+  rate: 0.5
+  burst: 5
+stats-hourly-retention: 48h
 `
 
 func (s *ConfigSuite) readConfig(c *gc.C, content string) (*config.Config, error) {
@@ -99,18 +120,39 @@ func (s *ConfigSuite) TestRead(c *gc.C) {
 				mustParseKey("lsvcDkapKoFxIyjX9/eQgb3s41KVwPMISFwAJdVCZ70="),
 			},
 		},
-		StatsCacheMaxAge:  config.DurationString{time.Hour},
-		RequestTimeout:    config.DurationString{500 * time.Millisecond},
-		MaxMgoSessions:    10,
-		SearchCacheMaxAge: config.DurationString{15 * time.Minute},
-		BlobStore:         config.SwiftBlobStore,
-		SwiftAuthURL:      "https://foo.com",
-		SwiftUsername:     "bob",
-		SwiftSecret:       "secret",
-		SwiftBucket:       "bucket",
-		SwiftRegion:       "somewhere",
-		SwiftTenant:       "a-tenant",
-		SwiftAuthMode:     &config.SwiftAuthMode{identity.AuthUserPass},
+		StatsCacheMaxAge:        config.DurationString{time.Hour},
+		RequestTimeout:          config.DurationString{500 * time.Millisecond},
+		MaxMgoSessions:          10,
+		SearchCacheMaxAge:       config.DurationString{15 * time.Minute},
+		BlobStore:               config.SwiftBlobStore,
+		SwiftAuthURL:            "https://foo.com",
+		SwiftUsername:           "bob",
+		SwiftSecret:             "secret",
+		SwiftBucket:             "bucket",
+		SwiftRegion:             "somewhere",
+		SwiftTenant:             "a-tenant",
+		SwiftAuthMode:           &config.SwiftAuthMode{identity.AuthUserPass},
+		AuditCheckpointKey:      config.SecretKey("secret key"),
+		AuditCheckpointInterval: 500,
+		GroupProvider:           config.MongoDBGroupProvider,
+		GroupCacheMaxAge:        config.DurationString{30 * time.Second},
+		EntityCacheMaxAge:       config.DurationString{5 * time.Minute},
+		OIDCIssuer:              "https://accounts.example.com",
+		OIDCClientID:            "charmstore",
+		OIDCJWKSURL:             "https://accounts.example.com/keys",
+		OIDCUsernameClaim:       "preferred_username",
+		OIDCGroupsClaim:         "roles",
+		OIDCGroupPrefix:         "example:",
+		TrustedProxies:          []string{"10.0.0.0/8", "192.168.1.1"},
+		ReadRateLimit: config.RateLimit{
+			Rate:  10,
+			Burst: 50,
+		},
+		DownloadRateLimit: config.RateLimit{
+			Rate:  0.5,
+			Burst: 5,
+		},
+		StatsHourlyRetention: config.DurationString{48 * time.Hour},
 	})
 }
 
@@ -125,6 +167,22 @@ func (s *ConfigSuite) TestValidateConfigError(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password in config file")
 	c.Assert(cfg, gc.IsNil)
 
+	cfg, err = s.readConfig(c, "oidc-issuer: https://accounts.example.com\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, oidc-client-id in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "write-rate-limit: {rate: -1}\n")
+	c.Assert(err, gc.ErrorMatches, `invalid write-rate-limit \(negative value\)`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "group-provider: ldap\n")
+	c.Assert(err, gc.ErrorMatches, `invalid group provider "ldap"`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "trusted-proxies: [proxy.example.com]\n")
+	c.Assert(err, gc.ErrorMatches, `invalid trusted proxy "proxy.example.com"`)
+	c.Assert(cfg, gc.IsNil)
+
 	cfg, err = s.readConfig(c, "blobstore: swift\n")
 	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, swift-auth-url, swift-username, swift-secret, swift-bucket, swift-region, swift-tenant, swift-auth-mode in config file")
 	c.Assert(cfg, gc.IsNil)
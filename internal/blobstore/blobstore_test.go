@@ -4,6 +4,7 @@
 package blobstore_test // import "gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -555,6 +556,7 @@ func (s *blobStoreSuite) TestFinishUploadSuccess(c *gc.C) {
 			hashOf(content0),
 			hashOf(content1),
 		},
+		Hash256: hash256Of(content0 + content1),
 	})
 }
 
@@ -577,6 +579,7 @@ func (s *blobStoreSuite) TestFinishUploadSuccessOnePart(c *gc.C) {
 		Hashes: []string{
 			hashOf(content0),
 		},
+		Hash256: hash256Of(content0),
 	})
 }
 
@@ -606,6 +609,7 @@ func (s *blobStoreSuite) TestFinishUploadAgain(c *gc.C) {
 		Hashes: []string{
 			hashOf(content0),
 		},
+		Hash256: hash256Of(content0),
 	})
 
 	// We should get exactly the same thing if we call
@@ -622,6 +626,7 @@ func (s *blobStoreSuite) TestFinishUploadAgain(c *gc.C) {
 		Hashes: []string{
 			hashOf(content0),
 		},
+		Hash256: hash256Of(content0),
 	})
 }
 
@@ -867,18 +872,22 @@ func (s *blobStoreSuite) TestUploadInfo(c *gc.C) {
 	c.Assert(info, jc.DeepEquals, blobstore.UploadInfo{
 		Parts: []*blobstore.PartInfo{{
 			Hash:     hashOf(part0),
+			Hash256:  hash256Of(part0),
 			Size:     int64(len(part0)),
 			Complete: true,
 		}, {
 			Hash:     hashOf(part1),
+			Hash256:  hash256Of(part1),
 			Size:     int64(len(part1)),
 			Complete: true,
 		}, {
 			Hash:     hashOf(part2),
+			Hash256:  hash256Of(part2),
 			Size:     int64(len(part2)),
 			Complete: true,
 		}},
-		Hash: hashOf(part0 + part1 + part2),
+		Hash:    hashOf(part0 + part1 + part2),
+		Hash256: hash256Of(part0 + part1 + part2),
 	})
 
 	// Check that we can read the blob from the index
@@ -1036,6 +1045,10 @@ func hashOf(s string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+func hash256Of(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
 type dataSource struct {
 	buf      []byte
 	bufIndex int
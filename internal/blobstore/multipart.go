@@ -4,6 +4,7 @@
 package blobstore
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -41,6 +42,10 @@ type uploadDoc struct {
 	// is empty until after FinishUpload is called.
 	Hash string `bson:"hash,omitempty"`
 
+	// Hash256 holds the SHA256 hash of all the concatenated parts.
+	// It is set at the same time as Hash.
+	Hash256 string `bson:"hash256,omitempty"`
+
 	// Expires holds the expiry time of the upload.
 	Expires time.Time
 
@@ -64,6 +69,10 @@ type uploadDoc struct {
 type PartInfo struct {
 	// Hash holds the SHA384 hash of the part.
 	Hash string
+	// Hash256 holds the SHA256 hash of the part. It is
+	// calculated as the part is uploaded, and is only
+	// set when the part is complete.
+	Hash256 string `bson:",omitempty"`
 	// Size holds the size of the part.
 	Size int64
 	// Complete holds whether the part has been
@@ -86,6 +95,11 @@ type UploadInfo struct {
 	// This will be empty until the upload has
 	// been completed with FinishUpload.
 	Hash string `bson:"hash,omitempty"`
+
+	// Hash256 holds the SHA256 hash of the entire
+	// upload. Like Hash, it is empty until the upload
+	// has been completed.
+	Hash256 string `bson:"hash256,omitempty"`
 }
 
 // Index returns a multipart index suitable for opening
@@ -97,8 +111,9 @@ func (info *UploadInfo) Index() (*mongodoc.MultipartIndex, bool) {
 		return nil, false
 	}
 	idx := &mongodoc.MultipartIndex{
-		Sizes:  make([]uint32, len(info.Parts)),
-		Hashes: make(mongodoc.Hashes, len(info.Parts)),
+		Sizes:   make([]uint32, len(info.Parts)),
+		Hashes:  make(mongodoc.Hashes, len(info.Parts)),
+		Hash256: info.Hash256,
 	}
 	for i, p := range info.Parts {
 		idx.Sizes[i] = uint32(p.Size)
@@ -175,8 +190,12 @@ func (s *Store) PutPart(uploadId string, part int, r io.Reader, size int64, hash
 		}
 	}
 	// The part record has been updated successfully, so
-	// we can actually upload the part now.
-	if err := s.Put(r, hash, size); err != nil {
+	// we can actually upload the part now. The SHA256 hash
+	// is calculated as the content is read so that the hash
+	// of the whole upload does not need to be calculated
+	// from scratch later.
+	hash256 := sha256.New()
+	if err := s.Put(io.TeeReader(r, hash256), hash, size); err != nil {
 		return errgo.Notef(err, "cannot upload part %q", hash)
 	}
 
@@ -189,6 +208,7 @@ func (s *Store) PutPart(uploadId string, part int, r io.Reader, size int64, hash
 			partElem,
 			PartInfo{
 				Hash:     hash,
+				Hash256:  fmt.Sprintf("%x", hash256.Sum(nil)),
 				Size:     size,
 				Complete: true,
 			},
@@ -253,6 +273,7 @@ func (s *Store) UploadInfo(uploadId string) (UploadInfo, error) {
 		Parts:   udoc.Parts,
 		Expires: udoc.Expires,
 		Hash:    udoc.Hash,
+		Hash256: udoc.Hash256,
 	}, nil
 }
 
@@ -319,7 +340,7 @@ func (s *Store) FinishUpload(uploadId string, parts []Part) (idx *mongodoc.Multi
 	}
 	// Calculate the hash of the entire thing, which marks
 	// it as a completed upload.
-	hash, err = s.setUploadHash(uploadId, udoc)
+	hash, hash256, err := s.setUploadHash(uploadId, udoc)
 	if err != nil {
 		if errgo.Cause(err) == ErrNotFound {
 			return nil, "", errgo.New("upload expired or removed")
@@ -327,8 +348,9 @@ func (s *Store) FinishUpload(uploadId string, parts []Part) (idx *mongodoc.Multi
 		return nil, "", errgo.Mask(err)
 	}
 	idx = &mongodoc.MultipartIndex{
-		Sizes:  make([]uint32, len(parts)),
-		Hashes: make(mongodoc.Hashes, len(parts)),
+		Sizes:   make([]uint32, len(parts)),
+		Hashes:  make(mongodoc.Hashes, len(parts)),
+		Hash256: hash256,
 	}
 	for i, p := range udoc.Parts {
 		idx.Sizes[i] = uint32(p.Size)
@@ -337,40 +359,45 @@ func (s *Store) FinishUpload(uploadId string, parts []Part) (idx *mongodoc.Multi
 	return idx, hash, nil
 }
 
-// setUploadHash calculates the hash of an complete multipart
-// upload and sets it on the upload document which marks
-// is as complete. It returns the hash.
+// setUploadHash calculates the SHA384 and SHA256 hashes of an
+// complete multipart upload and sets them on the upload document which
+// marks is as complete. It returns the hashes.
 // Precondition: all the parts have previously been checked for
 // validity.
-func (s *Store) setUploadHash(uploadId string, udoc *uploadDoc) (string, error) {
+func (s *Store) setUploadHash(uploadId string, udoc *uploadDoc) (hash, hash256 string, err error) {
 	if udoc.Hash != "" {
-		return udoc.Hash, nil
+		return udoc.Hash, udoc.Hash256, nil
 	}
-	var hash string
 	if len(udoc.Parts) == 1 {
-		// If there's only one part, we already know the hash
+		// If there's only one part, we already know the hashes
 		// of the whole thing.
 		hash = udoc.Parts[0].Hash
+		hash256 = udoc.Parts[0].Hash256
 	} else {
+		// Both hashes are calculated in the same pass
+		// over the content.
 		h := NewHash()
+		h256 := sha256.New()
+		w := io.MultiWriter(h, h256)
 		for i := range udoc.Parts {
-			if err := s.copyBlob(h, udoc.Parts[i].Hash); err != nil {
-				return "", errgo.Mask(err, errgo.Is(ErrNotFound))
+			if err := s.copyBlob(w, udoc.Parts[i].Hash); err != nil {
+				return "", "", errgo.Mask(err, errgo.Is(ErrNotFound))
 			}
 		}
 		hash = fmt.Sprintf("%x", h.Sum(nil))
+		hash256 = fmt.Sprintf("%x", h256.Sum(nil))
 	}
 	// Note: setting the hash field marks the upload as complete.
-	err := s.uploadc.UpdateId(uploadId, bson.D{{
-		"$set", bson.D{{"hash", hash}},
+	err = s.uploadc.UpdateId(uploadId, bson.D{{
+		"$set", bson.D{{"hash", hash}, {"hash256", hash256}},
 	}})
 	if err == mgo.ErrNotFound {
-		return "", ErrNotFound
+		return "", "", ErrNotFound
 	}
 	if err != nil {
-		return "", errgo.Notef(err, "could not update hash")
+		return "", "", errgo.Notef(err, "could not update hash")
 	}
-	return hash, nil
+	return hash, hash256, nil
 }
 
 // copyBlob copies the contents of blob with the given hash
@@ -0,0 +1,117 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// AccessTokenPrefix holds the prefix of all access token values,
+// which allows them to be distinguished from other credentials.
+const AccessTokenPrefix = "cst_"
+
+// NewAccessToken stores the given access token, setting its Id, Hash
+// and Created fields, and returns the secret value that must be
+// presented to use the token. The value itself is not stored, so it
+// cannot be retrieved later.
+func (s *Store) NewAccessToken(tok *mongodoc.AccessToken) (string, error) {
+	id, err := randomString(8)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	value := AccessTokenPrefix + secret
+	tok.Id = id
+	tok.Hash = accessTokenHash(value)
+	// Match mongo's behaviour so that the returned time is accurate.
+	tok.Created = time.Now().Truncate(time.Millisecond)
+	if err := s.DB.AccessTokens().Insert(tok); err != nil {
+		return "", errgo.Notef(err, "cannot insert access token")
+	}
+	return value, nil
+}
+
+// AccessToken returns the access token with the given secret value,
+// and records that the token has been used. If there is no such token
+// or it has expired, it returns an error with a params.ErrNotFound
+// cause.
+func (s *Store) AccessToken(value string) (*mongodoc.AccessToken, error) {
+	if !strings.HasPrefix(value, AccessTokenPrefix) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "access token not found")
+	}
+	var tok mongodoc.AccessToken
+	if err := s.DB.AccessTokens().Find(bson.D{{"hash", accessTokenHash(value)}}).One(&tok); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "access token not found")
+		}
+		return nil, errgo.Notef(err, "cannot retrieve access token")
+	}
+	now := time.Now()
+	if !tok.Expires.IsZero() && !now.Before(tok.Expires) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "access token has expired")
+	}
+	if err := s.DB.AccessTokens().UpdateId(tok.Id, bson.D{{"$set", bson.D{{"lastused", now}}}}); err != nil {
+		logger.Errorf("cannot update last use of access token %q: %v", tok.Id, err)
+	}
+	return &tok, nil
+}
+
+// AccessTokens returns all the access tokens owned by the given user,
+// oldest first.
+func (s *Store) AccessTokens(user string) ([]mongodoc.AccessToken, error) {
+	tokens := make([]mongodoc.AccessToken, 0)
+	if err := s.DB.AccessTokens().Find(bson.D{{"user", user}}).Sort("created", "_id").All(&tokens); err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve access tokens")
+	}
+	return tokens, nil
+}
+
+// RemoveAccessToken removes the access token with the given id and
+// returns it. If user is not empty, the token must be owned by that
+// user. If there is no matching token, it returns an error with a
+// params.ErrNotFound cause.
+func (s *Store) RemoveAccessToken(id, user string) (*mongodoc.AccessToken, error) {
+	query := bson.D{{"_id", id}}
+	if user != "" {
+		query = append(query, bson.DocElem{"user", user})
+	}
+	var tok mongodoc.AccessToken
+	if _, err := s.DB.AccessTokens().Find(query).Apply(mgo.Change{Remove: true}, &tok); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "access token %q not found", id)
+		}
+		return nil, errgo.Notef(err, "cannot remove access token")
+	}
+	return &tok, nil
+}
+
+// accessTokenHash returns the hash of the given access token value
+// as stored in the database.
+func accessTokenHash(value string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
+}
+
+// randomString returns a URL-safe string encoding n random bytes.
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Notef(err, "cannot generate random bytes")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+type accessTokenSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&accessTokenSuite{})
+
+func (s *accessTokenSuite) TestNewAccessToken(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	tok := &mongodoc.AccessToken{
+		User:     "bob",
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{"write"},
+		Channels: []params.Channel{params.EdgeChannel},
+	}
+	value, err := store.NewAccessToken(tok)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(strings.HasPrefix(value, AccessTokenPrefix), gc.Equals, true)
+	c.Assert(tok.Id, gc.Not(gc.Equals), "")
+	c.Assert(tok.Hash, gc.Equals, accessTokenHash(value))
+	c.Assert(tok.Created.IsZero(), gc.Equals, false)
+
+	// The secret value is not stored.
+	n, err := store.DB.AccessTokens().Find(nil).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	var doc map[string]interface{}
+	err = store.DB.AccessTokens().FindId(tok.Id).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+	for k, v := range doc {
+		c.Assert(v, gc.Not(gc.Equals), value, gc.Commentf("field %q", k))
+	}
+
+	got, err := store.AccessToken(value)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(got.LastUsed.IsZero(), gc.Equals, true)
+	got.Created = got.Created.UTC()
+	tok.Created = tok.Created.UTC()
+	c.Assert(got, jc.DeepEquals, tok)
+
+	// Using the token records the time it was last used.
+	got, err = store.AccessToken(value)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(got.LastUsed.IsZero(), gc.Equals, false)
+
+	// Each token has a distinct id and value.
+	tok2 := &mongodoc.AccessToken{
+		User: "bob",
+	}
+	value2, err := store.NewAccessToken(tok2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(value2, gc.Not(gc.Equals), value)
+	c.Assert(tok2.Id, gc.Not(gc.Equals), tok.Id)
+}
+
+func (s *accessTokenSuite) TestAccessTokenNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	_, err := store.NewAccessToken(&mongodoc.AccessToken{
+		User: "bob",
+	})
+	c.Assert(err, gc.Equals, nil)
+	for _, value := range []string{"", "foo", AccessTokenPrefix + "foo"} {
+		_, err := store.AccessToken(value)
+		c.Assert(err, gc.ErrorMatches, "access token not found")
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	}
+}
+
+func (s *accessTokenSuite) TestAccessTokenExpired(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	value, err := store.NewAccessToken(&mongodoc.AccessToken{
+		User:    "bob",
+		Expires: time.Now().Add(-time.Minute),
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.AccessToken(value)
+	c.Assert(err, gc.ErrorMatches, "access token has expired")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	value, err = store.NewAccessToken(&mongodoc.AccessToken{
+		User:    "bob",
+		Expires: time.Now().Add(time.Hour),
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.AccessToken(value)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *accessTokenSuite) TestAccessTokens(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	tokens, err := store.AccessTokens("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, 0)
+
+	var ids []string
+	for _, user := range []string{"bob", "alice", "bob"} {
+		tok := &mongodoc.AccessToken{
+			User: user,
+		}
+		_, err := store.NewAccessToken(tok)
+		c.Assert(err, gc.Equals, nil)
+		if user == "bob" {
+			ids = append(ids, tok.Id)
+		}
+	}
+	tokens, err = store.AccessTokens("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tokens, gc.HasLen, 2)
+	c.Assert(tokens[0].Id, gc.Equals, ids[0])
+	c.Assert(tokens[1].Id, gc.Equals, ids[1])
+}
+
+func (s *accessTokenSuite) TestRemoveAccessToken(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	tok := &mongodoc.AccessToken{
+		User: "bob",
+	}
+	value, err := store.NewAccessToken(tok)
+	c.Assert(err, gc.Equals, nil)
+
+	// Another user cannot remove the token.
+	_, err = store.RemoveAccessToken(tok.Id, "alice")
+	c.Assert(err, gc.ErrorMatches, `access token ".*" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	removed, err := store.RemoveAccessToken(tok.Id, "bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(removed.Id, gc.Equals, tok.Id)
+	c.Assert(removed.User, gc.Equals, "bob")
+
+	_, err = store.AccessToken(value)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.RemoveAccessToken(tok.Id, "")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// An empty user matches any owner.
+	tok = &mongodoc.AccessToken{
+		User: "bob",
+	}
+	_, err = store.NewAccessToken(tok)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.RemoveAccessToken(tok.Id, "")
+	c.Assert(err, gc.Equals, nil)
+}
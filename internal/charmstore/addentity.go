@@ -604,13 +604,13 @@ func (s *Store) addBundle(b charm.Bundle, p addParams) error {
 // entity has already been validated and stored.
 func (s *Store) addEntity(entity *mongodoc.Entity) (err error) {
 	// Add the base entity to the database.
-	perms := []string{entity.User}
+	acl, err := s.newBaseEntityACL(entity.User)
+	if err != nil {
+		return errgo.Notef(err, "cannot determine base entity ACL")
+	}
 	channelACLs := make(map[params.Channel]mongodoc.ACL, len(params.OrderedChannels))
 	for _, ch := range params.OrderedChannels {
-		channelACLs[ch] = mongodoc.ACL{
-			Read:  perms,
-			Write: perms,
-		}
+		channelACLs[ch] = acl
 	}
 	baseEntity := &mongodoc.BaseEntity{
 		URL:         entity.BaseURL,
@@ -623,6 +623,13 @@ func (s *Store) addEntity(entity *mongodoc.Entity) (err error) {
 	if err != nil && !mgo.IsDup(err) {
 		return errgo.Notef(err, "cannot insert base entity")
 	}
+	if err == nil {
+		// The base URL now refers to a new base entity, so any
+		// redirect left by an earlier transfer no longer applies.
+		if err := s.DB.Redirects().RemoveId(entity.BaseURL); err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot remove redirect for %q", entity.BaseURL)
+		}
+	}
 
 	// Add the entity to the database.
 	err = s.DB.Entities().Insert(entity)
@@ -632,6 +639,8 @@ func (s *Store) addEntity(entity *mongodoc.Entity) (err error) {
 	if err != nil {
 		return errgo.Notef(err, "cannot insert entity")
 	}
+	defer s.invalidateEntityCache(entity.Name)
+	s.touchBaseEntitiesAfterChange(bson.D{{"_id", entity.BaseURL}})
 	return nil
 }
 
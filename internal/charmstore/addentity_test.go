@@ -525,8 +525,12 @@ func assertBaseEntity(c *gc.C, store *Store, url *charm.URL, promulgated bool) {
 	baseEntity, err := store.FindBaseEntity(url, nil)
 	c.Assert(err, gc.Equals, nil)
 	acls := mongodoc.ACL{
-		Read:  []string{url.User},
-		Write: []string{url.User},
+		Read:    []string{url.User},
+		Write:   []string{url.User},
+		Upload:  []string{url.User},
+		Publish: []string{url.User},
+		SetPerm: []string{url.User},
+		Delete:  []string{url.User},
 	}
 	expectACLs := map[params.Channel]mongodoc.ACL{
 		params.StableChannel:      acls,
@@ -195,6 +195,7 @@ func (s *Store) OpenCachedBlobFile(
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot update %q", entity.URL)
 	}
+	s.invalidateEntityCache(entity.URL.Name)
 	if !zipf.IsValid() {
 		// We searched for the file and didn't find it.
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
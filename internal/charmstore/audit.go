@@ -0,0 +1,446 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// AuditQuery holds the parameters of a query for audit log entries.
+// All the specified fields must match for an entry to be returned.
+type AuditQuery struct {
+	// Entity holds the entity the entries refer to. If its
+	// revision is -1, entries for all revisions of the entity
+	// are returned.
+	Entity *charm.URL
+
+	// User holds the user that performed the operation.
+	User string
+
+	// Op holds the audited operation.
+	Op audit.Operation
+
+	// Start and Stop hold the time range of the entries.
+	// A zero time leaves the range unbounded in that direction.
+	Start, Stop time.Time
+
+	// Skip and Limit control the pagination of the results.
+	// A zero Limit returns all the matching entries.
+	Skip, Limit int
+}
+
+// AuditEntries returns the audit log entries that match the given query,
+// most recent first.
+func (s *Store) AuditEntries(q AuditQuery) ([]audit.Entry, error) {
+	query := make(bson.D, 0, 4)
+	if q.Entity != nil {
+		if q.Entity.Revision == -1 {
+			query = append(query, bson.DocElem{"baseurl", mongodoc.BaseURL(q.Entity)})
+		} else {
+			query = append(query, bson.DocElem{"entity", q.Entity})
+		}
+	}
+	if q.User != "" {
+		query = append(query, bson.DocElem{"user", q.User})
+	}
+	if q.Op != "" {
+		query = append(query, bson.DocElem{"op", q.Op})
+	}
+	if !q.Start.IsZero() || !q.Stop.IsZero() {
+		timeRange := make(bson.D, 0, 2)
+		if !q.Start.IsZero() {
+			timeRange = append(timeRange, bson.DocElem{"$gte", q.Start})
+		}
+		if !q.Stop.IsZero() {
+			timeRange = append(timeRange, bson.DocElem{"$lte", q.Stop})
+		}
+		query = append(query, bson.DocElem{"time", timeRange})
+	}
+	var docs []mongodoc.AuditEntry
+	err := s.DB.Audit().Find(query).Sort("-time", "-_id").Skip(q.Skip).Limit(q.Limit).All(&docs)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve audit entries")
+	}
+	entries := make([]audit.Entry, len(docs))
+	for i, doc := range docs {
+		entries[i] = auditEntryFromDoc(&doc)
+	}
+	return entries, nil
+}
+
+// defaultAuditCheckpointInterval holds the default number of audit
+// log entries between signed checkpoints.
+const defaultAuditCheckpointInterval = 1000
+
+// auditLinkWindow holds the length of time that LinkAuditLog waits
+// for a missing entry to be stored before linking the entries that
+// follow it across the gap. Entries stored more recently than this
+// that have not been linked yet are not checked by VerifyAuditLog.
+var auditLinkWindow = time.Minute
+
+// auditSequenceId holds the id of the document in the audit sequence
+// collection that holds the last allocated sequence number.
+const auditSequenceId = "seq"
+
+// insertAudit stores the given audit log entry in the database. On
+// success, the Seq field of the entry is set.
+//
+// The sequence number of the entry is allocated atomically, so an
+// entry is never lost because other entries are being added
+// concurrently. The entry is linked into the hash chain later by
+// LinkAuditLog, so that requests never wait for each other.
+func (s *Store) insertAudit(entry *audit.Entry) error {
+	doc := mongodoc.AuditEntry{
+		Time:       entry.Time,
+		User:       entry.User,
+		Op:         string(entry.Op),
+		Entity:     entry.Entity,
+		Channel:    entry.Channel,
+		Resource:   entry.Resource,
+		RemoteAddr: entry.RemoteAddr,
+		AuthMethod: entry.AuthMethod,
+	}
+	if entry.Entity != nil {
+		doc.BaseURL = mongodoc.BaseURL(entry.Entity)
+	}
+	if entry.ACL != nil {
+		doc.ACL = &mongodoc.ACL{
+			Read:    entry.ACL.Read,
+			Write:   entry.ACL.Write,
+			Upload:  entry.ACL.Upload,
+			Publish: entry.ACL.Publish,
+			SetPerm: entry.ACL.SetPerm,
+			Delete:  entry.ACL.Delete,
+		}
+	}
+	var err error
+	if doc.OldValue, err = marshalAuditValue(entry.OldValue); err != nil {
+		return errgo.Notef(err, "cannot marshal old value")
+	}
+	if doc.NewValue, err = marshalAuditValue(entry.NewValue); err != nil {
+		return errgo.Notef(err, "cannot marshal new value")
+	}
+	doc.Seq, err = s.nextAuditSeq()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.DB.Audit().Insert(&doc); err != nil {
+		return errgo.Notef(err, "cannot insert audit entry")
+	}
+	entry.Seq = doc.Seq
+	return nil
+}
+
+// nextAuditSeq atomically allocates the sequence number of a new
+// audit log entry.
+func (s *Store) nextAuditSeq() (int64, error) {
+	change := mgo.Change{
+		Update:    bson.D{{"$inc", bson.D{{"seq", int64(1)}}}},
+		ReturnNew: true,
+	}
+	for {
+		var doc struct {
+			Seq int64
+		}
+		_, err := s.DB.AuditSequence().FindId(auditSequenceId).Apply(change, &doc)
+		if err == nil {
+			return doc.Seq, nil
+		}
+		if err != mgo.ErrNotFound {
+			return 0, errgo.Notef(err, "cannot allocate audit sequence number")
+		}
+		// There is no sequence document yet, so create one that
+		// follows on from any entries that have already been
+		// stored, then try again.
+		var last mongodoc.AuditEntry
+		err = s.DB.Audit().Find(bson.D{{"seq", bson.D{{"$gt", 0}}}}).Sort("-seq").Select(bson.D{{"seq", 1}}).One(&last)
+		if err != nil && err != mgo.ErrNotFound {
+			return 0, errgo.Notef(err, "cannot retrieve last audit entry")
+		}
+		err = s.DB.AuditSequence().Insert(bson.D{
+			{"_id", auditSequenceId},
+			{"seq", last.Seq},
+		})
+		if err != nil && !mgo.IsDup(err) {
+			return 0, errgo.Notef(err, "cannot create audit sequence")
+		}
+	}
+}
+
+// LinkAuditLog links the audit entries that have been stored since
+// it last ran into the hash chain, in sequence order, adding signed
+// checkpoints as configured. It returns the number of entries linked.
+// Linking is idempotent, so it does not matter if several servers link
+// the log concurrently.
+//
+// An entry missing from the sequence may still be being added by
+// another request, so linking stops at it until the entry that
+// follows it is older than auditLinkWindow. After that the following
+// entries are linked across the gap, which VerifyAuditLog then
+// reports.
+func (s *Store) LinkAuditLog() (int, error) {
+	last, err := s.lastLinkedAudit()
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	cutoff := time.Now().Add(-auditLinkWindow)
+	iter := s.DB.Audit().Find(bson.D{{"seq", bson.D{{"$gt", last.Seq}}}}).Sort("seq").Iter()
+	prev := last
+	n := 0
+	var doc mongodoc.AuditEntry
+	for iter.Next(&doc) {
+		if doc.Seq != prev.Seq+1 && doc.Time.After(cutoff) {
+			// An earlier entry may still be being added.
+			break
+		}
+		doc.PrevHash = prev.Hash
+		if doc.Hash, err = auditHash(&doc); err != nil {
+			iter.Close()
+			return n, errgo.Mask(err)
+		}
+		err := s.DB.Audit().Update(bson.D{
+			{"seq", doc.Seq},
+			{"hash", bson.D{{"$exists", false}}},
+		}, bson.D{{
+			"$set", bson.D{{"prevhash", doc.PrevHash}, {"hash", doc.Hash}},
+		}})
+		if err == mgo.ErrNotFound {
+			// Someone else is linking the log concurrently,
+			// so leave the rest to them.
+			iter.Close()
+			return n, nil
+		}
+		if err != nil {
+			iter.Close()
+			return n, errgo.Notef(err, "cannot link audit entry %d", doc.Seq)
+		}
+		n++
+		if len(s.pool.config.AuditCheckpointKey) > 0 && doc.Seq%int64(s.pool.config.AuditCheckpointInterval) == 0 {
+			if err := s.addAuditCheckpoint(doc.Seq, doc.Hash); err != nil {
+				logger.Errorf("cannot add audit checkpoint: %v", err)
+			}
+		}
+		prev = doc
+		doc = mongodoc.AuditEntry{}
+	}
+	if err := iter.Close(); err != nil {
+		return n, errgo.Notef(err, "cannot iterate through unlinked audit entries")
+	}
+	return n, nil
+}
+
+// lastLinkedAudit returns the last audit entry that has been linked
+// into the hash chain. If there is none, it returns the zero entry.
+func (s *Store) lastLinkedAudit() (mongodoc.AuditEntry, error) {
+	var last mongodoc.AuditEntry
+	err := s.DB.Audit().Find(bson.D{
+		{"seq", bson.D{{"$gt", 0}}},
+		{"hash", bson.D{{"$exists", true}}},
+	}).Sort("-seq").One(&last)
+	if err != nil && err != mgo.ErrNotFound {
+		return mongodoc.AuditEntry{}, errgo.Notef(err, "cannot retrieve last linked audit entry")
+	}
+	return last, nil
+}
+
+// addAuditCheckpoint stores a signed checkpoint for the audit
+// entry with the given sequence number and hash.
+func (s *Store) addAuditCheckpoint(seq int64, hash string) error {
+	err := s.DB.AuditCheckpoints().Insert(&mongodoc.AuditCheckpoint{
+		Seq:       seq,
+		Hash:      hash,
+		Time:      time.Now(),
+		Signature: auditCheckpointSignature(s.pool.config.AuditCheckpointKey, seq, hash),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// VerifyAuditLog walks the audit log hash chain, checking that no
+// entries are missing, that each entry is intact and follows on
+// from the previous one, and, if a checkpoint key has been
+// configured, that the chain matches the signed checkpoints.
+// Entries stored before the log was hash-chained are ignored, as are
+// entries that are still waiting to be linked by LinkAuditLog.
+//
+// An error is returned only if the verification could not be
+// completed; integrity failures are reported in the Breaks field
+// of the result.
+func (s *Store) VerifyAuditLog() (*audit.Verification, error) {
+	var v audit.Verification
+	checkpoints := make(map[int64]mongodoc.AuditCheckpoint)
+	if key := s.pool.config.AuditCheckpointKey; len(key) > 0 {
+		var docs []mongodoc.AuditCheckpoint
+		if err := s.DB.AuditCheckpoints().Find(nil).All(&docs); err != nil {
+			return nil, errgo.Notef(err, "cannot retrieve audit checkpoints")
+		}
+		for _, cp := range docs {
+			sig := auditCheckpointSignature(key, cp.Seq, cp.Hash)
+			if !hmac.Equal([]byte(cp.Signature), []byte(sig)) {
+				v.Breaks = append(v.Breaks, audit.Break{
+					Seq:    cp.Seq,
+					Reason: "invalid checkpoint signature",
+				})
+				continue
+			}
+			checkpoints[cp.Seq] = cp
+		}
+	}
+	lastLinked, err := s.lastLinkedAudit()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	cutoff := time.Now().Add(-auditLinkWindow)
+	iter := s.DB.Audit().Find(bson.D{{"seq", bson.D{{"$gt", 0}}}}).Sort("seq").Iter()
+	for {
+		var doc mongodoc.AuditEntry
+		if !iter.Next(&doc) {
+			break
+		}
+		if doc.Seq > lastLinked.Seq && doc.Time.After(cutoff) {
+			// This entry and those following it have not
+			// been linked yet, and may still be waiting for
+			// earlier entries to be stored.
+			break
+		}
+		v.Entries++
+		addBreak := func(f string, a ...interface{}) {
+			v.Breaks = append(v.Breaks, audit.Break{
+				Seq:    doc.Seq,
+				Reason: fmt.Sprintf(f, a...),
+			})
+		}
+		if doc.Hash == "" {
+			// The entry was stored too late to be linked
+			// into the chain, or the log is not being linked.
+			addBreak("entry has not been linked")
+			continue
+		}
+		switch {
+		case doc.Seq == v.LastSeq+2:
+			addBreak("entry %d is missing", v.LastSeq+1)
+		case doc.Seq != v.LastSeq+1:
+			addBreak("entries %d to %d are missing", v.LastSeq+1, doc.Seq-1)
+		case doc.PrevHash != v.LastHash:
+			addBreak("previous hash does not match entry %d", v.LastSeq)
+		}
+		hash, err := auditHash(&doc)
+		if err != nil {
+			iter.Close()
+			return nil, errgo.Notef(err, "cannot verify entry %d", doc.Seq)
+		}
+		if hash != doc.Hash {
+			addBreak("entry has been modified")
+		}
+		if cp, ok := checkpoints[doc.Seq]; ok {
+			v.Checkpoints++
+			if cp.Hash != doc.Hash {
+				addBreak("hash does not match signed checkpoint")
+			}
+			delete(checkpoints, doc.Seq)
+		}
+		v.LastSeq, v.LastHash = doc.Seq, doc.Hash
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate through audit entries")
+	}
+	// Any remaining checkpoints refer to entries that
+	// have been removed from the log.
+	for seq := range checkpoints {
+		v.Checkpoints++
+		v.Breaks = append(v.Breaks, audit.Break{
+			Seq:    seq,
+			Reason: "checkpointed entry is missing",
+		})
+	}
+	sort.Stable(auditBreaksBySeq(v.Breaks))
+	return &v, nil
+}
+
+// auditHash returns the hex-encoded SHA256 hash of the BSON
+// encoding of the given audit entry. The entry's Hash field must
+// be empty. Note that BSON encodes times with millisecond precision,
+// so the hash is not changed by storing the entry in the database.
+func auditHash(doc *mongodoc.AuditEntry) (string, error) {
+	doc1 := *doc
+	doc1.Hash = ""
+	data, err := bson.Marshal(&doc1)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot marshal audit entry")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// auditCheckpointSignature returns the hex-encoded signature of an
+// audit checkpoint for the entry with the given sequence number
+// and hash, using the given key.
+func auditCheckpointSignature(key []byte, seq int64, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d %s", seq, hash)
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+type auditBreaksBySeq []audit.Break
+
+func (b auditBreaksBySeq) Len() int           { return len(b) }
+func (b auditBreaksBySeq) Less(i, j int) bool { return b[i].Seq < b[j].Seq }
+func (b auditBreaksBySeq) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func marshalAuditValue(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// auditEntryFromDoc returns the audit log entry represented by
+// the given document. Old and new values are returned as
+// json.RawMessage values.
+func auditEntryFromDoc(doc *mongodoc.AuditEntry) audit.Entry {
+	e := audit.Entry{
+		Time:       doc.Time.UTC(),
+		User:       doc.User,
+		Op:         audit.Operation(doc.Op),
+		Entity:     doc.Entity,
+		Channel:    doc.Channel,
+		Resource:   doc.Resource,
+		RemoteAddr: doc.RemoteAddr,
+		AuthMethod: doc.AuthMethod,
+		Seq:        doc.Seq,
+		PrevHash:   doc.PrevHash,
+		Hash:       doc.Hash,
+	}
+	if doc.ACL != nil {
+		e.ACL = &audit.ACL{
+			Read:    doc.ACL.Read,
+			Write:   doc.ACL.Write,
+			Upload:  doc.ACL.Upload,
+			Publish: doc.ACL.Publish,
+			SetPerm: doc.ACL.SetPerm,
+			Delete:  doc.ACL.Delete,
+		}
+	}
+	if len(doc.OldValue) > 0 {
+		e.OldValue = json.RawMessage(doc.OldValue)
+	}
+	if len(doc.NewValue) > 0 {
+		e.NewValue = json.RawMessage(doc.NewValue)
+	}
+	return e
+}
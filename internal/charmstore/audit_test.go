@@ -0,0 +1,475 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+type auditSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&auditSuite{})
+
+var auditTime = time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// auditTestEntries holds the entries added by auditSuite.addEntries,
+// in the order they are added.
+var auditTestEntries = []audit.Entry{{
+	Time:   auditTime,
+	User:   "bob",
+	Op:     audit.OpUploadEntity,
+	Entity: charm.MustParseURL("~bob/precise/wordpress-0"),
+}, {
+	Time:    auditTime.Add(time.Hour),
+	User:    "bob",
+	Op:      audit.OpSetPerm,
+	Entity:  charm.MustParseURL("~bob/precise/wordpress-0"),
+	Channel: "stable",
+	ACL: &audit.ACL{
+		Read: []string{"everyone"},
+	},
+	RemoteAddr: "127.0.0.1:1234",
+	AuthMethod: "macaroon",
+}, {
+	Time:   auditTime.Add(24 * time.Hour),
+	User:   "alice",
+	Op:     audit.OpSetExtraInfo,
+	Entity: charm.MustParseURL("~bob/precise/wordpress-1"),
+	OldValue: map[string]interface{}{
+		"a": nil,
+	},
+	NewValue: map[string]interface{}{
+		"a": 1,
+	},
+}, {
+	Time:     auditTime.Add(48 * time.Hour),
+	User:     "admin",
+	Op:       audit.OpCreateUpload,
+	NewValue: "upload-id",
+}}
+
+var auditEntriesTests = []struct {
+	about       string
+	query       AuditQuery
+	expectIndex []int
+}{{
+	about:       "all entries",
+	expectIndex: []int{3, 2, 1, 0},
+}, {
+	about: "specific entity",
+	query: AuditQuery{
+		Entity: charm.MustParseURL("~bob/precise/wordpress-0"),
+	},
+	expectIndex: []int{1, 0},
+}, {
+	about: "all revisions of an entity",
+	query: AuditQuery{
+		Entity: charm.MustParseURL("~bob/wordpress"),
+	},
+	expectIndex: []int{2, 1, 0},
+}, {
+	about: "user",
+	query: AuditQuery{
+		User: "bob",
+	},
+	expectIndex: []int{1, 0},
+}, {
+	about: "operation",
+	query: AuditQuery{
+		Op: audit.OpSetExtraInfo,
+	},
+	expectIndex: []int{2},
+}, {
+	about: "start time",
+	query: AuditQuery{
+		Start: auditTime.Add(30 * time.Minute),
+	},
+	expectIndex: []int{3, 2, 1},
+}, {
+	about: "time range",
+	query: AuditQuery{
+		Start: auditTime.Add(30 * time.Minute),
+		Stop:  auditTime.Add(2 * time.Hour),
+	},
+	expectIndex: []int{1},
+}, {
+	about: "pagination",
+	query: AuditQuery{
+		Skip:  1,
+		Limit: 2,
+	},
+	expectIndex: []int{2, 1},
+}, {
+	about: "no matches",
+	query: AuditQuery{
+		User: "nobody",
+	},
+	expectIndex: []int{},
+}}
+
+func (s *auditSuite) TestAuditEntries(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, e := range auditTestEntries {
+		store.addAuditAtTime(e, e.Time)
+	}
+	for i, test := range auditEntriesTests {
+		c.Logf("test %d: %s", i, test.about)
+		entries, err := store.AuditEntries(test.query)
+		c.Assert(err, gc.Equals, nil)
+		expect := make([]audit.Entry, len(test.expectIndex))
+		for i, index := range test.expectIndex {
+			expect[i] = auditTestEntries[index]
+		}
+		// The hash chain fields are checked in TestAuditHashChain.
+		for i := range entries {
+			entries[i].Seq = 0
+			entries[i].PrevHash = ""
+			entries[i].Hash = ""
+		}
+		// Old and new values are returned as raw JSON,
+		// so compare the JSON representations.
+		data, err := json.Marshal(entries)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(data), jc.JSONEquals, expect)
+	}
+}
+
+func (s *auditSuite) TestAuditEntriesRawValues(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	store.addAuditAtTime(auditTestEntries[2], auditTestEntries[2].Time)
+	entries, err := store.AuditEntries(AuditQuery{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entries, gc.HasLen, 1)
+	c.Assert(entries[0].OldValue, jc.DeepEquals, json.RawMessage(`{"a":null}`))
+	c.Assert(entries[0].NewValue, jc.DeepEquals, json.RawMessage(`{"a":1}`))
+}
+
+func (s *auditSuite) TestAuditHashChain(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, e := range auditTestEntries {
+		store.addAuditAtTime(e, e.Time)
+	}
+	n, err := store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, len(auditTestEntries))
+	entries, err := store.AuditEntries(AuditQuery{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entries, gc.HasLen, len(auditTestEntries))
+	prevHash := ""
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		c.Assert(e.Seq, gc.Equals, int64(len(entries)-i))
+		c.Assert(e.PrevHash, gc.Equals, prevHash)
+		c.Assert(e.Hash, gc.Matches, "[0-9a-f]{64}")
+		prevHash = e.Hash
+	}
+	v, err := store.VerifyAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v, jc.DeepEquals, &audit.Verification{
+		Entries:  int64(len(auditTestEntries)),
+		LastSeq:  int64(len(auditTestEntries)),
+		LastHash: prevHash,
+	})
+}
+
+func (s *auditSuite) TestAuditHashChainIgnoresUnchainedEntries(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	// Simulate an entry stored before the log was hash-chained.
+	err := store.DB.Audit().Insert(&mongodoc.AuditEntry{
+		Time: auditTime,
+		User: "bob",
+		Op:   string(audit.OpUploadEntity),
+	})
+	c.Assert(err, gc.Equals, nil)
+	store.addAuditAtTime(auditTestEntries[0], auditTestEntries[0].Time)
+	_, err = store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	entries, err := store.AuditEntries(AuditQuery{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entries, gc.HasLen, 2)
+	c.Assert(entries[0].Seq, gc.Equals, int64(1))
+	c.Assert(entries[0].PrevHash, gc.Equals, "")
+	c.Assert(entries[1].Seq, gc.Equals, int64(0))
+	v, err := store.VerifyAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v.Entries, gc.Equals, int64(1))
+	c.Assert(v.Breaks, gc.HasLen, 0)
+}
+
+func (s *auditSuite) TestAuditHashChainConcurrentEntries(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(e audit.Entry) {
+			defer wg.Done()
+			store := store.Copy()
+			defer store.Close()
+			store.addAuditAtTime(e, e.Time)
+		}(auditTestEntries[i%len(auditTestEntries)])
+	}
+	wg.Wait()
+	_, err := store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	entries, err := store.AuditEntries(AuditQuery{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entries, gc.HasLen, n)
+	v, err := store.VerifyAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v.Entries, gc.Equals, int64(n))
+	c.Assert(v.LastSeq, gc.Equals, int64(n))
+	c.Assert(v.Breaks, gc.HasLen, 0)
+}
+
+func (s *auditSuite) TestAuditHashChainLinksUnlinkedEntries(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	store.addAuditAtTime(auditTestEntries[0], auditTestEntries[0].Time)
+	// Simulate an entry that was stored but could not be linked
+	// into the chain.
+	seq, err := store.nextAuditSeq()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(seq, gc.Equals, int64(2))
+	err = store.DB.Audit().Insert(&mongodoc.AuditEntry{
+		Time: auditTime,
+		User: "bob",
+		Op:   string(audit.OpUploadEntity),
+		Seq:  seq,
+	})
+	c.Assert(err, gc.Equals, nil)
+	store.addAuditAtTime(auditTestEntries[1], auditTestEntries[1].Time)
+	_, err = store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	v, err := store.VerifyAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v.Entries, gc.Equals, int64(3))
+	c.Assert(v.LastSeq, gc.Equals, int64(3))
+	c.Assert(v.Breaks, gc.HasLen, 0)
+}
+
+func (s *auditSuite) TestAuditSequenceContinuesExistingChain(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	store.addAuditAtTime(auditTestEntries[0], auditTestEntries[0].Time)
+	store.addAuditAtTime(auditTestEntries[1], auditTestEntries[1].Time)
+	// Simulate a chain created before the sequence was stored.
+	_, err := store.DB.AuditSequence().RemoveAll(nil)
+	c.Assert(err, gc.Equals, nil)
+	store.addAuditAtTime(auditTestEntries[2], auditTestEntries[2].Time)
+	_, err = store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	v, err := store.VerifyAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v.Entries, gc.Equals, int64(3))
+	c.Assert(v.LastSeq, gc.Equals, int64(3))
+	c.Assert(v.Breaks, gc.HasLen, 0)
+}
+
+func (s *auditSuite) TestLinkAuditLogWaitsForMissingEntries(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	store.addAuditAtTime(auditTestEntries[0], time.Now())
+	// Simulate an entry that is still being added.
+	seq, err := store.nextAuditSeq()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(seq, gc.Equals, int64(2))
+	store.addAuditAtTime(auditTestEntries[1], time.Now())
+
+	// The entry after the gap is not linked until the missing
+	// entry has had time to be stored, and it is not checked
+	// in the meantime.
+	n, err := store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	v, err := store.VerifyAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v.Entries, gc.Equals, int64(1))
+	c.Assert(v.LastSeq, gc.Equals, int64(1))
+	c.Assert(v.Breaks, gc.HasLen, 0)
+
+	// Once the linking window has passed, the chain is linked
+	// across the gap, which is reported.
+	s.PatchValue(&auditLinkWindow, time.Duration(0))
+	n, err = store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	v, err = store.VerifyAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v.Entries, gc.Equals, int64(2))
+	c.Assert(v.LastSeq, gc.Equals, int64(3))
+	c.Assert(v.Breaks, jc.DeepEquals, []audit.Break{{
+		Seq:    3,
+		Reason: "entry 2 is missing",
+	}})
+
+	// An entry stored after the chain has been linked past it
+	// is reported rather than linked.
+	err = store.DB.Audit().Insert(&mongodoc.AuditEntry{
+		Time: time.Now(),
+		User: "bob",
+		Op:   string(audit.OpUploadEntity),
+		Seq:  seq,
+	})
+	c.Assert(err, gc.Equals, nil)
+	n, err = store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	v, err = store.VerifyAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v.Entries, gc.Equals, int64(3))
+	c.Assert(v.Breaks, jc.DeepEquals, []audit.Break{{
+		Seq:    2,
+		Reason: "entry has not been linked",
+	}, {
+		Seq:    3,
+		Reason: "entry 2 is missing",
+	}})
+}
+
+var verifyAuditLogTests = []struct {
+	about        string
+	tamper       func(c *gc.C, db StoreDatabase)
+	expectBreaks []audit.Break
+}{{
+	about: "modified entry",
+	tamper: func(c *gc.C, db StoreDatabase) {
+		err := db.Audit().Update(bson.D{{"seq", 2}}, bson.D{{"$set", bson.D{{"user", "eve"}}}})
+		c.Assert(err, gc.Equals, nil)
+	},
+	expectBreaks: []audit.Break{{
+		Seq:    2,
+		Reason: "entry has been modified",
+	}},
+}, {
+	about: "modified entry with recalculated hash",
+	tamper: func(c *gc.C, db StoreDatabase) {
+		rehashAuditEntry(c, db, 3, func(doc *mongodoc.AuditEntry) {
+			doc.User = "eve"
+		})
+	},
+	expectBreaks: []audit.Break{{
+		Seq:    4,
+		Reason: "previous hash does not match entry 3",
+	}},
+}, {
+	about: "removed entry",
+	tamper: func(c *gc.C, db StoreDatabase) {
+		err := db.Audit().Remove(bson.D{{"seq", 3}})
+		c.Assert(err, gc.Equals, nil)
+	},
+	expectBreaks: []audit.Break{{
+		Seq:    4,
+		Reason: "entry 3 is missing",
+	}},
+}, {
+	about: "rewritten chain",
+	tamper: func(c *gc.C, db StoreDatabase) {
+		for seq := int64(1); seq <= 4; seq++ {
+			rehashAuditEntry(c, db, seq, func(doc *mongodoc.AuditEntry) {
+				if seq == 1 {
+					doc.User = "eve"
+				}
+			})
+		}
+	},
+	expectBreaks: []audit.Break{{
+		Seq:    2,
+		Reason: "hash does not match signed checkpoint",
+	}, {
+		Seq:    4,
+		Reason: "hash does not match signed checkpoint",
+	}},
+}, {
+	about: "truncated log",
+	tamper: func(c *gc.C, db StoreDatabase) {
+		err := db.Audit().Remove(bson.D{{"seq", 4}})
+		c.Assert(err, gc.Equals, nil)
+	},
+	expectBreaks: []audit.Break{{
+		Seq:    4,
+		Reason: "checkpointed entry is missing",
+	}},
+}, {
+	about: "forged checkpoint",
+	tamper: func(c *gc.C, db StoreDatabase) {
+		err := db.AuditCheckpoints().UpdateId(2, bson.D{{"$set", bson.D{{"hash", "0000"}}}})
+		c.Assert(err, gc.Equals, nil)
+	},
+	expectBreaks: []audit.Break{{
+		Seq:    2,
+		Reason: "invalid checkpoint signature",
+	}},
+}}
+
+func (s *auditSuite) TestVerifyAuditLog(c *gc.C) {
+	for i, test := range verifyAuditLogTests {
+		c.Logf("test %d: %s", i, test.about)
+		s.Session.DB("juju_test").DropDatabase()
+		p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+			AuditCheckpointKey:      []byte("checkpoint key"),
+			AuditCheckpointInterval: 2,
+		})
+		c.Assert(err, gc.Equals, nil)
+		store := p.Store()
+		for _, e := range auditTestEntries {
+			store.addAuditAtTime(e, e.Time)
+		}
+		_, err = store.LinkAuditLog()
+		c.Assert(err, gc.Equals, nil)
+		n, err := store.DB.AuditCheckpoints().Count()
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(n, gc.Equals, 2)
+		v, err := store.VerifyAuditLog()
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(v.Entries, gc.Equals, int64(4))
+		c.Assert(v.Checkpoints, gc.Equals, 2)
+		c.Assert(v.Breaks, gc.HasLen, 0)
+
+		test.tamper(c, store.DB)
+		v, err = store.VerifyAuditLog()
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(v.Breaks, jc.DeepEquals, test.expectBreaks)
+		store.Close()
+		p.Close()
+	}
+}
+
+// rehashAuditEntry updates the audit entry with the given sequence
+// number using the given function, linking it to the current hash
+// of the previous entry and recalculating its hash, as someone
+// trying to cover their tracks might.
+func rehashAuditEntry(c *gc.C, db StoreDatabase, seq int64, update func(*mongodoc.AuditEntry)) {
+	var prev mongodoc.AuditEntry
+	if seq > 1 {
+		err := db.Audit().Find(bson.D{{"seq", seq - 1}}).One(&prev)
+		c.Assert(err, gc.Equals, nil)
+	}
+	var doc mongodoc.AuditEntry
+	err := db.Audit().Find(bson.D{{"seq", seq}}).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+	update(&doc)
+	doc.PrevHash = prev.Hash
+	doc.Hash, err = auditHash(&doc)
+	c.Assert(err, gc.Equals, nil)
+	err = db.Audit().Update(bson.D{{"seq", seq}}, &doc)
+	c.Assert(err, gc.Equals, nil)
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	tomb "gopkg.in/tomb.v2"
+)
+
+var auditLinkInterval = 10 * time.Second
+
+// auditLinker implements the worker that links new audit log
+// entries into the audit log hash chain.
+type auditLinker struct {
+	tomb tomb.Tomb
+	pool *Pool
+}
+
+// newAuditLinker returns a new running audit log linking worker.
+func newAuditLinker(pool *Pool) *auditLinker {
+	al := &auditLinker{
+		pool: pool,
+	}
+	al.tomb.Go(al.run)
+	return al
+}
+
+// Kill implements worker.Worker.Kill.
+func (al *auditLinker) Kill() {
+	al.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (al *auditLinker) Wait() error {
+	return al.tomb.Wait()
+}
+
+func (al *auditLinker) run() error {
+	for {
+		if err := al.link(); err != nil {
+			logger.Errorf("cannot link audit log: %v", err)
+		}
+		select {
+		case <-al.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(auditLinkInterval):
+		}
+	}
+}
+
+func (al *auditLinker) link() error {
+	store := al.pool.Store()
+	defer store.Close()
+	n, err := store.LinkAuditLog()
+	if n > 0 {
+		logger.Debugf("linked %d audit log entries", n)
+	}
+	return err
+}
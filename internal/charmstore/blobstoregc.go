@@ -63,6 +63,16 @@ func (gc *blobstoreGC) run() error {
 func (gc *blobstoreGC) doGC() error {
 	store := gc.pool.Store()
 	defer store.Close()
+	if keep := gc.pool.config.ResourceRetentionCount; keep > 0 {
+		// A failure to prune resources must not prevent the
+		// collection of the blobs that are already unused.
+		n, err := store.PruneResources(keep)
+		if err != nil {
+			logger.Errorf("resource pruning failed: %v", err)
+		} else {
+			logger.Infof("pruned %d old resource revisions", n)
+		}
+	}
 	err := store.BlobStore.RemoveExpiredUploads()
 	if err != nil {
 		return errgo.Notef(err, "expired-upload garbage collection failed")
@@ -10,7 +10,7 @@ var (
 	esMapping = mustParseJSON(esMappingJSON)
 )
 
-const esSettingsVersion = 12
+const esSettingsVersion = 13
 
 func mustParseJSON(s string) interface{} {
 	var j json.RawMessage
@@ -362,6 +362,11 @@ const esMappingJSON = `
         "omit_norms": true,
         "index_options": "docs"
       },
+      "ReleaseNotes": {
+        "type": "string",
+        "analyzer": "lowercase_words",
+        "include_in_all": false
+      },
       "BundleCharms": {
         "type": "string",
         "index": "not_analyzed",
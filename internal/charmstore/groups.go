@@ -0,0 +1,170 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/cache"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// defaultGroupCacheMaxAge holds the default length of time that the
+// groups of a user are cached for.
+const defaultGroupCacheMaxAge = time.Minute
+
+// GroupProvider is used to find out which groups a user is a member
+// of, so that groups can be used in ACLs.
+type GroupProvider interface {
+	// Groups returns the names of the groups that the user with
+	// the given name is a member of.
+	Groups(username string) ([]string, error)
+}
+
+// NewMongoGroupProvider returns a GroupProvider that uses the groups
+// stored in the given database, which are managed with the
+// SetGroupMembers, AddGroupMember, RemoveGroupMember and RemoveGroup
+// methods.
+func NewMongoGroupProvider(db *mgo.Database) GroupProvider {
+	return mongoGroupProvider{StoreDatabase{db}}
+}
+
+type mongoGroupProvider struct {
+	db StoreDatabase
+}
+
+// Groups implements GroupProvider.Groups.
+func (p mongoGroupProvider) Groups(username string) ([]string, error) {
+	db := p.db.copy()
+	defer db.Close()
+	var groups []mongodoc.Group
+	if err := db.Groups().Find(bson.D{{"members", username}}).Select(bson.D{{"_id", 1}}).Sort("_id").All(&groups); err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve groups of %q", username)
+	}
+	names := make([]string, len(groups))
+	for i, g := range groups {
+		names[i] = g.Name
+	}
+	return names, nil
+}
+
+// groupCache wraps a GroupProvider, caching the groups of each user.
+type groupCache struct {
+	provider GroupProvider
+	cache    *cache.Cache
+}
+
+// Groups implements GroupProvider.Groups.
+func (c *groupCache) Groups(username string) ([]string, error) {
+	v, err := c.cache.Get(username, func() (interface{}, error) {
+		groups, err := c.provider.Groups(username)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		return groups, nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return v.([]string), nil
+}
+
+// GroupProvider returns the provider used to find out which groups
+// users are members of, or nil if group membership should be obtained
+// from the identity manager. The results of the returned provider are
+// cached for at most ServerParams.GroupCacheMaxAge.
+func (s *Store) GroupProvider() GroupProvider {
+	if s.pool.groups == nil {
+		return nil
+	}
+	return s.pool.groups
+}
+
+// Groups returns all the groups stored in the database, ordered by
+// name.
+func (s *Store) Groups() ([]mongodoc.Group, error) {
+	groups := make([]mongodoc.Group, 0)
+	if err := s.DB.Groups().Find(nil).Sort("_id").All(&groups); err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve groups")
+	}
+	return groups, nil
+}
+
+// Group returns the group with the given name. If there is no such
+// group, it returns an error with a params.ErrNotFound cause.
+func (s *Store) Group(name string) (*mongodoc.Group, error) {
+	var group mongodoc.Group
+	if err := s.DB.Groups().FindId(name).One(&group); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", name)
+		}
+		return nil, errgo.Notef(err, "cannot retrieve group %q", name)
+	}
+	return &group, nil
+}
+
+// SetGroupMembers sets the members of the group with the given name,
+// creating the group if it does not exist.
+func (s *Store) SetGroupMembers(name string, members []string) error {
+	if members == nil {
+		members = []string{}
+	}
+	if _, err := s.DB.Groups().UpsertId(name, bson.D{{"$set", bson.D{{"members", members}}}}); err != nil {
+		return errgo.Notef(err, "cannot update group %q", name)
+	}
+	s.evictGroups()
+	return nil
+}
+
+// AddGroupMember adds the user with the given name to the group with
+// the given name, creating the group if it does not exist.
+func (s *Store) AddGroupMember(name, username string) error {
+	if _, err := s.DB.Groups().UpsertId(name, bson.D{{"$addToSet", bson.D{{"members", username}}}}); err != nil {
+		return errgo.Notef(err, "cannot add %q to group %q", username, name)
+	}
+	s.evictGroups()
+	return nil
+}
+
+// RemoveGroupMember removes the user with the given name from the group
+// with the given name. If there is no such group, it returns an error
+// with a params.ErrNotFound cause.
+func (s *Store) RemoveGroupMember(name, username string) error {
+	if err := s.DB.Groups().UpdateId(name, bson.D{{"$pull", bson.D{{"members", username}}}}); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", name)
+		}
+		return errgo.Notef(err, "cannot remove %q from group %q", username, name)
+	}
+	s.evictGroups()
+	return nil
+}
+
+// RemoveGroup removes the group with the given name. If there is no
+// such group, it returns an error with a params.ErrNotFound cause.
+func (s *Store) RemoveGroup(name string) error {
+	if err := s.DB.Groups().RemoveId(name); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", name)
+		}
+		return errgo.Notef(err, "cannot remove group %q", name)
+	}
+	s.evictGroups()
+	return nil
+}
+
+// evictGroups removes all cached group membership information so
+// that changes to the groups take effect immediately. Other charm
+// store servers sharing the same database will see the changes
+// when their cached entries expire.
+func (s *Store) evictGroups() {
+	if s.pool.groups != nil {
+		s.pool.groups.cache.EvictAll()
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+type groupsSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&groupsSuite{})
+
+func (s *groupsSuite) TestGroups(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	groups, err := store.Groups()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.HasLen, 0)
+
+	err = store.SetGroupMembers("team-x", []string{"bob", "alice"})
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddGroupMember("team-a", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddGroupMember("team-a", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetGroupMembers("empty", nil)
+	c.Assert(err, gc.Equals, nil)
+
+	groups, err = store.Groups()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []mongodoc.Group{{
+		Name:    "empty",
+		Members: []string{},
+	}, {
+		Name:    "team-a",
+		Members: []string{"bob"},
+	}, {
+		Name:    "team-x",
+		Members: []string{"bob", "alice"},
+	}})
+
+	err = store.RemoveGroupMember("team-x", "bob")
+	c.Assert(err, gc.Equals, nil)
+	group, err := store.Group("team-x")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(group, jc.DeepEquals, &mongodoc.Group{
+		Name:    "team-x",
+		Members: []string{"alice"},
+	})
+
+	err = store.RemoveGroup("team-x")
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.Group("team-x")
+	c.Assert(err, gc.ErrorMatches, `group "team-x" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.RemoveGroup("team-x")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.RemoveGroupMember("team-x", "alice")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *groupsSuite) TestMongoGroupProvider(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	c.Assert(store.GroupProvider(), gc.IsNil)
+
+	err := store.SetGroupMembers("team-x", []string{"bob", "alice"})
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetGroupMembers("team-a", []string{"bob"})
+	c.Assert(err, gc.Equals, nil)
+
+	gp := NewMongoGroupProvider(store.DB.Database)
+	groups, err := gp.Groups("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"team-a", "team-x"})
+	groups, err = gp.Groups("alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"team-x"})
+	groups, err = gp.Groups("charlie")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.HasLen, 0)
+}
+
+func (s *groupsSuite) TestGroupProviderCache(c *gc.C) {
+	var calls int
+	p, err := NewPool(s.Session.DB("juju_test"), nil, &bakery.NewServiceParams{}, ServerParams{
+		NewGroupProvider: func(db *mgo.Database) GroupProvider {
+			gp := NewMongoGroupProvider(db)
+			return groupProviderFunc(func(username string) ([]string, error) {
+				calls++
+				return gp.Groups(username)
+			})
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	err = store.SetGroupMembers("team-x", []string{"bob"})
+	c.Assert(err, gc.Equals, nil)
+	gp := store.GroupProvider()
+	for i := 0; i < 2; i++ {
+		groups, err := gp.Groups("bob")
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(groups, jc.DeepEquals, []string{"team-x"})
+	}
+	c.Assert(calls, gc.Equals, 1)
+
+	// Changing the groups invalidates the cache.
+	err = store.AddGroupMember("team-a", "bob")
+	c.Assert(err, gc.Equals, nil)
+	groups, err := gp.Groups("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"team-a", "team-x"})
+	c.Assert(calls, gc.Equals, 2)
+}
+
+type groupProviderFunc func(username string) ([]string, error)
+
+func (f groupProviderFunc) Groups(username string) ([]string, error) {
+	return f(username)
+}
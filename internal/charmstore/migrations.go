@@ -31,6 +31,8 @@ const (
 	migrationCandidateBetaChannels   mongodoc.MigrationName = "populate candidate and beta channel ACLs"
 	migrationRevisionsCollection     mongodoc.MigrationName = "populate revisions collection"
 	migrationBlobRefs                mongodoc.MigrationName = "populate blobref table"
+	migrationFineGrainedACLs         mongodoc.MigrationName = "populate fine-grained channel ACLs"
+	migrationStatRollups             mongodoc.MigrationName = "build stats rollups"
 )
 
 // migrations holds all the migration functions that are executed in the order
@@ -87,6 +89,12 @@ var migrations = []migration{{
 }, {
 	name:    migrationBlobRefs,
 	migrate: migrateBlobRefs,
+}, {
+	name:    migrationFineGrainedACLs,
+	migrate: migrateFineGrainedACLs,
+}, {
+	name:    migrationStatRollups,
+	migrate: migrateStatRollups,
 }}
 
 // migration holds a migration function with its corresponding name.
@@ -215,6 +223,56 @@ func migrateRevisionsCollection(db StoreDatabase) error {
 	return nil
 }
 
+// migrateFineGrainedACLs populates the upload, publish, set-perm
+// and delete permissions of all the channel ACLs from their write
+// permissions, which used to allow all those operations.
+func migrateFineGrainedACLs(db StoreDatabase) error {
+	iter := db.BaseEntities().Find(nil).Select(bson.D{{"channelacls", 1}}).Iter()
+	for {
+		var baseEntity mongodoc.BaseEntity
+		if !iter.Next(&baseEntity) {
+			break
+		}
+		update := make(bson.D, 0, 4*len(baseEntity.ChannelACLs))
+		for ch, acl := range baseEntity.ChannelACLs {
+			write := acl.Write
+			if write == nil {
+				write = []string{}
+			}
+			prefix := "channelacls." + string(ch) + "."
+			if acl.Upload == nil {
+				update = append(update, bson.DocElem{prefix + "upload", write})
+			}
+			if acl.Publish == nil {
+				update = append(update, bson.DocElem{prefix + "publish", write})
+			}
+			if acl.SetPerm == nil {
+				update = append(update, bson.DocElem{prefix + "setperm", write})
+			}
+			if acl.Delete == nil {
+				update = append(update, bson.DocElem{prefix + "delete", write})
+			}
+		}
+		if len(update) == 0 {
+			continue
+		}
+		if err := db.BaseEntities().UpdateId(baseEntity.URL, bson.D{{"$set", update}}); err != nil {
+			iter.Close()
+			return errgo.Notef(err, "cannot update ACLs of %q", baseEntity.URL)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "could not iterate through all base entities")
+	}
+	return nil
+}
+
+// migrateStatRollups builds the rollups of the existing statistics
+// counters for all complete weeks and months.
+func migrateStatRollups(db StoreDatabase) error {
+	return buildStatRollups(db, time.Now())
+}
+
 // blobRefDoc holds a mapping from blob hash to
 // backend blob name.
 // This is duplicated from internal/blobstore.
@@ -844,9 +844,28 @@ func isPromulgated(isProm bool) baseEntityChecker {
 	}
 }
 
+// hasACLs checks that the base entity has the given channel ACLs.
+// Any fine-grained permissions left unspecified are expected to
+// have been populated from the write permissions by the migration.
 func hasACLs(acls map[params.Channel]mongodoc.ACL) baseEntityChecker {
+	expect := make(map[params.Channel]mongodoc.ACL)
+	for ch, acl := range acls {
+		if acl.Upload == nil {
+			acl.Upload = acl.Write
+		}
+		if acl.Publish == nil {
+			acl.Publish = acl.Write
+		}
+		if acl.SetPerm == nil {
+			acl.SetPerm = acl.Write
+		}
+		if acl.Delete == nil {
+			acl.Delete = acl.Write
+		}
+		expect[ch] = acl
+	}
 	return func(c *gc.C, entity *mongodoc.BaseEntity) {
-		c.Assert(entity.ChannelACLs, jc.DeepEquals, acls)
+		c.Assert(entity.ChannelACLs, jc.DeepEquals, expect)
 	}
 }
 
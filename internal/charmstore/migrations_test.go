@@ -5,12 +5,14 @@ package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/char
 
 import (
 	"net/http"
+	"time"
 
 	jujutesting "github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 )
@@ -182,6 +184,41 @@ func (s *migrationsSuite) TestMigrateMigrationList(c *gc.C) {
 	}
 }
 
+func (s *migrationsSuite) TestMigrateStatRollups(c *gc.C) {
+	day := func(month time.Month, day int) time.Time {
+		return time.Date(2012, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	for _, counter := range []statCounter{
+		{Key: "1:", Time: timeToStamp(day(time.January, 2)), Count: 1},
+		{Key: "1:", Time: timeToStamp(day(time.January, 3)), Count: 2},
+		{Key: "1:", Time: timeToStamp(day(time.January, 10)), Count: 4},
+		{Key: "1:", Time: timeToStamp(day(time.February, 1)), Count: 8},
+		{Key: "2:", Time: timeToStamp(day(time.January, 2)), Count: 16},
+	} {
+		err := s.db.StatCounters().Insert(counter)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	err := migrateStatRollups(s.db)
+	c.Assert(err, gc.Equals, nil)
+
+	var rollups []statRollup
+	err = s.db.StatRollups().Find(nil).Select(bson.D{{"_id", 0}}).Sort("p", "k", "t").All(&rollups)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rollups, jc.DeepEquals, []statRollup{
+		{Key: "1:", Period: "month", Time: timeToStamp(day(time.January, 1)), Count: 7},
+		{Key: "1:", Period: "month", Time: timeToStamp(day(time.February, 1)), Count: 8},
+		{Key: "2:", Period: "month", Time: timeToStamp(day(time.January, 1)), Count: 16},
+		{Key: "1:", Period: "week", Time: timeToStamp(day(time.January, 1)), Count: 3},
+		{Key: "1:", Period: "week", Time: timeToStamp(day(time.January, 8)), Count: 4},
+		{Key: "1:", Period: "week", Time: timeToStamp(day(time.January, 29)), Count: 8},
+		{Key: "2:", Period: "week", Time: timeToStamp(day(time.January, 1)), Count: 16},
+	})
+	until, err := statRollupWatermark(s.db)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(until.After(time.Now().Add(-statsRollupMinAge-time.Minute)), jc.IsTrue)
+}
+
 func (s *migrationsSuite) checkExecuted(c *gc.C, expected ...mongodoc.MigrationName) {
 	var obtained []mongodoc.MigrationName
 	var doc mongodoc.Migration
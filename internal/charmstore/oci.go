@@ -0,0 +1,349 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// OCIImageResourceType holds the name of the resource type
+// used for OCI image resources.
+const OCIImageResourceType = "oci-image"
+
+// OCIManifestMediaType holds the default media type of an OCI
+// image manifest.
+const OCIManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+
+// maxOCIManifestSize holds the maximum size of an OCI image manifest.
+const maxOCIManifestSize = 4 * 1024 * 1024
+
+var ociDigestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// OCIDescriptor describes content referred to by an OCI image manifest.
+type OCIDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// OCIManifest holds the parts of an OCI image manifest
+// used by the charm store.
+type OCIManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        OCIDescriptor   `json:"config"`
+	Layers        []OCIDescriptor `json:"layers"`
+}
+
+// IsOCIImageResource reports whether the given resource
+// holds an OCI image.
+func IsOCIImageResource(r resource.Meta) bool {
+	return r.Type.String() == OCIImageResourceType
+}
+
+// ValidOCIDigest reports whether the given digest is a valid
+// OCI content digest. Only SHA256 digests are supported.
+func ValidOCIDigest(digest string) bool {
+	return ociDigestPattern.MatchString(digest)
+}
+
+// ParseOCIManifest parses the given OCI image manifest.
+func ParseOCIManifest(data []byte) (*OCIManifest, error) {
+	var m OCIManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal OCI image manifest")
+	}
+	if m.SchemaVersion != 2 {
+		return nil, errgo.Newf("unsupported OCI image manifest schema version %d", m.SchemaVersion)
+	}
+	if m.MediaType == "" {
+		m.MediaType = OCIManifestMediaType
+	}
+	for _, d := range append([]OCIDescriptor{m.Config}, m.Layers...) {
+		if !ValidOCIDigest(d.Digest) {
+			return nil, errgo.Newf("invalid digest %q in OCI image manifest", d.Digest)
+		}
+	}
+	return &m, nil
+}
+
+// UploadOCIBlob adds blob to the blob store and associates it with the
+// given OCI content digest and the charm with the given id, so that it
+// can be referred to by the manifests of the charm's OCI image
+// resources. The name holds the name of the OCI image resource the
+// blob is uploaded for.
+func (s *Store) UploadOCIBlob(id *router.ResolvedURL, name, digest string, blob io.Reader, blobHash string, size int64) error {
+	if !ValidOCIDigest(digest) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid digest %q", digest)
+	}
+	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if !charmHasOCIImageResource(entity.CharmMeta, name) {
+		return errgo.WithCausef(nil, params.ErrNotFound, "charm does not have OCI image resource %q", name)
+	}
+	blobHash256, err := s.putArchive(blob, size, blobHash)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if digest != "sha256:"+blobHash256 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "digest mismatch (got %q want %q)", "sha256:"+blobHash256, digest)
+	}
+	_, err = s.DB.OCIBlobs().Upsert(bson.D{
+		{"baseurl", entity.BaseURL},
+		{"digest", digest},
+	}, &mongodoc.OCIBlob{
+		BaseURL:    entity.BaseURL,
+		Digest:     digest,
+		BlobHash:   blobHash,
+		Size:       size,
+		UploadTime: time.Now().UTC(),
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot insert OCI blob")
+	}
+	return nil
+}
+
+// OpenOCIBlob returns the OCI blob with the given digest associated
+// with the charm with the given id. If no such blob has been uploaded,
+// an error with a params.ErrNotFound cause is returned.
+func (s *Store) OpenOCIBlob(id *router.ResolvedURL, digest string) (*Blob, error) {
+	var doc mongodoc.OCIBlob
+	err := s.DB.OCIBlobs().Find(bson.D{
+		{"baseurl", mongodoc.BaseURL(&id.URL)},
+		{"digest", digest},
+	}).One(&doc)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "blob %q not found", digest)
+		}
+		return nil, errgo.Notef(err, "cannot get OCI blob")
+	}
+	r, size, err := s.BlobStore.Open(doc.BlobHash, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open blob %q", digest)
+	}
+	return &Blob{
+		ReadSeekCloser: r,
+		Size:           size,
+		Hash:           doc.BlobHash,
+	}, nil
+}
+
+// ResolveOCIManifest returns the revision of the named OCI image
+// resource associated with the given id whose manifest has the given
+// digest. If no such revision exists, an error with a
+// params.ErrNotFound cause is returned.
+func (s *Store) ResolveOCIManifest(id *router.ResolvedURL, name, digest string) (*mongodoc.Resource, error) {
+	if !ValidOCIDigest(digest) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "manifest %q not found", digest)
+	}
+	q := append(newResourceQuery(mongodoc.BaseURL(&id.URL), name, -1), bson.DocElem{
+		"blobhash256", strings.TrimPrefix(digest, "sha256:"),
+	})
+	var r mongodoc.Resource
+	if err := s.DB.Resources().Find(q).Sort("-revision").One(&r); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "manifest %q not found", digest)
+		}
+		return nil, errgo.Mask(err)
+	}
+	return &r, nil
+}
+
+// checkOCIManifest checks that data holds a valid OCI image manifest
+// and that all the blobs it refers to have been uploaded for the charm
+// with the given base URL.
+func (s *Store) checkOCIManifest(baseURL *charm.URL, data []byte) error {
+	m, err := ParseOCIManifest(data)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	descriptors := append([]OCIDescriptor{m.Config}, m.Layers...)
+	digests := make([]string, len(descriptors))
+	for i, d := range descriptors {
+		digests[i] = d.Digest
+	}
+	var docs []mongodoc.OCIBlob
+	err = s.DB.OCIBlobs().Find(bson.D{
+		{"baseurl", baseURL},
+		{"digest", bson.D{{"$in", digests}}},
+	}).Select(FieldSelector("digest", "size")).All(&docs)
+	if err != nil {
+		return errgo.Notef(err, "cannot get OCI blobs")
+	}
+	sizes := make(map[string]int64)
+	for _, doc := range docs {
+		sizes[doc.Digest] = doc.Size
+	}
+	for _, d := range descriptors {
+		size, ok := sizes[d.Digest]
+		if !ok {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "blob %q referred to by manifest has not been uploaded", d.Digest)
+		}
+		if size != d.Size {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "size mismatch for blob %q (got %d want %d)", d.Digest, d.Size, size)
+		}
+	}
+	return nil
+}
+
+// addOCIBlobRefs adds to refs the hashes of the OCI blobs that are
+// referred to by the manifest of an OCI image resource revision, and
+// of those uploaded after the given time, which may be referred to by
+// a manifest that has not been uploaded yet. The documents of all the
+// other OCI blobs are removed.
+func (s *Store) addOCIBlobRefs(refs *blobstore.Refs, before time.Time) error {
+	var baseURLs []*charm.URL
+	if err := s.DB.OCIBlobs().Find(nil).Distinct("baseurl", &baseURLs); err != nil {
+		return errgo.Notef(err, "cannot get OCI blob base URLs")
+	}
+	for _, baseURL := range baseURLs {
+		digests, err := s.ociManifestDigests(baseURL)
+		if err != nil {
+			// Keep all the OCI blobs of this base entity rather
+			// than let one bad manifest stop the collection of
+			// all the other blobs.
+			logger.Errorf("keeping all OCI blobs of %s: %v", baseURL, err)
+		}
+		iter := s.DB.OCIBlobs().Find(bson.D{{"baseurl", baseURL}}).Select(FieldSelector("digest", "blobhash", "uploadtime")).Iter()
+		var doc mongodoc.OCIBlob
+		for iter.Next(&doc) {
+			if digests == nil || digests[doc.Digest] || doc.UploadTime.After(before) {
+				refs.Add(doc.BlobHash)
+				continue
+			}
+			// Note that the blob may have been uploaded again
+			// since we read the document, in which case it is
+			// left alone. Its blob is then not removed by the
+			// blob store garbage collector either, because its
+			// put time has been updated.
+			err := s.DB.OCIBlobs().Remove(bson.D{
+				{"baseurl", baseURL},
+				{"digest", doc.Digest},
+				{"uploadtime", bson.D{{"$lte", before}}},
+			})
+			if err != nil && err != mgo.ErrNotFound {
+				iter.Close()
+				return errgo.Notef(err, "cannot remove OCI blob %q", doc.Digest)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return errgo.Notef(err, "cannot iterate through OCI blobs")
+		}
+	}
+	return nil
+}
+
+// ociManifestDigests returns the set of digests referred to by the
+// manifests of all the revisions of the OCI image resources of the
+// charm with the given base URL. Revisions are included whatever
+// channels they are published to, and whether or not they are
+// published at all, because any of them may still be published and
+// downloaded; old revisions are only removed by PruneResources.
+// Revisions with no manifest blob are ignored.
+func (s *Store) ociManifestDigests(baseURL *charm.URL) (map[string]bool, error) {
+	var entities []mongodoc.Entity
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", baseURL}}).Select(FieldSelector("charmmeta")).All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot get entities for %s", baseURL)
+	}
+	nameSet := make(map[string]bool)
+	for _, e := range entities {
+		if e.CharmMeta == nil {
+			continue
+		}
+		for name, r := range e.CharmMeta.Resources {
+			if IsOCIImageResource(r) {
+				nameSet[name] = true
+			}
+		}
+	}
+	digests := make(map[string]bool)
+	if len(nameSet) == 0 {
+		return digests, nil
+	}
+	names := make([]string, 0, len(nameSet))
+	for name := range nameSet {
+		names = append(names, name)
+	}
+	var resources []mongodoc.Resource
+	if err := s.DB.Resources().Find(bson.D{
+		{"baseurl", baseURL},
+		{"name", bson.D{{"$in", names}}},
+	}).Select(FieldSelector("blobhash", "size")).All(&resources); err != nil {
+		return nil, errgo.Notef(err, "cannot get OCI image resources for %s", baseURL)
+	}
+	for _, res := range resources {
+		if res.BlobHash == "" {
+			continue
+		}
+		// Any failure to read a manifest is fatal, because
+		// otherwise the blobs it refers to would be removed.
+		m, err := s.readOCIManifestBlob(res.BlobHash, res.Size)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read OCI image manifest for %s", baseURL)
+		}
+		for _, d := range append([]OCIDescriptor{m.Config}, m.Layers...) {
+			digests[d.Digest] = true
+		}
+	}
+	return digests, nil
+}
+
+// readOCIManifestBlob reads and parses the OCI image manifest held
+// in the blob with the given hash and size.
+func (s *Store) readOCIManifestBlob(hash string, size int64) (*OCIManifest, error) {
+	r, _, err := s.BlobStore.Open(hash, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer r.Close()
+	data, err := readOCIManifest(r, size)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	m, err := ParseOCIManifest(data)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return m, nil
+}
+
+// readOCIManifest reads an OCI image manifest from r, which should
+// hold size bytes.
+func readOCIManifest(r io.Reader, size int64) ([]byte, error) {
+	if size > maxOCIManifestSize {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "OCI image manifest too large")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errgo.Notef(err, "cannot read OCI image manifest")
+	}
+	return data, nil
+}
+
+func charmHasOCIImageResource(meta *charm.Meta, name string) bool {
+	if meta == nil {
+		return false
+	}
+	r, ok := meta.Resources[name]
+	return ok && IsOCIImageResource(r)
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type ociSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&ociSuite{})
+
+func ociDigestOfString(s string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(s)))
+}
+
+var parseOCIManifestTests = []struct {
+	about       string
+	manifest    string
+	expectError string
+}{{
+	about:    "valid manifest",
+	manifest: fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q,"size":1},"layers":[{"digest":%q,"size":2}]}`, ociDigestOfString("a"), ociDigestOfString("bb")),
+}, {
+	about:       "invalid JSON",
+	manifest:    `{`,
+	expectError: `cannot unmarshal OCI image manifest: .*`,
+}, {
+	about:       "bad schema version",
+	manifest:    `{"schemaVersion":1}`,
+	expectError: `unsupported OCI image manifest schema version 1`,
+}, {
+	about:       "bad digest",
+	manifest:    fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q,"size":1},"layers":[{"digest":"md5:1234","size":2}]}`, ociDigestOfString("a")),
+	expectError: `invalid digest "md5:1234" in OCI image manifest`,
+}}
+
+func (s *ociSuite) TestParseOCIManifest(c *gc.C) {
+	for i, test := range parseOCIManifestTests {
+		c.Logf("test %d: %s", i, test.about)
+		m, err := ParseOCIManifest([]byte(test.manifest))
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(m.MediaType, gc.Equals, OCIManifestMediaType)
+	}
+}
+
+func (s *ociSuite) TestParseOCIImageResource(c *gc.C) {
+	meta, err := charm.ReadMeta(strings.NewReader(`
+name: image-charm
+summary: A charm with an OCI image resource.
+description: A charm with an OCI image resource.
+resources:
+  image:
+    type: oci-image
+    description: The image to run.
+`))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(IsOCIImageResource(meta.Resources["image"]), gc.Equals, true)
+	c.Assert(meta.Resources["image"].Type.String(), gc.Equals, OCIImageResourceType)
+}
+
+func (s *ociSuite) addOCIImageCharm(c *gc.C, store *Store, id *router.ResolvedURL) {
+	ociType, err := resource.ParseType(OCIImageResourceType)
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(id, storetesting.NewCharm(&charm.Meta{
+		Resources: map[string]resource.Meta{
+			"image": {
+				Name: "image",
+				Type: ociType,
+			},
+		},
+	}))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *ociSuite) TestUploadOCIImage(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	s.addOCIImageCharm(c, store, id)
+
+	layer := "layer content"
+	err := store.UploadOCIBlob(id, "image", ociDigestOfString(layer), strings.NewReader(layer), hashOfString(layer), int64(len(layer)))
+	c.Assert(err, gc.Equals, nil)
+
+	// Uploading the same blob again succeeds.
+	err = store.UploadOCIBlob(id, "image", ociDigestOfString(layer), strings.NewReader(layer), hashOfString(layer), int64(len(layer)))
+	c.Assert(err, gc.Equals, nil)
+
+	blob, err := store.OpenOCIBlob(id, ociDigestOfString(layer))
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadAll(blob)
+	blob.Close()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, layer)
+
+	// A manifest that refers to a blob that has not been
+	// uploaded is rejected.
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q,"size":6},"layers":[{"digest":%q,"size":%d}]}`, ociDigestOfString("config"), ociDigestOfString(layer), len(layer))
+	_, err = store.UploadResource(id, "image", strings.NewReader(manifest), hashOfString(manifest), int64(len(manifest)), nil)
+	c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`blob %q referred to by manifest has not been uploaded`, ociDigestOfString("config")))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.UploadOCIBlob(id, "image", ociDigestOfString("config"), strings.NewReader("config"), hashOfString("config"), int64(len("config")))
+	c.Assert(err, gc.Equals, nil)
+	res, err := store.UploadResource(id, "image", strings.NewReader(manifest), hashOfString(manifest), int64(len(manifest)), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Revision, gc.Equals, 0)
+
+	res1, err := store.ResolveOCIManifest(id, "image", ociDigestOfString(manifest))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res1.Revision, gc.Equals, 0)
+
+	_, err = store.ResolveOCIManifest(id, "image", ociDigestOfString("other"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *ociSuite) TestUploadOCIBlobDigestMismatch(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	s.addOCIImageCharm(c, store, id)
+
+	layer := "layer content"
+	err := store.UploadOCIBlob(id, "image", ociDigestOfString("other"), strings.NewReader(layer), hashOfString(layer), int64(len(layer)))
+	c.Assert(err, gc.ErrorMatches, `digest mismatch .*`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	_, err = store.OpenOCIBlob(id, ociDigestOfString("other"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *ociSuite) TestUploadOCIBlobNotOCIImageResource(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+
+	layer := "layer content"
+	err = store.UploadOCIBlob(id, "someResource", ociDigestOfString(layer), strings.NewReader(layer), hashOfString(layer), int64(len(layer)))
+	c.Assert(err, gc.ErrorMatches, `charm does not have OCI image resource "someResource"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *ociSuite) TestBlobStoreGCRemovesUnreferencedOCIBlobs(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	s.addOCIImageCharm(c, store, id)
+
+	for _, content := range []string{"config", "layer", "unused"} {
+		err := store.UploadOCIBlob(id, "image", ociDigestOfString(content), strings.NewReader(content), hashOfString(content), int64(len(content)))
+		c.Assert(err, gc.Equals, nil)
+	}
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q,"size":6},"layers":[{"digest":%q,"size":5}]}`, ociDigestOfString("config"), ociDigestOfString("layer"))
+	_, err := store.UploadResource(id, "image", strings.NewReader(manifest), hashOfString(manifest), int64(len(manifest)), nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// Blobs uploaded after the GC time are retained, because a
+	// manifest referring to them may not have been uploaded yet.
+	err = store.BlobStoreGC(time.Now().Add(-time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	blob, err := store.OpenOCIBlob(id, ociDigestOfString("unused"))
+	c.Assert(err, gc.Equals, nil)
+	blob.Close()
+
+	err = store.BlobStoreGC(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.OpenOCIBlob(id, ociDigestOfString("unused"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, _, err = store.BlobStore.Open(hashOfString("unused"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+
+	// The blobs referred to by the manifest are retained.
+	for _, content := range []string{"config", "layer"} {
+		blob, err := store.OpenOCIBlob(id, ociDigestOfString(content))
+		c.Assert(err, gc.Equals, nil)
+		data, err := ioutil.ReadAll(blob)
+		blob.Close()
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(data), gc.Equals, content)
+	}
+}
+
+func (s *ociSuite) TestBlobStoreGCKeepsOCIBlobsWithUnreadableManifest(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	good := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	bad := MustParseResolvedURL("cs:~charmers/precise/mysql-3")
+	for _, id := range []*router.ResolvedURL{good, bad} {
+		s.addOCIImageCharm(c, store, id)
+		for _, content := range []string{"config", "unused-" + id.URL.Name} {
+			err := store.UploadOCIBlob(id, "image", ociDigestOfString(content), strings.NewReader(content), hashOfString(content), int64(len(content)))
+			c.Assert(err, gc.Equals, nil)
+		}
+		manifest := fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q,"size":6},"layers":[]}`, ociDigestOfString("config"))
+		_, err := store.UploadResource(id, "image", strings.NewReader(manifest), hashOfString(manifest), int64(len(manifest)), nil)
+		c.Assert(err, gc.Equals, nil)
+	}
+	// Make the manifest of one charm unreadable.
+	_, err := store.DB.Resources().UpdateAll(bson.D{{"baseurl", mongodoc.BaseURL(&bad.URL)}}, bson.D{{"$set", bson.D{{"blobhash", hashOfString("no such blob")}}}})
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.BlobStoreGC(time.Now())
+	c.Assert(err, gc.Equals, nil)
+
+	// The unused blob of the charm with a readable manifest has
+	// been removed, but all the blobs of the other are kept.
+	_, err = store.OpenOCIBlob(good, ociDigestOfString("unused-wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	blob, err := store.OpenOCIBlob(bad, ociDigestOfString("unused-mysql"))
+	c.Assert(err, gc.Equals, nil)
+	blob.Close()
+}
@@ -0,0 +1,206 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// Orgs returns all the organisations stored in the database, ordered
+// by name.
+func (s *Store) Orgs() ([]mongodoc.Org, error) {
+	orgs := make([]mongodoc.Org, 0)
+	if err := s.DB.Orgs().Find(nil).Sort("_id").All(&orgs); err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve organisations")
+	}
+	return orgs, nil
+}
+
+// Org returns the organisation with the given name. If there is no
+// such organisation, it returns an error with a params.ErrNotFound
+// cause.
+func (s *Store) Org(name string) (*mongodoc.Org, error) {
+	var org mongodoc.Org
+	if err := s.DB.Orgs().FindId(name).One(&org); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "organisation %q not found", name)
+		}
+		return nil, errgo.Notef(err, "cannot retrieve organisation %q", name)
+	}
+	return &org, nil
+}
+
+// UserOrgs returns the names of the organisations that the user with
+// the given name is a member of, ordered by name. The results are
+// cached for at most ServerParams.GroupCacheMaxAge.
+func (s *Store) UserOrgs(username string) ([]string, error) {
+	v, err := s.pool.userOrgs.Get(username, func() (interface{}, error) {
+		var orgs []mongodoc.Org
+		if err := s.DB.Orgs().Find(bson.D{{"members.user", username}}).Select(bson.D{{"_id", 1}}).Sort("_id").All(&orgs); err != nil {
+			return nil, errgo.Notef(err, "cannot retrieve organisations of %q", username)
+		}
+		names := make([]string, len(orgs))
+		for i, org := range orgs {
+			names[i] = org.Name
+		}
+		return names, nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return v.([]string), nil
+}
+
+// SetOrg creates or replaces the given organisation.
+func (s *Store) SetOrg(org *mongodoc.Org) error {
+	if org.Members == nil {
+		org.Members = []mongodoc.OrgMember{}
+	}
+	if _, err := s.DB.Orgs().UpsertId(org.Name, org); err != nil {
+		return errgo.Notef(err, "cannot update organisation %q", org.Name)
+	}
+	s.pool.userOrgs.EvictAll()
+	return nil
+}
+
+// SetOrgMember adds the user with the given name to the organisation
+// with the given name, or changes the role of the user if they are
+// already a member. If there is no such organisation, it returns an
+// error with a params.ErrNotFound cause.
+func (s *Store) SetOrgMember(name, username string, role mongodoc.OrgRole) error {
+	member := mongodoc.OrgMember{
+		User: username,
+		Role: role,
+	}
+	// Each update only applies when the user is, or is not, already
+	// a member, so that the user is never listed more than once. If
+	// neither applies, the membership changed between the two
+	// updates (or there is no such organisation), so try again.
+	for i := 0; i < 3; i++ {
+		err := s.DB.Orgs().Update(bson.D{
+			{"_id", name},
+			{"members.user", username},
+		}, bson.D{{"$set", bson.D{{"members.$.role", role}}}})
+		if err == nil {
+			s.pool.userOrgs.EvictAll()
+			return nil
+		}
+		if err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot update %q in organisation %q", username, name)
+		}
+		err = s.DB.Orgs().Update(bson.D{
+			{"_id", name},
+			{"members.user", bson.D{{"$ne", username}}},
+		}, bson.D{{"$push", bson.D{{"members", member}}}})
+		if err == nil {
+			s.pool.userOrgs.EvictAll()
+			return nil
+		}
+		if err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot add %q to organisation %q", username, name)
+		}
+		if _, err := s.Org(name); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+	}
+	return errgo.Newf("cannot add %q to organisation %q: too many concurrent changes", username, name)
+}
+
+// RemoveOrgMember removes the user with the given name from the
+// organisation with the given name. If there is no such organisation,
+// it returns an error with a params.ErrNotFound cause.
+func (s *Store) RemoveOrgMember(name, username string) error {
+	if err := s.DB.Orgs().UpdateId(name, bson.D{{"$pull", bson.D{{"members", bson.D{{"user", username}}}}}}); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "organisation %q not found", name)
+		}
+		return errgo.Notef(err, "cannot remove %q from organisation %q", username, name)
+	}
+	s.pool.userOrgs.EvictAll()
+	return nil
+}
+
+// SetOrgDefaultACL sets the ACL given to new base entities created in
+// the namespace of the organisation with the given name. If there is
+// no such organisation, it returns an error with a params.ErrNotFound
+// cause.
+func (s *Store) SetOrgDefaultACL(name string, acl mongodoc.ACL) error {
+	if err := s.DB.Orgs().UpdateId(name, bson.D{{"$set", bson.D{{"defaultacl", acl}}}}); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "organisation %q not found", name)
+		}
+		return errgo.Notef(err, "cannot update organisation %q", name)
+	}
+	return nil
+}
+
+// RemoveOrg removes the organisation with the given name. Entities in
+// its namespace are left unchanged. If there is no such organisation,
+// it returns an error with a params.ErrNotFound cause.
+func (s *Store) RemoveOrg(name string) error {
+	if err := s.DB.Orgs().RemoveId(name); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "organisation %q not found", name)
+		}
+		return errgo.Notef(err, "cannot remove organisation %q", name)
+	}
+	s.pool.userOrgs.EvictAll()
+	return nil
+}
+
+// OrgDefaultACL returns the ACL given to all channels of new base
+// entities created in the given organisation's namespace. An empty
+// read field of the organisation's DefaultACL is set to the
+// organisation's name; the other empty fields are set to the members
+// with the admin or uploader role at the time of the call.
+func OrgDefaultACL(org *mongodoc.Org) mongodoc.ACL {
+	var uploaders []string
+	for _, m := range org.Members {
+		if m.Role == mongodoc.OrgAdmin || m.Role == mongodoc.OrgUploader {
+			uploaders = append(uploaders, m.User)
+		}
+	}
+	def := func(users, def []string) []string {
+		if len(users) == 0 {
+			return def
+		}
+		return users
+	}
+	members := []string{org.Name}
+	return mongodoc.ACL{
+		Read:    def(org.DefaultACL.Read, members),
+		Write:   def(org.DefaultACL.Write, uploaders),
+		Upload:  def(org.DefaultACL.Upload, uploaders),
+		Publish: def(org.DefaultACL.Publish, uploaders),
+		SetPerm: def(org.DefaultACL.SetPerm, uploaders),
+		Delete:  def(org.DefaultACL.Delete, uploaders),
+	}
+}
+
+// newBaseEntityACL returns the ACL given to all channels of a new base
+// entity in the given namespace. When the namespace is owned by an
+// organisation, the organisation's default ACL is used.
+func (s *Store) newBaseEntityACL(namespace string) (mongodoc.ACL, error) {
+	org, err := s.Org(namespace)
+	if err == nil {
+		return OrgDefaultACL(org), nil
+	}
+	if errgo.Cause(err) != params.ErrNotFound {
+		return mongodoc.ACL{}, errgo.Mask(err)
+	}
+	perms := []string{namespace}
+	return mongodoc.ACL{
+		Read:    perms,
+		Write:   perms,
+		Upload:  perms,
+		Publish: perms,
+		SetPerm: perms,
+		Delete:  perms,
+	}, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type orgsSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&orgsSuite{})
+
+func (s *orgsSuite) TestOrgs(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	orgs, err := store.Orgs()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(orgs, gc.HasLen, 0)
+
+	err = store.SetOrg(&mongodoc.Org{
+		Name: "acme",
+		Members: []mongodoc.OrgMember{{
+			User: "bob",
+			Role: mongodoc.OrgAdmin,
+		}},
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetOrg(&mongodoc.Org{
+		Name: "empty",
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetOrgMember("acme", "alice", mongodoc.OrgUploader)
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetOrgMember("acme", "bob", mongodoc.OrgMemberRole)
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetOrgDefaultACL("acme", mongodoc.ACL{
+		Read: []string{params.Everyone},
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	orgs, err = store.Orgs()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(orgs, jc.DeepEquals, []mongodoc.Org{{
+		Name: "acme",
+		Members: []mongodoc.OrgMember{{
+			User: "bob",
+			Role: mongodoc.OrgMemberRole,
+		}, {
+			User: "alice",
+			Role: mongodoc.OrgUploader,
+		}},
+		DefaultACL: mongodoc.ACL{
+			Read: []string{params.Everyone},
+		},
+	}, {
+		Name:    "empty",
+		Members: []mongodoc.OrgMember{},
+	}})
+
+	err = store.RemoveOrgMember("acme", "bob")
+	c.Assert(err, gc.Equals, nil)
+	org, err := store.Org("acme")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(org.Members, jc.DeepEquals, []mongodoc.OrgMember{{
+		User: "alice",
+		Role: mongodoc.OrgUploader,
+	}})
+
+	err = store.RemoveOrg("acme")
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.Org("acme")
+	c.Assert(err, gc.ErrorMatches, `organisation "acme" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.RemoveOrg("acme")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.SetOrgMember("acme", "bob", mongodoc.OrgAdmin)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.RemoveOrgMember("acme", "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.SetOrgDefaultACL("acme", mongodoc.ACL{})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *orgsSuite) TestUserOrgs(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.SetOrg(&mongodoc.Org{
+		Name: "acme",
+		Members: []mongodoc.OrgMember{{
+			User: "bob",
+			Role: mongodoc.OrgAdmin,
+		}},
+	})
+	c.Assert(err, gc.Equals, nil)
+	orgs, err := store.UserOrgs("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(orgs, jc.DeepEquals, []string{"acme"})
+
+	// Changing an organisation invalidates the cache.
+	err = store.SetOrg(&mongodoc.Org{
+		Name: "widgets",
+		Members: []mongodoc.OrgMember{{
+			User: "bob",
+			Role: mongodoc.OrgMemberRole,
+		}},
+	})
+	c.Assert(err, gc.Equals, nil)
+	orgs, err = store.UserOrgs("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(orgs, jc.DeepEquals, []string{"acme", "widgets"})
+
+	err = store.RemoveOrgMember("acme", "bob")
+	c.Assert(err, gc.Equals, nil)
+	orgs, err = store.UserOrgs("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(orgs, jc.DeepEquals, []string{"widgets"})
+
+	orgs, err = store.UserOrgs("alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(orgs, gc.HasLen, 0)
+}
+
+func (s *orgsSuite) TestNewBaseEntityUsesOrgDefaultACL(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.SetOrg(&mongodoc.Org{
+		Name: "acme",
+		Members: []mongodoc.OrgMember{{
+			User: "bob",
+			Role: mongodoc.OrgAdmin,
+		}, {
+			User: "alice",
+			Role: mongodoc.OrgUploader,
+		}, {
+			User: "carol",
+			Role: mongodoc.OrgMemberRole,
+		}},
+		DefaultACL: mongodoc.ACL{
+			Read:   []string{params.Everyone},
+			Delete: []string{"acme-admins"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.AddCharmWithArchive(MustParseResolvedURL("~acme/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("~bob/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	be, err := store.FindBaseEntity(charm.MustParseURL("~acme/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	expectACL := mongodoc.ACL{
+		Read:    []string{params.Everyone},
+		Write:   []string{"bob", "alice"},
+		Upload:  []string{"bob", "alice"},
+		Publish: []string{"bob", "alice"},
+		SetPerm: []string{"bob", "alice"},
+		Delete:  []string{"acme-admins"},
+	}
+	for _, ch := range params.OrderedChannels {
+		c.Assert(be.ChannelACLs[ch], jc.DeepEquals, expectACL, gc.Commentf("channel %s", ch))
+	}
+
+	// Namespaces not owned by an organisation are unaffected.
+	be, err = store.FindBaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.ChannelACLs[params.StableChannel].Read, jc.DeepEquals, []string{"bob"})
+	c.Assert(be.ChannelACLs[params.StableChannel].Delete, jc.DeepEquals, []string{"bob"})
+}
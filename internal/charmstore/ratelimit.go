@@ -0,0 +1,56 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"gopkg.in/juju/charmstore.v5-unstable/internal/ratelimit"
+)
+
+// RequestKind classifies requests so that separate rate limits
+// can be applied to different kinds of request.
+type RequestKind int
+
+const (
+	// ReadRequest is the kind of requests that only read data,
+	// other than archive and resource downloads.
+	ReadRequest RequestKind = iota
+
+	// WriteRequest is the kind of requests that change data.
+	WriteRequest
+
+	// DownloadRequest is the kind of requests that download
+	// archives or resources.
+	DownloadRequest
+
+	numRequestKinds
+)
+
+var requestKindNames = [numRequestKinds]string{
+	ReadRequest:     "read",
+	WriteRequest:    "write",
+	DownloadRequest: "download",
+}
+
+// String returns the name of the request kind.
+func (k RequestKind) String() string {
+	return requestKindNames[k]
+}
+
+// newRateLimiters returns the rate limiters for each kind
+// of request as specified by the given configuration.
+func newRateLimiters(config ServerParams) [numRequestKinds]*ratelimit.Limiter {
+	return [numRequestKinds]*ratelimit.Limiter{
+		ReadRequest:     ratelimit.New(config.ReadRateLimit),
+		WriteRequest:    ratelimit.New(config.WriteRateLimit),
+		DownloadRequest: ratelimit.New(config.DownloadRateLimit),
+	}
+}
+
+// RateLimiter returns the limiter for requests of the given kind. The
+// limiters are shared by all the API versions served from the pool.
+// It returns nil, which allows all requests, when requests of that
+// kind are not limited.
+func (p *Pool) RateLimiter(kind RequestKind) *ratelimit.Limiter {
+	return p.rateLimiters[kind]
+}
@@ -3,6 +3,7 @@
 
 package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"sort"
@@ -135,14 +136,30 @@ func mapRevisions(resourceRevisions []mongodoc.ResourceRevision) map[string]int
 	return revisions
 }
 
+// ResourceUploadInfo holds optional information about a resource
+// revision that is recorded when it is uploaded.
+type ResourceUploadInfo struct {
+	// Uploader holds the name of the user uploading the resource.
+	Uploader string
+
+	// Description holds a description of the new revision.
+	Description string
+
+	// Metadata holds arbitrary key/value metadata to be associated
+	// with the new revision.
+	Metadata map[string]string
+}
+
 // UploadResource add blob to the blob store and adds a new resource with
 // the given name to the entity with the given id. The revision of the new resource
 // will be calculated to be one higher than any existing resources.
+// If info is non-nil, the information it holds is recorded
+// with the new revision.
 //
 // TODO consider restricting uploads so that if the hash matches the
 // latest revision then a new revision isn't created. This would match
 // the behaviour for charms and bundles.
-func (s *Store) UploadResource(id *router.ResolvedURL, name string, blob io.Reader, blobHash string, size int64) (*mongodoc.Resource, error) {
+func (s *Store) UploadResource(id *router.ResolvedURL, name string, blob io.Reader, blobHash string, size int64, info *ResourceUploadInfo) (*mongodoc.Resource, error) {
 	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
@@ -150,17 +167,32 @@ func (s *Store) UploadResource(id *router.ResolvedURL, name string, blob io.Read
 	if !charmHasResource(entity.CharmMeta, name) {
 		return nil, errgo.Newf("charm does not have resource %q", name)
 	}
-	if _, err := s.putArchive(blob, size, blobHash); err != nil {
+	if charmHasOCIImageResource(entity.CharmMeta, name) {
+		// The content of an OCI image resource revision is
+		// its manifest, which must refer only to blobs that
+		// have already been uploaded.
+		data, err := readOCIManifest(blob, size)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		if err := s.checkOCIManifest(entity.BaseURL, data); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		blob = bytes.NewReader(data)
+	}
+	blobHash256, err := s.putArchive(blob, size, blobHash)
+	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	res, err := s.addResource(&mongodoc.Resource{
-		BaseURL:    entity.BaseURL,
-		Name:       name,
-		Revision:   -1,
-		BlobHash:   blobHash,
-		Size:       size,
-		UploadTime: time.Now().UTC(),
-	}, "")
+	res, err := s.addResource(newResourceDoc(&mongodoc.Resource{
+		BaseURL:     entity.BaseURL,
+		Name:        name,
+		Revision:    -1,
+		BlobHash:    blobHash,
+		BlobHash256: blobHash256,
+		Size:        size,
+		UploadTime:  time.Now().UTC(),
+	}, info), "")
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -169,7 +201,7 @@ func (s *Store) UploadResource(id *router.ResolvedURL, name string, blob io.Read
 
 // AddResourceWithUploadId is like UploadResource except that it associates
 // the resource with an already-uploaded multipart upload.
-func (s *Store) AddResourceWithUploadId(id *router.ResolvedURL, name string, uploadId string) (*mongodoc.Resource, error) {
+func (s *Store) AddResourceWithUploadId(id *router.ResolvedURL, name string, uploadId string, info *ResourceUploadInfo) (*mongodoc.Resource, error) {
 	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
@@ -177,33 +209,50 @@ func (s *Store) AddResourceWithUploadId(id *router.ResolvedURL, name string, upl
 	if !charmHasResource(entity.CharmMeta, name) {
 		return nil, errgo.Newf("charm does not have resource %q", name)
 	}
-	info, err := s.BlobStore.UploadInfo(uploadId)
+	uploadInfo, err := s.BlobStore.UploadInfo(uploadId)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	var size int64
-	for _, p := range info.Parts {
+	for _, p := range uploadInfo.Parts {
 		size += p.Size
 	}
-	idx, ok := info.Index()
+	idx, ok := uploadInfo.Index()
 	if !ok {
 		return nil, errgo.Newf("upload not completed yet")
 	}
-	res, err := s.addResource(&mongodoc.Resource{
-		BaseURL:    entity.BaseURL,
-		Name:       name,
-		Revision:   -1,
-		BlobHash:   info.Hash,
-		BlobIndex:  idx,
-		Size:       size,
-		UploadTime: time.Now().UTC(),
-	}, uploadId)
+	if charmHasOCIImageResource(entity.CharmMeta, name) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "cannot use multipart upload for OCI image resource %q", name)
+	}
+	res, err := s.addResource(newResourceDoc(&mongodoc.Resource{
+		BaseURL:     entity.BaseURL,
+		Name:        name,
+		Revision:    -1,
+		BlobHash:    uploadInfo.Hash,
+		BlobHash256: idx.Hash256,
+		BlobIndex:   idx,
+		Size:        size,
+		UploadTime:  time.Now().UTC(),
+	}, info), uploadId)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
 	}
 	return res, nil
 }
 
+// newResourceDoc returns r updated with the information in info,
+// which may be nil.
+func newResourceDoc(r *mongodoc.Resource, info *ResourceUploadInfo) *mongodoc.Resource {
+	if info != nil {
+		r.Uploader = info.Uploader
+		r.Description = info.Description
+		if len(info.Metadata) > 0 {
+			r.Metadata = info.Metadata
+		}
+	}
+	return r
+}
+
 // addResource adds r to the resources collection. If r does not specify
 // a revision number will be one higher than any existing revisions. The
 // inserted resource is returned on success.
@@ -293,6 +342,133 @@ func (s *Store) ResolveResource(url *router.ResolvedURL, name string, revision i
 	return &r, nil
 }
 
+// DeleteResource deletes the given revision of the named resource
+// associated with the entity with the given id. If the revision is
+// currently published in any channel, it returns an error with an
+// ErrForbidden cause. The blob holding the resource content will be
+// removed by the next blob store garbage collection if it is not
+// referenced elsewhere.
+func (s *Store) DeleteResource(id *router.ResolvedURL, name string, revision int) error {
+	baseEntity, err := s.FindBaseEntity(&id.URL, FieldSelector("channelresources"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	var published []string
+	for ch, revisions := range baseEntity.ChannelResources {
+		if rev, ok := mapRevisions(revisions)[name]; ok && rev == revision {
+			published = append(published, string(ch))
+		}
+	}
+	if len(published) > 0 {
+		sort.Strings(published)
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot delete %q resource %q because it is published in channels %s", baseEntity.URL, fmt.Sprintf("%s/%d", name, revision), published)
+	}
+	if err := s.DB.Resources().Remove(newResourceQuery(baseEntity.URL, name, revision)); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "%s has no %q resource", baseEntity.URL, fmt.Sprintf("%s/%d", name, revision))
+		}
+		return errgo.Notef(err, "cannot remove resource")
+	}
+	return nil
+}
+
+// PruneResources removes old revisions of all resources, keeping
+// the given number of the most recent revisions of each resource
+// that are not published in any channel. Published revisions are
+// never removed. It returns the number of resource revisions removed.
+func (s *Store) PruneResources(keep int) (int, error) {
+	if keep < 0 {
+		return 0, errgo.Newf("negative retention count %d", keep)
+	}
+	// Iterating in index order means that all revisions of a given
+	// resource are contiguous and in ascending revision order.
+	iter := s.DB.Resources().Find(nil).
+		Select(FieldSelector("baseurl", "name", "revision")).
+		Sort("baseurl", "name", "revision").
+		Iter()
+	removed := 0
+	var baseURL *charm.URL
+	var name string
+	var revisions []int
+	prune := func() error {
+		if len(revisions) <= keep {
+			return nil
+		}
+		n, err := s.pruneResourceRevisions(baseURL, name, revisions, keep)
+		removed += n
+		return errgo.Mask(err)
+	}
+	var r mongodoc.Resource
+	for iter.Next(&r) {
+		if baseURL == nil || *baseURL != *r.BaseURL || name != r.Name {
+			if err := prune(); err != nil {
+				iter.Close()
+				return removed, errgo.Mask(err)
+			}
+			baseURL, name, revisions = r.BaseURL, r.Name, revisions[:0]
+		}
+		revisions = append(revisions, r.Revision)
+	}
+	if err := iter.Close(); err != nil {
+		return removed, errgo.Mask(err)
+	}
+	if err := prune(); err != nil {
+		return removed, errgo.Mask(err)
+	}
+	return removed, nil
+}
+
+// pruneResourceRevisions removes all but the last keep unpublished
+// revisions of the named resource associated with the given base URL.
+// The revisions must be sorted in ascending order.
+func (s *Store) pruneResourceRevisions(baseURL *charm.URL, name string, revisions []int, keep int) (int, error) {
+	baseEntity, err := s.FindBaseEntity(baseURL, FieldSelector("channelresources"))
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			// The resource is not associated with any charm;
+			// leave it alone.
+			return 0, nil
+		}
+		return 0, errgo.Mask(err)
+	}
+	var remove []int
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if isPublishedResource(baseEntity, name, revisions[i]) {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		remove = append(remove, revisions[i])
+	}
+	if len(remove) == 0 {
+		return 0, nil
+	}
+	info, err := s.DB.Resources().RemoveAll(bson.D{
+		{"baseurl", baseURL},
+		{"name", name},
+		{"revision", bson.D{{"$in", remove}}},
+	})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot remove resources")
+	}
+	return info.Removed, nil
+}
+
+// isPublishedResource reports whether the given revision of the named
+// resource is published in any channel of the given base entity.
+func isPublishedResource(baseEntity *mongodoc.BaseEntity, name string, revision int) bool {
+	for _, revisions := range baseEntity.ChannelResources {
+		for _, rr := range revisions {
+			if rr.Name == name && rr.Revision == revision {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func charmHasResource(meta *charm.Meta, name string) bool {
 	if meta == nil {
 		return false
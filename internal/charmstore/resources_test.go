@@ -4,6 +4,7 @@
 package charmstore
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"strconv"
@@ -219,7 +220,7 @@ func (s *resourceSuite) TestUploadResource(c *gc.C) {
 
 	now := time.Now()
 	blob := "content 1"
-	res, err := store.UploadResource(id, "someResource", strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	res, err := store.UploadResource(id, "someResource", strings.NewReader(blob), hashOfString(blob), int64(len(blob)), nil)
 	c.Assert(err, gc.Equals, nil)
 	if res.UploadTime.Before(now) {
 		c.Fatalf("upload time earlier than expected; want > %v; got %v", now, res.UploadTime)
@@ -227,11 +228,46 @@ func (s *resourceSuite) TestUploadResource(c *gc.C) {
 	checkResourceDocs(c, store, id, []string{"someResource/0"}, []*mongodoc.Resource{res})
 
 	blob = "content 2"
-	res, err = store.UploadResource(id, "someResource", strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	res, err = store.UploadResource(id, "someResource", strings.NewReader(blob), hashOfString(blob), int64(len(blob)), nil)
 	c.Assert(err, gc.Equals, nil)
 	checkResourceDocs(c, store, id, []string{"someResource/1"}, []*mongodoc.Resource{res})
 }
 
+func (s *resourceSuite) TestUploadResourceWithInfo(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	blob := "content 1"
+	res, err := store.UploadResource(id, "someResource", strings.NewReader(blob), hashOfString(blob), int64(len(blob)), &ResourceUploadInfo{
+		Uploader:    "bob",
+		Description: "first revision",
+		Metadata: map[string]string{
+			"arch": "amd64",
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.BlobHash256, gc.Equals, fmt.Sprintf("%x", sha256.Sum256([]byte(blob))))
+	c.Assert(res.Uploader, gc.Equals, "bob")
+	c.Assert(res.Description, gc.Equals, "first revision")
+	c.Assert(res.Metadata, jc.DeepEquals, map[string]string{
+		"arch": "amd64",
+	})
+	checkResourceDocs(c, store, id, []string{"someResource/0"}, []*mongodoc.Resource{res})
+
+	// Invalid metadata keys are rejected.
+	_, err = store.UploadResource(id, "someResource", strings.NewReader(blob), hashOfString(blob), int64(len(blob)), &ResourceUploadInfo{
+		Metadata: map[string]string{
+			"a.b": "c",
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid metadata key "a.b"`)
+}
+
 func (s *resourceSuite) TestAddResourceWithUploadId(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -247,7 +283,7 @@ func (s *resourceSuite) TestAddResourceWithUploadId(c *gc.C) {
 	}
 	uid := putMultipart(c, store.BlobStore, time.Time{}, contents...)
 
-	res, err := store.AddResourceWithUploadId(id, "someResource", uid)
+	res, err := store.AddResourceWithUploadId(id, "someResource", uid, nil)
 	c.Assert(err, gc.Equals, nil)
 
 	// Check that the upload document has been removed.
@@ -261,6 +297,7 @@ func (s *resourceSuite) TestAddResourceWithUploadId(c *gc.C) {
 	defer blob.Close()
 	c.Assert(blob.Size, gc.Equals, int64(len(allContents)))
 	c.Assert(blob.Hash, gc.Equals, hashOfString(allContents))
+	c.Assert(res.BlobHash256, gc.Equals, fmt.Sprintf("%x", sha256.Sum256([]byte(allContents))))
 	data, err := ioutil.ReadAll(blob)
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(string(data), gc.Equals, allContents)
@@ -285,7 +322,7 @@ func (s *resourceSuite) TestAddResourceWithSharedUploadId(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 
 	// We get an error but the upload should not be removed.
-	_, err = store.AddResourceWithUploadId(id, "someResource", uid)
+	_, err = store.AddResourceWithUploadId(id, "someResource", uid, nil)
 	c.Assert(err, gc.ErrorMatches, `cannot set owner of upload: upload already used by something else`)
 
 	// Check that the blob is still around.
@@ -355,7 +392,7 @@ func (s *resourceSuite) TestUploadResourceErrors(c *gc.C) {
 
 	for i, test := range uploadResourceErrorTests {
 		c.Logf("%d. %s", i, test.about)
-		_, err = store.UploadResource(id, test.name, strings.NewReader(test.blob), test.hash, test.size)
+		_, err = store.UploadResource(id, test.name, strings.NewReader(test.blob), test.hash, test.size, nil)
 		c.Assert(err, gc.ErrorMatches, test.expectError)
 	}
 }
@@ -438,7 +475,7 @@ func (s *resourceSuite) TestResolveResource(c *gc.C) {
 	// Upload three version of the resource.
 	for i := 0; i < 3; i++ {
 		content := fmt.Sprintf("content%d", i)
-		_, err := store.UploadResource(id, "someResource", strings.NewReader(content), hashOfString(content), int64(len(content)))
+		_, err := store.UploadResource(id, "someResource", strings.NewReader(content), hashOfString(content), int64(len(content)), nil)
 		c.Assert(err, gc.Equals, nil)
 	}
 	// Publish the charm to different channels with the different resources.
@@ -545,6 +582,129 @@ func (s *resourceSuite) TestOpenResourceBlob(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, `cannot open archive data for cs:~charmers/wordpress resource "someResource/0": blob not found`)
 }
 
+func (s *resourceSuite) TestDeleteResource(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	uploadResource(c, store, id, "someResource", "content 0")
+	uploadResource(c, store, id, "someResource", "content 1")
+
+	err = store.DeleteResource(id, "someResource", 1)
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.ResolveResource(id, "someResource", 1, params.UnpublishedChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The latest remaining revision is now used in the unpublished channel.
+	res, err := store.ResolveResource(id, "someResource", -1, params.UnpublishedChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Revision, gc.Equals, 0)
+
+	// The blob is removed by the garbage collector.
+	err = store.BlobStoreGC(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	_, _, err = store.BlobStore.Open(hashOfString("content 1"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	r, _, err := store.BlobStore.Open(hashOfString("content 0"), nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+}
+
+func (s *resourceSuite) TestDeleteResourceNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.DeleteResource(id, "someResource", 0)
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/wordpress has no "someResource/0" resource`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *resourceSuite) TestDeleteResourcePublished(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	uploadResource(c, store, id, "someResource", "content 0")
+	err = store.Publish(id, map[string]int{"someResource": 0}, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.DeleteResource(id, "someResource", 0)
+	c.Assert(err, gc.ErrorMatches, `cannot delete "cs:~charmers/wordpress" resource "someResource/0" because it is published in channels \[edge stable\]`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+
+	_, err = store.ResolveResource(id, "someResource", 0, params.UnpublishedChannel)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *resourceSuite) TestPruneResources(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	meta := storetesting.MetaWithResources(nil, "resource1", "resource2")
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	for i := 0; i < 5; i++ {
+		uploadResource(c, store, id, "resource1", fmt.Sprint("resource1 content ", i))
+	}
+	uploadResource(c, store, id, "resource2", "resource2 content")
+
+	// Publish an old revision of resource1 so that it is retained.
+	err = store.Publish(id, map[string]int{"resource1": 1, "resource2": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	n, err := store.PruneResources(2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 2)
+
+	var remaining []string
+	var docs []*mongodoc.Resource
+	err = store.DB.Resources().Find(nil).Sort("name", "revision").All(&docs)
+	c.Assert(err, gc.Equals, nil)
+	for _, doc := range docs {
+		remaining = append(remaining, fmt.Sprintf("%s/%d", doc.Name, doc.Revision))
+	}
+	c.Assert(remaining, jc.DeepEquals, []string{
+		"resource1/1",
+		"resource1/3",
+		"resource1/4",
+		"resource2/0",
+	})
+
+	// The blobs of the pruned revisions are removed by the
+	// garbage collector.
+	err = store.BlobStoreGC(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	for i := 0; i < 5; i++ {
+		r, _, err := store.BlobStore.Open(hashOfString(fmt.Sprint("resource1 content ", i)), nil)
+		if i == 0 || i == 2 {
+			c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		r.Close()
+	}
+
+	// Pruning again removes nothing more.
+	n, err = store.PruneResources(2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
+
 // uploadResources uploads all the resources required by the given entity,
 // giving each one blob content that's the resource name
 // followed by the given content suffix.
@@ -556,13 +716,13 @@ func uploadResources(c *gc.C, store *Store, id *router.ResolvedURL, contentSuffi
 		content := name + contentSuffix
 		hash := hashOfString(content)
 		r := strings.NewReader(content)
-		_, err := store.UploadResource(id, name, r, hash, int64(len(content)))
+		_, err := store.UploadResource(id, name, r, hash, int64(len(content)), nil)
 		c.Assert(err, gc.Equals, nil)
 	}
 }
 
 func uploadResource(c *gc.C, store *Store, id *router.ResolvedURL, name string, blob string) {
-	_, err := store.UploadResource(id, name, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	_, err := store.UploadResource(id, name, strings.NewReader(blob), hashOfString(blob), int64(len(blob)), nil)
 	c.Assert(err, gc.Equals, nil)
 }
 
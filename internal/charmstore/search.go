@@ -556,6 +556,7 @@ func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
 				"CharmMeta.Categories.tok": 5,
 				"CharmMeta.Tags.tok":       5,
 				"BundleData.Tags.tok":      5,
+				"ReleaseNotes":             1,
 			}),
 			MinimumShouldMatch: "100%",
 		}
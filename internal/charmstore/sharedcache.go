@@ -0,0 +1,278 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	tomb "gopkg.in/tomb.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// The shared entity cache holds the entities and base entities found
+// for requests, so that they can be reused by later requests served by
+// the same process. It is enabled by ServerParams.EntityCacheMaxAge.
+//
+// Cache entries are grouped by entity name: the lookup of a URL only
+// ever involves entities with the same name as the URL, because
+// promulgated URLs and transferred entities keep the name of the
+// entity. When a Store changes the entities or base entities with a
+// name, it evicts the cache entries for that name and records the name
+// in the following MongoDB collection, which the caches of other
+// processes sharing the database poll:
+//
+//     juju.entitycache.invalidations - Recently changed entity names
+//
+// Changes made without a Store that has the cache enabled are only
+// noticed when the cache entries expire.
+
+func (s StoreDatabase) EntityCacheInvalidations() *mgo.Collection {
+	return s.C("juju.entitycache.invalidations")
+}
+
+var (
+	// entityCacheInvalidationInterval holds the interval between
+	// polls of the invalidations collection.
+	entityCacheInvalidationInterval = time.Second
+
+	// entityCacheInvalidationSlack holds how far before the
+	// previous poll invalidations are read from, to allow for
+	// differences between the clocks of the servers and for
+	// invalidations that take a while to be inserted.
+	entityCacheInvalidationSlack = 10 * time.Second
+)
+
+// entityCacheInvalidationRetention holds the length of time that
+// invalidations are kept for before MongoDB removes them.
+const entityCacheInvalidationRetention = time.Hour
+
+// sharedEntityCacheMaxEntries holds the maximum number of entries
+// held by the shared entity cache. The cache is emptied when it
+// is reached.
+const sharedEntityCacheMaxEntries = 10000
+
+// entityCacheInvalidation holds an invalidation document.
+type entityCacheInvalidation struct {
+	Name string    `bson:"name"`
+	Time time.Time `bson:"t"`
+}
+
+// sharedEntityCache implements the shared entity cache, and the worker
+// that polls the invalidations collection.
+type sharedEntityCache struct {
+	tomb   tomb.Tomb
+	pool   *Pool
+	maxAge time.Duration
+
+	// mu guards the fields following it.
+	mu sync.Mutex
+
+	// entries holds the cache entries, keyed by the cache key.
+	entries map[string]sharedEntityCacheEntry
+
+	// names holds the set of cache keys of the entries for each
+	// entity name.
+	names map[string]map[string]bool
+
+	// generation is incremented every time entries are evicted, so
+	// that values fetched concurrently with an eviction are not
+	// added to the cache.
+	generation int
+}
+
+// sharedEntityCacheEntry holds an entry in the shared entity cache.
+type sharedEntityCacheEntry struct {
+	value  interface{}
+	expire time.Time
+}
+
+// newSharedEntityCache returns a new shared entity cache that holds
+// entries for at most the given length of time, and starts polling
+// the invalidations collection.
+func newSharedEntityCache(pool *Pool, maxAge time.Duration) *sharedEntityCache {
+	c := &sharedEntityCache{
+		pool:    pool,
+		maxAge:  maxAge,
+		entries: make(map[string]sharedEntityCacheEntry),
+		names:   make(map[string]map[string]bool),
+	}
+	c.tomb.Go(c.run)
+	return c
+}
+
+// Kill implements worker.Worker.Kill.
+func (c *sharedEntityCache) Kill() {
+	c.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (c *sharedEntityCache) Wait() error {
+	return c.tomb.Wait()
+}
+
+func (c *sharedEntityCache) run() error {
+	since := time.Now()
+	for {
+		select {
+		case <-c.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(entityCacheInvalidationInterval):
+		}
+		now := time.Now()
+		if err := c.poll(since.Add(-entityCacheInvalidationSlack)); err != nil {
+			logger.Errorf("%v", err)
+			continue
+		}
+		since = now
+	}
+}
+
+// poll evicts the entries for all the entity names recorded in the
+// invalidations collection since the given time.
+func (c *sharedEntityCache) poll(since time.Time) error {
+	store := c.pool.Store()
+	defer store.Close()
+	var names []string
+	if err := store.DB.EntityCacheInvalidations().Find(bson.D{{"t", bson.D{{"$gte", since}}}}).Distinct("name", &names); err != nil {
+		return errgo.Notef(err, "cannot read entity cache invalidations")
+	}
+	for _, name := range names {
+		c.evict(name)
+	}
+	return nil
+}
+
+// get returns the cached value with the given key, which must be for
+// an entity with the given name. If there is no such value, it calls
+// fetch to obtain it. Errors returned by fetch are not cached.
+func (c *sharedEntityCache) get(name, key string, fetch func() (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && now.Before(e.expire) {
+		c.mu.Unlock()
+		return e.value, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	v, err := fetch()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		// Some entries have been evicted while the value was
+		// being fetched, so it may be out of date already.
+		return v, nil
+	}
+	if len(c.entries) >= sharedEntityCacheMaxEntries {
+		c.entries = make(map[string]sharedEntityCacheEntry)
+		c.names = make(map[string]map[string]bool)
+	}
+	c.entries[key] = sharedEntityCacheEntry{
+		value:  v,
+		expire: now.Add(c.maxAge),
+	}
+	keys := c.names[name]
+	if keys == nil {
+		keys = make(map[string]bool)
+		c.names[name] = keys
+	}
+	keys[key] = true
+	return v, nil
+}
+
+// evict removes the entries for entities with the given name.
+func (c *sharedEntityCache) evict(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key := range c.names[name] {
+		delete(c.entries, key)
+	}
+	delete(c.names, name)
+}
+
+// entityCacheKey returns the shared entity cache key for the given
+// kind of lookup, URL and fields.
+func entityCacheKey(kind string, url *charm.URL, fields map[string]int) string {
+	names := make([]string, 0, len(fields))
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	if fields == nil {
+		names = []string{"*"}
+	}
+	return kind + "|" + url.String() + "|" + strings.Join(names, ",")
+}
+
+// CachedFindBestEntity is like FindBestEntity except that the entity is
+// obtained from the shared entity cache when it is enabled. The
+// returned entity is a copy of the cached one made with
+// mongodoc.Entity.Copy, so only the values that Copy documents as
+// copied may be changed.
+func (s *Store) CachedFindBestEntity(url *charm.URL, channel params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
+	c := s.pool.entityCache
+	if c == nil {
+		return s.FindBestEntity(url, channel, fields)
+	}
+	v, err := c.get(url.Name, entityCacheKey("e|"+string(channel), url, fields), func() (interface{}, error) {
+		return s.FindBestEntity(url, channel, fields)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return v.(*mongodoc.Entity).Copy(), nil
+}
+
+// CachedFindBaseEntity is like FindBaseEntity except that the base
+// entity is obtained from the shared entity cache when it is enabled.
+// The returned base entity is a copy of the cached one made with
+// mongodoc.BaseEntity.Copy, so only the values that Copy documents as
+// copied may be changed.
+func (s *Store) CachedFindBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc.BaseEntity, error) {
+	c := s.pool.entityCache
+	if c == nil {
+		return s.FindBaseEntity(url, fields)
+	}
+	v, err := c.get(url.Name, entityCacheKey("b", url, fields), func() (interface{}, error) {
+		return s.FindBaseEntity(url, fields)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return v.(*mongodoc.BaseEntity).Copy(), nil
+}
+
+// invalidateEntityCache evicts the shared entity cache entries for the
+// entities with the given name, and records the invalidation for the
+// caches of other processes. It does nothing when the shared entity
+// cache is disabled. It must be called after the entities have been
+// changed and their base entities touched, with touchBaseEntities or
+// withTouch.
+func (s *Store) invalidateEntityCache(name string) {
+	c := s.pool.entityCache
+	if c == nil {
+		return
+	}
+	c.evict(name)
+	if err := s.DB.EntityCacheInvalidations().Insert(&entityCacheInvalidation{
+		Name: name,
+		Time: time.Now(),
+	}); err != nil {
+		logger.Errorf("cannot record entity cache invalidation for %q: %v", name, err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type sharedCacheSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&sharedCacheSuite{})
+
+func (s *sharedCacheSuite) newPool(c *gc.C) *Pool {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, &bakery.NewServiceParams{}, ServerParams{
+		EntityCacheMaxAge: time.Hour,
+	})
+	c.Assert(err, gc.Equals, nil)
+	return p
+}
+
+func (s *sharedCacheSuite) TestCachedFindBestEntity(c *gc.C) {
+	p := s.newPool(c)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	err := store.AddCharmWithArchive(MustParseResolvedURL("~alice/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	url := charm.MustParseURL("~alice/wordpress")
+	_, err = store.CachedFindBestEntity(url, params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Errors are not cached, so the published entity is found.
+	err = store.Publish(MustParseResolvedURL("~alice/precise/wordpress-0"), nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	e, err := store.CachedFindBestEntity(url, params.StableChannel, FieldSelector("blobhash"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~alice/precise/wordpress-0")
+	hash := e.BlobHash
+
+	// Changing the entity directly in the database does not
+	// affect the cached value.
+	err = store.DB.Entities().UpdateId(e.URL, bson.D{{"$set", bson.D{{"blobhash", "changed"}}}})
+	c.Assert(err, gc.Equals, nil)
+	e, err = store.CachedFindBestEntity(url, params.StableChannel, FieldSelector("blobhash"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.BlobHash, gc.Equals, hash)
+
+	// Lookups with different fields are cached separately.
+	e, err = store.CachedFindBestEntity(url, params.StableChannel, FieldSelector("blobhash", "size"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.BlobHash, gc.Equals, "changed")
+
+	// Publishing a new revision invalidates the cache.
+	err = store.AddCharmWithArchive(MustParseResolvedURL("~alice/precise/wordpress-1"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(MustParseResolvedURL("~alice/precise/wordpress-1"), nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	e, err = store.CachedFindBestEntity(url, params.StableChannel, FieldSelector("blobhash"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~alice/precise/wordpress-1")
+
+	// Promulgating the entity invalidates the cache.
+	_, err = store.CachedFindBestEntity(charm.MustParseURL("wordpress"), params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	be, err := store.CachedFindBaseEntity(url, FieldSelector("promulgated"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.Promulgated, gc.Equals, false)
+	err = store.SetPromulgated(MustParseResolvedURL("~alice/precise/wordpress-1"), true)
+	c.Assert(err, gc.Equals, nil)
+	be, err = store.CachedFindBaseEntity(url, FieldSelector("promulgated"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.Promulgated, gc.Equals, true)
+	e, err = store.CachedFindBestEntity(charm.MustParseURL("wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~alice/precise/wordpress-1")
+}
+
+func (s *sharedCacheSuite) TestCachedFindBaseEntityUpdate(c *gc.C) {
+	p := s.newPool(c)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	id := MustParseResolvedURL("~alice/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	url := charm.MustParseURL("~alice/wordpress")
+	be, err := store.CachedFindBaseEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.NoIngest, gc.Equals, false)
+
+	// The returned base entity is a copy, including its
+	// per-channel maps.
+	be.NoIngest = true
+	be.ChannelACLs[params.StableChannel] = mongodoc.ACL{
+		Read: []string{"changed"},
+	}
+	be.ChannelACLs[params.UnpublishedChannel] = mongodoc.ACL{}
+	be, err = store.CachedFindBaseEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.NoIngest, gc.Equals, false)
+	c.Assert(be.ChannelACLs[params.StableChannel].Read, gc.DeepEquals, []string{"alice"})
+	c.Assert(be.ChannelACLs[params.UnpublishedChannel].Read, gc.DeepEquals, []string{"alice"})
+
+	err = store.UpdateBaseEntity(id, bson.D{{"$set", bson.D{{"noingest", true}}}})
+	c.Assert(err, gc.Equals, nil)
+	be, err = store.CachedFindBaseEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.NoIngest, gc.Equals, true)
+
+	err = store.SetPerms(url, "stable.read", "bob")
+	c.Assert(err, gc.Equals, nil)
+	be, err = store.CachedFindBaseEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.ChannelACLs[params.StableChannel].Read, gc.DeepEquals, []string{"bob"})
+}
+
+func (s *sharedCacheSuite) TestCacheDisabled(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("~alice/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	url := charm.MustParseURL("~alice/wordpress")
+	be, err := store.CachedFindBaseEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.NoIngest, gc.Equals, false)
+	err = store.DB.BaseEntities().UpdateId(mongodoc.BaseURL(url), bson.D{{"$set", bson.D{{"noingest", true}}}})
+	c.Assert(err, gc.Equals, nil)
+	be, err = store.CachedFindBaseEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.NoIngest, gc.Equals, true)
+
+	// No invalidations are recorded.
+	n, err := store.DB.EntityCacheInvalidations().Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *sharedCacheSuite) TestInvalidationBetweenPools(c *gc.C) {
+	s.PatchValue(&entityCacheInvalidationInterval, 10*time.Millisecond)
+	p1 := s.newPool(c)
+	defer p1.Close()
+	store1 := p1.Store()
+	defer store1.Close()
+	p2 := s.newPool(c)
+	defer p2.Close()
+	store2 := p2.Store()
+	defer store2.Close()
+
+	id := MustParseResolvedURL("~alice/precise/wordpress-0")
+	err := store2.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	url := charm.MustParseURL("~alice/wordpress")
+	be, err := store1.CachedFindBaseEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.NoIngest, gc.Equals, false)
+
+	err = store2.UpdateBaseEntity(id, bson.D{{"$set", bson.D{{"noingest", true}}}})
+	c.Assert(err, gc.Equals, nil)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		be, err = store1.CachedFindBaseEntity(url, nil)
+		c.Assert(err, gc.Equals, nil)
+		if be.NoIngest {
+			return
+		}
+	}
+	c.Fatalf("cache of other pool not invalidated")
+}
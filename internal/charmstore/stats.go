@@ -35,8 +35,9 @@ type stats struct {
 
 // StatsGranularity holds the time granularity of statistics
 // gathering. IncCounter(Async) calls within this duration
-// may be aggregated.
-const StatsGranularity = time.Minute
+// may be aggregated. Counters older than the hourly retention
+// window are rolled up into daily counters (see RollUpStatCounters).
+const StatsGranularity = time.Hour
 
 // The stats mechanism uses the following MongoDB collections:
 //
@@ -163,6 +164,13 @@ func (s *stats) idToken(id int) (token string, found bool) {
 
 var counterEpoch = time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
 
+// statCounter holds a statistics counter document.
+type statCounter struct {
+	Key   string `bson:"k"`
+	Time  int32  `bson:"t"`
+	Count int64  `bson:"c"`
+}
+
 func timeToStamp(t time.Time) int32 {
 	return int32(t.Unix() - counterEpoch)
 }
@@ -190,11 +198,63 @@ func (s *Store) IncCounterAtTime(key []string, t time.Time) error {
 		return err
 	}
 
-	// Round to the start of the minute so we get one document per minute at most.
-	t = t.UTC().Add(-time.Duration(t.Second()) * time.Second)
+	// Round to the start of the hour so we get one document per hour at most.
+	t = t.UTC().Truncate(time.Hour)
 	counters := s.DB.StatCounters()
-	_, err = counters.Upsert(bson.D{{"k", skey}, {"t", timeToStamp(t)}}, bson.D{{"$inc", bson.D{{"c", 1}}}})
-	return err
+	if _, err := counters.Upsert(bson.D{{"k", skey}, {"t", timeToStamp(t)}}, bson.D{{"$inc", bson.D{{"c", 1}}}}); err != nil {
+		return err
+	}
+	if t.Before(time.Now().Add(-statsRollupMinAge)) {
+		// The counter may be in a period that has already
+		// been rolled up.
+		return s.incStatRollups(skey, t)
+	}
+	return nil
+}
+
+// RollUpStatCounters rolls up the hourly statistics counters for times
+// before the given time into daily counters, and returns the number of
+// hourly counters that were rolled up. Counters that are rolled up can
+// no longer be queried ByHour; their counts are reported at the start
+// of their day.
+func (s *Store) RollUpStatCounters(before time.Time) (int, error) {
+	counters := s.DB.StatCounters()
+	var counter statCounter
+	n := 0
+	iter := counters.Find(bson.D{{"t", bson.D{
+		{"$lt", timeToStamp(before)},
+		{"$not", bson.D{{"$mod", []int{86400, 0}}}},
+	}}}).Iter()
+	for iter.Next(&counter) {
+		// Claim the hourly counter by removing it, so that
+		// its count is added to the daily counter exactly once
+		// even when several roll-ups run concurrently. Any
+		// increment made after the claim creates a new hourly
+		// counter, which is rolled up later.
+		var claimed statCounter
+		if _, err := counters.Find(bson.D{{"k", counter.Key}, {"t", counter.Time}}).Apply(mgo.Change{Remove: true}, &claimed); err != nil {
+			if err == mgo.ErrNotFound {
+				// Another roll-up has claimed it.
+				continue
+			}
+			iter.Close()
+			return n, errgo.Notef(err, "cannot remove stats counter")
+		}
+		day := claimed.Time - claimed.Time%86400
+		if _, err := counters.Upsert(bson.D{{"k", claimed.Key}, {"t", day}}, bson.D{{"$inc", bson.D{{"c", claimed.Count}}}}); err != nil {
+			// Put the count back so that it is not lost.
+			if _, err := counters.Upsert(bson.D{{"k", claimed.Key}, {"t", claimed.Time}}, bson.D{{"$inc", bson.D{{"c", claimed.Count}}}}); err != nil {
+				logger.Errorf("cannot restore stats counter %v at %d: %v", claimed.Key, claimed.Time, err)
+			}
+			iter.Close()
+			return n, errgo.Notef(err, "cannot update stats counter")
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, errgo.Notef(err, "cannot iterate stats counters")
+	}
+	return n, nil
 }
 
 // CounterRequest represents a request to aggregate counter values.
@@ -231,6 +291,12 @@ type CounterRequest struct {
 	//
 	List bool
 
+	// Depth holds the number of key tokens after Key that counters
+	// are aggregated under when List and Prefix are true. If it is
+	// zero, counters are aggregated under a single additional
+	// token, as in the example above.
+	Depth int
+
 	// By defines the period covered by each aggregated data point.
 	// If unspecified, it defaults to ByAll, which aggregates all
 	// matching data points in a single entry.
@@ -251,6 +317,8 @@ const (
 	ByAll CounterRequestBy = iota
 	ByDay
 	ByWeek
+	ByHour
+	ByMonth
 )
 
 type Counter struct {
@@ -262,7 +330,6 @@ type Counter struct {
 
 // Counters aggregates and returns counter values according to the provided request.
 func (s *Store) Counters(req *CounterRequest) ([]Counter, error) {
-	tokensColl := s.DB.StatTokens()
 	countersColl := s.DB.StatCounters()
 
 	searchKey, err := s.stats.key(s.DB, req.Key, false)
@@ -294,6 +361,12 @@ func (s *Store) Counters(req *CounterRequest) ([]Counter, error) {
 		emit = "emit(k+'@'+NumberInt(this.t/86400), this.c);"
 	case ByWeek:
 		emit = "emit(k+'@'+NumberInt(this.t/604800), this.c);"
+	case ByHour:
+		emit = "emit(k+'@'+NumberInt(this.t/3600), this.c);"
+	case ByMonth:
+		// Months vary in length, so emit the number of months
+		// since year zero.
+		emit = fmt.Sprintf("var d = new Date((%d+this.t)*1000); emit(k+'@'+NumberInt(d.getUTCFullYear()*12+d.getUTCMonth()), this.c);", counterEpoch)
 	default:
 		emit = "emit(k, this.c);"
 	}
@@ -301,12 +374,20 @@ func (s *Store) Counters(req *CounterRequest) ([]Counter, error) {
 		// For a search key "a:b:" matching a key "a:b:c:d:e:", this map function emits "a:b:c:*".
 		// For a search key "a:b:" matching a key "a:b:c:", it emits "a:b:c:".
 		// For a search key "a:b:" matching a key "a:b:", it emits "a:b:".
-		job.Scope = bson.D{{"searchKeyLen", len(searchKey)}}
+		// With a depth of 2, it emits "a:b:c:d:*" for a key "a:b:c:d:e:".
+		depth := req.Depth
+		if depth < 1 {
+			depth = 1
+		}
+		job.Scope = bson.D{{"searchKeyLen", len(searchKey)}, {"depth", depth}}
 		job.Map = fmt.Sprintf(`
 			function() {
 				var k = this.k;
-				var i = k.indexOf(':', searchKeyLen)+1;
-				if (k.length > i)  { k = k.substr(0, i)+'*'; }
+				var i = searchKeyLen;
+				for (var n = 0; n < depth && i > 0; n++) {
+					i = k.indexOf(':', i)+1;
+				}
+				if (i > 0 && k.length > i)  { k = k.substr(0, i)+'*'; }
 				%s
 			}`, emit)
 	} else {
@@ -325,10 +406,6 @@ func (s *Store) Counters(req *CounterRequest) ([]Counter, error) {
 			}`, emit)
 	}
 
-	var result []struct {
-		Key   string `bson:"_id"`
-		Value int64
-	}
 	var query, tquery bson.D
 	if !req.Start.IsZero() {
 		tquery = append(tquery, bson.DocElem{
@@ -342,15 +419,56 @@ func (s *Store) Counters(req *CounterRequest) ([]Counter, error) {
 			Value: timeToStamp(req.Stop),
 		})
 	}
+	// Counts for complete periods that have been rolled up are read
+	// from the rollups rather than aggregated from the counters.
+	period, rollupTimes, err := s.rollupRange(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if period != nil {
+		if req.Start.IsZero() {
+			// The rollups cover all times before the
+			// start of the remaining counters.
+			tquery = append(tquery, bson.DocElem{
+				Name:  "$gte",
+				Value: rollupTimes[0].Value,
+			})
+		} else {
+			tquery = append(tquery, bson.DocElem{
+				Name:  "$not",
+				Value: rollupTimes,
+			})
+		}
+	}
 	if len(tquery) == 0 {
 		query = bson.D{{"k", bson.D{{"$regex", regex}}}}
 	} else {
 		query = bson.D{{"k", bson.D{{"$regex", regex}}}, {"t", tquery}}
 	}
+	var result []counterResult
 	_, err = countersColl.Find(query).MapReduce(&job, &result)
 	if err != nil {
 		return nil, err
 	}
+	if period != nil {
+		var rollups []counterResult
+		_, err = s.DB.StatRollups().Find(bson.D{
+			{"k", bson.D{{"$regex", regex}}},
+			{"p", period.name},
+			{"t", rollupTimes},
+		}).MapReduce(&job, &rollups)
+		if err != nil {
+			return nil, err
+		}
+		result = mergeCounterResults(result, rollups)
+	}
+	return s.resultCounters(req, result)
+}
+
+// resultCounters converts the given aggregated results, keyed as by
+// the map function used by Counters, to counters.
+func (s *Store) resultCounters(req *CounterRequest, result []counterResult) ([]Counter, error) {
+	tokensColl := s.DB.StatTokens()
 	var counters []Counter
 	for i := range result {
 		key := result[i].Key
@@ -366,12 +484,15 @@ func (s *Store) Counters(req *CounterRequest) ([]Counter, error) {
 			}
 			switch req.By {
 			case ByDay:
-				stamp = stamp * 86400
+				when = time.Unix(counterEpoch+stamp*86400, 0).In(time.UTC)
 			case ByWeek:
 				// The +1 puts it at the end of the period.
-				stamp = (stamp + 1) * 604800
+				when = time.Unix(counterEpoch+(stamp+1)*604800, 0).In(time.UTC)
+			case ByHour:
+				when = time.Unix(counterEpoch+stamp*3600, 0).In(time.UTC)
+			case ByMonth:
+				when = time.Date(int(stamp/12), time.Month(stamp%12+1), 1, 0, 0, 0, 0, time.UTC)
 			}
-			when = time.Unix(counterEpoch+stamp, 0).In(time.UTC)
 		}
 		ids := strings.Split(key, ":")
 		tokens := make([]string, 0, len(ids))
@@ -411,6 +532,30 @@ func (s *Store) Counters(req *CounterRequest) ([]Counter, error) {
 	return counters, nil
 }
 
+// counterResult holds a result of the map-reduce job used by Counters.
+type counterResult struct {
+	Key   string `bson:"_id"`
+	Value int64
+}
+
+// mergeCounterResults returns the sum of the counts in r1 and r2
+// for each key.
+func mergeCounterResults(r1, r2 []counterResult) []counterResult {
+	index := make(map[string]int, len(r1))
+	for i, r := range r1 {
+		index[r.Key] = i
+	}
+	for _, r := range r2 {
+		if i, ok := index[r.Key]; ok {
+			r1[i].Value += r.Value
+			continue
+		}
+		index[r.Key] = len(r1)
+		r1 = append(r1, r)
+	}
+	return r1
+}
+
 type sortableCounters []Counter
 
 func (s sortableCounters) Len() int      { return len(s) }
@@ -464,6 +609,344 @@ func EntityStatsKey(url *charm.URL, kind string) []string {
 	return key
 }
 
+// Download dimensions are the kinds of the statistics that break down
+// archive downloads by a property of the download. Their keys are
+// generated using the following schema:
+//   kind:series:name:user:value:revision
+// where value holds the value of the property for the download. For
+// instance:
+//   - archive-download-channel:trusty:django:who:* -> all downloads of
+//     a user owned charm, listed by channel;
+//   - archive-download-channel:trusty:django:who:edge:42 -> the
+//     downloads of a specific revision from the edge channel.
+// Downloads are only counted against the user owned entity, not
+// against any promulgated alias.
+const (
+	// StatsArchiveDownloadChannel breaks down downloads by the
+	// channel that the entity was resolved in.
+	StatsArchiveDownloadChannel = "archive-download-channel"
+
+	// StatsArchiveDownloadSeries breaks down downloads by the
+	// series requested by the client.
+	StatsArchiveDownloadSeries = "archive-download-series"
+
+	// StatsArchiveDownloadClientVersion breaks down downloads by
+	// the version of the client that downloaded the archive.
+	StatsArchiveDownloadClientVersion = "archive-download-client-version"
+
+	// StatsUnknownValue is recorded as the value of a download
+	// dimension when the value is not known.
+	StatsUnknownValue = "unknown"
+)
+
+// DownloadDimensions holds all the download dimension kinds.
+var DownloadDimensions = []string{
+	StatsArchiveDownloadChannel,
+	StatsArchiveDownloadSeries,
+	StatsArchiveDownloadClientVersion,
+}
+
+// DownloadInfo holds information about an archive download that
+// is recorded in the download dimension statistics. Empty fields
+// are recorded as StatsUnknownValue.
+type DownloadInfo struct {
+	// Channel holds the channel that the entity was resolved in.
+	Channel params.Channel
+
+	// Series holds the series requested by the client.
+	Series string
+
+	// ClientVersion holds the version of the client that
+	// downloaded the archive, for instance "2.1.3".
+	ClientVersion string
+
+	// ClientId identifies the client that downloaded the archive,
+	// for instance by its address. If it is not empty, the download
+	// is counted in the unique client counts of the entity. Only a
+	// hash of the identifier is stored.
+	ClientId string
+}
+
+type downloadDimension struct {
+	kind, value string
+}
+
+// dimensions returns the kind and value of each download dimension
+// described by info.
+func (info *DownloadInfo) dimensions() []downloadDimension {
+	value := func(v string) string {
+		if v == "" {
+			return StatsUnknownValue
+		}
+		return v
+	}
+	return []downloadDimension{
+		{StatsArchiveDownloadChannel, value(string(info.Channel))},
+		{StatsArchiveDownloadSeries, value(info.Series)},
+		{StatsArchiveDownloadClientVersion, value(info.ClientVersion)},
+	}
+}
+
+// DownloadDimensionStatsKey returns a stats key for the given charm or
+// bundle reference, download dimension kind and dimension value.
+func DownloadDimensionStatsKey(url *charm.URL, kind, value string) []string {
+	key := []string{kind, url.Series, url.Name, url.User, value}
+	if url.Revision != -1 {
+		key = append(key, strconv.Itoa(url.Revision))
+	}
+	return key
+}
+
+// ArchiveDownloadCountsBy returns the aggregated download counts for
+// all the revisions of the given user owned charm or bundle, keyed by
+// the values of the given download dimension. Values with no downloads
+// are omitted.
+func (s *Store) ArchiveDownloadCountsBy(id *charm.URL, kind string) (map[string]AggregatedCounts, error) {
+	key := []string{kind, id.Series, id.Name, id.User}
+	today := time.Now()
+	recent, err := s.Counters(&CounterRequest{
+		Key:    key,
+		Prefix: true,
+		List:   true,
+		By:     ByDay,
+		Start:  recentStatsStart(today),
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve stats")
+	}
+	totals, err := s.Counters(&CounterRequest{
+		Key:    key,
+		Prefix: true,
+		List:   true,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve stats")
+	}
+	counts := make(map[string]AggregatedCounts)
+	for _, result := range totals {
+		if len(result.Key) < 5 {
+			continue
+		}
+		c := counts[result.Key[4]]
+		c.Total += result.Count
+		counts[result.Key[4]] = c
+	}
+	for _, result := range recent {
+		if len(result.Key) < 5 {
+			continue
+		}
+		c := counts[result.Key[4]]
+		c.addRecent([]Counter{result}, today)
+		counts[result.Key[4]] = c
+	}
+	return counts, nil
+}
+
+// DownloadTotals holds the total archive downloads of all the
+// user owned charms and bundles.
+type DownloadTotals struct {
+	// Entities holds the downloads of all the revisions of each
+	// charm or bundle, most downloaded first.
+	Entities []EntityDownloads
+
+	// Series holds the downloads of each series, as recorded in
+	// the StatsArchiveDownloadSeries dimension, so that downloads
+	// of multi-series charms are counted in the series that was
+	// downloaded.
+	Series map[string]int64
+}
+
+// EntityDownloads holds the downloads of all the revisions of
+// a charm or bundle.
+type EntityDownloads struct {
+	// Id holds the id of the charm or bundle, without a revision.
+	Id *charm.URL
+
+	// Count holds the number of downloads.
+	Count int64
+}
+
+// downloadTotalsCacheKey holds the key of the DownloadTotals value
+// in the stats cache. It cannot clash with an entity id.
+const downloadTotalsCacheKey = "download-totals"
+
+// ArchiveDownloadTotals returns the total archive downloads of each
+// user owned charm or bundle and of each series. The result may be
+// cached for up to the StatsCacheMaxAge server parameter.
+func (s *Store) ArchiveDownloadTotals() (*DownloadTotals, error) {
+	v, err := s.pool.statsCache.Get(downloadTotalsCacheKey, s.archiveDownloadTotals)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return v.(*DownloadTotals), nil
+}
+
+func (s *Store) archiveDownloadTotals() (interface{}, error) {
+	entities, err := s.entityArchiveDownloads(time.Time{}, time.Time{})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// List the downloads under the series, name, user and value
+	// tokens of the series dimension keys, aggregating all
+	// revisions, and add them up by value.
+	results, err := s.Counters(&CounterRequest{
+		Key:    []string{StatsArchiveDownloadSeries},
+		Prefix: true,
+		List:   true,
+		Depth:  4,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve stats")
+	}
+	totals := &DownloadTotals{
+		Entities: entities,
+		Series:   make(map[string]int64),
+	}
+	for _, result := range results {
+		if len(result.Key) != 5 {
+			continue
+		}
+		totals.Series[result.Key[4]] += result.Count
+	}
+	sort.Sort(entityDownloadsByCount(totals.Entities))
+	return totals, nil
+}
+
+// entityArchiveDownloads returns the archive downloads of all
+// revisions of each user owned charm or bundle between the given
+// times, which are interpreted as CounterRequest.Start and Stop.
+func (s *Store) entityArchiveDownloads(start, stop time.Time) ([]EntityDownloads, error) {
+	// List the downloads under the series, name and user
+	// tokens of the keys, aggregating all revisions.
+	results, err := s.Counters(&CounterRequest{
+		Key:    []string{params.StatsArchiveDownload},
+		Prefix: true,
+		List:   true,
+		Depth:  3,
+		Start:  start,
+		Stop:   stop,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve stats")
+	}
+	var entities []EntityDownloads
+	for _, result := range results {
+		if len(result.Key) != 4 {
+			continue
+		}
+		entities = append(entities, EntityDownloads{
+			Id: &charm.URL{
+				Schema:   "cs",
+				Series:   result.Key[1],
+				Name:     result.Key[2],
+				User:     result.Key[3],
+				Revision: -1,
+			},
+			Count: result.Count,
+		})
+	}
+	return entities, nil
+}
+
+// DownloadTrend holds the archive downloads of a charm or bundle in
+// a period and in the period of the same length before it.
+type DownloadTrend struct {
+	// Id holds the id of the charm or bundle, without a revision.
+	Id *charm.URL
+
+	// Count holds the downloads of all revisions of the entity
+	// in the period.
+	Count int64
+
+	// PreviousCount holds the downloads of all revisions of the
+	// entity in the previous period.
+	PreviousCount int64
+}
+
+// Growth returns the increase in downloads from the previous
+// period.
+func (t DownloadTrend) Growth() int64 {
+	return t.Count - t.PreviousCount
+}
+
+// ArchiveDownloadTrends returns the archive downloads of each user
+// owned charm or bundle over the given period up to now and over the
+// period before that, most downloaded first. Only charms and bundles
+// downloaded in either period are included. The result may be cached
+// for up to the StatsCacheMaxAge server parameter.
+func (s *Store) ArchiveDownloadTrends(period time.Duration) ([]DownloadTrend, error) {
+	v, err := s.pool.statsCache.Get(fmt.Sprintf("download-trends-%v", period), func() (interface{}, error) {
+		return s.archiveDownloadTrends(period)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return v.([]DownloadTrend), nil
+}
+
+func (s *Store) archiveDownloadTrends(period time.Duration) ([]DownloadTrend, error) {
+	start := time.Now().Add(-period)
+	current, err := s.entityArchiveDownloads(start, time.Time{})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// The stop time is inclusive, so stop just before the
+	// current period starts.
+	previous, err := s.entityArchiveDownloads(start.Add(-period), start.Add(-time.Second))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	trends := make(map[string]*DownloadTrend)
+	for _, e := range current {
+		trends[e.Id.String()] = &DownloadTrend{
+			Id:    e.Id,
+			Count: e.Count,
+		}
+	}
+	for _, e := range previous {
+		t := trends[e.Id.String()]
+		if t == nil {
+			t = &DownloadTrend{
+				Id: e.Id,
+			}
+			trends[e.Id.String()] = t
+		}
+		t.PreviousCount = e.Count
+	}
+	result := make([]DownloadTrend, 0, len(trends))
+	for _, t := range trends {
+		result = append(result, *t)
+	}
+	sort.Sort(downloadTrendsByCount(result))
+	return result, nil
+}
+
+// downloadTrendsByCount sorts download trends with the most
+// downloaded first, then by id.
+type downloadTrendsByCount []DownloadTrend
+
+func (s downloadTrendsByCount) Len() int      { return len(s) }
+func (s downloadTrendsByCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s downloadTrendsByCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Id.String() < s[j].Id.String()
+}
+
+// entityDownloadsByCount sorts entity downloads with the most
+// downloaded first, then by id.
+type entityDownloadsByCount []EntityDownloads
+
+func (s entityDownloadsByCount) Len() int      { return len(s) }
+func (s entityDownloadsByCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s entityDownloadsByCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Id.String() < s[j].Id.String()
+}
+
 // AggregatedCounts contains counts for a statistic aggregated over the
 // lastDay, lastWeek, lastMonth and all time.
 type AggregatedCounts struct {
@@ -520,19 +1003,44 @@ func (s *Store) statsCacheFetch(id *charm.URL) (interface{}, error) {
 // key.
 func (s *Store) aggregateStats(key []string, prefix bool) (AggregatedCounts, error) {
 	var counts AggregatedCounts
+	today := time.Now()
 
+	// Only recent counters need to be aggregated by day; the
+	// total can be read from the rollups for older periods.
 	req := CounterRequest{
 		Key:    key,
 		By:     ByDay,
 		Prefix: prefix,
+		Start:  recentStatsStart(today),
 	}
 	results, err := s.Counters(&req)
+	if err != nil {
+		return counts, errgo.Notef(err, "cannot retrieve stats")
+	}
+	counts.addRecent(results, today)
 
+	totals, err := s.Counters(&CounterRequest{
+		Key:    key,
+		Prefix: prefix,
+	})
 	if err != nil {
 		return counts, errgo.Notef(err, "cannot retrieve stats")
 	}
+	for _, total := range totals {
+		counts.Total += total.Count
+	}
+	return counts, nil
+}
 
-	today := time.Now()
+// recentStatsStart returns the earliest time of the daily counters
+// that addRecent needs relative to the given time.
+func recentStatsStart(today time.Time) time.Time {
+	return today.AddDate(0, -1, -1)
+}
+
+// addRecent adds the given daily counters to the last day, week
+// and month counts, relative to the given time.
+func (counts *AggregatedCounts) addRecent(results []Counter, today time.Time) {
 	lastDay := today.AddDate(0, 0, -1)
 	lastWeek := today.AddDate(0, 0, -7)
 	lastMonth := today.AddDate(0, -1, 0)
@@ -548,17 +1056,16 @@ func (s *Store) aggregateStats(key []string, prefix bool) (AggregatedCounts, err
 				}
 			}
 		}
-		counts.Total += result.Count
 	}
-	return counts, nil
 }
 
 // IncrementDownloadCountsAsync updates the download statistics for entity id in both
-// the statistics database and the search database. The action is done in the
-// background using a separate goroutine.
-func (s *Store) IncrementDownloadCountsAsync(id *router.ResolvedURL) {
+// the statistics database and the search database. If info is not nil, the
+// download is also counted under each of the download dimensions. The action
+// is done in the background using a separate goroutine.
+func (s *Store) IncrementDownloadCountsAsync(id *router.ResolvedURL, info *DownloadInfo) {
 	s.Go(func(s *Store) {
-		if err := s.IncrementDownloadCounts(id); err != nil {
+		if err := s.incrementDownloadCounts(id, info, time.Now()); err != nil {
 			logger.Errorf("cannot increase download counter for %v: %s", id, err)
 		}
 	})
@@ -570,13 +1077,40 @@ func (s *Store) IncrementDownloadCounts(id *router.ResolvedURL) error {
 	return s.IncrementDownloadCountsAtTime(id, time.Now())
 }
 
+// IncrementDownloadCountsWithInfo is like IncrementDownloadCounts
+// except that the download is also counted under each of the download
+// dimensions described by info.
+func (s *Store) IncrementDownloadCountsWithInfo(id *router.ResolvedURL, info *DownloadInfo) error {
+	return s.incrementDownloadCounts(id, info, time.Now())
+}
+
 // IncrementDownloadCountsAtTime updates the download statistics for entity id in both
 // the statistics database and the search database, associating it with the given time.
 func (s *Store) IncrementDownloadCountsAtTime(id *router.ResolvedURL, t time.Time) error {
+	return s.incrementDownloadCounts(id, nil, t)
+}
+
+// incrementDownloadCounts implements IncrementDownloadCountsAtTime,
+// also counting the download under each download dimension if info
+// is not nil.
+func (s *Store) incrementDownloadCounts(id *router.ResolvedURL, info *DownloadInfo, t time.Time) error {
 	key := EntityStatsKey(&id.URL, params.StatsArchiveDownload)
 	if err := s.IncCounterAtTime(key, t); err != nil {
 		return errgo.Notef(err, "cannot increase stats counter for %v", key)
 	}
+	if info != nil {
+		for _, d := range info.dimensions() {
+			key := DownloadDimensionStatsKey(&id.URL, d.kind, d.value)
+			if err := s.IncCounterAtTime(key, t); err != nil {
+				return errgo.Notef(err, "cannot increase stats counter for %v", key)
+			}
+		}
+		if info.ClientId != "" {
+			if err := s.IncUniqueAtTime(key, info.ClientId, t); err != nil {
+				return errgo.Notef(err, "cannot record unique client for %v", key)
+			}
+		}
+	}
 	if id.PromulgatedRevision == -1 {
 		// Check that the id really is for an unpromulgated entity.
 		// This unfortunately adds an extra round trip to the database,
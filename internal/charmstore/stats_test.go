@@ -420,6 +420,28 @@ func (s *StatsSuite) TestListCountersBy(c *gc.C) {
 				{Key: []string{"a", "c"}, Prefix: false, Count: 1, Time: day(6)},
 				{Key: []string{"a", "c"}, Prefix: true, Count: 3, Time: day(13)},
 			},
+		}, {
+			charmstore.CounterRequest{
+				Key:    []string{"a"},
+				Prefix: false,
+				List:   false,
+				By:     charmstore.ByHour,
+			},
+			[]charmstore.Counter{
+				{Key: []string{"a"}, Prefix: false, Count: 1, Time: day(1)},
+				{Key: []string{"a"}, Prefix: false, Count: 1, Time: day(1).Add(time.Hour)},
+				{Key: []string{"a"}, Prefix: false, Count: 1, Time: day(3).Add(5 * time.Hour)},
+			},
+		}, {
+			charmstore.CounterRequest{
+				Key:    []string{"a"},
+				Prefix: true,
+				List:   false,
+				By:     charmstore.ByMonth,
+			},
+			[]charmstore.Counter{
+				{Key: []string{"a"}, Prefix: true, Count: 6, Time: day(1)},
+			},
 		},
 	}
 
@@ -430,6 +452,165 @@ func (s *StatsSuite) TestListCountersBy(c *gc.C) {
 	}
 }
 
+func (s *StatsSuite) TestRollUpStatCounters(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+
+	day := func(i int) time.Time {
+		return time.Date(2012, time.May, i, 0, 0, 0, 0, time.UTC)
+	}
+	for _, t := range []time.Time{
+		day(1),
+		day(1).Add(time.Hour),
+		day(1).Add(2*time.Hour + 30*time.Minute),
+		day(2).Add(23 * time.Hour),
+		day(3).Add(4 * time.Hour),
+	} {
+		err := s.store.IncCounterAtTime([]string{"a"}, t)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	n, err := s.store.RollUpStatCounters(day(3))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 3)
+
+	// The hourly counters before the given time have been
+	// rolled up into daily counters.
+	result, err := s.store.Counters(&charmstore.CounterRequest{
+		Key: []string{"a"},
+		By:  charmstore.ByHour,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result, jc.DeepEquals, []charmstore.Counter{
+		{Key: []string{"a"}, Count: 3, Time: day(1)},
+		{Key: []string{"a"}, Count: 1, Time: day(2)},
+		{Key: []string{"a"}, Count: 1, Time: day(3).Add(4 * time.Hour)},
+	})
+	count, err := s.store.DB.StatCounters().Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(count, gc.Equals, 3)
+
+	// Rolling up again has no effect.
+	n, err = s.store.RollUpStatCounters(day(3))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	result, err = s.store.Counters(&charmstore.CounterRequest{
+		Key: []string{"a"},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result, jc.DeepEquals, []charmstore.Counter{
+		{Key: []string{"a"}, Count: 5},
+	})
+}
+
+func (s *StatsSuite) TestStatRollups(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+
+	day := func(month time.Month, day int) time.Time {
+		return time.Date(2012, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	incs := []struct {
+		key []string
+		t   time.Time
+	}{
+		{[]string{"a", "b"}, day(time.January, 2)},
+		{[]string{"a", "b"}, day(time.January, 3)},
+		{[]string{"a", "c"}, day(time.January, 10)},
+		{[]string{"a", "b"}, day(time.January, 31)},
+		{[]string{"a", "b"}, day(time.February, 1)},
+		{[]string{"a", "c"}, day(time.February, 14)},
+		{[]string{"a", "b"}, day(time.March, 5)},
+	}
+	for _, inc := range incs {
+		err := s.store.IncCounterAtTime(inc.key, inc.t)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	requests := []charmstore.CounterRequest{{
+		Key:    []string{"a"},
+		Prefix: true,
+	}, {
+		Key:    []string{"a"},
+		Prefix: true,
+		List:   true,
+	}, {
+		Key:    []string{"a", "b"},
+		Prefix: false,
+		By:     charmstore.ByWeek,
+	}, {
+		Key:    []string{"a"},
+		Prefix: true,
+		List:   true,
+		By:     charmstore.ByMonth,
+	}, {
+		Key:    []string{"a"},
+		Prefix: true,
+		By:     charmstore.ByMonth,
+		Start:  day(time.January, 3),
+		Stop:   day(time.February, 14),
+	}, {
+		Key:    []string{"a"},
+		Prefix: true,
+		By:     charmstore.ByWeek,
+		Start:  day(time.January, 8),
+	}, {
+		Key:    []string{"a"},
+		Prefix: true,
+		Stop:   day(time.February, 28),
+	}, {
+		Key:    []string{"a", "b"},
+		Prefix: false,
+		By:     charmstore.ByDay,
+	}}
+	expect := make([][]charmstore.Counter, len(requests))
+	for i := range requests {
+		result, err := s.store.Counters(&requests[i])
+		c.Assert(err, gc.Equals, nil)
+		expect[i] = result
+	}
+
+	// Building the rollups does not change the results.
+	err := s.store.BuildStatRollups(day(time.March, 10))
+	c.Assert(err, gc.Equals, nil)
+	for i := range requests {
+		c.Logf("request %d: %#v", i, requests[i])
+		result, err := s.store.Counters(&requests[i])
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(result, jc.DeepEquals, expect[i])
+	}
+
+	// Counters incremented later in rolled up periods update
+	// the rollups.
+	err = s.store.IncCounterAtTime([]string{"a", "b"}, day(time.January, 20))
+	c.Assert(err, gc.Equals, nil)
+	result, err := s.store.Counters(&charmstore.CounterRequest{
+		Key: []string{"a", "b"},
+		By:  charmstore.ByMonth,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result, jc.DeepEquals, []charmstore.Counter{
+		{Key: []string{"a", "b"}, Count: 4, Time: day(time.January, 1)},
+		{Key: []string{"a", "b"}, Count: 1, Time: day(time.February, 1)},
+		{Key: []string{"a", "b"}, Count: 1, Time: day(time.March, 1)},
+	})
+
+	// The rollups are used instead of the counters for rolled
+	// up periods.
+	_, err = s.store.DB.StatCounters().RemoveAll(nil)
+	c.Assert(err, gc.Equals, nil)
+	result, err = s.store.Counters(&charmstore.CounterRequest{
+		Key:    []string{"a"},
+		Prefix: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result, jc.DeepEquals, []charmstore.Counter{
+		{Key: []string{"a"}, Prefix: true, Count: 7},
+	})
+}
+
 type testStatsEntity struct {
 	id        *router.ResolvedURL
 	lastDay   int
@@ -603,6 +784,238 @@ func setDownloadCounts(c *gc.C, s *charmstore.Store, id *charm.URL, t time.Time,
 	}
 }
 
+func (s *StatsSuite) TestArchiveDownloadTotals(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	now := time.Now()
+	setDownloadCounts(c, s.store, charm.MustParseURL("~charmers/trusty/wordpress-1"), now, 2)
+	setDownloadCounts(c, s.store, charm.MustParseURL("~charmers/trusty/wordpress-2"), now.Add(-100*24*time.Hour), 3)
+	setDownloadCounts(c, s.store, charm.MustParseURL("~charmers/precise/wordpress-0"), now, 1)
+	setDownloadCounts(c, s.store, charm.MustParseURL("~who/trusty/mysql-0"), now, 5)
+	setDownloadCounts(c, s.store, charm.MustParseURL("~who/bundle/wordpress-simple-3"), now, 1)
+	// Downloads of promulgated aliases are not counted twice.
+	setDownloadCounts(c, s.store, charm.MustParseURL("trusty/wordpress-0"), now, 4)
+	// The series totals are taken from the series dimension,
+	// which holds the series that was downloaded.
+	setDownloadSeriesCounts(c, s.store, charm.MustParseURL("~charmers/trusty/wordpress-1"), "trusty", now, 2)
+	setDownloadSeriesCounts(c, s.store, charm.MustParseURL("~who/mysql-0"), "xenial", now, 3)
+	setDownloadSeriesCounts(c, s.store, charm.MustParseURL("~who/mysql-0"), "trusty", now.Add(-100*24*time.Hour), 1)
+	setDownloadSeriesCounts(c, s.store, charm.MustParseURL("~who/bundle/wordpress-simple-3"), "bundle", now, 1)
+
+	totals, err := s.store.ArchiveDownloadTotals()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(totals, jc.DeepEquals, &charmstore.DownloadTotals{
+		Entities: []charmstore.EntityDownloads{{
+			Id:    charm.MustParseURL("~charmers/trusty/wordpress"),
+			Count: 5,
+		}, {
+			Id:    charm.MustParseURL("~who/trusty/mysql"),
+			Count: 5,
+		}, {
+			Id:    charm.MustParseURL("~charmers/precise/wordpress"),
+			Count: 1,
+		}, {
+			Id:    charm.MustParseURL("~who/bundle/wordpress-simple"),
+			Count: 1,
+		}},
+		Series: map[string]int64{
+			"trusty": 3,
+			"xenial": 3,
+			"bundle": 1,
+		},
+	})
+
+	// The totals are cached.
+	setDownloadSeriesCounts(c, s.store, charm.MustParseURL("~who/trusty/mysql-0"), "trusty", now, 1)
+	totals, err = s.store.ArchiveDownloadTotals()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(totals.Series["trusty"], gc.Equals, int64(3))
+}
+
+func setDownloadSeriesCounts(c *gc.C, s *charmstore.Store, id *charm.URL, series string, t time.Time, n int) {
+	key := charmstore.DownloadDimensionStatsKey(id, charmstore.StatsArchiveDownloadSeries, series)
+	for i := 0; i < n; i++ {
+		err := s.IncCounterAtTime(key, t)
+		c.Assert(err, gc.Equals, nil)
+	}
+}
+
+func (s *StatsSuite) TestArchiveDownloadTrends(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	now := time.Now()
+	week := 7 * 24 * time.Hour
+	setDownloadCounts(c, s.store, charm.MustParseURL("~charmers/trusty/wordpress-1"), now.Add(-time.Hour), 2)
+	setDownloadCounts(c, s.store, charm.MustParseURL("~charmers/trusty/wordpress-2"), now.Add(-2*24*time.Hour), 1)
+	setDownloadCounts(c, s.store, charm.MustParseURL("~charmers/trusty/wordpress-1"), now.Add(-10*24*time.Hour), 5)
+	setDownloadCounts(c, s.store, charm.MustParseURL("~who/precise/mysql-0"), now.Add(-time.Hour), 3)
+	setDownloadCounts(c, s.store, charm.MustParseURL("~who/bundle/wordpress-simple-0"), now.Add(-10*24*time.Hour), 1)
+	// Downloads before the previous period are not included.
+	setDownloadCounts(c, s.store, charm.MustParseURL("~who/trusty/varnish-0"), now.Add(-20*24*time.Hour), 7)
+
+	trends, err := s.store.ArchiveDownloadTrends(week)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(trends, jc.DeepEquals, []charmstore.DownloadTrend{{
+		Id:            charm.MustParseURL("~charmers/trusty/wordpress"),
+		Count:         3,
+		PreviousCount: 5,
+	}, {
+		Id:    charm.MustParseURL("~who/precise/mysql"),
+		Count: 3,
+	}, {
+		Id:            charm.MustParseURL("~who/bundle/wordpress-simple"),
+		PreviousCount: 1,
+	}})
+	c.Assert(trends[0].Growth(), gc.Equals, int64(-2))
+	c.Assert(trends[1].Growth(), gc.Equals, int64(3))
+}
+
+func (s *StatsSuite) TestUniqueCounters(c *gc.C) {
+	day1 := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	for _, inc := range []struct {
+		key      []string
+		clientId string
+		t        time.Time
+	}{
+		{[]string{"a", "b"}, "client1", day1},
+		{[]string{"a", "b"}, "client1", day1.Add(time.Hour)},
+		{[]string{"a", "b"}, "client2", day1},
+		{[]string{"a", "b"}, "client1", day2},
+		{[]string{"a", "b"}, "client3", day2},
+		{[]string{"a", "c"}, "client1", day2},
+	} {
+		err := s.store.IncUniqueAtTime(inc.key, inc.clientId, inc.t)
+		c.Assert(err, gc.Equals, nil)
+	}
+	tests := []struct {
+		about  string
+		req    charmstore.CounterRequest
+		expect []charmstore.Counter
+	}{{
+		about: "single key",
+		req: charmstore.CounterRequest{
+			Key: []string{"a", "b"},
+		},
+		expect: []charmstore.Counter{{
+			Key:   []string{"a", "b"},
+			Count: 3,
+		}},
+	}, {
+		about: "prefix",
+		req: charmstore.CounterRequest{
+			Key:    []string{"a"},
+			Prefix: true,
+		},
+		expect: []charmstore.Counter{{
+			Key:    []string{"a"},
+			Prefix: true,
+			Count:  3,
+		}},
+	}, {
+		about: "list by day",
+		req: charmstore.CounterRequest{
+			Key:    []string{"a"},
+			Prefix: true,
+			List:   true,
+			By:     charmstore.ByDay,
+		},
+		expect: []charmstore.Counter{{
+			Key:   []string{"a", "b"},
+			Count: 2,
+			Time:  time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+		}, {
+			Key:   []string{"a", "b"},
+			Count: 2,
+			Time:  time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC),
+		}, {
+			Key:   []string{"a", "c"},
+			Count: 1,
+			Time:  time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC),
+		}},
+	}, {
+		about: "start time",
+		req: charmstore.CounterRequest{
+			Key:   []string{"a", "b"},
+			Start: day2.Add(time.Hour),
+		},
+		expect: []charmstore.Counter{{
+			Key:   []string{"a", "b"},
+			Count: 2,
+		}},
+	}, {
+		about: "unknown key",
+		req: charmstore.CounterRequest{
+			Key: []string{"x"},
+		},
+		expect: []charmstore.Counter{{
+			Key: []string{"x"},
+		}},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		result, err := s.store.UniqueCounters(&test.req)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(result, jc.DeepEquals, test.expect)
+	}
+
+	_, err := s.store.UniqueCounters(&charmstore.CounterRequest{
+		Key: []string{"a", "b"},
+		By:  charmstore.ByHour,
+	})
+	c.Assert(err, gc.ErrorMatches, "unique counts are not available by hour")
+}
+
+func (s *StatsSuite) TestUniqueCountersEstimate(c *gc.C) {
+	key := []string{"a"}
+	t := time.Now()
+	for i := 0; i < 3000; i++ {
+		err := s.store.IncUniqueAtTime(key, "client"+strconv.Itoa(i%2000), t)
+		c.Assert(err, gc.Equals, nil)
+	}
+	result, err := s.store.UniqueCounters(&charmstore.CounterRequest{
+		Key: key,
+	})
+	c.Assert(err, gc.Equals, nil)
+	// The standard error is about 3%, so allow for 4 standard errors.
+	c.Assert(result[0].Count > 1760 && result[0].Count < 2240, gc.Equals, true, gc.Commentf("estimate %d", result[0].Count))
+}
+
+func (s *StatsSuite) TestArchiveUniqueDownloadCounts(c *gc.C) {
+	now := time.Now()
+	for _, inc := range []struct {
+		id       string
+		clientId string
+		t        time.Time
+	}{
+		{"~charmers/trusty/wordpress-1", "client1", now},
+		{"~charmers/trusty/wordpress-1", "client1", now},
+		{"~charmers/trusty/wordpress-1", "client2", now.Add(-3 * 24 * time.Hour)},
+		{"~charmers/trusty/wordpress-2", "client1", now.Add(-20 * 24 * time.Hour)},
+		{"~charmers/trusty/wordpress-2", "client3", now.Add(-100 * 24 * time.Hour)},
+	} {
+		key := charmstore.EntityStatsKey(charm.MustParseURL(inc.id), params.StatsArchiveDownload)
+		err := s.store.IncUniqueAtTime(key, inc.clientId, inc.t)
+		c.Assert(err, gc.Equals, nil)
+	}
+	thisRevision, allRevisions, err := s.store.ArchiveUniqueDownloadCounts(charm.MustParseURL("~charmers/trusty/wordpress-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(thisRevision, jc.DeepEquals, charmstore.AggregatedCounts{
+		LastDay:   1,
+		LastWeek:  2,
+		LastMonth: 2,
+		Total:     2,
+	})
+	c.Assert(allRevisions, jc.DeepEquals, charmstore.AggregatedCounts{
+		LastDay:   1,
+		LastWeek:  2,
+		LastMonth: 2,
+		Total:     3,
+	})
+}
+
 func (s *StatsSuite) TestIncrementDownloadCounts(c *gc.C) {
 	ch := storetesting.Charms.CharmDir("wordpress")
 	id := charmstore.MustParseResolvedURL("0 ~charmers/trusty/wordpress-1")
@@ -673,6 +1086,97 @@ func (s *StatsSuite) TestIncrementDownloadCountsOnIdWithPreferredSeries(c *gc.C)
 	c.Assert(allRevisions, jc.DeepEquals, expect)
 }
 
+func (s *StatsSuite) TestIncrementDownloadCountsWithInfo(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	ch := storetesting.Charms.CharmDir("wordpress")
+	for _, id := range []string{"0 ~charmers/trusty/wordpress-1", "1 ~charmers/trusty/wordpress-2"} {
+		err := s.store.AddCharmWithArchive(charmstore.MustParseResolvedURL(id), ch)
+		c.Assert(err, gc.Equals, nil)
+	}
+	for i, test := range []struct {
+		id   string
+		info charmstore.DownloadInfo
+	}{{
+		id: "0 ~charmers/trusty/wordpress-1",
+		info: charmstore.DownloadInfo{
+			Channel:       params.StableChannel,
+			Series:        "trusty",
+			ClientVersion: "2.1.3",
+		},
+	}, {
+		id: "1 ~charmers/trusty/wordpress-2",
+		info: charmstore.DownloadInfo{
+			Channel:       params.EdgeChannel,
+			Series:        "trusty",
+			ClientVersion: "2.1.3",
+		},
+	}, {
+		id: "1 ~charmers/trusty/wordpress-2",
+		info: charmstore.DownloadInfo{
+			Channel: params.StableChannel,
+		},
+	}} {
+		c.Logf("test %d: %s %#v", i, test.id, test.info)
+		err := s.store.IncrementDownloadCountsWithInfo(charmstore.MustParseResolvedURL(test.id), &test.info)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	// The downloads are still counted against the entity.
+	_, allRevisions, err := s.store.ArchiveDownloadCounts(charm.MustParseURL("~charmers/trusty/wordpress-2"), true)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(allRevisions.Total, gc.Equals, int64(3))
+
+	count := func(n int64) charmstore.AggregatedCounts {
+		return charmstore.AggregatedCounts{
+			LastDay:   n,
+			LastWeek:  n,
+			LastMonth: n,
+			Total:     n,
+		}
+	}
+	id := charm.MustParseURL("~charmers/trusty/wordpress")
+	counts, err := s.store.ArchiveDownloadCountsBy(id, charmstore.StatsArchiveDownloadChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, map[string]charmstore.AggregatedCounts{
+		"stable": count(2),
+		"edge":   count(1),
+	})
+	counts, err = s.store.ArchiveDownloadCountsBy(id, charmstore.StatsArchiveDownloadSeries)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, map[string]charmstore.AggregatedCounts{
+		"trusty":                     count(2),
+		charmstore.StatsUnknownValue: count(1),
+	})
+	counts, err = s.store.ArchiveDownloadCountsBy(id, charmstore.StatsArchiveDownloadClientVersion)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, map[string]charmstore.AggregatedCounts{
+		"2.1.3":                      count(2),
+		charmstore.StatsUnknownValue: count(1),
+	})
+
+	// The counters can be listed by revision.
+	cs, err := s.store.Counters(&charmstore.CounterRequest{
+		Key:    []string{charmstore.StatsArchiveDownloadChannel, "trusty", "wordpress", "charmers", "stable"},
+		Prefix: true,
+		List:   true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(cs, jc.DeepEquals, []charmstore.Counter{{
+		Key:   []string{charmstore.StatsArchiveDownloadChannel, "trusty", "wordpress", "charmers", "stable", "1"},
+		Count: 1,
+	}, {
+		Key:   []string{charmstore.StatsArchiveDownloadChannel, "trusty", "wordpress", "charmers", "stable", "2"},
+		Count: 1,
+	}})
+
+	// Entities that have never been downloaded have no counts.
+	counts, err = s.store.ArchiveDownloadCountsBy(charm.MustParseURL("~charmers/trusty/mysql"), charmstore.StatsArchiveDownloadChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, gc.HasLen, 0)
+}
+
 func (s *StatsSuite) TestIncrementDownloadCountsCaching(c *gc.C) {
 	ch := storetesting.Charms.CharmDir("wordpress")
 	id := charmstore.MustParseResolvedURL("0 ~charmers/trusty/wordpress-1")
@@ -0,0 +1,80 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	tomb "gopkg.in/tomb.v2"
+)
+
+var statsCompactionInterval = time.Hour
+
+// defaultStatsHourlyRetention holds the default length of time
+// that hourly statistics counters are kept for before they are
+// rolled up into daily counters.
+const defaultStatsHourlyRetention = 7 * 24 * time.Hour
+
+// statsCompactor implements the worker that compacts the
+// statistics counters and builds the weekly and monthly
+// rollups of old counters.
+type statsCompactor struct {
+	tomb tomb.Tomb
+	pool *Pool
+}
+
+// newStatsCompactor returns a new running statistics
+// compaction worker.
+func newStatsCompactor(pool *Pool) *statsCompactor {
+	sc := &statsCompactor{
+		pool: pool,
+	}
+	sc.tomb.Go(sc.run)
+	return sc
+}
+
+// Kill implements worker.Worker.Kill.
+func (sc *statsCompactor) Kill() {
+	sc.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (sc *statsCompactor) Wait() error {
+	return sc.tomb.Wait()
+}
+
+func (sc *statsCompactor) run() error {
+	for {
+		logger.Infof("starting statistics compaction")
+		if err := sc.compact(); err != nil {
+			logger.Errorf("%v", err)
+		} else {
+			logger.Infof("completed statistics compaction")
+		}
+		select {
+		case <-sc.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(statsCompactionInterval):
+		}
+	}
+}
+
+func (sc *statsCompactor) compact() error {
+	store := sc.pool.Store()
+	defer store.Close()
+	retention := sc.pool.config.StatsHourlyRetention
+	if retention == 0 {
+		retention = defaultStatsHourlyRetention
+	}
+	n, err := store.RollUpStatCounters(time.Now().Add(-retention))
+	if err != nil {
+		return errgo.Notef(err, "cannot roll up hourly statistics")
+	}
+	logger.Infof("rolled up %d hourly statistics counters", n)
+	if err := store.BuildStatRollups(time.Now()); err != nil {
+		return errgo.Notef(err, "cannot build statistics rollups")
+	}
+	return nil
+}
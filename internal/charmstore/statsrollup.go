@@ -0,0 +1,253 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Statistics rollups hold the sum of the statistics counters for each
+// key over a complete week or month, so that Counters does not need to
+// aggregate every counter for old periods. Rollups are built for all
+// the periods that end before the rollup watermark, which is moved
+// forward by BuildStatRollups.
+//
+// The rollups use the following MongoDB collections:
+//
+//     juju.stat.rollups    - Weekly and monthly counter sums
+//     juju.stat.rollupinfo - The rollup watermark
+
+func (s StoreDatabase) StatRollups() *mgo.Collection {
+	return s.C("juju.stat.rollups")
+}
+
+func (s StoreDatabase) StatRollupInfo() *mgo.Collection {
+	return s.C("juju.stat.rollupinfo")
+}
+
+// statsRollupMinAge holds the minimum age of the rollup watermark.
+// Counters are only incremented at times before this age when
+// statistics are updated after the event, so live counter updates
+// never need to update the rollups.
+const statsRollupMinAge = 24 * time.Hour
+
+// statRollupWatermarkId holds the id of the document that holds
+// the rollup watermark in the rollup info collection.
+const statRollupWatermarkId = "watermark"
+
+// statRollup holds a rollup document.
+type statRollup struct {
+	Key    string `bson:"k"`
+	Period string `bson:"p"`
+	Time   int32  `bson:"t"`
+	Count  int64  `bson:"c"`
+}
+
+// statPeriod holds a kind of period that counters are rolled up over.
+type statPeriod struct {
+	// name holds the name of the period stored in rollup documents.
+	name string
+
+	// start returns the start of the period that contains t.
+	start func(t time.Time) time.Time
+
+	// next returns the start of the period following the period
+	// that starts at t.
+	next func(t time.Time) time.Time
+}
+
+var weekPeriod = &statPeriod{
+	name: "week",
+	start: func(t time.Time) time.Time {
+		// Weeks are aligned to the counter epoch, as in
+		// Counters with ByWeek.
+		stamp := timeToStamp(t)
+		return stampToTime(stamp - stamp%604800)
+	},
+	next: func(t time.Time) time.Time {
+		return t.Add(7 * 24 * time.Hour)
+	},
+}
+
+var monthPeriod = &statPeriod{
+	name: "month",
+	start: func(t time.Time) time.Time {
+		t = t.UTC()
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	},
+	next: func(t time.Time) time.Time {
+		return t.AddDate(0, 1, 0)
+	},
+}
+
+// statPeriods holds all the periods that counters are rolled up over.
+var statPeriods = []*statPeriod{weekPeriod, monthPeriod}
+
+// rollupPeriod returns the period whose rollups can be used to
+// aggregate counters by the given unit, or nil if there is none.
+func rollupPeriod(by CounterRequestBy) *statPeriod {
+	switch by {
+	case ByAll, ByMonth:
+		return monthPeriod
+	case ByWeek:
+		return weekPeriod
+	}
+	return nil
+}
+
+func stampToTime(stamp int32) time.Time {
+	return time.Unix(counterEpoch+int64(stamp), 0).In(time.UTC)
+}
+
+// statRollupWatermark returns the rollup watermark. Rollups exist for
+// all the periods that end before it. It returns the zero time if no
+// rollups have been built.
+func statRollupWatermark(db StoreDatabase) (time.Time, error) {
+	var doc struct {
+		Time int32 `bson:"t"`
+	}
+	if err := db.StatRollupInfo().FindId(statRollupWatermarkId).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return time.Time{}, nil
+		}
+		return time.Time{}, errgo.Notef(err, "cannot get stats rollup watermark")
+	}
+	return stampToTime(doc.Time), nil
+}
+
+// rollupRange returns the period of the rollups that can be used to
+// answer the given request, and a query on counter times that matches
+// the complete periods covered by those rollups. It returns a nil
+// period if no rollups can be used.
+func (s *Store) rollupRange(req *CounterRequest) (*statPeriod, bson.D, error) {
+	period := rollupPeriod(req.By)
+	if period == nil {
+		return nil, nil, nil
+	}
+	until, err := statRollupWatermark(s.DB)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	if until.IsZero() {
+		return nil, nil, nil
+	}
+	to := period.start(until)
+	if !req.Stop.IsZero() {
+		// The stop time is inclusive.
+		if stop := period.start(stampToTime(timeToStamp(req.Stop) + 1)); stop.Before(to) {
+			to = stop
+		}
+	}
+	if req.Start.IsZero() {
+		return period, bson.D{{"$lt", timeToStamp(to)}}, nil
+	}
+	from := period.start(req.Start)
+	if from.Before(req.Start) {
+		from = period.next(from)
+	}
+	if !from.Before(to) {
+		return nil, nil, nil
+	}
+	return period, bson.D{{"$gte", timeToStamp(from)}, {"$lt", timeToStamp(to)}}, nil
+}
+
+// incStatRollups increments the rollups that cover the given time for
+// the counter with the given stats key, if they have been built.
+func (s *Store) incStatRollups(skey string, t time.Time) error {
+	until, err := statRollupWatermark(s.DB)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, period := range statPeriods {
+		start := period.start(t)
+		if period.next(start).After(until) {
+			// The period has not been rolled up yet.
+			continue
+		}
+		if _, err := s.DB.StatRollups().Upsert(
+			bson.D{{"k", skey}, {"p", period.name}, {"t", timeToStamp(start)}},
+			bson.D{{"$inc", bson.D{{"c", 1}}}},
+		); err != nil {
+			return errgo.Notef(err, "cannot update stats rollup")
+		}
+	}
+	return nil
+}
+
+// BuildStatRollups builds the rollups of the statistics counters for
+// all the weeks and months that end before the given time and have not
+// already been rolled up, and moves the rollup watermark forward. The
+// time is limited to a day ago so that counters incremented live never
+// need to update the rollups.
+func (s *Store) BuildStatRollups(before time.Time) error {
+	return buildStatRollups(s.DB, before)
+}
+
+func buildStatRollups(db StoreDatabase, before time.Time) error {
+	if latest := time.Now().Add(-statsRollupMinAge); before.After(latest) {
+		before = latest
+	}
+	until, err := statRollupWatermark(db)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !before.After(until) {
+		return nil
+	}
+	if until.IsZero() {
+		// Start from the earliest counter.
+		var counter statCounter
+		if err := db.StatCounters().Find(nil).Sort("t").One(&counter); err != nil {
+			if err != mgo.ErrNotFound {
+				return errgo.Notef(err, "cannot find earliest stats counter")
+			}
+			// There are no counters yet.
+			until = before
+		} else {
+			until = stampToTime(counter.Time)
+		}
+	}
+	for _, period := range statPeriods {
+		start := period.start(until)
+		for end := period.next(start); !end.After(before); start, end = end, period.next(end) {
+			if err := buildStatRollup(db, period, start, end); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	if _, err := db.StatRollupInfo().UpsertId(statRollupWatermarkId, bson.D{{"$set", bson.D{{"t", timeToStamp(before)}}}}); err != nil {
+		return errgo.Notef(err, "cannot update stats rollup watermark")
+	}
+	return nil
+}
+
+// buildStatRollup builds the rollups of the given period for the
+// counters between the start and end times.
+func buildStatRollup(db StoreDatabase, period *statPeriod, start, end time.Time) error {
+	counts := make(map[string]int64)
+	iter := db.StatCounters().Find(bson.D{{"t", bson.D{
+		{"$gte", timeToStamp(start)},
+		{"$lt", timeToStamp(end)},
+	}}}).Iter()
+	var counter statCounter
+	for iter.Next(&counter) {
+		counts[counter.Key] += counter.Count
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate stats counters")
+	}
+	for key, count := range counts {
+		if _, err := db.StatRollups().Upsert(
+			bson.D{{"k", key}, {"p", period.name}, {"t", timeToStamp(start)}},
+			bson.D{{"$set", bson.D{{"c", count}}}},
+		); err != nil {
+			return errgo.Notef(err, "cannot update stats rollup")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Unique client counts estimate the number of distinct clients that
+// incremented a statistic, using a HyperLogLog sketch for each key and
+// day. A sketch records only the maximum rank seen in each of its
+// registers, so client identifiers cannot be recovered from it.
+// Sketches for different days are merged by taking the maximum of
+// each register.
+//
+// The sketches use the following MongoDB collection:
+//
+//     juju.stat.sketches - Daily HyperLogLog sketches
+//
+// Sketch documents hold the stats key, the start of the day and the
+// non-zero registers, keyed by register index:
+//
+//     {k: "1:2:3:", t: 86400, r: {"17": 3, "803": 1}}
+
+func (s StoreDatabase) StatSketches() *mgo.Collection {
+	return s.C("juju.stat.sketches")
+}
+
+// hllPrecision holds the number of bits of a client hash that select
+// a sketch register. The standard error of the estimates is about
+// 1.04/sqrt(2^hllPrecision), or 3%.
+const hllPrecision = 10
+
+// hllRegisters holds the number of registers in a sketch.
+const hllRegisters = 1 << hllPrecision
+
+// statSketch holds a sketch document.
+type statSketch struct {
+	Key       string         `bson:"k"`
+	Time      int32          `bson:"t"`
+	Registers map[string]int `bson:"r"`
+}
+
+// hllSketch holds the registers of a HyperLogLog sketch.
+type hllSketch [hllRegisters]uint8
+
+// merge sets each register of h to the maximum of its value and
+// the value of the register in the given sketch document registers.
+func (h *hllSketch) merge(registers map[string]int) {
+	for idx, rank := range registers {
+		i, err := strconv.Atoi(idx)
+		if err != nil || i < 0 || i >= hllRegisters {
+			continue
+		}
+		if uint8(rank) > h[i] {
+			h[i] = uint8(rank)
+		}
+	}
+}
+
+// estimate returns the estimated number of distinct clients added to
+// the sketch.
+func (h *hllSketch) estimate() int64 {
+	const m = float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(e + 0.5)
+}
+
+// hllRegister returns the index of the sketch register updated by the
+// client with the given identifier, and the rank recorded in it.
+func hllRegister(clientId string) (idx int, rank uint8) {
+	sum := sha256.Sum256([]byte(clientId))
+	h := binary.BigEndian.Uint64(sum[:8])
+	idx = int(h >> (64 - hllPrecision))
+	// The rank is the position of the first set bit in
+	// the remaining bits of the hash.
+	rank = 1
+	for w := h << hllPrecision; w&(1<<63) == 0 && rank <= 64-hllPrecision; w <<= 1 {
+		rank++
+	}
+	return idx, rank
+}
+
+// IncUniqueAtTime records that the client with the given identifier
+// incremented the statistic with the given key at the given time.
+// Only a hash of the identifier is used.
+func (s *Store) IncUniqueAtTime(key []string, clientId string, t time.Time) error {
+	skey, err := s.stats.key(s.DB, key, true)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	idx, rank := hllRegister(clientId)
+	t = t.UTC().Truncate(24 * time.Hour)
+	if _, err := s.DB.StatSketches().Upsert(
+		bson.D{{"k", skey}, {"t", timeToStamp(t)}},
+		bson.D{{"$max", bson.D{{"r." + strconv.Itoa(idx), int(rank)}}}},
+	); err != nil {
+		return errgo.Notef(err, "cannot update stats sketch")
+	}
+	return nil
+}
+
+// UniqueCounters returns the estimated number of distinct clients that
+// incremented the statistics matching the given request. The request
+// is interpreted as by Counters, except that sketches are kept by day,
+// so counts cannot be requested ByHour and the Start and Stop times
+// select whole days.
+func (s *Store) UniqueCounters(req *CounterRequest) ([]Counter, error) {
+	if req.By == ByHour {
+		return nil, errgo.New("unique counts are not available by hour")
+	}
+	searchKey, err := s.stats.key(s.DB, req.Key, false)
+	if errgo.Cause(err) == params.ErrNotFound {
+		if !req.List {
+			return []Counter{{
+				Key:    req.Key,
+				Prefix: req.Prefix,
+				Count:  0,
+			}}, nil
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	query := bson.D{{"k", bson.D{{"$regex", sketchKeyRegex(searchKey, req.Prefix)}}}}
+	var tquery bson.D
+	if !req.Start.IsZero() {
+		tquery = append(tquery, bson.DocElem{
+			Name:  "$gte",
+			Value: timeToStamp(req.Start.UTC().Truncate(24 * time.Hour)),
+		})
+	}
+	if !req.Stop.IsZero() {
+		tquery = append(tquery, bson.DocElem{
+			Name:  "$lte",
+			Value: timeToStamp(req.Stop),
+		})
+	}
+	if len(tquery) > 0 {
+		query = append(query, bson.DocElem{
+			Name:  "t",
+			Value: tquery,
+		})
+	}
+	sketches := make(map[string]*hllSketch)
+	var keys []string
+	var doc statSketch
+	iter := s.DB.StatSketches().Find(query).Iter()
+	for iter.Next(&doc) {
+		key := sketchResultKey(req, searchKey, doc.Key, doc.Time)
+		h := sketches[key]
+		if h == nil {
+			h = new(hllSketch)
+			sketches[key] = h
+			keys = append(keys, key)
+		}
+		h.merge(doc.Registers)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate stats sketches")
+	}
+	result := make([]counterResult, len(keys))
+	for i, key := range keys {
+		result[i] = counterResult{
+			Key:   key,
+			Value: sketches[key].estimate(),
+		}
+	}
+	return s.resultCounters(req, result)
+}
+
+// sketchKeyRegex returns the regular expression that matches the
+// stats keys of the sketches for the given search key.
+func sketchKeyRegex(searchKey string, prefix bool) string {
+	if prefix {
+		return "^" + searchKey + ".+"
+	}
+	return "^" + searchKey + "$"
+}
+
+// sketchResultKey returns the key that the sketch with the given
+// stats key and time is aggregated under, in the same form as the
+// keys emitted by the map function used by Counters.
+func sketchResultKey(req *CounterRequest, searchKey, k string, t int32) string {
+	if req.List && req.Prefix {
+		depth := req.Depth
+		if depth < 1 {
+			depth = 1
+		}
+		i := len(searchKey)
+		for n := 0; n < depth && i > 0; n++ {
+			if j := strings.Index(k[i:], ":"); j >= 0 {
+				i += j + 1
+			} else {
+				i = 0
+			}
+		}
+		if i > 0 && len(k) > i {
+			k = k[:i] + "*"
+		}
+	} else {
+		k = searchKey
+		if req.Prefix {
+			k += "*"
+		}
+	}
+	switch req.By {
+	case ByDay:
+		k += fmt.Sprintf("@%d", t/86400)
+	case ByWeek:
+		k += fmt.Sprintf("@%d", t/604800)
+	case ByMonth:
+		when := stampToTime(t)
+		k += fmt.Sprintf("@%d", when.Year()*12+int(when.Month())-1)
+	}
+	return k
+}
+
+// ArchiveUniqueDownloadCounts returns the estimated number of distinct
+// clients that downloaded the given user owned charm or bundle in the
+// last day, week and month and in total, for the revision in the id
+// and for all its revisions.
+func (s *Store) ArchiveUniqueDownloadCounts(id *charm.URL) (thisRevision, allRevisions AggregatedCounts, err error) {
+	key := EntityStatsKey(id, params.StatsArchiveDownload)
+	thisRevision, err = s.aggregateUniques(key, false)
+	if err != nil {
+		return AggregatedCounts{}, AggregatedCounts{}, errgo.Mask(err)
+	}
+	base := *id
+	base.Revision = -1
+	allRevisions, err = s.aggregateUniques(EntityStatsKey(&base, params.StatsArchiveDownload), true)
+	if err != nil {
+		return AggregatedCounts{}, AggregatedCounts{}, errgo.Mask(err)
+	}
+	return thisRevision, allRevisions, nil
+}
+
+// aggregateUniques returns the estimated number of distinct clients
+// for the statistics with the given key in the last day, week and
+// month and in total. All the periods are estimated from a single
+// scan of the sketches.
+func (s *Store) aggregateUniques(key []string, prefix bool) (AggregatedCounts, error) {
+	searchKey, err := s.stats.key(s.DB, key, false)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return AggregatedCounts{}, nil
+	}
+	if err != nil {
+		return AggregatedCounts{}, errgo.Mask(err)
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	dayStart := timeToStamp(today)
+	weekStart := timeToStamp(today.AddDate(0, 0, -6))
+	monthStart := timeToStamp(today.AddDate(0, -1, 1))
+	var day, week, month, total hllSketch
+	var doc statSketch
+	iter := s.DB.StatSketches().Find(bson.D{{"k", bson.D{{"$regex", sketchKeyRegex(searchKey, prefix)}}}}).Iter()
+	for iter.Next(&doc) {
+		total.merge(doc.Registers)
+		if doc.Time >= monthStart {
+			month.merge(doc.Registers)
+		}
+		if doc.Time >= weekStart {
+			week.merge(doc.Registers)
+		}
+		if doc.Time >= dayStart {
+			day.merge(doc.Registers)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return AggregatedCounts{}, errgo.Notef(err, "cannot iterate stats sketches")
+	}
+	return AggregatedCounts{
+		LastDay:   day.estimate(),
+		LastWeek:  week.estimate(),
+		LastMonth: month.estimate(),
+		Total:     total.estimate(),
+	}, nil
+}
+
+// moveStatSketches moves the sketches with keys that start with
+// fromKey to keys that start with toKey instead, merging them with
+// any existing sketches.
+func (s *Store) moveStatSketches(fromKey, toKey string) error {
+	sketches := s.DB.StatSketches()
+	var doc statSketch
+	iter := sketches.Find(bson.D{{"k", bson.RegEx{Pattern: "^" + fromKey}}}).Iter()
+	for iter.Next(&doc) {
+		newKey := toKey + strings.TrimPrefix(doc.Key, fromKey)
+		registers := make(bson.D, 0, len(doc.Registers))
+		for idx, rank := range doc.Registers {
+			registers = append(registers, bson.DocElem{
+				Name:  "r." + idx,
+				Value: rank,
+			})
+		}
+		if len(registers) > 0 {
+			if _, err := sketches.Upsert(bson.D{{"k", newKey}, {"t", doc.Time}}, bson.D{{"$max", registers}}); err != nil {
+				iter.Close()
+				return errgo.Notef(err, "cannot update stats sketch")
+			}
+		}
+		if err := sketches.Remove(bson.D{{"k", doc.Key}, {"t", doc.Time}}); err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return errgo.Notef(err, "cannot remove stats sketch")
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate stats sketches")
+	}
+	return nil
+}
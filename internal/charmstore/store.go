@@ -17,6 +17,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/juju/worker.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery/mgostorage"
 	"gopkg.in/mgo.v2"
@@ -28,6 +29,7 @@ import (
 	"gopkg.in/juju/charmstore.v5-unstable/internal/cache"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/monitoring"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/ratelimit"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
 )
 
@@ -52,9 +54,27 @@ type Pool struct {
 	// statsCache holds a cache of AggregatedCounts
 	// values, keyed by entity id. When the id has no
 	// revision, the counts apply to all revisions of the
-	// entity.
+	// entity. It also holds the DownloadTotals value,
+	// keyed by downloadTotalsCacheKey.
 	statsCache *cache.Cache
 
+	// groups holds the cached group provider, or nil
+	// if group membership is obtained from the identity
+	// manager.
+	groups *groupCache
+
+	// userOrgs holds a cache of the organisations
+	// that each user is a member of.
+	userOrgs *cache.Cache
+
+	// entityCache holds the shared entity cache, or nil
+	// if it is disabled.
+	entityCache *sharedEntityCache
+
+	// rateLimiters holds the rate limiter for each kind of
+	// request.
+	rateLimiters [numRequestKinds]*ratelimit.Limiter
+
 	config ServerParams
 
 	// auditEncoder encodes messages to auditLogger.
@@ -98,20 +118,34 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 	if config.StatsCacheMaxAge == 0 {
 		config.StatsCacheMaxAge = time.Hour
 	}
+	if config.AuditCheckpointInterval == 0 {
+		config.AuditCheckpointInterval = defaultAuditCheckpointInterval
+	}
 	if config.NewBlobBackend == nil {
 		config.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
 			return blobstore.NewMongoBackend(db, "entitystore")
 		}
 	}
+	if config.GroupCacheMaxAge == 0 {
+		config.GroupCacheMaxAge = defaultGroupCacheMaxAge
+	}
 
 	p := &Pool{
-		db:          StoreDatabase{db}.copy(),
-		es:          si,
-		statsCache:  cache.New(config.StatsCacheMaxAge),
-		config:      config,
-		run:         parallel.NewRun(maxAsyncGoroutines),
-		auditLogger: config.AuditLogger,
-		rootKeys:    mgostorage.NewRootKeys(100),
+		db:           StoreDatabase{db}.copy(),
+		es:           si,
+		statsCache:   cache.New(config.StatsCacheMaxAge),
+		rateLimiters: newRateLimiters(config),
+		userOrgs:     cache.New(config.GroupCacheMaxAge),
+		config:       config,
+		run:          parallel.NewRun(maxAsyncGoroutines),
+		auditLogger:  config.AuditLogger,
+		rootKeys:     mgostorage.NewRootKeys(100),
+	}
+	if config.NewGroupProvider != nil {
+		p.groups = &groupCache{
+			provider: config.NewGroupProvider(p.db.Database),
+			cache:    cache.New(config.GroupCacheMaxAge),
+		}
 	}
 	if config.MaxMgoSessions > 0 {
 		p.reqStoreC = make(chan *Store, config.MaxMgoSessions)
@@ -139,6 +173,9 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 	if err := store.ES.ensureIndexes(false); err != nil {
 		return nil, errgo.Notef(err, "cannot ensure elasticsearch indexes")
 	}
+	if config.EntityCacheMaxAge > 0 {
+		p.entityCache = newSharedEntityCache(p, config.EntityCacheMaxAge)
+	}
 	return p, nil
 }
 
@@ -153,6 +190,11 @@ func (p *Pool) Close() {
 	p.closed = true
 	p.mu.Unlock()
 	p.run.Wait()
+	if p.entityCache != nil {
+		if err := worker.Stop(p.entityCache); err != nil {
+			logger.Errorf("failed to stop entity cache invalidation: %v", err)
+		}
+	}
 	p.db.Close()
 	// Close all cached stores. Any used by
 	// outstanding requests will be closed when the
@@ -350,9 +392,21 @@ func (s *Store) ensureIndexes() error {
 	}{{
 		s.DB.StatCounters(),
 		mgo.Index{Key: []string{"k", "t"}, Unique: true},
+	}, {
+		s.DB.StatCounters(),
+		mgo.Index{Key: []string{"t"}},
+	}, {
+		s.DB.StatRollups(),
+		mgo.Index{Key: []string{"k", "p", "t"}, Unique: true},
+	}, {
+		s.DB.StatSketches(),
+		mgo.Index{Key: []string{"k", "t"}, Unique: true},
 	}, {
 		s.DB.StatTokens(),
 		mgo.Index{Key: []string{"t"}, Unique: true},
+	}, {
+		s.DB.EntityCacheInvalidations(),
+		mgo.Index{Key: []string{"t"}, ExpireAfter: entityCacheInvalidationRetention},
 	}, {
 		s.DB.Entities(),
 		mgo.Index{Key: []string{"baseurl"}},
@@ -407,6 +461,39 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.Resources(),
 		mgo.Index{Key: []string{"baseurl", "name", "revision"}, Unique: true},
+	}, {
+		s.DB.OCIBlobs(),
+		mgo.Index{Key: []string{"baseurl", "digest"}, Unique: true},
+	}, {
+		s.DB.AccessTokens(),
+		mgo.Index{Key: []string{"hash"}, Unique: true},
+	}, {
+		s.DB.AccessTokens(),
+		mgo.Index{Key: []string{"user", "created"}},
+	}, {
+		s.DB.Groups(),
+		mgo.Index{Key: []string{"members"}},
+	}, {
+		s.DB.Orgs(),
+		mgo.Index{Key: []string{"members.user"}},
+	}, {
+		s.DB.Redirects(),
+		mgo.Index{Key: []string{"to"}},
+	}, {
+		s.DB.Audit(),
+		mgo.Index{Key: []string{"time"}},
+	}, {
+		s.DB.Audit(),
+		mgo.Index{Key: []string{"entity", "time"}},
+	}, {
+		s.DB.Audit(),
+		mgo.Index{Key: []string{"baseurl", "time"}},
+	}, {
+		s.DB.Audit(),
+		mgo.Index{Key: []string{"user", "time"}},
+	}, {
+		s.DB.Audit(),
+		mgo.Index{Key: []string{"seq"}, Unique: true, Sparse: true},
 	}, {
 		// TODO this index should be created by the mgo gridfs code.
 		s.DB.C("entitystore.files"),
@@ -481,6 +568,9 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 	if err := iter.Err(); err != nil {
 		return errgo.Mask(err)
 	}
+	if err := s.addOCIBlobRefs(refs, before); err != nil {
+		return errgo.Mask(err)
+	}
 	stats, err := s.BlobStore.GC(refs, before)
 	if err != nil {
 		return errgo.Notef(err, "blobstore GC failed")
@@ -489,19 +579,26 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 	return nil
 }
 
-// AddAudit adds the given entry to the audit log.
+// AddAudit adds the given entry to the audit log. The entry is
+// stored in the database and, if an audit logger has been
+// configured, written to the audit log file.
 func (s *Store) AddAudit(entry audit.Entry) {
 	s.addAuditAtTime(entry, time.Now())
 }
 
 func (s *Store) addAuditAtTime(entry audit.Entry, t time.Time) {
+	entry.Time = t
+	if err := s.insertAudit(&entry); err != nil {
+		logger.Errorf("Cannot insert audit log entry: %v", err)
+		monitoring.RecordAuditFailure("mongodb")
+	}
 	if s.pool.auditEncoder == nil {
 		return
 	}
-	entry.Time = t
 	err := s.pool.auditEncoder.Encode(entry)
 	if err != nil {
 		logger.Errorf("Cannot write audit log entry: %v", err)
+		monitoring.RecordAuditFailure("file")
 	}
 }
 
@@ -638,22 +735,53 @@ func (s *Store) FindEntities(url *charm.URL, fields map[string]int) ([]*mongodoc
 // If the URL does not contain a revision then the channel is searched
 // for the best match, here NoChannel will be treated as
 // params.StableChannel.
+//
+// If no entity matches a URL with a user and its base entity has been
+// transferred to another namespace, the entity is looked up in the new
+// namespace instead.
 func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
+	entity, err := s.findBestEntity(url, channel, fields)
+	if errgo.Cause(err) != params.ErrNotFound || url.User == "" {
+		return entity, err
+	}
+	to, rerr := s.redirectURL(url)
+	if errgo.Cause(rerr) == params.ErrNotFound {
+		return nil, err
+	}
+	if rerr != nil {
+		return nil, errgo.Mask(rerr)
+	}
+	return s.findBestEntity(to, channel, fields)
+}
+
+// bestEntityFields holds the fields that findBestEntity needs
+// to choose between entities.
+var bestEntityFields = mongodoc.EntityFields.Set(
+	"_id",
+	"promulgated-url",
+	"promulgated-revision",
+	"series",
+	"revision",
+	"published",
+)
+
+// findBestEntity is the internal version of FindBestEntity that does
+// not follow redirects.
+func (s *Store) findBestEntity(url *charm.URL, channel params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
 	if fields != nil {
 		// Make sure we have all the fields we need to make a decision.
-		// TODO this would be more efficient if we used bitmasks for field selection.
-		nfields := map[string]int{
-			"_id":                  1,
-			"promulgated-url":      1,
-			"promulgated-revision": 1,
-			"series":               1,
-			"revision":             1,
-			"published":            1,
-		}
-		for f := range fields {
-			nfields[f] = 1
+		if set, ok := mongodoc.EntityFields.FromSelector(fields); ok {
+			fields = mongodoc.EntityFields.Selector(set.Union(bestEntityFields))
+		} else {
+			nfields := make(map[string]int)
+			for _, f := range mongodoc.EntityFields.Names(bestEntityFields) {
+				nfields[f] = 1
+			}
+			for f := range fields {
+				nfields[f] = 1
+			}
+			fields = nfields
 		}
-		fields = nfields
 	}
 	if url.Revision != -1 {
 		// If the URL contains a revision, then it refers to a single entity.
@@ -868,6 +996,8 @@ func (s *Store) FindBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc
 
 // FieldSelector returns a field selector that will select
 // the given fields, or all fields if none are specified.
+// Selectors for entity and base entity documents can also be
+// obtained from mongodoc.EntityFields and mongodoc.BaseEntityFields.
 func FieldSelector(fields ...string) map[string]int {
 	if len(fields) == 0 {
 		return nil
@@ -892,6 +1022,8 @@ func (s *Store) UpdateEntity(url *router.ResolvedURL, update bson.D) error {
 		}
 		return errgo.Notef(err, "cannot update %q", url)
 	}
+	defer s.invalidateEntityCache(url.URL.Name)
+	s.touchBaseEntitiesAfterChange(bson.D{{"_id", mongodoc.BaseURL(&url.URL)}})
 	return nil
 }
 
@@ -902,15 +1034,67 @@ func (s *Store) UpdateBaseEntity(url *router.ResolvedURL, update bson.D) error {
 	if len(update) == 0 {
 		return nil
 	}
-	if err := s.DB.BaseEntities().Update(bson.D{{"_id", mongodoc.BaseURL(&url.URL)}}, update); err != nil {
+	if err := s.DB.BaseEntities().Update(bson.D{{"_id", mongodoc.BaseURL(&url.URL)}}, withTouch(update)); err != nil {
 		if err == mgo.ErrNotFound {
 			return errgo.WithCausef(err, params.ErrNotFound, "cannot update base entity for %q", url)
 		}
 		return errgo.Notef(err, "cannot update base entity for %q", url)
 	}
+	s.invalidateEntityCache(url.URL.Name)
 	return nil
 }
 
+// touchBaseEntities records that the base entities matching the given
+// query, or any of their entities, have changed, by incrementing their
+// update counts and setting their update times. It must be called after
+// the changes have been made, and before the shared entity cache is
+// invalidated so that the cache cannot keep the old update counts.
+func (s *Store) touchBaseEntities(query bson.D) error {
+	if _, err := s.DB.BaseEntities().UpdateAll(query, bson.D{
+		{"$inc", bson.D{{"updatecount", 1}}},
+		{"$set", bson.D{{"updatetime", time.Now()}}},
+	}); err != nil {
+		return errgo.Notef(err, "cannot update base entities")
+	}
+	return nil
+}
+
+// touchBaseEntitiesAfterChange is like touchBaseEntities except that
+// a failure is only logged. It is used after changes to entities that
+// have already been applied, which should not be reported as failed.
+func (s *Store) touchBaseEntitiesAfterChange(query bson.D) {
+	if err := s.touchBaseEntities(query); err != nil {
+		logger.Errorf("cannot record change of base entities matching %v: %v", query, err)
+	}
+}
+
+// withTouch returns the given base entity update with the changes made
+// by touchBaseEntities added to it, so that a base entity can be
+// changed and touched in a single update. The operators in update
+// must hold bson.D values.
+func withTouch(update bson.D) bson.D {
+	touched := make(bson.D, 0, len(update)+2)
+	var inc, set bool
+	for _, op := range update {
+		switch op.Name {
+		case "$inc":
+			op.Value = append(append(bson.D(nil), op.Value.(bson.D)...), bson.DocElem{"updatecount", 1})
+			inc = true
+		case "$set":
+			op.Value = append(append(bson.D(nil), op.Value.(bson.D)...), bson.DocElem{"updatetime", time.Now()})
+			set = true
+		}
+		touched = append(touched, op)
+	}
+	if !inc {
+		touched = append(touched, bson.DocElem{"$inc", bson.D{{"updatecount", 1}}})
+	}
+	if !set {
+		touched = append(touched, bson.DocElem{"$set", bson.D{{"updatetime", time.Now()}}})
+	}
+	return touched
+}
+
 var ErrPublishResourceMismatch = errgo.Newf("charm published with incorrect resources")
 
 // Publish assigns channels to the entity corresponding to the given URL.
@@ -1035,9 +1219,21 @@ func (s *Store) checkPublishedResources(entity *mongodoc.Entity, resources map[s
 // This will be remedied when a new charm is uploaded by the promulgated
 // user. As promulgation is a rare operation, it is considered that the
 // chances this will happen are slim.
-func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
+func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) (err error) {
 	baseEntities := s.DB.BaseEntities()
 	base := mongodoc.BaseURL(&url.URL)
+	// Promulgated URLs have the same name as their entities, so
+	// only entities with the same name are changed.
+	defer s.invalidateEntityCache(base.Name)
+	defer func() {
+		// Setting the promulgation again repeats any changes
+		// that were not made, so a failure to record the
+		// changes is returned rather than leaving out of date
+		// validators behind.
+		if terr := s.touchBaseEntities(bson.D{{"name", base.Name}}); terr != nil && err == nil {
+			err = errgo.Notef(terr, "cannot record promulgation change of %q", base)
+		}
+	}()
 	if !promulgate {
 		err := baseEntities.UpdateId(
 			base,
@@ -1084,7 +1280,7 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 	}
 
 	// Set the promulgated flag on the base entity.
-	err := s.DB.BaseEntities().UpdateId(base, bson.D{{"$set", bson.D{{"promulgated", mongodoc.IntBool(true)}}}})
+	err = s.DB.BaseEntities().UpdateId(base, bson.D{{"$set", bson.D{{"promulgated", mongodoc.IntBool(true)}}}})
 	if err != nil {
 		if errgo.Cause(err) == mgo.ErrNotFound {
 			return errgo.WithCausef(nil, params.ErrNotFound, "base entity %q not found", base)
@@ -1217,13 +1413,18 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 // SetPerms sets the ACL specified by which for the base entity with the
 // given id. The which parameter is in the form "channel.operation",
 // where channel is the string corresponding to one of the ValidChannels
-// and operation is one of "read" or "write". If which does not specify a
-// channel then the unpublished ACL is updated.
+// and operation is one of "read", "write", "upload", "publish", "setperm"
+// or "delete". If which does not specify a channel then the unpublished
+// ACL is updated.
 // This is only provided for testing.
 func (s *Store) SetPerms(id *charm.URL, which string, acl ...string) error {
-	return s.DB.BaseEntities().UpdateId(mongodoc.BaseURL(id), bson.D{{"$set",
+	if err := s.DB.BaseEntities().UpdateId(mongodoc.BaseURL(id), withTouch(bson.D{{"$set",
 		bson.D{{"channelacls." + which, acl}},
-	}})
+	}})); err != nil {
+		return err
+	}
+	s.invalidateEntityCache(id.Name)
+	return nil
 }
 
 // MatchingInterfacesQuery returns a mongo query
@@ -1345,7 +1546,8 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		}
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-
+	defer s.invalidateEntityCache(id.URL.Name)
+	s.touchBaseEntitiesAfterChange(bson.D{{"_id", mongodoc.BaseURL(&id.URL)}})
 	return nil
 }
 
@@ -1400,6 +1602,58 @@ func (s StoreDatabase) Resources() *mgo.Collection {
 	return s.C("resources")
 }
 
+// OCIBlobs returns the mongo collection where the blobs
+// referred to by OCI image resources are stored.
+func (s StoreDatabase) OCIBlobs() *mgo.Collection {
+	return s.C("ociblobs")
+}
+
+// AccessTokens returns the mongo collection where personal access
+// tokens are stored.
+func (s StoreDatabase) AccessTokens() *mgo.Collection {
+	return s.C("accesstokens")
+}
+
+// Groups returns the mongo collection where the groups managed
+// by the charm store are stored.
+func (s StoreDatabase) Groups() *mgo.Collection {
+	return s.C("groups")
+}
+
+// Orgs returns the mongo collection where organisations are stored.
+func (s StoreDatabase) Orgs() *mgo.Collection {
+	return s.C("orgs")
+}
+
+// Redirects returns the mongo collection where the redirects
+// left behind by transferred base entities are stored.
+func (s StoreDatabase) Redirects() *mgo.Collection {
+	return s.C("redirects")
+}
+
+// Transfers returns the mongo collection where the base entity
+// transfers that are in progress are recorded.
+func (s StoreDatabase) Transfers() *mgo.Collection {
+	return s.C("transfers")
+}
+
+// Audit returns the mongo collection where audit log entries are stored.
+func (s StoreDatabase) Audit() *mgo.Collection {
+	return s.C("audit")
+}
+
+// AuditCheckpoints returns the mongo collection where signed
+// checkpoints of the audit log are stored.
+func (s StoreDatabase) AuditCheckpoints() *mgo.Collection {
+	return s.C("audit.checkpoints")
+}
+
+// AuditSequence returns the mongo collection that holds the last
+// sequence number allocated to an audit log entry.
+func (s StoreDatabase) AuditSequence() *mgo.Collection {
+	return s.C("audit.sequence")
+}
+
 // Logs returns the Mongo collection where charm store logs are stored.
 func (s StoreDatabase) Logs() *mgo.Collection {
 	return s.C("logs")
@@ -1417,14 +1671,27 @@ func (s StoreDatabase) Macaroons() *mgo.Collection {
 // allCollections holds for each collection used by the charm store a
 // function returns that collection.
 var allCollections = []func(StoreDatabase) *mgo.Collection{
+	StoreDatabase.AccessTokens,
+	StoreDatabase.Audit,
+	StoreDatabase.AuditCheckpoints,
+	StoreDatabase.AuditSequence,
 	StoreDatabase.BaseEntities,
 	StoreDatabase.Entities,
+	StoreDatabase.EntityCacheInvalidations,
+	StoreDatabase.Groups,
 	StoreDatabase.Logs,
 	StoreDatabase.Macaroons,
 	StoreDatabase.Migrations,
+	StoreDatabase.OCIBlobs,
+	StoreDatabase.Orgs,
+	StoreDatabase.Redirects,
+	StoreDatabase.Transfers,
 	StoreDatabase.Resources,
 	StoreDatabase.Revisions,
 	StoreDatabase.StatCounters,
+	StoreDatabase.StatRollupInfo,
+	StoreDatabase.StatRollups,
+	StoreDatabase.StatSketches,
 	StoreDatabase.StatTokens,
 }
 
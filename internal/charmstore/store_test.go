@@ -352,24 +352,44 @@ var findBaseEntityTests = []struct {
 		Promulgated: true,
 		ChannelACLs: map[params.Channel]mongodoc.ACL{
 			params.UnpublishedChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
+				Read:    []string{"charmers"},
+				Write:   []string{"charmers"},
+				Upload:  []string{"charmers"},
+				Publish: []string{"charmers"},
+				SetPerm: []string{"charmers"},
+				Delete:  []string{"charmers"},
 			},
 			params.EdgeChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
+				Read:    []string{"charmers"},
+				Write:   []string{"charmers"},
+				Upload:  []string{"charmers"},
+				Publish: []string{"charmers"},
+				SetPerm: []string{"charmers"},
+				Delete:  []string{"charmers"},
 			},
 			params.BetaChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
+				Read:    []string{"charmers"},
+				Write:   []string{"charmers"},
+				Upload:  []string{"charmers"},
+				Publish: []string{"charmers"},
+				SetPerm: []string{"charmers"},
+				Delete:  []string{"charmers"},
 			},
 			params.CandidateChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
+				Read:    []string{"charmers"},
+				Write:   []string{"charmers"},
+				Upload:  []string{"charmers"},
+				Publish: []string{"charmers"},
+				SetPerm: []string{"charmers"},
+				Delete:  []string{"charmers"},
 			},
 			params.StableChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
+				Read:    []string{"charmers"},
+				Write:   []string{"charmers"},
+				Upload:  []string{"charmers"},
+				Publish: []string{"charmers"},
+				SetPerm: []string{"charmers"},
+				Delete:  []string{"charmers"},
 			},
 		},
 	}),
@@ -391,24 +411,44 @@ var findBaseEntityTests = []struct {
 		URL: charm.MustParseURL("~who/mysql"),
 		ChannelACLs: map[params.Channel]mongodoc.ACL{
 			params.UnpublishedChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
+				Read:    []string{"who"},
+				Write:   []string{"who"},
+				Upload:  []string{"who"},
+				Publish: []string{"who"},
+				SetPerm: []string{"who"},
+				Delete:  []string{"who"},
 			},
 			params.EdgeChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
+				Read:    []string{"who"},
+				Write:   []string{"who"},
+				Upload:  []string{"who"},
+				Publish: []string{"who"},
+				SetPerm: []string{"who"},
+				Delete:  []string{"who"},
 			},
 			params.BetaChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
+				Read:    []string{"who"},
+				Write:   []string{"who"},
+				Upload:  []string{"who"},
+				Publish: []string{"who"},
+				SetPerm: []string{"who"},
+				Delete:  []string{"who"},
 			},
 			params.CandidateChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
+				Read:    []string{"who"},
+				Write:   []string{"who"},
+				Upload:  []string{"who"},
+				Publish: []string{"who"},
+				SetPerm: []string{"who"},
+				Delete:  []string{"who"},
 			},
 			params.StableChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
+				Read:    []string{"who"},
+				Write:   []string{"who"},
+				Upload:  []string{"who"},
+				Publish: []string{"who"},
+				SetPerm: []string{"who"},
+				Delete:  []string{"who"},
 			},
 		},
 	},
@@ -1098,7 +1138,9 @@ func (s *StoreSuite) TestCollections(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 	// Some collections don't have indexes so they are created only when used.
 	createdOnUse := map[string]bool{
-		"migrations": true,
+		"migrations":           true,
+		"audit.checkpoints":    true,
+		"juju.stat.rollupinfo": true,
 	}
 	// Check that all collections mentioned by Collections are actually created.
 	for _, coll := range colls {
@@ -2631,6 +2673,46 @@ func (s *StoreSuite) TestUpdateBaseEntity(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestUpdatesTouchBaseEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	otherId := router.MustNewResolvedURL("~bob/precise/wordpress-0", -1)
+	err = store.AddCharmWithArchive(otherId, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	assertTouched := func(url *charm.URL, expectCount int) {
+		be, err := store.FindBaseEntity(url, mongodoc.BaseEntityFields.Selector(mongodoc.BaseEntityFields.Set("updatecount", "updatetime")))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(be.UpdateCount, gc.Equals, expectCount)
+		c.Assert(be.UpdateTime.IsZero(), gc.Equals, false)
+	}
+	// Adding the entities touched their base entities.
+	assertTouched(&id.URL, 1)
+	assertTouched(&otherId.URL, 1)
+
+	err = store.UpdateEntity(id, bson.D{{"$set", bson.D{{"extrainfo.test", []byte("PASS")}}}})
+	c.Assert(err, gc.Equals, nil)
+	assertTouched(&id.URL, 2)
+
+	err = store.UpdateBaseEntity(id, bson.D{{"$set", bson.D{{"commoninfo.test", []byte("PASS")}}}})
+	c.Assert(err, gc.Equals, nil)
+	assertTouched(&id.URL, 3)
+	assertTouched(&otherId.URL, 1)
+
+	err = store.SetPerms(&id.URL, "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	assertTouched(&id.URL, 4)
+
+	// Promulgation touches all the base entities with the same name.
+	err = store.SetPromulgated(id, true)
+	c.Assert(err, gc.Equals, nil)
+	assertTouched(&id.URL, 5)
+	assertTouched(&otherId.URL, 2)
+}
+
 var promulgateTests = []struct {
 	about              string
 	entities           []*mongodoc.Entity
@@ -4254,7 +4336,7 @@ func (s *StoreSuite) TestGC(c *gc.C) {
 		"abcdefghijklmnopqrstuvxwyz",
 	}
 	uid := putMultipart(c, store.BlobStore, time.Time{}, contents...)
-	_, err = store.AddResourceWithUploadId(id3, "someResource", uid)
+	_, err = store.AddResourceWithUploadId(id3, "someResource", uid, nil)
 	c.Assert(err, gc.Equals, nil)
 
 	contents = []string{
@@ -4262,7 +4344,7 @@ func (s *StoreSuite) TestGC(c *gc.C) {
 		"ABCDEFGHIJKLMNOPQURSTUVWXYZ",
 	}
 	uid = putMultipart(c, store.BlobStore, time.Time{}, contents...)
-	resource2, err := store.AddResourceWithUploadId(id3, "someResource", uid)
+	resource2, err := store.AddResourceWithUploadId(id3, "someResource", uid, nil)
 	c.Assert(err, gc.Equals, nil)
 
 	type blobInfo struct {
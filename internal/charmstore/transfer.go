@@ -0,0 +1,418 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/elasticsearch"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// userStatsKinds holds the kinds of statistics that are keyed by the
+// user that owns an entity.
+var userStatsKinds = append([]string{
+	params.StatsArchiveDownload,
+	params.StatsArchiveDelete,
+	params.StatsArchiveUpload,
+	params.StatsArchiveFailedUpload,
+}, DownloadDimensions...)
+
+// beforeTransferEntity is called by TransferBaseEntity before each
+// entity is moved. It is replaced in tests to simulate a transfer
+// that is interrupted part way through.
+var beforeTransferEntity = func(url *charm.URL) error {
+	return nil
+}
+
+// TransferBaseEntity transfers the base entity with the given base URL
+// to the namespace of the given user, and returns its new base URL.
+// All its entities, revisions, resources, OCI blobs, statistics
+// counters and search records are moved too, and a redirect is left
+// behind so that FindBestEntity continues to resolve the old URL.
+// Any occurrence of the old owner in the channel ACLs is replaced by
+// the new owner. Promulgated URLs are unaffected.
+//
+// The transfer is recorded in the transfers collection while it is in
+// progress. If it is interrupted, calling TransferBaseEntity again
+// with the same arguments completes it.
+//
+// If the base entity does not exist, an error with a params.ErrNotFound
+// cause is returned. If the target namespace already holds a base
+// entity with the same name, or the base entity is being transferred
+// to another namespace, an error with a params.ErrForbidden cause is
+// returned.
+func (s *Store) TransferBaseEntity(from *charm.URL, user string) (*charm.URL, error) {
+	from = mongodoc.BaseURL(from)
+	if from.User == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "cannot transfer %q: no user specified", from)
+	}
+	if user == "" || user == from.User {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "cannot transfer %q to user %q", from, user)
+	}
+	to := transferURL(from, user)
+	// The transferred entities keep their name, so only
+	// entities with the same name are changed.
+	defer s.invalidateEntityCache(from.Name)
+	resume, err := s.startTransfer(from, to)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
+	}
+
+	// Create the new base entity first so that we fail early if the
+	// target name is already in use. If an earlier attempt has
+	// already removed the old base entity, the new one is in place.
+	baseEntity, err := s.FindBaseEntity(from, nil)
+	switch {
+	case err == nil:
+		if err := s.insertTransferredBaseEntity(baseEntity, to, resume); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+		}
+	case errgo.Cause(err) == params.ErrNotFound && resume:
+	default:
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+
+	// Move the entities. An earlier attempt may have moved some
+	// of them already, so the series are taken from both the
+	// old and the new entities.
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", from}}).All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities for %q", from)
+	}
+	var moved []*mongodoc.Entity
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", to}}).Select(FieldSelector("_id")).All(&moved); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities for %q", to)
+	}
+	series := make(map[string]bool)
+	searchIds := make(map[string]*charm.URL)
+	for _, e := range moved {
+		oldURL := transferURL(e.URL, from.User)
+		series[oldURL.Series] = true
+		searchIds[s.ES.getID(oldURL)] = oldURL
+	}
+	for _, e := range entities {
+		series[e.URL.Series] = true
+		searchIds[s.ES.getID(e.URL)] = e.URL
+		if err := beforeTransferEntity(e.URL); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if err := s.transferEntity(e, to); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	// Move the latest revision records.
+	var revisions []mongodoc.LatestRevision
+	if err := s.DB.Revisions().Find(bson.D{{"baseurl", from}}).All(&revisions); err != nil {
+		return nil, errgo.Notef(err, "cannot find revisions for %q", from)
+	}
+	for _, r := range revisions {
+		oldURL := r.URL
+		r.URL = transferURL(oldURL, user)
+		r.BaseURL = to
+		if _, err := s.DB.Revisions().UpsertId(r.URL, r); err != nil {
+			return nil, errgo.Notef(err, "cannot add revision record for %q", r.URL)
+		}
+		if err := s.DB.Revisions().RemoveId(oldURL); err != nil && err != mgo.ErrNotFound {
+			return nil, errgo.Notef(err, "cannot remove revision record for %q", oldURL)
+		}
+	}
+
+	// Move the resources and OCI blobs.
+	update := bson.D{{"$set", bson.D{{"baseurl", to}}}}
+	if _, err := s.DB.Resources().UpdateAll(bson.D{{"baseurl", from}}, update); err != nil {
+		return nil, errgo.Notef(err, "cannot update resources for %q", from)
+	}
+	if _, err := s.DB.OCIBlobs().UpdateAll(bson.D{{"baseurl", from}}, update); err != nil {
+		return nil, errgo.Notef(err, "cannot update OCI blobs for %q", from)
+	}
+
+	if err := s.transferStats(from, to, series); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if err := s.DB.BaseEntities().RemoveId(from); err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot remove base entity %q", from)
+	}
+
+	// Leave a redirect behind, updating any existing redirects to
+	// the old URL so that they never need to be followed more than
+	// once. The new URL may itself have been the source of an
+	// earlier transfer, in which case that redirect no longer
+	// applies.
+	if _, err := s.DB.Redirects().UpdateAll(bson.D{{"to", from}}, bson.D{{"$set", bson.D{{"to", to}}}}); err != nil {
+		return nil, errgo.Notef(err, "cannot update redirects to %q", from)
+	}
+	if _, err := s.DB.Redirects().UpsertId(from, mongodoc.Redirect{
+		URL: from,
+		To:  to,
+	}); err != nil {
+		return nil, errgo.Notef(err, "cannot add redirect for %q", from)
+	}
+	if err := s.DB.Redirects().RemoveId(to); err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot remove redirect for %q", to)
+	}
+
+	// Update the search index.
+	for id, url := range searchIds {
+		if err := s.ES.delete(id); err != nil {
+			return nil, errgo.Notef(err, "cannot remove search record for %q", url)
+		}
+	}
+	if err := s.UpdateSearchBaseURL(to); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := s.DB.Transfers().RemoveId(from); err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot remove transfer record for %q", from)
+	}
+	return to, nil
+}
+
+// startTransfer records that the base entity with the base URL from
+// is being transferred to the base URL to. It reports whether the
+// same transfer was already in progress, in which case it should be
+// resumed.
+func (s *Store) startTransfer(from, to *charm.URL) (resume bool, err error) {
+	var t mongodoc.Transfer
+	err = s.DB.Transfers().FindId(from).One(&t)
+	if err == nil {
+		if t.To.String() != to.String() {
+			return false, errgo.WithCausef(nil, params.ErrForbidden, "cannot transfer %q: transfer to %q already in progress", from, t.To)
+		}
+		return true, nil
+	}
+	if err != mgo.ErrNotFound {
+		return false, errgo.Notef(err, "cannot find transfer record for %q", from)
+	}
+	if _, err := s.FindBaseEntity(from, FieldSelector("_id")); err != nil {
+		return false, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	n, err := s.DB.BaseEntities().FindId(to).Count()
+	if err != nil {
+		return false, errgo.Notef(err, "cannot count base entities")
+	}
+	if n > 0 {
+		return false, errgo.WithCausef(nil, params.ErrForbidden, "cannot transfer %q: %q already exists", from, to)
+	}
+	if err := s.DB.Transfers().Insert(&mongodoc.Transfer{
+		URL: from,
+		To:  to,
+	}); err != nil {
+		if mgo.IsDup(err) {
+			return false, errgo.WithCausef(nil, params.ErrForbidden, "cannot transfer %q: transfer already in progress", from)
+		}
+		return false, errgo.Notef(err, "cannot add transfer record for %q", from)
+	}
+	return false, nil
+}
+
+// insertTransferredBaseEntity inserts a copy of the given base entity
+// with the base URL to. If resume is true, the copy may already have
+// been inserted by an earlier attempt at the transfer. Otherwise, if
+// the base URL is already in use, the transfer record is removed and
+// an error with a params.ErrForbidden cause is returned.
+func (s *Store) insertTransferredBaseEntity(baseEntity *mongodoc.BaseEntity, to *charm.URL, resume bool) error {
+	from := baseEntity.URL
+	baseEntity.URL = to
+	baseEntity.User = to.User
+	for _, urls := range baseEntity.ChannelEntities {
+		for series, url := range urls {
+			urls[series] = transferURL(url, to.User)
+		}
+	}
+	for ch, acl := range baseEntity.ChannelACLs {
+		baseEntity.ChannelACLs[ch] = transferACL(acl, from.User, to.User)
+	}
+	err := s.DB.BaseEntities().Insert(baseEntity)
+	if err == nil || resume && mgo.IsDup(err) {
+		return nil
+	}
+	if !mgo.IsDup(err) {
+		return errgo.Notef(err, "cannot insert base entity %q", to)
+	}
+	if err := s.DB.Transfers().RemoveId(from); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove transfer record for %q", from)
+	}
+	return errgo.WithCausef(nil, params.ErrForbidden, "cannot transfer %q: %q already exists", from, to)
+}
+
+// transferEntity moves the given entity to the base entity with the
+// base URL to. The new entity is inserted before the old one is
+// removed, so the promulgated URL, which must be unique, is first
+// cleared from the old entity. The promulgated revision is left in
+// place so that the promulgated URL can be restored if the transfer
+// is interrupted and resumed.
+func (s *Store) transferEntity(e *mongodoc.Entity, to *charm.URL) error {
+	oldURL := e.URL
+	if e.PromulgatedURL != nil {
+		if err := s.DB.Entities().UpdateId(oldURL, bson.D{{"$unset", bson.D{{"promulgated-url", ""}}}}); err != nil {
+			return errgo.Notef(err, "cannot clear promulgated URL of %q", oldURL)
+		}
+	}
+	if e.PromulgatedRevision != -1 {
+		purl := *oldURL
+		purl.User = ""
+		purl.Revision = e.PromulgatedRevision
+		e.PromulgatedURL = &purl
+	}
+	e.URL = transferURL(oldURL, to.User)
+	e.BaseURL = to
+	e.User = to.User
+	if err := s.DB.Entities().Insert(e); err != nil && !mgo.IsDup(err) {
+		return errgo.Notef(err, "cannot insert entity %q", e.URL)
+	}
+	if err := s.DB.Entities().RemoveId(oldURL); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove entity %q", oldURL)
+	}
+	return nil
+}
+
+// transferStats moves the statistics counters, rollups and sketches for the entities with
+// the given base URL and series from the owner of from to the owner
+// of to.
+func (s *Store) transferStats(from, to *charm.URL, series map[string]bool) error {
+	counters := s.DB.StatCounters()
+	rollups := s.DB.StatRollups()
+	for _, kind := range userStatsKinds {
+		for ser := range series {
+			fromKey, err := s.stats.key(s.DB, []string{kind, ser, from.Name, from.User}, false)
+			if errgo.Cause(err) == params.ErrNotFound {
+				// There are no counters with this prefix.
+				continue
+			}
+			if err != nil {
+				return errgo.Notef(err, "cannot get stats key")
+			}
+			toKey, err := s.stats.key(s.DB, []string{kind, ser, to.Name, to.User}, true)
+			if err != nil {
+				return errgo.Notef(err, "cannot make stats key")
+			}
+			var counter statCounter
+			iter := counters.Find(bson.D{{"k", bson.RegEx{Pattern: "^" + fromKey}}}).Iter()
+			for iter.Next(&counter) {
+				newKey := toKey + strings.TrimPrefix(counter.Key, fromKey)
+				if err := moveStatCount(counters, bson.D{{"k", newKey}, {"t", counter.Time}}, counter.Key, counter.Count); err != nil {
+					iter.Close()
+					return errgo.Notef(err, "cannot update stats counter")
+				}
+				if err := counters.Remove(bson.D{{"k", counter.Key}, {"t", counter.Time}}); err != nil && err != mgo.ErrNotFound {
+					iter.Close()
+					return errgo.Notef(err, "cannot remove stats counter")
+				}
+			}
+			if err := iter.Close(); err != nil {
+				return errgo.Notef(err, "cannot iterate stats counters")
+			}
+			var rollup statRollup
+			iter = rollups.Find(bson.D{{"k", bson.RegEx{Pattern: "^" + fromKey}}}).Iter()
+			for iter.Next(&rollup) {
+				newKey := toKey + strings.TrimPrefix(rollup.Key, fromKey)
+				if err := moveStatCount(rollups, bson.D{{"k", newKey}, {"p", rollup.Period}, {"t", rollup.Time}}, rollup.Key, rollup.Count); err != nil {
+					iter.Close()
+					return errgo.Notef(err, "cannot update stats rollup")
+				}
+				if err := rollups.Remove(bson.D{{"k", rollup.Key}, {"p", rollup.Period}, {"t", rollup.Time}}); err != nil && err != mgo.ErrNotFound {
+					iter.Close()
+					return errgo.Notef(err, "cannot remove stats rollup")
+				}
+			}
+			if err := iter.Close(); err != nil {
+				return errgo.Notef(err, "cannot iterate stats rollups")
+			}
+			if err := s.moveStatSketches(fromKey, toKey); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	return nil
+}
+
+// moveStatCount adds count to the count of the document in c that
+// matches sel, creating it if needed, as part of moving the document
+// with the key fromKey. The key is recorded in the document so that
+// moving the same count again, when a transfer is resumed, has no
+// effect. The document selected by sel must be unique.
+func moveStatCount(c *mgo.Collection, sel bson.D, fromKey string, count int64) error {
+	query := append(sel[:len(sel):len(sel)], bson.DocElem{"moved", bson.D{{"$ne", fromKey}}})
+	_, err := c.Upsert(query, bson.D{
+		{"$inc", bson.D{{"c", count}}},
+		{"$addToSet", bson.D{{"moved", fromKey}}},
+	})
+	if mgo.IsDup(err) {
+		// The document exists and already includes the count.
+		return nil
+	}
+	return err
+}
+
+// redirectURL returns the URL that the given URL refers to after its
+// base entity has been transferred to another namespace. If there is
+// no such redirect, it returns an error with a params.ErrNotFound
+// cause.
+func (s *Store) redirectURL(url *charm.URL) (*charm.URL, error) {
+	var r mongodoc.Redirect
+	if err := s.DB.Redirects().FindId(mongodoc.BaseURL(url)).One(&r); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "no redirect for %q", url)
+		}
+		return nil, errgo.Notef(err, "cannot find redirect for %q", url)
+	}
+	to := *url
+	to.User = r.To.User
+	to.Name = r.To.Name
+	return &to, nil
+}
+
+// transferURL returns a copy of url in the namespace of the given user.
+func transferURL(url *charm.URL, user string) *charm.URL {
+	url1 := *url
+	url1.User = user
+	return &url1
+}
+
+// transferACL returns a copy of acl with any occurrence of the user
+// from replaced by the user to.
+func transferACL(acl mongodoc.ACL, from, to string) mongodoc.ACL {
+	replace := func(names []string) []string {
+		if names == nil {
+			return nil
+		}
+		names1 := make([]string, len(names))
+		for i, name := range names {
+			if name == from {
+				name = to
+			}
+			names1[i] = name
+		}
+		return names1
+	}
+	return mongodoc.ACL{
+		Read:    replace(acl.Read),
+		Write:   replace(acl.Write),
+		Upload:  replace(acl.Upload),
+		Publish: replace(acl.Publish),
+		SetPerm: replace(acl.SetPerm),
+		Delete:  replace(acl.Delete),
+	}
+}
+
+// delete removes the search record with the given id, as returned by
+// getID, from the search index if elasticsearch is configured.
+func (si *SearchIndex) delete(id string) error {
+	if si == nil || si.Database == nil {
+		return nil
+	}
+	err := si.DeleteDocument(si.Index, typeName, id)
+	if err != nil && err != elasticsearch.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	return nil
+}
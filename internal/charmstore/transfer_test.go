@@ -0,0 +1,187 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type transferSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&transferSuite{})
+
+func (s *transferSuite) TestTransferBaseEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{"~alice/precise/wordpress-0", "~alice/precise/wordpress-1"} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.Publish(MustParseResolvedURL("~alice/precise/wordpress-1"), nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.IncrementDownloadCountsWithInfo(MustParseResolvedURL("~alice/precise/wordpress-0"), &DownloadInfo{
+		ClientId: "client1",
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	to, err := store.TransferBaseEntity(charm.MustParseURL("~alice/precise/wordpress-0"), "bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(to.String(), gc.Equals, "cs:~bob/wordpress")
+
+	// The base entity has moved, along with its channel state.
+	_, err = store.FindBaseEntity(charm.MustParseURL("~alice/wordpress"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	be, err := store.FindBaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.User, gc.Equals, "bob")
+	c.Assert(be.ChannelEntities[params.StableChannel], jc.DeepEquals, map[string]*charm.URL{
+		"precise": charm.MustParseURL("~bob/precise/wordpress-1"),
+	})
+	c.Assert(be.ChannelACLs[params.StableChannel].Read, jc.DeepEquals, []string{"bob"})
+
+	// The old URLs redirect to the new ones.
+	e, err := store.FindBestEntity(charm.MustParseURL("~alice/precise/wordpress-0"), params.NoChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~bob/precise/wordpress-0")
+	c.Assert(e.BaseURL.String(), gc.Equals, "cs:~bob/wordpress")
+	c.Assert(e.User, gc.Equals, "bob")
+	e, err = store.FindBestEntity(charm.MustParseURL("~alice/wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~bob/precise/wordpress-1")
+	_, err = store.FindBestEntity(charm.MustParseURL("~alice/precise/wordpress-5"), params.NoChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The revisions and statistics have moved.
+	rev, err := store.NewRevision(charm.MustParseURL("~bob/precise/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 2)
+	thisRevision, _, err := store.ArchiveDownloadCounts(charm.MustParseURL("~bob/precise/wordpress-0"), true)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(thisRevision.Total, gc.Equals, int64(1))
+	thisRevision, _, err = store.ArchiveDownloadCounts(charm.MustParseURL("~alice/precise/wordpress-0"), true)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(thisRevision.Total, gc.Equals, int64(0))
+	thisRevision, _, err = store.ArchiveUniqueDownloadCounts(charm.MustParseURL("~bob/precise/wordpress-0"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(thisRevision.Total, gc.Equals, int64(1))
+	thisRevision, _, err = store.ArchiveUniqueDownloadCounts(charm.MustParseURL("~alice/precise/wordpress-0"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(thisRevision.Total, gc.Equals, int64(0))
+
+	// A later transfer updates the earlier redirect.
+	_, err = store.TransferBaseEntity(charm.MustParseURL("~bob/wordpress"), "carol")
+	c.Assert(err, gc.Equals, nil)
+	e, err = store.FindBestEntity(charm.MustParseURL("~alice/precise/wordpress-1"), params.NoChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~carol/precise/wordpress-1")
+
+	// Uploading to the old URL takes precedence over the redirect.
+	err = store.AddCharmWithArchive(MustParseResolvedURL("~alice/precise/wordpress-3"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	e, err = store.FindBestEntity(charm.MustParseURL("~alice/precise/wordpress-3"), params.NoChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~alice/precise/wordpress-3")
+
+	// The redirect is removed, so revisions that do not exist in
+	// the new base entity are not found in the transferred one.
+	_, err = store.redirectURL(charm.MustParseURL("~alice/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.FindBestEntity(charm.MustParseURL("~alice/precise/wordpress-1"), params.NoChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *transferSuite) TestTransferBaseEntityResume(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{"0 ~alice/precise/wordpress-0", "1 ~alice/precise/wordpress-1"} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		err = store.IncrementDownloadCountsWithInfo(MustParseResolvedURL(id), &DownloadInfo{
+			ClientId: "client1",
+		})
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	// Interrupt the transfer after the first entity has moved.
+	moved := 0
+	s.PatchValue(&beforeTransferEntity, func(url *charm.URL) error {
+		if moved == 1 {
+			return errgo.New("simulated failure")
+		}
+		moved++
+		return nil
+	})
+	_, err := store.TransferBaseEntity(charm.MustParseURL("~alice/wordpress"), "bob")
+	c.Assert(err, gc.ErrorMatches, `simulated failure`)
+	n, err := store.DB.Entities().Find(bson.D{{"baseurl", charm.MustParseURL("~bob/wordpress")}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	n, err = store.DB.Entities().Find(bson.D{{"baseurl", charm.MustParseURL("~alice/wordpress")}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+
+	// The interrupted transfer cannot be redirected elsewhere.
+	_, err = store.TransferBaseEntity(charm.MustParseURL("~alice/wordpress"), "carol")
+	c.Assert(err, gc.ErrorMatches, `cannot transfer "cs:~alice/wordpress": transfer to "cs:~bob/wordpress" already in progress`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+
+	// Running the transfer again completes it.
+	moved = 0
+	to, err := store.TransferBaseEntity(charm.MustParseURL("~alice/wordpress"), "bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(to.String(), gc.Equals, "cs:~bob/wordpress")
+	n, err = store.DB.Transfers().Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	_, err = store.FindBaseEntity(charm.MustParseURL("~alice/wordpress"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	for i, id := range []string{"~alice/precise/wordpress-0", "~alice/precise/wordpress-1"} {
+		e, err := store.FindBestEntity(charm.MustParseURL(id), params.NoChannel, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.URL, jc.DeepEquals, transferURL(charm.MustParseURL(id), "bob"))
+		c.Assert(e.PromulgatedURL.String(), gc.Equals, fmt.Sprintf("cs:precise/wordpress-%d", i))
+		thisRevision, _, err := store.ArchiveDownloadCounts(e.URL, true)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(thisRevision.Total, gc.Equals, int64(1))
+	}
+	var e mongodoc.Entity
+	err = store.DB.Entities().Find(bson.D{{"promulgated-url", charm.MustParseURL("precise/wordpress-0")}}).One(&e)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~bob/precise/wordpress-0")
+}
+
+func (s *transferSuite) TestTransferBaseEntityErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{"~alice/precise/wordpress-0", "~bob/precise/wordpress-0"} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	_, err := store.TransferBaseEntity(charm.MustParseURL("~alice/wordpress"), "bob")
+	c.Assert(err, gc.ErrorMatches, `cannot transfer "cs:~alice/wordpress": "cs:~bob/wordpress" already exists`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+
+	_, err = store.TransferBaseEntity(charm.MustParseURL("~alice/mysql"), "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, err = store.TransferBaseEntity(charm.MustParseURL("~alice/wordpress"), "alice")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	// The failed transfer has not affected the original entity.
+	e, err := store.FindBestEntity(charm.MustParseURL("~alice/precise/wordpress-0"), params.NoChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL.String(), gc.Equals, "cs:~alice/precise/wordpress-0")
+}
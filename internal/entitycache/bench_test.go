@@ -1,11 +1,13 @@
 package entitycache_test
 
 import (
+	"fmt"
 	"testing"
 
 	"gopkg.in/juju/charm.v6-unstable"
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/entitycache"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 )
 
@@ -34,14 +36,80 @@ func BenchmarkSingleRequest(b *testing.B) {
 	baseURL := charm.MustParseURL("~bob/wordpress")
 	for i := 0; i < b.N; i++ {
 		c := entitycache.New(store)
-		c.AddEntityFields(map[string]int{"size": 1, "blobname": 1})
-		e, err := c.Entity(url, nil)
+		c.AddEntityFields(mongodoc.EntityFields.Set("size", "blobhash"))
+		e, err := c.Entity(url, 0)
 		if err != nil || e != entity {
 			b.Fatalf("get returned unexpected entity (err %v)", err)
 		}
-		be, err := c.BaseEntity(baseURL, nil)
+		be, err := c.BaseEntity(baseURL, 0)
 		if err != nil || be != baseEntity {
 			b.Fatalf("get returned unexpected base entity (err %v)", err)
 		}
 	}
 }
+
+// bulkFieldSets holds the field sets required by the
+// metadata handlers of a typical bulk meta/any request.
+var bulkFieldSets = []fieldset.Set{
+	mongodoc.EntityFields.Set("charmmeta"),
+	mongodoc.EntityFields.Set("charmconfig"),
+	mongodoc.EntityFields.Set("size", "blobhash", "blobhash256"),
+	mongodoc.EntityFields.Set("supportedseries"),
+	mongodoc.EntityFields.Set("extrainfo"),
+	mongodoc.EntityFields.Set("published"),
+}
+
+func BenchmarkAddFields(b *testing.B) {
+	// This benchmarks adding fields that are mostly already
+	// required, as happens for every metadata handler of every
+	// entity in a bulk request.
+	c := entitycache.New(&staticStore{})
+	defer c.Close()
+	for i := 0; i < b.N; i++ {
+		c.AddEntityFields(bulkFieldSets[i%len(bulkFieldSets)])
+	}
+}
+
+func BenchmarkBulkRequest(b *testing.B) {
+	// This benchmarks getting many entities with the
+	// fields required by several metadata handlers,
+	// as done by a bulk meta/any request.
+	const numEntities = 50
+	store := &staticStore{}
+	var urls []*charm.URL
+	for i := 0; i < numEntities; i++ {
+		url := charm.MustParseURL(fmt.Sprintf("~bob/wordpress%d-1", i))
+		baseURL := mongodoc.BaseURL(url)
+		store.entities = append(store.entities, &mongodoc.Entity{
+			URL:      url,
+			BaseURL:  baseURL,
+			BlobHash: fmt.Sprint("w", i),
+		})
+		store.baseEntities = append(store.baseEntities, &mongodoc.BaseEntity{
+			URL:  baseURL,
+			Name: baseURL.Name,
+		})
+		urls = append(urls, url)
+	}
+	baseFields := mongodoc.BaseEntityFields.Set("channelacls")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := entitycache.New(store)
+		for _, fields := range bulkFieldSets {
+			c.AddEntityFields(fields)
+		}
+		c.AddBaseEntityFields(baseFields)
+		c.StartFetch(urls)
+		for _, url := range urls {
+			for _, fields := range bulkFieldSets {
+				if _, err := c.Entity(url, fields); err != nil {
+					b.Fatalf("cannot get entity: %v", err)
+				}
+			}
+			if _, err := c.BaseEntity(url, baseFields); err != nil {
+				b.Fatalf("cannot get base entity: %v", err)
+			}
+		}
+		c.Close()
+	}
+}
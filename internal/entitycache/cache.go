@@ -11,14 +11,15 @@ import (
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 	"gopkg.in/mgo.v2"
 
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 )
 
-// TODO it might be better to represent the field selection with
-// a uint64 bitmask instead of a map[string]int.
-
 // Store holds the underlying storage used by the entity cache.
-// It is implemented by *charmstore.Store.
+// It is implemented by *charmstore.Store. The fields passed to
+// its methods are selectors obtained from the schemas in
+// mongodoc.EntityFields and mongodoc.BaseEntityFields, which must
+// not be modified.
 type Store interface {
 	FindBestEntity(url *charm.URL, fields map[string]int) (*mongodoc.Entity, error)
 	FindBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc.BaseEntity, error)
@@ -61,22 +62,22 @@ type Cache struct {
 	baseEntities stash
 }
 
-var requiredEntityFields = map[string]int{
-	"_id":             1,
-	"promulgated-url": 1,
-	"baseurl":         1,
-}
+var requiredEntityFields = mongodoc.EntityFields.Set(
+	"_id",
+	"promulgated-url",
+	"baseurl",
+)
 
-var requiredBaseEntityFields = map[string]int{
-	"_id": 1,
-}
+var requiredBaseEntityFields = mongodoc.BaseEntityFields.Set(
+	"_id",
+)
 
 // New returns a new cache that uses the given store
 // for fetching entities.
 func New(store Store) *Cache {
 	var c Cache
-	c.entities.init(c.getEntity, &c.wg, requiredEntityFields)
-	c.baseEntities.init(c.getBaseEntity, &c.wg, requiredBaseEntityFields)
+	c.entities.init(c.getEntity, &c.wg, mongodoc.EntityFields, requiredEntityFields)
+	c.baseEntities.init(c.getBaseEntity, &c.wg, mongodoc.BaseEntityFields, requiredBaseEntityFields)
 	c.store = store
 	return &c
 }
@@ -92,7 +93,7 @@ func (c *Cache) Close() {
 //
 // If all the required fields are added before retrieving any entities,
 // fewer database round trips will be required.
-func (c *Cache) AddEntityFields(fields map[string]int) {
+func (c *Cache) AddEntityFields(fields fieldset.Set) {
 	c.entities.mu.Lock()
 	defer c.entities.mu.Unlock()
 	c.entities.addFields(fields)
@@ -103,7 +104,7 @@ func (c *Cache) AddEntityFields(fields map[string]int) {
 //
 // If all the required fields are added before retrieving any base entities,
 // less database round trips will be required.
-func (c *Cache) AddBaseEntityFields(fields map[string]int) {
+func (c *Cache) AddBaseEntityFields(fields fieldset.Set) {
 	c.baseEntities.mu.Lock()
 	defer c.baseEntities.mu.Unlock()
 	c.baseEntities.addFields(fields)
@@ -133,7 +134,7 @@ func (c *Cache) StartFetch(ids []*charm.URL) {
 // Entity returns the entity with the given id. If the entity is not
 // found, it returns an error with a params.ErrNotFound cause.
 // The returned entity will have at least the given fields filled out.
-func (c *Cache) Entity(id *charm.URL, fields map[string]int) (*mongodoc.Entity, error) {
+func (c *Cache) Entity(id *charm.URL, fields fieldset.Set) (*mongodoc.Entity, error) {
 	// Start the base entity fetch asynchronously if we have
 	// an id we can infer the base entity URL from.
 	if id.User != "" {
@@ -151,7 +152,7 @@ func (c *Cache) Entity(id *charm.URL, fields map[string]int) (*mongodoc.Entity,
 // BaseEntity returns the base entity with the given id. If the entity is not
 // found, it returns an error with a params.ErrNotFound cause.
 // The returned entity will have at least the given fields filled out.
-func (c *Cache) BaseEntity(id *charm.URL, fields map[string]int) (*mongodoc.BaseEntity, error) {
+func (c *Cache) BaseEntity(id *charm.URL, fields fieldset.Set) (*mongodoc.BaseEntity, error) {
 	if id.User == "" {
 		return nil, errgo.Newf("cannot get base entity of URL %q with no user", id)
 	}
@@ -222,15 +223,13 @@ type stash struct {
 	// found are indicated with a notFoundEntity value.
 	entities map[charm.URL]stashEntity
 
+	// schema holds the schema of the entity fields.
+	schema *fieldset.Schema
+
 	// fields holds the set of fields required when fetching an
-	// entity. This map is never changed after it is first populated
-	// - it is replaced instead, which means that it's OK to pass it
-	// to concurrent goroutines that access it without the mutex
-	// locked.
-	//
-	// When it does change, the entity cache is invalidated. Fields
-	// are never deleted.
-	fields map[string]int
+	// entity. When it changes, the entity cache is invalidated.
+	// Fields are never deleted.
+	fields fieldset.Set
 
 	// version is incremented every time fields is modified.
 	version int
@@ -241,17 +240,18 @@ type stash struct {
 }
 
 // init initializes the stash with the given entity get function.
-func (s *stash) init(get func(id *charm.URL, fields map[string]int) (stashEntity, error), wg *sync.WaitGroup, initialFields map[string]int) {
+func (s *stash) init(get func(id *charm.URL, fields map[string]int) (stashEntity, error), wg *sync.WaitGroup, schema *fieldset.Schema, initialFields fieldset.Set) {
 	s.changed.L = &s.mu
 	s.get = get
 	s.wg = wg
+	s.schema = schema
 	s.fields = initialFields
 	s.entities = make(map[charm.URL]stashEntity)
 }
 
 // entity returns the entity with the given id. If the entity is not
 // found, it returns an error with a params.ErrNotFound cause.
-func (s *stash) entity(id *charm.URL, fields map[string]int) (stashEntity, error) {
+func (s *stash) entity(id *charm.URL, fields fieldset.Set) (stashEntity, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.addFields(fields)
@@ -292,15 +292,8 @@ func (s *stash) entity(id *charm.URL, fields map[string]int) (stashEntity, error
 // when an entity is fetched.
 //
 // Called with s.mu locked.
-func (s *stash) addFields(fields map[string]int) {
-	changed := false
-	for field := range fields {
-		if _, ok := s.fields[field]; !ok {
-			changed = true
-			break
-		}
-	}
-	if !changed {
+func (s *stash) addFields(fields fieldset.Set) {
+	if s.fields.Contains(fields) {
 		return
 	}
 	if len(s.entities) > 0 {
@@ -313,14 +306,7 @@ func (s *stash) addFields(fields map[string]int) {
 		// fetch.
 		s.changed.Broadcast()
 	}
-	newFields := make(map[string]int)
-	for field := range s.fields {
-		newFields[field] = 1
-	}
-	for field := range fields {
-		newFields[field] = 1
-	}
-	s.fields = newFields
+	s.fields = s.fields.Union(fields)
 }
 
 // startFetch starts an asynchronous fetch for the given id.
@@ -332,8 +318,6 @@ func (s *stash) startFetch(id *charm.URL) {
 		return
 	}
 	s.entities[*id] = nil
-	// Note that it's only OK to pass s.fields here because
-	// it's never mutated, only replaced.
 	s.wg.Add(1)
 	go s.fetchAsync(id, s.fields, s.version)
 }
@@ -342,7 +326,7 @@ func (s *stash) startFetch(id *charm.URL) {
 // in a separate goroutine, with s.wg.Add called appropriately
 // beforehand.
 // Called with s.mu unlocked.
-func (s *stash) fetchAsync(url *charm.URL, fields map[string]int, version int) stashEntity {
+func (s *stash) fetchAsync(url *charm.URL, fields fieldset.Set, version int) stashEntity {
 	defer s.wg.Done()
 	return s.fetch(url, fields, version)
 }
@@ -360,8 +344,8 @@ func (s *stash) fetchAsync(url *charm.URL, fields map[string]int, version int) s
 // been encountered (in this case the error will be stored in s.err).
 //
 // Called with no locks held.
-func (s *stash) fetch(url *charm.URL, fields map[string]int, version int) stashEntity {
-	e, err := s.get(url, fields)
+func (s *stash) fetch(url *charm.URL, fields fieldset.Set, version int) stashEntity {
+	e, err := s.get(url, s.schema.Selector(fields))
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err != nil {
@@ -456,7 +440,7 @@ func (*notFoundEntity) promulgatedURL() *charm.URL {
 // be a query on the entities collection.
 // The entities produced by the returned iterator
 // will have at least the given fields populated.
-func (c *Cache) Iter(q *mgo.Query, fields map[string]int) *Iter {
+func (c *Cache) Iter(q *mgo.Query, fields fieldset.Set) *Iter {
 	return c.CustomIter(mgoQuery{q}, fields)
 }
 
@@ -465,12 +449,12 @@ func (c *Cache) Iter(q *mgo.Query, fields map[string]int) *Iter {
 // a MongoDB query. Care must be taken to ensure that
 // the fields returned are valid for the entities they purport
 // to represent.
-func (c *Cache) CustomIter(q StoreQuery, fields map[string]int) *Iter {
+func (c *Cache) CustomIter(q StoreQuery, fields fieldset.Set) *Iter {
 	c.entities.mu.Lock()
 	defer c.entities.mu.Unlock()
 	c.entities.addFields(fields)
 	iter := &Iter{
-		iter:    q.Iter(c.entities.fields),
+		iter:    q.Iter(c.entities.schema.Selector(c.entities.fields)),
 		cache:   c,
 		entityc: make(chan *mongodoc.Entity),
 		closed:  make(chan struct{}),
@@ -706,7 +690,8 @@ func (e baseEntity) promulgatedURL() *charm.URL {
 // other different underlying representations.
 type StoreQuery interface {
 	// Iter returns an iterator over the query, selecting
-	// at least the fields mentioned in the given map.
+	// at least the fields mentioned in the given map,
+	// which must not be modified.
 	Iter(fields map[string]int) StoreIter
 }
 
@@ -14,6 +14,7 @@ import (
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/entitycache"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 )
 
@@ -47,7 +48,7 @@ func (*suite) TestEntityIssuesBaseEntityQueryConcurrently(c *gc.C) {
 	store := newChanStore()
 	cache := entitycache.New(store)
 	defer cache.Close()
-	cache.AddBaseEntityFields(map[string]int{"name": 1})
+	cache.AddBaseEntityFields(mongodoc.BaseEntityFields.Set("name"))
 
 	entity := &mongodoc.Entity{
 		URL:      charm.MustParseURL("~bob/wordpress-1"),
@@ -62,7 +63,7 @@ func (*suite) TestEntityIssuesBaseEntityQueryConcurrently(c *gc.C) {
 	queryDone := make(chan struct{})
 	go func() {
 		defer close(queryDone)
-		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), map[string]int{"blobhash": 1})
+		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), mongodoc.EntityFields.Set("blobhash"))
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields("blobhash")))
 	}()
@@ -87,11 +88,11 @@ func (*suite) TestEntityIssuesBaseEntityQueryConcurrently(c *gc.C) {
 	// not call any method on the store - if it does, then it'll send
 	// on the query channels and we won't receive it, so the test
 	// will deadlock.
-	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), map[string]int{"baseurl": 1, "blobhash": 1})
+	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), mongodoc.EntityFields.Set("baseurl", "blobhash"))
 	c.Check(err, gc.Equals, nil)
 	c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields("blobhash")))
 
-	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), map[string]int{"name": 1})
+	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), mongodoc.BaseEntityFields.Set("name"))
 	c.Check(err, gc.Equals, nil)
 	c.Check(be, jc.DeepEquals, selectBaseEntityFields(baseEntity, baseEntityFields("name")))
 }
@@ -100,7 +101,7 @@ func (*suite) TestEntityIssuesBaseEntityQuerySequentiallyForPromulgatedURL(c *gc
 	store := newChanStore()
 	cache := entitycache.New(store)
 	defer cache.Close()
-	cache.AddBaseEntityFields(map[string]int{"name": 1})
+	cache.AddBaseEntityFields(mongodoc.BaseEntityFields.Set("name"))
 
 	entity := &mongodoc.Entity{
 		URL:            charm.MustParseURL("~bob/wordpress-1"),
@@ -116,7 +117,7 @@ func (*suite) TestEntityIssuesBaseEntityQuerySequentiallyForPromulgatedURL(c *gc
 	queryDone := make(chan struct{})
 	go func() {
 		defer close(queryDone)
-		e, err := cache.Entity(charm.MustParseURL("wordpress-1"), map[string]int{"blobhash": 1})
+		e, err := cache.Entity(charm.MustParseURL("wordpress-1"), mongodoc.EntityFields.Set("blobhash"))
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields("blobhash")))
 	}()
@@ -146,11 +147,11 @@ func (*suite) TestEntityIssuesBaseEntityQuerySequentiallyForPromulgatedURL(c *gc
 	// not call any method on the store - if it does, then it'll send
 	// on the query channels and we won't receive it, so the test
 	// will deadlock.
-	e, err := cache.Entity(charm.MustParseURL("wordpress-1"), map[string]int{"baseurl": 1, "blobhash": 1})
+	e, err := cache.Entity(charm.MustParseURL("wordpress-1"), mongodoc.EntityFields.Set("baseurl", "blobhash"))
 	c.Check(err, gc.Equals, nil)
 	c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields("blobhash")))
 
-	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), map[string]int{"name": 1})
+	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), mongodoc.BaseEntityFields.Set("name"))
 	c.Check(err, gc.Equals, nil)
 	c.Check(be, jc.DeepEquals, selectBaseEntityFields(baseEntity, baseEntityFields("name")))
 }
@@ -159,7 +160,7 @@ func (*suite) TestFetchWhenFieldsChangeBeforeQueryResult(c *gc.C) {
 	store := newChanStore()
 	cache := entitycache.New(store)
 	defer cache.Close()
-	cache.AddBaseEntityFields(map[string]int{"name": 1})
+	cache.AddBaseEntityFields(mongodoc.BaseEntityFields.Set("name"))
 
 	entity := &mongodoc.Entity{
 		URL:      charm.MustParseURL("~bob/wordpress-1"),
@@ -179,7 +180,7 @@ func (*suite) TestFetchWhenFieldsChangeBeforeQueryResult(c *gc.C) {
 	queryDone := make(chan struct{})
 	go func() {
 		defer close(queryDone)
-		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields()))
 	}()
@@ -199,7 +200,7 @@ func (*suite) TestFetchWhenFieldsChangeBeforeQueryResult(c *gc.C) {
 	go func() {
 		defer close(query2Done)
 		// Note the extra "size" field.
-		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), map[string]int{"size": 1})
+		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), mongodoc.EntityFields.Set("size"))
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity2, entityFields("size")))
 	}()
@@ -223,7 +224,7 @@ func (*suite) TestFetchWhenFieldsChangeBeforeQueryResult(c *gc.C) {
 	// to ensure it doesn't.
 	close(store.entityqc)
 	close(store.baseEntityqc)
-	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 	c.Check(err, gc.Equals, nil)
 	c.Check(e, jc.DeepEquals, selectEntityFields(entity2, entityFields("size")))
 }
@@ -232,7 +233,7 @@ func (*suite) TestSecondFetchesWaitForFirst(c *gc.C) {
 	store := newChanStore()
 	cache := entitycache.New(store)
 	defer cache.Close()
-	cache.AddBaseEntityFields(map[string]int{"name": 1})
+	cache.AddBaseEntityFields(mongodoc.BaseEntityFields.Set("name"))
 
 	entity := &mongodoc.Entity{
 		URL:      charm.MustParseURL("~bob/wordpress-1"),
@@ -253,7 +254,7 @@ func (*suite) TestSecondFetchesWaitForFirst(c *gc.C) {
 	initialRequestGroup.Add(1)
 	go func() {
 		defer initialRequestGroup.Done()
-		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields()))
 	}()
@@ -268,7 +269,7 @@ func (*suite) TestSecondFetchesWaitForFirst(c *gc.C) {
 		initialRequestGroup.Add(1)
 		go func() {
 			defer initialRequestGroup.Done()
-			e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+			e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 			c.Check(err, gc.Equals, nil)
 			c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields()))
 		}()
@@ -290,7 +291,7 @@ func (*suite) TestSecondFetchesWaitForFirst(c *gc.C) {
 	otherRequestDone := make(chan struct{})
 	go func() {
 		defer close(otherRequestDone)
-		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-2"), nil)
+		e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-2"), 0)
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity2, entityFields()))
 	}()
@@ -324,13 +325,13 @@ func (*suite) TestGetEntityNotFound(c *gc.C) {
 	}
 	cache := entitycache.New(store)
 	defer cache.Close()
-	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 	c.Assert(e, gc.IsNil)
 	c.Assert(err, gc.ErrorMatches, "entity: not found")
 	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
 
 	// Make sure that the not-found result has been cached.
-	e, err = cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+	e, err = cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 	c.Assert(e, gc.IsNil)
 	c.Assert(err, gc.ErrorMatches, "entity: not found")
 	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
@@ -338,12 +339,12 @@ func (*suite) TestGetEntityNotFound(c *gc.C) {
 	c.Assert(entityFetchCount, gc.Equals, 1)
 
 	// Make sure fetching the base entity works the same way.
-	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), 0)
 	c.Assert(be, gc.IsNil)
 	c.Assert(err, gc.ErrorMatches, "base entity: not found")
 	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
 
-	be, err = cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	be, err = cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), 0)
 	c.Assert(be, gc.IsNil)
 	c.Assert(err, gc.ErrorMatches, "base entity: not found")
 	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
@@ -368,24 +369,24 @@ func (*suite) TestFetchError(c *gc.C) {
 	defer cache.Close()
 
 	// Check that we get the entity fetch error from cache.Entity.
-	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 	c.Assert(e, gc.IsNil)
 	c.Assert(err, gc.ErrorMatches, `cannot fetch "cs:~bob/wordpress-1": entity error`)
 
 	// Check that the error is cached.
-	e, err = cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+	e, err = cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 	c.Assert(e, gc.IsNil)
 	c.Assert(err, gc.ErrorMatches, `cannot fetch "cs:~bob/wordpress-1": entity error`)
 
 	c.Assert(entityFetchCount, gc.Equals, 1)
 
 	// Check that we get the base-entity fetch error from cache.BaseEntity.
-	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), 0)
 	c.Assert(be, gc.IsNil)
 	c.Assert(err, gc.ErrorMatches, `cannot fetch "cs:~bob/wordpress": base entity error`)
 
 	// Check that the error is cached.
-	be, err = cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	be, err = cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), 0)
 	c.Assert(be, gc.IsNil)
 	c.Assert(err, gc.ErrorMatches, `cannot fetch "cs:~bob/wordpress": base entity error`)
 	c.Assert(baseEntityFetchCount, gc.Equals, 1)
@@ -417,14 +418,14 @@ func (*suite) TestStartFetch(c *gc.C) {
 	entityQueryDone := make(chan struct{})
 	go func() {
 		defer close(entityQueryDone)
-		e, err := cache.Entity(url, nil)
+		e, err := cache.Entity(url, 0)
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields()))
 	}()
 	baseEntityQueryDone := make(chan struct{})
 	go func() {
 		defer close(baseEntityQueryDone)
-		e, err := cache.BaseEntity(baseURL, nil)
+		e, err := cache.BaseEntity(baseURL, 0)
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, baseEntity)
 	}()
@@ -466,26 +467,26 @@ func (*suite) TestAddEntityFields(c *gc.C) {
 		return baseEntity, nil
 	}
 	cache := entitycache.New(store)
-	cache.AddEntityFields(map[string]int{"blobhash": 1, "size": 1})
+	cache.AddEntityFields(mongodoc.EntityFields.Set("blobhash", "size"))
 	queryDone := make(chan struct{})
 	go func() {
 		defer close(queryDone)
-		e, err := cache.Entity(charm.MustParseURL("cs:~bob/wordpress-1"), map[string]int{"blobhash": 1})
+		e, err := cache.Entity(charm.MustParseURL("cs:~bob/wordpress-1"), mongodoc.EntityFields.Set("blobhash"))
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields("blobhash", "size")))
 
 		// Adding existing entity fields should have no effect.
-		cache.AddEntityFields(map[string]int{"blobhash": 1, "size": 1})
+		cache.AddEntityFields(mongodoc.EntityFields.Set("blobhash", "size"))
 
-		e, err = cache.Entity(charm.MustParseURL("cs:~bob/wordpress-1"), map[string]int{"size": 1})
+		e, err = cache.Entity(charm.MustParseURL("cs:~bob/wordpress-1"), mongodoc.EntityFields.Set("size"))
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields("blobhash", "size")))
 
 		// Adding a new field should will cause the cache to be invalidated
 		// and a new fetch to take place.
 
-		cache.AddEntityFields(map[string]int{"prev5blobhash": 1})
-		e, err = cache.Entity(charm.MustParseURL("cs:~bob/wordpress-1"), nil)
+		cache.AddEntityFields(mongodoc.EntityFields.Set("prev5blobhash"))
+		e, err = cache.Entity(charm.MustParseURL("cs:~bob/wordpress-1"), 0)
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields("blobhash", "prev5blobhash", "size")))
 	}()
@@ -533,7 +534,7 @@ func (*suite) TestLookupByDifferentKey(c *gc.C) {
 	}
 	cache := entitycache.New(store)
 	defer cache.Close()
-	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 	c.Assert(err, gc.Equals, nil)
 	c.Check(e, jc.DeepEquals, selectEntityFields(entity, entityFields()))
 
@@ -547,7 +548,7 @@ func (*suite) TestLookupByDifferentKey(c *gc.C) {
 		BaseURL:  charm.MustParseURL("~bob/wordpress"),
 		BlobHash: "w2",
 	}
-	e, err = cache.Entity(charm.MustParseURL("~bob/wordpress"), nil)
+	e, err = cache.Entity(charm.MustParseURL("~bob/wordpress"), 0)
 	c.Assert(err, gc.Equals, nil)
 	c.Logf("got %p; old entity %p; new entity %p", e, oldEntity, entity)
 	c.Assert(e, gc.Equals, oldEntity)
@@ -563,7 +564,7 @@ func (s *suite) TestIterSingle(c *gc.C) {
 	cache := entitycache.New(store)
 	defer cache.Close()
 	fakeIter := newFakeIter()
-	iter := cache.CustomIter(fakeIter, map[string]int{"size": 1, "blobsize": 1})
+	iter := cache.CustomIter(fakeIter, mongodoc.EntityFields.Set("size", "blobhash256"))
 	nextDone := make(chan struct{})
 	go func() {
 		defer close(nextDone)
@@ -603,10 +604,10 @@ func (s *suite) TestIterSingle(c *gc.C) {
 
 	// Check that the entity is the one we expect.
 	cachedEntity := iter.Entity()
-	c.Assert(cachedEntity, jc.DeepEquals, selectEntityFields(entity, entityFields("size", "blobsize")))
+	c.Assert(cachedEntity, jc.DeepEquals, selectEntityFields(entity, entityFields("size", "blobhash256")))
 
 	// Check that the entity can now be fetched from the cache.
-	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(e, gc.Equals, cachedEntity)
 
@@ -619,7 +620,7 @@ func (s *suite) TestIterSingle(c *gc.C) {
 	queryDone := make(chan struct{})
 	go func() {
 		defer close(queryDone)
-		e, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+		e, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), 0)
 		c.Check(err, gc.Equals, nil)
 		c.Check(e, jc.DeepEquals, selectBaseEntityFields(baseEntity, baseEntityFields()))
 	}()
@@ -663,12 +664,12 @@ func (*suite) TestIterWithEntryAlreadyInCache(c *gc.C) {
 	}
 	cache := entitycache.New(store)
 	defer cache.Close()
-	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), map[string]int{"size": 1, "blobsize": 1})
+	e, err := cache.Entity(charm.MustParseURL("~bob/wordpress-1"), mongodoc.EntityFields.Set("size", "blobhash256"))
 	c.Assert(err, gc.Equals, nil)
-	c.Check(e, jc.DeepEquals, selectEntityFields(store.entities[0], entityFields("size", "blobsize")))
+	c.Check(e, jc.DeepEquals, selectEntityFields(store.entities[0], entityFields("size", "blobhash256")))
 	cachedEntity := e
 
-	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	be, err := cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), 0)
 	c.Assert(err, gc.Equals, nil)
 	c.Check(be, jc.DeepEquals, selectBaseEntityFields(store.baseEntities[0], baseEntityFields()))
 	cachedBaseEntity := be
@@ -680,7 +681,7 @@ func (*suite) TestIterWithEntryAlreadyInCache(c *gc.C) {
 	}
 
 	fakeIter := newFakeIter()
-	iter := cache.CustomIter(fakeIter, map[string]int{"size": 1, "blobsize": 1})
+	iter := cache.CustomIter(fakeIter, mongodoc.EntityFields.Set("size", "blobhash256"))
 	iterDone := make(chan struct{})
 	go func() {
 		defer close(iterDone)
@@ -689,7 +690,7 @@ func (*suite) TestIterWithEntryAlreadyInCache(c *gc.C) {
 		// Even though the entity is in the cache, we still
 		// receive the entity returned from the iterator.
 		// We can't actually tell this though.
-		c.Check(iter.Entity(), jc.DeepEquals, selectEntityFields(iterEntity, entityFields("size", "blobsize")))
+		c.Check(iter.Entity(), jc.DeepEquals, selectEntityFields(iterEntity, entityFields("size", "blobhash256")))
 
 		ok = iter.Next()
 		c.Check(ok, gc.Equals, false)
@@ -709,11 +710,11 @@ func (*suite) TestIterWithEntryAlreadyInCache(c *gc.C) {
 	<-iterDone
 
 	// The original cached entities should still be there.
-	e, err = cache.Entity(charm.MustParseURL("~bob/wordpress-1"), nil)
+	e, err = cache.Entity(charm.MustParseURL("~bob/wordpress-1"), 0)
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(e, gc.Equals, cachedEntity)
 
-	be, err = cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	be, err = cache.BaseEntity(charm.MustParseURL("~bob/wordpress"), 0)
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(be, gc.Equals, cachedBaseEntity)
 }
@@ -749,7 +750,7 @@ func (*suite) TestIterCloseEarlyWhenBatchLimitExceeded(c *gc.C) {
 	fakeIter := &sliceIter{
 		entities: entities,
 	}
-	iter := cache.CustomIter(fakeIter, map[string]int{"blobhash": 1})
+	iter := cache.CustomIter(fakeIter, mongodoc.EntityFields.Set("blobhash"))
 	iter.Close()
 	c.Assert(iter.Next(), gc.Equals, false)
 }
@@ -777,7 +778,7 @@ func (*suite) TestIterEntityBatchLimitExceeded(c *gc.C) {
 	fakeIter := &sliceIter{
 		entities: entities,
 	}
-	iter := cache.CustomIter(fakeIter, map[string]int{"blobhash": 1})
+	iter := cache.CustomIter(fakeIter, mongodoc.EntityFields.Set("blobhash"))
 
 	// The iterator should fetch up to entityThreshold entities
 	// from the underlying iterator before sending
@@ -811,10 +812,10 @@ func (*suite) TestIterEntityBatchLimitExceeded(c *gc.C) {
 
 	// Check that all the entities and base entities are in fact cached.
 	for _, want := range entities {
-		got, err := cache.Entity(want.URL, nil)
+		got, err := cache.Entity(want.URL, 0)
 		c.Assert(err, gc.Equals, nil)
 		c.Assert(got, jc.DeepEquals, want)
-		gotBase, err := cache.BaseEntity(want.URL, nil)
+		gotBase, err := cache.BaseEntity(want.URL, 0)
 		c.Assert(err, gc.Equals, nil)
 		c.Assert(gotBase, jc.DeepEquals, &mongodoc.BaseEntity{
 			URL: want.BaseURL,
@@ -825,7 +826,7 @@ func (*suite) TestIterEntityBatchLimitExceeded(c *gc.C) {
 func (*suite) TestIterError(c *gc.C) {
 	cache := entitycache.New(&staticStore{})
 	fakeIter := newFakeIter()
-	iter := cache.CustomIter(fakeIter, nil)
+	iter := cache.CustomIter(fakeIter, 0)
 	// Err returns nil while the iteration is in progress.
 	err := iter.Err()
 	c.Assert(err, gc.Equals, nil)
@@ -1081,19 +1082,16 @@ func bsonFieldName(f reflect.StructField) string {
 }
 
 func entityFields(fields ...string) map[string]int {
-	return addFields(entitycache.RequiredEntityFields, fields...)
+	return addFields(mongodoc.EntityFields, entitycache.RequiredEntityFields, fields...)
 }
 
 func baseEntityFields(fields ...string) map[string]int {
-	return addFields(entitycache.RequiredBaseEntityFields, fields...)
+	return addFields(mongodoc.BaseEntityFields, entitycache.RequiredBaseEntityFields, fields...)
 }
 
-func addFields(fields map[string]int, extra ...string) map[string]int {
+func addFields(schema *fieldset.Schema, fields fieldset.Set, extra ...string) map[string]int {
 	fields1 := make(map[string]int)
-	for f := range fields {
-		fields1[f] = 1
-	}
-	for _, f := range extra {
+	for _, f := range schema.Names(fields.Union(schema.Set(extra...))) {
 		fields1[f] = 1
 	}
 	return fields1
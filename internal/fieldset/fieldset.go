@@ -0,0 +1,126 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package fieldset implements compact sets of document fields, used
+// to select the fields fetched from MongoDB.
+package fieldset // import "gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxSelectors holds the maximum number of field selectors
+// remembered by a Schema.
+const maxSelectors = 1024
+
+// Set holds a set of document fields, each represented by a single
+// bit. The field represented by each bit is defined by a Schema.
+// The zero Set holds no fields.
+type Set uint64
+
+// Union returns the set of the fields in either s or t.
+func (s Set) Union(t Set) Set {
+	return s | t
+}
+
+// Contains reports whether all the fields in t are in s.
+func (s Set) Contains(t Set) bool {
+	return s&t == t
+}
+
+// Schema defines the fields of a kind of document, each of which
+// can be held in a Set.
+type Schema struct {
+	names []string
+	bits  map[string]Set
+
+	// mu guards selectors.
+	mu sync.Mutex
+
+	// selectors holds the field selectors already returned by
+	// Selector, keyed by their field set.
+	selectors map[Set]map[string]int
+}
+
+// NewSchema returns a schema that holds the given fields. It panics if
+// there are more than 64 fields or if any field is repeated.
+func NewSchema(names ...string) *Schema {
+	if len(names) > 64 {
+		panic(fmt.Sprintf("too many fields in schema (%d)", len(names)))
+	}
+	s := &Schema{
+		names:     names,
+		bits:      make(map[string]Set, len(names)),
+		selectors: make(map[Set]map[string]int),
+	}
+	for i, name := range names {
+		if _, ok := s.bits[name]; ok {
+			panic(fmt.Sprintf("duplicate field %q in schema", name))
+		}
+		s.bits[name] = 1 << uint(i)
+	}
+	return s
+}
+
+// Set returns the set of the given fields. It panics if a field is not
+// defined by the schema.
+func (s *Schema) Set(names ...string) Set {
+	var set Set
+	for _, name := range names {
+		bit, ok := s.bits[name]
+		if !ok {
+			panic(fmt.Sprintf("unknown field %q", name))
+		}
+		set |= bit
+	}
+	return set
+}
+
+// FromSelector returns the set of the fields selected by the given
+// MongoDB field selector. It reports false if the selector does not
+// include only fields defined by the schema.
+func (s *Schema) FromSelector(selector map[string]int) (Set, bool) {
+	var set Set
+	for name, v := range selector {
+		bit, ok := s.bits[name]
+		if !ok || v == 0 {
+			return 0, false
+		}
+		set |= bit
+	}
+	return set, true
+}
+
+// Names returns the names of the fields in the given set, in schema
+// order.
+func (s *Schema) Names(set Set) []string {
+	var names []string
+	for i, name := range s.names {
+		if set&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Selector returns a MongoDB field selector that selects the fields in
+// the given set. The same selector may be returned to other callers,
+// so it must not be modified. Note that MongoDB selects all fields
+// when the selector is empty.
+func (s *Schema) Selector(set Set) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if selector, ok := s.selectors[set]; ok {
+		return selector
+	}
+	names := s.Names(set)
+	selector := make(map[string]int, len(names))
+	for _, name := range names {
+		selector[name] = 1
+	}
+	if len(s.selectors) < maxSelectors {
+		s.selectors[set] = selector
+	}
+	return selector
+}
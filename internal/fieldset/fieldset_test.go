@@ -0,0 +1,72 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package fieldset_test
+
+import (
+	"fmt"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
+)
+
+type suite struct{}
+
+var _ = gc.Suite(&suite{})
+
+var schema = fieldset.NewSchema("_id", "name", "size", "blobhash")
+
+func (*suite) TestSet(c *gc.C) {
+	set := schema.Set("size", "_id")
+	c.Assert(set, gc.Equals, fieldset.Set(5))
+	c.Assert(schema.Names(set), jc.DeepEquals, []string{"_id", "size"})
+	c.Assert(schema.Set(), gc.Equals, fieldset.Set(0))
+	c.Assert(schema.Names(0), gc.HasLen, 0)
+	c.Assert(func() { schema.Set("other") }, gc.PanicMatches, `unknown field "other"`)
+}
+
+func (*suite) TestUnionContains(c *gc.C) {
+	s1 := schema.Set("_id", "name")
+	s2 := schema.Set("name", "size")
+	c.Assert(s1.Union(s2), gc.Equals, schema.Set("_id", "name", "size"))
+	c.Assert(s1.Union(s2).Contains(s1), gc.Equals, true)
+	c.Assert(s1.Contains(s2), gc.Equals, false)
+	c.Assert(s1.Contains(0), gc.Equals, true)
+}
+
+func (*suite) TestFromSelector(c *gc.C) {
+	set, ok := schema.FromSelector(map[string]int{"name": 1, "blobhash": 1})
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(set, gc.Equals, schema.Set("name", "blobhash"))
+
+	set, ok = schema.FromSelector(nil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(set, gc.Equals, fieldset.Set(0))
+
+	_, ok = schema.FromSelector(map[string]int{"name": 1, "other": 1})
+	c.Assert(ok, gc.Equals, false)
+
+	_, ok = schema.FromSelector(map[string]int{"name": 0})
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (*suite) TestSelector(c *gc.C) {
+	sel := schema.Selector(schema.Set("name", "blobhash"))
+	c.Assert(sel, jc.DeepEquals, map[string]int{"name": 1, "blobhash": 1})
+	c.Assert(schema.Selector(0), jc.DeepEquals, map[string]int{})
+
+	// The selector is remembered.
+	sel1 := schema.Selector(schema.Set("blobhash", "name"))
+	c.Assert(fmt.Sprintf("%p", sel1), gc.Equals, fmt.Sprintf("%p", sel))
+}
+
+func (*suite) TestNewSchemaErrors(c *gc.C) {
+	c.Assert(func() { fieldset.NewSchema("a", "b", "a") }, gc.PanicMatches, `duplicate field "a" in schema`)
+	names := make([]string, 65)
+	for i := range names {
+		names[i] = fmt.Sprint(i)
+	}
+	c.Assert(func() { fieldset.NewSchema(names...) }, gc.PanicMatches, `too many fields in schema \(65\)`)
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+import (
+	"time"
+
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+)
+
+// AccessToken holds a personal access token, which allows requests
+// to be made with the credentials of a user but restricted to a set
+// of operations on a set of base entities.
+type AccessToken struct {
+	// Id holds the public identifier of the token.
+	Id string `bson:"_id"`
+
+	// Hash holds the hex-encoded SHA256 hash of the secret
+	// token value. The value itself is never stored.
+	Hash string
+
+	// User holds the name of the user that owns the token.
+	User string
+
+	// Description holds an optional description of the
+	// token provided by its owner.
+	Description string `bson:",omitempty"`
+
+	// Entities holds the base URLs of the entities that the
+	// token may be used with.
+	Entities []*charm.URL
+
+	// Ops holds the operations that the token allows.
+	Ops []string
+
+	// Channels holds the channels that the token allows
+	// entities to be published to.
+	Channels []params.Channel `bson:",omitempty"`
+
+	// Created holds the time the token was created.
+	Created time.Time
+
+	// Expires holds the time the token expires. The zero
+	// time means that the token does not expire.
+	Expires time.Time `bson:",omitempty"`
+
+	// LastUsed holds the time the token was last used
+	// to authenticate a request.
+	LastUsed time.Time `bson:",omitempty"`
+}
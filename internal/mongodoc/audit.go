@@ -0,0 +1,65 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+import (
+	"time"
+
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// AuditEntry holds the in-database representation of an audit log
+// entry. See the audit package for a description of the fields.
+type AuditEntry struct {
+	Time   time.Time
+	User   string
+	Op     string
+	Entity *charm.URL `bson:",omitempty"`
+
+	// BaseURL holds the base URL of Entity, so that entries
+	// for all revisions of an entity can be found.
+	BaseURL *charm.URL `bson:",omitempty"`
+
+	ACL      *ACL   `bson:",omitempty"`
+	Channel  string `bson:",omitempty"`
+	Resource string `bson:",omitempty"`
+
+	// OldValue and NewValue hold the JSON-encoded values
+	// before and after the audited operation.
+	OldValue []byte `bson:",omitempty"`
+	NewValue []byte `bson:",omitempty"`
+
+	RemoteAddr string `bson:",omitempty"`
+	AuthMethod string `bson:",omitempty"`
+
+	// Seq holds the position of the entry in the audit log,
+	// starting at 1. Entries stored before the log was
+	// hash-chained have no sequence number.
+	Seq int64 `bson:",omitempty"`
+
+	// PrevHash holds the hex-encoded hash of the previous entry
+	// and Hash holds the hex-encoded SHA256 hash of the BSON
+	// encoding of this entry with Hash left empty.
+	PrevHash string `bson:",omitempty"`
+	Hash     string `bson:",omitempty"`
+}
+
+// AuditCheckpoint holds a signed record of the hash of an entry
+// in the audit log. Checkpoints allow the verification of the
+// hash chain up to the checkpointed entry by someone holding the
+// signing key, even if the entries themselves have been rewritten.
+type AuditCheckpoint struct {
+	// Seq holds the sequence number of the checkpointed entry.
+	Seq int64 `bson:"_id"`
+
+	// Hash holds the hash of the checkpointed entry.
+	Hash string
+
+	// Time holds the time the checkpoint was created.
+	Time time.Time
+
+	// Signature holds the hex-encoded HMAC-SHA256 signature
+	// of Seq and Hash.
+	Signature string
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc // import "gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+
+import (
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+)
+
+// Copy returns a copy of e whose fields, URLs, supported series and
+// published channels may be changed without affecting e. Other values
+// that e refers to, such as its charm metadata, are shared with e and
+// must not be changed.
+func (e *Entity) Copy() *Entity {
+	e1 := *e
+	e1.URL = copyURL(e.URL)
+	e1.PromulgatedURL = copyURL(e.PromulgatedURL)
+	if e.SupportedSeries != nil {
+		e1.SupportedSeries = append([]string(nil), e.SupportedSeries...)
+	}
+	if e.Published != nil {
+		e1.Published = make(map[params.Channel]bool, len(e.Published))
+		for ch, ok := range e.Published {
+			e1.Published[ch] = ok
+		}
+	}
+	return &e1
+}
+
+// Copy returns a copy of e whose fields, URL and per-channel maps may
+// be changed without affecting e. The values held in the maps, such as
+// ACLs, are shared with e and must not be changed.
+func (e *BaseEntity) Copy() *BaseEntity {
+	e1 := *e
+	e1.URL = copyURL(e.URL)
+	if e.ChannelACLs != nil {
+		e1.ChannelACLs = make(map[params.Channel]ACL, len(e.ChannelACLs))
+		for ch, acl := range e.ChannelACLs {
+			e1.ChannelACLs[ch] = acl
+		}
+	}
+	if e.ChannelEntities != nil {
+		e1.ChannelEntities = make(map[params.Channel]map[string]*charm.URL, len(e.ChannelEntities))
+		for ch, entities := range e.ChannelEntities {
+			if entities == nil {
+				e1.ChannelEntities[ch] = nil
+				continue
+			}
+			m := make(map[string]*charm.URL, len(entities))
+			for series, url := range entities {
+				m[series] = url
+			}
+			e1.ChannelEntities[ch] = m
+		}
+	}
+	if e.ChannelResources != nil {
+		e1.ChannelResources = make(map[params.Channel][]ResourceRevision, len(e.ChannelResources))
+		for ch, resources := range e.ChannelResources {
+			e1.ChannelResources[ch] = resources
+		}
+	}
+	return &e1
+}
+
+func copyURL(u *charm.URL) *charm.URL {
+	if u == nil {
+		return nil
+	}
+	u1 := *u
+	return &u1
+}
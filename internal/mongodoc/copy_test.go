@@ -0,0 +1,84 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+type CopySuite struct{}
+
+var _ = gc.Suite(&CopySuite{})
+
+func (*CopySuite) TestEntityCopy(c *gc.C) {
+	e := &mongodoc.Entity{
+		URL:             charm.MustParseURL("~bob/precise/wordpress-0"),
+		SupportedSeries: []string{"precise"},
+		ExtraInfo: map[string][]byte{
+			"key": []byte(`"value"`),
+		},
+		CharmMeta: &charm.Meta{
+			Name: "wordpress",
+			Provides: map[string]charm.Relation{
+				"url": {Name: "url", Interface: "http"},
+			},
+		},
+		Published: map[params.Channel]bool{
+			params.StableChannel: true,
+		},
+	}
+	e1 := e.Copy()
+	c.Assert(e1, jc.DeepEquals, e)
+
+	e1.URL.Revision = 1
+	e1.SupportedSeries[0] = "trusty"
+	e1.ExtraInfo = nil
+	e1.Published[params.EdgeChannel] = true
+	c.Assert(e.URL.String(), gc.Equals, "cs:~bob/precise/wordpress-0")
+	c.Assert(e.SupportedSeries, jc.DeepEquals, []string{"precise"})
+	c.Assert(string(e.ExtraInfo["key"]), gc.Equals, `"value"`)
+	c.Assert(e.Published, jc.DeepEquals, map[params.Channel]bool{
+		params.StableChannel: true,
+	})
+
+	// Other values are shared.
+	c.Assert(e1.CharmMeta, gc.Equals, e.CharmMeta)
+}
+
+func (*CopySuite) TestBaseEntityCopy(c *gc.C) {
+	be := &mongodoc.BaseEntity{
+		URL: charm.MustParseURL("~bob/wordpress"),
+		ChannelACLs: map[params.Channel]mongodoc.ACL{
+			params.StableChannel: {
+				Read: []string{"bob"},
+			},
+		},
+		ChannelEntities: map[params.Channel]map[string]*charm.URL{
+			params.StableChannel: {
+				"precise": charm.MustParseURL("~bob/precise/wordpress-0"),
+			},
+		},
+	}
+	be1 := be.Copy()
+	c.Assert(be1, jc.DeepEquals, be)
+
+	be1.URL.Name = "mysql"
+	be1.ChannelACLs[params.StableChannel] = mongodoc.ACL{
+		Read: []string{"alice"},
+	}
+	be1.ChannelACLs[params.EdgeChannel] = mongodoc.ACL{}
+	be1.ChannelEntities[params.StableChannel]["precise"] = charm.MustParseURL("~bob/precise/wordpress-1")
+	c.Assert(be.URL.String(), gc.Equals, "cs:~bob/wordpress")
+	c.Assert(be.ChannelACLs, jc.DeepEquals, map[params.Channel]mongodoc.ACL{
+		params.StableChannel: {
+			Read: []string{"bob"},
+		},
+	})
+	c.Assert(be.ChannelEntities[params.StableChannel]["precise"].String(), gc.Equals, "cs:~bob/precise/wordpress-0")
+}
@@ -87,6 +87,11 @@ type Entity struct {
 	// the entity. The byte slices hold JSON-encoded data.
 	ExtraInfo map[string][]byte `bson:",omitempty" json:",omitempty"`
 
+	// ReleaseNotes holds markdown-formatted notes describing
+	// what has changed in this revision of the entity. It may be
+	// provided when the entity is uploaded or published.
+	ReleaseNotes string `bson:",omitempty" json:",omitempty"`
+
 	// TODO(rog) verify that all these types marshal to the expected
 	// JSON form.
 	CharmMeta    *charm.Meta
@@ -198,6 +203,15 @@ type BaseEntity struct {
 	// at present, this signifies that someone has taken over control from
 	// the ingester.
 	NoIngest bool `bson:",omitempty"`
+
+	// UpdateCount holds the number of times that the base entity
+	// or any of its entities have been changed. It is used to
+	// validate cached metadata responses.
+	UpdateCount int `bson:",omitempty"`
+
+	// UpdateTime holds the time of the most recent change to the
+	// base entity or any of its entities.
+	UpdateTime time.Time `bson:",omitempty"`
 }
 
 // LatestRevision holds an entry in the revisions collection.
@@ -229,9 +243,29 @@ type ACL struct {
 	// Read holds users and groups that are allowed to read the charm
 	// or bundle.
 	Read []string
-	// Write holds users and groups that are allowed to upload/modify the charm
-	// or bundle.
+	// Write holds users and groups that are allowed to modify the charm
+	// or bundle, for instance by changing its extra-info.
 	Write []string
+
+	// Upload holds users and groups that are allowed to upload
+	// new revisions of the charm or bundle, which is checked against
+	// the ACL for the unpublished channel, and to upload resources
+	// and OCI images for it, which is checked against the ACL for
+	// the channel that the entity is resolved in.
+	Upload []string `bson:",omitempty"`
+
+	// Publish holds users and groups that are allowed to publish
+	// the charm or bundle to the channel that the ACL applies to.
+	Publish []string `bson:",omitempty"`
+
+	// SetPerm holds users and groups that are allowed to change
+	// the ACL.
+	SetPerm []string `bson:",omitempty"`
+
+	// Delete holds users and groups that are allowed to delete
+	// revisions of the charm or bundle, and its resources and
+	// OCI images.
+	Delete []string `bson:",omitempty"`
 }
 
 type FileId string
@@ -4,12 +4,15 @@
 package mongodoc_test
 
 import (
+	"time"
+
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/juju/charm.v6-unstable"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 	"gopkg.in/mgo.v2/bson"
 
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 )
 
@@ -105,3 +108,42 @@ func (s *DocSuite) TestPreferredURL(c *gc.C) {
 		c.Assert(test.entity.PreferredURL(false).Series, gc.Not(gc.Equals), "foo")
 	}
 }
+
+func (s *DocSuite) TestEntityFields(c *gc.C) {
+	for i, test := range []struct {
+		doc    interface{}
+		schema *fieldset.Schema
+	}{{
+		doc: &mongodoc.Entity{
+			URL:            charm.MustParseURL("~bob/precise/wordpress-1"),
+			PromulgatedURL: charm.MustParseURL("precise/wordpress-2"),
+			ExtraInfo:      map[string][]byte{"a": []byte("b")},
+			ReleaseNotes:   "notes",
+			Published:      map[params.Channel]bool{params.StableChannel: true},
+		},
+		schema: mongodoc.EntityFields,
+	}, {
+		doc: &mongodoc.BaseEntity{
+			URL:         charm.MustParseURL("~bob/wordpress"),
+			CommonInfo:  map[string][]byte{"a": []byte("b")},
+			NoIngest:    true,
+			UpdateCount: 1,
+			UpdateTime:  time.Now(),
+		},
+		schema: mongodoc.BaseEntityFields,
+	}} {
+		c.Logf("test %d: %T", i, test.doc)
+		b, err := bson.Marshal(test.doc)
+		c.Assert(err, gc.Equals, nil)
+		var doc bson.M
+		err = bson.Unmarshal(b, &doc)
+		c.Assert(err, gc.Equals, nil)
+		selector := make(map[string]int)
+		for name := range doc {
+			selector[name] = 1
+		}
+		set, ok := test.schema.FromSelector(selector)
+		c.Assert(ok, gc.Equals, true, gc.Commentf("fields %v", selector))
+		c.Assert(test.schema.Selector(set), jc.DeepEquals, selector)
+	}
+}
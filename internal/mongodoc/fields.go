@@ -0,0 +1,40 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc // import "gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+
+import (
+	"reflect"
+	"strings"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
+)
+
+// EntityFields holds the schema of the fields of Entity documents.
+var EntityFields = fieldset.NewSchema(bsonFieldNames(Entity{})...)
+
+// BaseEntityFields holds the schema of the fields of BaseEntity
+// documents.
+var BaseEntityFields = fieldset.NewSchema(bsonFieldNames(BaseEntity{})...)
+
+// bsonFieldNames returns the names of the document fields that the
+// bson package uses for the fields of the given struct.
+func bsonFieldNames(x interface{}) []string {
+	t := reflect.TypeOf(x)
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("bson")
+		if i := strings.Index(name, ","); i >= 0 {
+			name = name[:i]
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		names = append(names, name)
+	}
+	return names
+}
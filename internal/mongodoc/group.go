@@ -0,0 +1,15 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+// Group holds a group of users managed by the charm store itself,
+// which can be used in ACLs when group membership is not provided
+// by the identity manager.
+type Group struct {
+	// Name holds the name of the group.
+	Name string `bson:"_id"`
+
+	// Members holds the names of the users in the group.
+	Members []string
+}
@@ -0,0 +1,34 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+import (
+	"time"
+
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// OCIBlob holds the in-database representation of a blob (an image
+// layer or configuration) referred to by the manifest of an OCI image
+// resource. The combination of BaseURL and Digest provide a unique key
+// for a blob.
+type OCIBlob struct {
+	// BaseURL identifies the base URL of the charm associated with
+	// this blob.
+	BaseURL *charm.URL
+
+	// Digest holds the OCI content digest of the blob,
+	// for example "sha256:2c26b4...".
+	Digest string
+
+	// BlobHash holds the hash checksum of the blob, in hexadecimal
+	// format, as created by blobstore.NewHash.
+	BlobHash string
+
+	// Size holds the size of the blob in bytes.
+	Size int64 `bson:"size"`
+
+	// UploadTime holds the time the blob was last uploaded.
+	UploadTime time.Time
+}
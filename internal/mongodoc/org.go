@@ -0,0 +1,73 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+// Org holds an organisation, which owns the namespace with the same
+// name as the organisation. Members of an organisation are treated
+// as members of a group with the organisation's name when checking
+// ACLs.
+type Org struct {
+	// Name holds the name of the organisation, which is also
+	// the user part of the ids of entities in its namespace.
+	Name string `bson:"_id"`
+
+	// Members holds the members of the organisation.
+	Members []OrgMember
+
+	// DefaultACL holds the ACL given to all the channels of new
+	// base entities created in the organisation's namespace. An
+	// empty read field defaults to the organisation's name, which
+	// allows access to all its members; the other empty fields
+	// default to the members with the admin or uploader role.
+	DefaultACL ACL
+}
+
+// OrgMember holds a member of an organisation.
+type OrgMember struct {
+	// User holds the name of the user.
+	User string
+
+	// Role holds the role of the user within the organisation.
+	Role OrgRole
+}
+
+// OrgRole represents the role of a member of an organisation.
+type OrgRole string
+
+const (
+	// OrgAdmin is the role of members that can manage the
+	// organisation and create new entities in its namespace.
+	OrgAdmin OrgRole = "admin"
+
+	// OrgUploader is the role of members that can create new
+	// entities in the organisation's namespace.
+	OrgUploader OrgRole = "uploader"
+
+	// OrgMemberRole is the role of members that have no special
+	// privileges other than those granted to the organisation in
+	// ACLs.
+	OrgMemberRole OrgRole = "member"
+)
+
+// ValidOrgRoles holds the set of all valid organisation roles.
+var ValidOrgRoles = map[OrgRole]bool{
+	OrgAdmin:      true,
+	OrgUploader:   true,
+	OrgMemberRole: true,
+}
+
+// UsersWithRole returns the names of the members of the
+// organisation that have any of the given roles.
+func (o *Org) UsersWithRole(roles ...OrgRole) []string {
+	users := make([]string, 0, len(o.Members))
+	for _, m := range o.Members {
+		for _, r := range roles {
+			if m.Role == r {
+				users = append(users, m.User)
+				break
+			}
+		}
+	}
+	return users
+}
@@ -0,0 +1,21 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+import (
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// Redirect holds an entry in the redirects collection. It is left
+// behind when a base entity is transferred to another namespace so
+// that its old URL continues to resolve.
+type Redirect struct {
+	// URL holds the base URL that the base entity was transferred
+	// from, for instance cs:~alice/foo.
+	URL *charm.URL `bson:"_id"`
+
+	// To holds the base URL that the base entity was transferred
+	// to, for instance cs:~team/foo.
+	To *charm.URL
+}
@@ -4,6 +4,7 @@
 package mongodoc
 
 import (
+	"strings"
 	"time"
 
 	"gopkg.in/errgo.v1"
@@ -39,12 +40,33 @@ type Resource struct {
 	// UploadTime is the is the time the resource file was stored in
 	// the blob store.
 	UploadTime time.Time
+
+	// BlobHash256 holds the SHA256 hash of the resource file, in
+	// hexadecimal format. It may be empty for resources uploaded
+	// before it was recorded.
+	BlobHash256 string `bson:",omitempty"`
+
+	// Uploader holds the name of the user that uploaded the resource.
+	Uploader string `bson:",omitempty"`
+
+	// Description holds an optional description of this revision
+	// of the resource, as provided by the uploader.
+	Description string `bson:",omitempty"`
+
+	// Metadata holds arbitrary key/value metadata associated
+	// with this revision of the resource.
+	Metadata map[string]string `bson:",omitempty"`
 }
 
 // MultipartIndex holds the index of all the parts of a multipart blob.
 type MultipartIndex struct {
 	Sizes  []uint32
 	Hashes Hashes
+
+	// Hash256 holds the SHA256 hash of the whole blob, in
+	// hexadecimal format. It may be empty for uploads completed
+	// before it was recorded.
+	Hash256 string `bson:",omitempty"`
 }
 
 // Validate ensures that the doc is valid.
@@ -81,5 +103,11 @@ func (doc *Resource) Validate() error {
 		return errgo.New("missing upload timestamp")
 	}
 
+	for key := range doc.Metadata {
+		if key == "" || strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			return errgo.Newf("invalid metadata key %q", key)
+		}
+	}
+
 	return nil
 }
@@ -123,6 +123,49 @@ var validateTests = []struct {
 		Size:     12,
 	},
 	expectError: `missing upload timestamp`,
+}, {
+	about: "good resource with metadata",
+	resource: &mongodoc.Resource{
+		BaseURL:     charm.MustParseURL("cs:spam"),
+		Name:        "spam",
+		Revision:    1,
+		BlobHash:    fakeBlobHash,
+		Size:        12,
+		UploadTime:  time.Now().UTC(),
+		Uploader:    "bob",
+		Description: "more spam",
+		Metadata: map[string]string{
+			"arch": "amd64",
+		},
+	},
+}, {
+	about: "metadata key with dot",
+	resource: &mongodoc.Resource{
+		BaseURL:    charm.MustParseURL("cs:spam"),
+		Name:       "spam",
+		Revision:   1,
+		BlobHash:   fakeBlobHash,
+		Size:       12,
+		UploadTime: time.Now().UTC(),
+		Metadata: map[string]string{
+			"a.b": "c",
+		},
+	},
+	expectError: `invalid metadata key "a.b"`,
+}, {
+	about: "metadata key with dollar prefix",
+	resource: &mongodoc.Resource{
+		BaseURL:    charm.MustParseURL("cs:spam"),
+		Name:       "spam",
+		Revision:   1,
+		BlobHash:   fakeBlobHash,
+		Size:       12,
+		UploadTime: time.Now().UTC(),
+		Metadata: map[string]string{
+			"$set": "c",
+		},
+	},
+	expectError: `invalid metadata key "\$set"`,
 }}
 
 func (s *ResourceSuite) TestValidate(c *gc.C) {
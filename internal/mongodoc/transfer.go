@@ -0,0 +1,22 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+import (
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// Transfer holds an entry in the transfers collection. It records a
+// transfer of a base entity to another namespace while the transfer
+// is in progress, so that an interrupted transfer can be completed
+// by running it again.
+type Transfer struct {
+	// URL holds the base URL that the base entity is being
+	// transferred from, for instance cs:~alice/foo.
+	URL *charm.URL `bson:"_id"`
+
+	// To holds the base URL that the base entity is being
+	// transferred to, for instance cs:~team/foo.
+	To *charm.URL
+}
@@ -49,6 +49,20 @@ var (
 		Name:      "mean_blob_size",
 		Help:      "The mean stored blob size",
 	})
+
+	throttledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "charmstore",
+		Subsystem: "ratelimit",
+		Name:      "throttled_requests_total",
+		Help:      "The number of requests rejected because of rate limits.",
+	}, []string{"kind", "key"})
+
+	auditFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "charmstore",
+		Subsystem: "audit",
+		Name:      "failures_total",
+		Help:      "The number of audit log entries that could not be recorded.",
+	}, []string{"destination"})
 )
 
 // BlobStats holds statistics about blobs in the blob store.
@@ -69,6 +83,20 @@ func SetBlobStoreStats(s BlobStats) {
 	meanBlobSize.Set(float64(s.MeanSize))
 }
 
+// RecordThrottledRequest records that a request of the given kind was
+// rejected because of a rate limit. The key parameter holds what the
+// limit was applied to, either "user" or "ip".
+func RecordThrottledRequest(kind, key string) {
+	throttledRequests.WithLabelValues(kind, key).Inc()
+}
+
+// RecordAuditFailure records that an audit log entry could not be
+// recorded. The destination parameter holds where the entry was being
+// written, either "mongodb" or "file".
+func RecordAuditFailure(destination string) {
+	auditFailures.WithLabelValues(destination).Inc()
+}
+
 func init() {
 	prometheus.MustRegister(requestDuration)
 	prometheus.MustRegister(uploadProcessingDuration)
@@ -76,5 +104,7 @@ func init() {
 	prometheus.MustRegister(blobCount)
 	prometheus.MustRegister(maxBlobSize)
 	prometheus.MustRegister(meanBlobSize)
+	prometheus.MustRegister(throttledRequests)
+	prometheus.MustRegister(auditFailures)
 	prometheus.MustRegister(monitoring.NewMgoStatsCollector("charmstore"))
 }
@@ -0,0 +1,228 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package oidc // import "gopkg.in/juju/charmstore.v5-unstable/internal/oidc"
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// keySetMaxAge holds the maximum length of time that a fetched
+	// key set is used before it is fetched again.
+	keySetMaxAge = time.Hour
+
+	// keySetMinRefresh holds the minimum length of time between
+	// fetches of the key set triggered by tokens signed with
+	// unknown keys, so that bad tokens cannot be used to flood
+	// the issuer with requests.
+	keySetMinRefresh = time.Minute
+)
+
+// jsonWebKeySet holds a JSON Web Key Set as defined by RFC 7517.
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// jsonWebKey holds the fields of a JSON Web Key that are used to
+// verify signatures.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA keys.
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// Elliptic curve keys.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey holds a key that can be used to verify token signatures.
+type publicKey struct {
+	id  string
+	alg string
+	key crypto.PublicKey
+}
+
+// parseKeySet parses the given JSON Web Key Set. Keys that are not
+// used for signatures or have an unsupported type are ignored.
+func parseKeySet(data []byte) ([]publicKey, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal key set")
+	}
+	keys := make([]publicKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaKey()
+		case "EC":
+			key, err = k.ecdsaKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid key %q", k.Kid)
+		}
+		keys = append(keys, publicKey{
+			id:  k.Kid,
+			alg: k.Alg,
+			key: key,
+		})
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) rsaKey() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid modulus")
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid exponent")
+	}
+	if e.BitLen() > 31 {
+		return nil, errgo.New("exponent too large")
+	}
+	return &rsa.PublicKey{
+		N: n,
+		E: int(e.Int64()),
+	}, nil
+}
+
+func (k *jsonWebKey) ecdsaKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errgo.Newf("unsupported curve %q", k.Crv)
+	}
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid x coordinate")
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid y coordinate")
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errgo.New("point not on curve")
+	}
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     x,
+		Y:     y,
+	}, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(data) == 0 {
+		return nil, errgo.New("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// keySet holds the keys of an issuer, fetching them when required.
+type keySet struct {
+	// fetch fetches the current keys of the issuer.
+	// It is nil when the keys are configured statically.
+	fetch func() ([]publicKey, error)
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// keys holds the most recently fetched keys.
+	keys []publicKey
+
+	// fetched holds when the keys were last fetched.
+	fetched time.Time
+}
+
+// get returns the keys that can be used to verify a token signed
+// with the key with the given id. If the id is not known, the keys
+// are fetched again, subject to keySetMinRefresh.
+func (s *keySet) get(kid string) ([]publicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetch == nil {
+		return s.keys, nil
+	}
+	now := timeNow()
+	refresh := s.keys == nil || now.Sub(s.fetched) > keySetMaxAge
+	if !refresh && kid != "" && !hasKey(s.keys, kid) {
+		// The issuer may have rotated its keys.
+		refresh = now.Sub(s.fetched) > keySetMinRefresh
+	}
+	if refresh {
+		keys, err := s.fetch()
+		if err != nil {
+			if s.keys == nil {
+				return nil, errgo.Mask(err)
+			}
+			// Carry on using the keys we already have.
+			logger.Errorf("cannot refresh OpenID Connect keys: %v", err)
+		} else {
+			s.keys = keys
+		}
+		s.fetched = now
+	}
+	return s.keys, nil
+}
+
+func hasKey(keys []publicKey, kid string) bool {
+	for _, k := range keys {
+		if k.id == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// getJSON fetches the given URL and unmarshals the JSON response
+// into v.
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errgo.Newf("GET %s: unexpected status %q", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errgo.Notef(err, "cannot unmarshal response from %s", url)
+	}
+	return nil
+}
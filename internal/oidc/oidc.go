@@ -0,0 +1,327 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package oidc verifies OpenID Connect ID tokens so that they can be
+// used to authenticate requests to the charm store.
+package oidc // import "gopkg.in/juju/charmstore.v5-unstable/internal/oidc"
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+)
+
+var logger = loggo.GetLogger("charmstore.internal.oidc")
+
+// timeNow is defined as a variable so that it can be overridden in tests.
+var timeNow = time.Now
+
+const (
+	defaultUsernameClaim = "sub"
+	defaultGroupsClaim   = "groups"
+
+	// clockSkew holds the tolerance allowed when checking the
+	// time-related claims of a token.
+	clockSkew = time.Minute
+)
+
+// ErrInvalidToken is the error cause used when an ID token cannot
+// be used for authentication.
+var ErrInvalidToken = errgo.New("invalid ID token")
+
+// Params holds the parameters for NewVerifier.
+type Params struct {
+	// Issuer holds the issuer identifier of the OpenID Connect
+	// provider. Only tokens with a matching "iss" claim are accepted.
+	Issuer string
+
+	// ClientID holds the client identifier that tokens must
+	// be issued for, as specified by their "aud" claim.
+	ClientID string
+
+	// JWKSURL holds the URL of the JSON Web Key Set used to verify
+	// token signatures. If this and Keys are empty, the URL is
+	// discovered from the issuer's OpenID provider configuration.
+	JWKSURL string
+
+	// Keys holds a JSON Web Key Set used to verify token
+	// signatures. If it is set, keys are never fetched from
+	// the issuer.
+	Keys []byte
+
+	// UsernameClaim holds the claim holding the name of the
+	// user. It defaults to "sub".
+	UsernameClaim string
+
+	// GroupsClaim holds the claim holding the groups that the
+	// user is a member of. It defaults to "groups".
+	GroupsClaim string
+
+	// Client holds the HTTP client used to fetch keys.
+	// If it is nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Identity holds the identity asserted by a verified ID token.
+type Identity struct {
+	// Username holds the name of the user.
+	Username string
+
+	// Groups holds the groups that the user is a member of.
+	Groups []string
+}
+
+// Verifier verifies ID tokens issued by an OpenID Connect provider.
+type Verifier struct {
+	params Params
+	keys   *keySet
+}
+
+// NewVerifier returns a new Verifier that verifies the tokens
+// issued by the provider described by p. Keys are fetched from the
+// provider when they are first needed.
+func NewVerifier(p Params) (*Verifier, error) {
+	if p.Issuer == "" {
+		return nil, errgo.New("no issuer specified")
+	}
+	if p.ClientID == "" {
+		return nil, errgo.New("no client id specified")
+	}
+	if p.UsernameClaim == "" {
+		p.UsernameClaim = defaultUsernameClaim
+	}
+	if p.GroupsClaim == "" {
+		p.GroupsClaim = defaultGroupsClaim
+	}
+	if p.Client == nil {
+		p.Client = http.DefaultClient
+	}
+	v := &Verifier{
+		params: p,
+		keys:   new(keySet),
+	}
+	if len(p.Keys) > 0 {
+		keys, err := parseKeySet(p.Keys)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		v.keys.keys = keys
+	} else {
+		v.keys.fetch = v.fetchKeys
+	}
+	return v, nil
+}
+
+// fetchKeys fetches the key set of the issuer, discovering its
+// location if required.
+func (v *Verifier) fetchKeys() ([]publicKey, error) {
+	url := v.params.JWKSURL
+	if url == "" {
+		var config struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(v.params.Client, strings.TrimSuffix(v.params.Issuer, "/")+"/.well-known/openid-configuration", &config); err != nil {
+			return nil, errgo.Notef(err, "cannot discover OpenID provider configuration")
+		}
+		if config.Issuer != v.params.Issuer {
+			return nil, errgo.Newf("provider configuration has unexpected issuer %q", config.Issuer)
+		}
+		if config.JWKSURI == "" {
+			return nil, errgo.New("provider configuration has no key set URL")
+		}
+		url = config.JWKSURI
+	}
+	var set json.RawMessage
+	if err := getJSON(v.params.Client, url, &set); err != nil {
+		return nil, errgo.Notef(err, "cannot fetch key set")
+	}
+	keys, err := parseKeySet(set)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return keys, nil
+}
+
+// Verify verifies the given ID token and returns the identity that it
+// asserts. If the token is not valid, it returns an error with an
+// ErrInvalidToken cause.
+func (v *Verifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid signature encoding")
+	}
+	alg, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "unsupported signing algorithm %q", header.Alg)
+	}
+	keys, err := v.keys.get(header.Kid)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get keys")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.id != header.Kid || k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if alg.verify(k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "signature verification failed")
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid claims: %v", err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrInvalidToken))
+	}
+	return v.identity(claims)
+}
+
+// checkClaims checks the registered claims of a token.
+func (v *Verifier) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); iss != v.params.Issuer {
+		return errgo.WithCausef(nil, ErrInvalidToken, "unexpected issuer %q", iss)
+	}
+	if !hasAudience(claims["aud"], v.params.ClientID) {
+		return errgo.WithCausef(nil, ErrInvalidToken, "token not issued for %q", v.params.ClientID)
+	}
+	now := timeNow()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errgo.WithCausef(nil, ErrInvalidToken, "no expiry time")
+	}
+	if now.Add(-clockSkew).After(unixTime(exp)) {
+		return errgo.WithCausef(nil, ErrInvalidToken, "token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(unixTime(nbf)) {
+		return errgo.WithCausef(nil, ErrInvalidToken, "token not yet valid")
+	}
+	return nil
+}
+
+// identity returns the identity asserted by the given claims.
+func (v *Verifier) identity(claims map[string]interface{}) (*Identity, error) {
+	username, _ := claims[v.params.UsernameClaim].(string)
+	if username == "" {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "no %q claim", v.params.UsernameClaim)
+	}
+	var groups []string
+	switch g := claims[v.params.GroupsClaim].(type) {
+	case nil:
+	case string:
+		groups = []string{g}
+	case []interface{}:
+		groups = make([]string, 0, len(g))
+		for _, name := range g {
+			s, ok := name.(string)
+			if !ok {
+				return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid %q claim", v.params.GroupsClaim)
+			}
+			groups = append(groups, s)
+		}
+	default:
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid %q claim", v.params.GroupsClaim)
+	}
+	return &Identity{
+		Username: username,
+		Groups:   groups,
+	}, nil
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unixTime(t float64) time.Time {
+	return time.Unix(int64(t), 0)
+}
+
+func decodeSegment(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// algorithm holds a supported signing algorithm.
+type algorithm struct {
+	hash  crypto.Hash
+	ecdsa bool
+}
+
+// algorithms holds the supported signing algorithms. Symmetric
+// algorithms and "none" are deliberately not supported.
+var algorithms = map[string]algorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"ES256": {hash: crypto.SHA256, ecdsa: true},
+	"ES384": {hash: crypto.SHA384, ecdsa: true},
+	"ES512": {hash: crypto.SHA512, ecdsa: true},
+}
+
+// verify reports whether sig is a valid signature of data made
+// with the private key corresponding to the given key.
+func (a algorithm) verify(key crypto.PublicKey, data, sig []byte) bool {
+	h := a.hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if a.ecdsa {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(key, a.hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		if !a.ecdsa {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
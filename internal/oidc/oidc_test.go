@@ -0,0 +1,352 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package oidc_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/oidc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/oidc/oidctest"
+)
+
+type oidcSuite struct {
+	jujutesting.IsolationSuite
+	issuer *oidctest.Issuer
+}
+
+var _ = gc.Suite(&oidcSuite{})
+
+func (s *oidcSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.issuer = oidctest.NewIssuer("charmstore")
+}
+
+func (s *oidcSuite) TearDownTest(c *gc.C) {
+	s.issuer.Close()
+	s.IsolationSuite.TearDownTest(c)
+}
+
+func (s *oidcSuite) newVerifier(c *gc.C) *oidc.Verifier {
+	v, err := oidc.NewVerifier(oidc.Params{
+		Issuer:   s.issuer.URL,
+		ClientID: "charmstore",
+	})
+	c.Assert(err, gc.Equals, nil)
+	return v
+}
+
+func (s *oidcSuite) TestVerifyWithDiscoveredKeys(c *gc.C) {
+	v := s.newVerifier(c)
+	ident, err := v.Verify(s.issuer.Token("bob", "team-x", "team-y"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ident, jc.DeepEquals, &oidc.Identity{
+		Username: "bob",
+		Groups:   []string{"team-x", "team-y"},
+	})
+	ident, err = v.Verify(s.issuer.Token("alice"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ident, jc.DeepEquals, &oidc.Identity{
+		Username: "alice",
+	})
+	// The keys are only fetched once.
+	c.Assert(s.issuer.KeySetRequests(), gc.Equals, 1)
+}
+
+func (s *oidcSuite) TestVerifyWithStaticKeys(c *gc.C) {
+	v, err := oidc.NewVerifier(oidc.Params{
+		Issuer:   s.issuer.URL,
+		ClientID: "charmstore",
+		Keys:     s.issuer.KeySet(),
+	})
+	c.Assert(err, gc.Equals, nil)
+	ident, err := v.Verify(s.issuer.Token("bob"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ident.Username, gc.Equals, "bob")
+	c.Assert(s.issuer.KeySetRequests(), gc.Equals, 0)
+
+	// Static keys are never refreshed.
+	s.issuer.RotateKey()
+	_, err = v.Verify(s.issuer.Token("bob"))
+	c.Assert(err, gc.ErrorMatches, "signature verification failed")
+	c.Assert(errgo.Cause(err), gc.Equals, oidc.ErrInvalidToken)
+}
+
+func (s *oidcSuite) TestVerifyWithCustomClaims(c *gc.C) {
+	v, err := oidc.NewVerifier(oidc.Params{
+		Issuer:        s.issuer.URL,
+		ClientID:      "charmstore",
+		JWKSURL:       s.issuer.JWKSURL(),
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "roles",
+	})
+	c.Assert(err, gc.Equals, nil)
+	ident, err := v.Verify(s.issuer.Sign(map[string]interface{}{
+		"iss":                s.issuer.URL,
+		"aud":                []string{"other", "charmstore"},
+		"sub":                "1234",
+		"preferred_username": "bob",
+		"roles":              "admin",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	}))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ident, jc.DeepEquals, &oidc.Identity{
+		Username: "bob",
+		Groups:   []string{"admin"},
+	})
+}
+
+func (s *oidcSuite) TestKeyRotation(c *gc.C) {
+	now := time.Now()
+	s.PatchValue(oidc.TimeNow, func() time.Time { return now })
+	v := s.newVerifier(c)
+	_, err := v.Verify(s.issuer.Token("bob"))
+	c.Assert(err, gc.Equals, nil)
+
+	// A token signed with an unknown key does not cause the
+	// keys to be fetched again straight away.
+	s.issuer.RotateKey()
+	_, err = v.Verify(s.issuer.Token("bob"))
+	c.Assert(err, gc.ErrorMatches, "signature verification failed")
+	c.Assert(s.issuer.KeySetRequests(), gc.Equals, 1)
+
+	now = now.Add(2 * time.Minute)
+	_, err = v.Verify(s.issuer.Token("bob"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(s.issuer.KeySetRequests(), gc.Equals, 2)
+}
+
+func (s *oidcSuite) TestVerifyECDSA(c *gc.C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.Equals, nil)
+	keys, err := json.Marshal(map[string]interface{}{
+		"keys": []interface{}{map[string]string{
+			"kty": "EC",
+			"kid": "ec",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}},
+	})
+	c.Assert(err, gc.Equals, nil)
+	v, err := oidc.NewVerifier(oidc.Params{
+		Issuer:   "https://issuer.example.com",
+		ClientID: "charmstore",
+		Keys:     keys,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	signed := segment(map[string]string{"alg": "ES256", "kid": "ec"}) + "." + segment(map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": "charmstore",
+		"sub": "bob",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	r, sv, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	c.Assert(err, gc.Equals, nil)
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), sv.Bytes()
+	copy(sig[32-len(rb):], rb)
+	copy(sig[64-len(sb):], sb)
+
+	ident, err := v.Verify(signed + "." + base64.RawURLEncoding.EncodeToString(sig))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ident.Username, gc.Equals, "bob")
+
+	sig[0] ^= 0xff
+	_, err = v.Verify(signed + "." + base64.RawURLEncoding.EncodeToString(sig))
+	c.Assert(err, gc.ErrorMatches, "signature verification failed")
+}
+
+var invalidTokenTests = []struct {
+	about       string
+	claims      func(iss string) map[string]interface{}
+	token       func(good string) string
+	expectError string
+}{{
+	about: "wrong issuer",
+	claims: func(iss string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": "https://other.example.com",
+			"aud": "charmstore",
+			"sub": "bob",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	},
+	expectError: `unexpected issuer "https://other.example.com"`,
+}, {
+	about: "wrong audience",
+	claims: func(iss string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": iss,
+			"aud": "other",
+			"sub": "bob",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	},
+	expectError: `token not issued for "charmstore"`,
+}, {
+	about: "expired",
+	claims: func(iss string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": iss,
+			"aud": "charmstore",
+			"sub": "bob",
+			"exp": time.Now().Add(-time.Hour).Unix(),
+		}
+	},
+	expectError: `token expired`,
+}, {
+	about: "no expiry",
+	claims: func(iss string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": iss,
+			"aud": "charmstore",
+			"sub": "bob",
+		}
+	},
+	expectError: `no expiry time`,
+}, {
+	about: "not yet valid",
+	claims: func(iss string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": iss,
+			"aud": "charmstore",
+			"sub": "bob",
+			"nbf": time.Now().Add(time.Hour).Unix(),
+			"exp": time.Now().Add(2 * time.Hour).Unix(),
+		}
+	},
+	expectError: `token not yet valid`,
+}, {
+	about: "no username",
+	claims: func(iss string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": iss,
+			"aud": "charmstore",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	},
+	expectError: `no "sub" claim`,
+}, {
+	about: "invalid groups",
+	claims: func(iss string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    iss,
+			"aud":    "charmstore",
+			"sub":    "bob",
+			"groups": []int{1, 2},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+	},
+	expectError: `invalid "groups" claim`,
+}, {
+	about: "malformed",
+	token: func(good string) string {
+		return "not-a-token"
+	},
+	expectError: `malformed token`,
+}, {
+	about: "modified claims",
+	token: func(good string) string {
+		parts := strings.Split(good, ".")
+		parts[1] = segment(map[string]interface{}{"sub": "admin"})
+		return strings.Join(parts, ".")
+	},
+	expectError: `signature verification failed`,
+}, {
+	about: "unsigned",
+	token: func(good string) string {
+		parts := strings.Split(good, ".")
+		return segment(map[string]string{"alg": "none"}) + "." + parts[1] + "."
+	},
+	expectError: `unsupported signing algorithm "none"`,
+}, {
+	about: "symmetric algorithm",
+	token: func(good string) string {
+		parts := strings.Split(good, ".")
+		parts[0] = segment(map[string]string{"alg": "HS256"})
+		return strings.Join(parts, ".")
+	},
+	expectError: `unsupported signing algorithm "HS256"`,
+}}
+
+func (s *oidcSuite) TestInvalidTokens(c *gc.C) {
+	v := s.newVerifier(c)
+	for i, test := range invalidTokenTests {
+		c.Logf("test %d: %s", i, test.about)
+		var token string
+		if test.claims != nil {
+			token = s.issuer.Sign(test.claims(s.issuer.URL))
+		} else {
+			token = test.token(s.issuer.Token("bob"))
+		}
+		ident, err := v.Verify(token)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, oidc.ErrInvalidToken)
+		c.Assert(ident, gc.IsNil)
+	}
+}
+
+func (s *oidcSuite) TestUnavailableIssuer(c *gc.C) {
+	iss := oidctest.NewIssuer("charmstore")
+	v, err := oidc.NewVerifier(oidc.Params{
+		Issuer:   iss.URL,
+		ClientID: "charmstore",
+	})
+	c.Assert(err, gc.Equals, nil)
+	token := iss.Token("bob")
+	iss.Close()
+	_, err = v.Verify(token)
+	c.Assert(err, gc.ErrorMatches, `cannot get keys: cannot discover OpenID provider configuration: .*`)
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), oidc.ErrInvalidToken)
+}
+
+var newVerifierErrorTests = []struct {
+	params      oidc.Params
+	expectError string
+}{{
+	params:      oidc.Params{ClientID: "charmstore"},
+	expectError: "no issuer specified",
+}, {
+	params:      oidc.Params{Issuer: "https://issuer.example.com"},
+	expectError: "no client id specified",
+}, {
+	params: oidc.Params{
+		Issuer:   "https://issuer.example.com",
+		ClientID: "charmstore",
+		Keys:     []byte(`{"keys": [{"kty": "RSA", "kid": "bad", "n": "", "e": "AQAB"}]}`),
+	},
+	expectError: `invalid key "bad": invalid modulus: empty value`,
+}}
+
+func (s *oidcSuite) TestNewVerifierError(c *gc.C) {
+	for i, test := range newVerifierErrorTests {
+		c.Logf("test %d: %s", i, test.expectError)
+		_, err := oidc.NewVerifier(test.params)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+	}
+}
+
+func segment(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal segment: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package oidctest provides a stand-in OpenID Connect issuer for
+// use in tests.
+package oidctest // import "gopkg.in/juju/charmstore.v5-unstable/internal/oidc/oidctest"
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Issuer is a stand-in OpenID Connect issuer. It serves its provider
+// configuration and key set over HTTP and issues ID tokens signed
+// with RS256.
+type Issuer struct {
+	// URL holds the issuer identifier, which is also the
+	// root URL of its HTTP server.
+	URL string
+
+	// ClientID holds the audience of the tokens issued
+	// by Token.
+	ClientID string
+
+	srv *httptest.Server
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// key holds the current signing key.
+	key *rsa.PrivateKey
+
+	// keyId holds the id of the current signing key.
+	keyId string
+
+	// keyCount holds the number of keys generated.
+	keyCount int
+
+	// keySetRequests holds the number of times the
+	// key set has been fetched.
+	keySetRequests int
+}
+
+// NewIssuer returns a new issuer that issues tokens for the
+// given client id. The issuer should be closed after use.
+func NewIssuer(clientID string) *Issuer {
+	iss := &Issuer{
+		ClientID: clientID,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", iss.serveConfiguration)
+	mux.HandleFunc("/keys", iss.serveKeys)
+	iss.srv = httptest.NewServer(mux)
+	iss.URL = iss.srv.URL
+	iss.RotateKey()
+	return iss
+}
+
+// Close shuts down the issuer's HTTP server.
+func (iss *Issuer) Close() {
+	iss.srv.Close()
+}
+
+// JWKSURL returns the URL of the issuer's key set.
+func (iss *Issuer) JWKSURL() string {
+	return iss.URL + "/keys"
+}
+
+// RotateKey replaces the issuer's signing key with a new one.
+func (iss *Issuer) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keyCount++
+	iss.key = key
+	iss.keyId = fmt.Sprintf("key-%d", iss.keyCount)
+}
+
+// KeySetRequests returns the number of times that the
+// issuer's key set has been fetched.
+func (iss *Issuer) KeySetRequests() int {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	return iss.keySetRequests
+}
+
+// KeySet returns the issuer's current JSON Web Key Set.
+func (iss *Issuer) KeySet() []byte {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	data, err := json.Marshal(map[string]interface{}{
+		"keys": []interface{}{map[string]string{
+			"kty": "RSA",
+			"kid": iss.keyId,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encodeBigInt(iss.key.N),
+			"e":   encodeBigInt(big.NewInt(int64(iss.key.E))),
+		}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Token returns an ID token for the given user and groups that
+// expires in an hour.
+func (iss *Issuer) Token(username string, groups ...string) string {
+	claims := map[string]interface{}{
+		"iss": iss.URL,
+		"aud": iss.ClientID,
+		"sub": username,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	if len(groups) > 0 {
+		claims["groups"] = groups
+	}
+	return iss.Sign(claims)
+}
+
+// Sign returns a token holding the given claims, signed with the
+// issuer's current key.
+func (iss *Issuer) Sign(claims map[string]interface{}) string {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	header := encodeSegment(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": iss.keyId,
+	})
+	signed := header + "." + encodeSegment(claims)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (iss *Issuer) serveConfiguration(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":   iss.URL,
+		"jwks_uri": iss.JWKSURL(),
+	})
+}
+
+func (iss *Issuer) serveKeys(w http.ResponseWriter, req *http.Request) {
+	iss.mu.Lock()
+	iss.keySetRequests++
+	iss.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(iss.KeySet())
+}
+
+func encodeSegment(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
@@ -0,0 +1,13 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ratelimit
+
+var TimeNow = &timeNow
+
+// NumBuckets returns the number of buckets held by the limiter.
+func NumBuckets(l *Limiter) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package ratelimit implements token bucket rate limits on
+// requests with arbitrary keys, such as user names or client
+// addresses.
+package ratelimit // import "gopkg.in/juju/charmstore.v5-unstable/internal/ratelimit"
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval holds the minimum interval between removals of
+// the buckets that no longer need to be remembered.
+const sweepInterval = time.Minute
+
+// timeNow is defined as a variable so that it can be overridden in tests.
+var timeNow = time.Now
+
+// Limit holds the parameters of a token bucket rate limit.
+type Limit struct {
+	// Rate holds the average number of requests per second
+	// that are allowed for each key. If it is zero, requests
+	// are not limited.
+	Rate float64
+
+	// Burst holds the maximum number of requests that are
+	// allowed in a burst. If it is less than one, one is used.
+	Burst int
+}
+
+// Limiter applies a rate limit to requests, holding a separate
+// token bucket for each key.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// buckets holds the bucket for each key. Keys whose
+	// buckets would be full are removed periodically.
+	buckets map[string]*bucket
+
+	// swept holds when the buckets were last swept.
+	swept time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// New returns a new Limiter that applies the given limit. If the
+// limit's rate is zero, it returns nil, which allows all requests.
+func New(limit Limit) *Limiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    limit.Rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		swept:   timeNow(),
+	}
+}
+
+// Allow reports whether a request with the given key is allowed,
+// taking a token from the key's bucket if so. If the request is not
+// allowed, it also returns how long it will be before a request with
+// the key is allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := timeNow()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > sweepInterval {
+		l.sweep(now)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{
+			tokens: l.burst,
+		}
+		l.buckets[key] = b
+	} else {
+		b.tokens = l.tokens(b, now)
+	}
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration(math.Ceil((1 - b.tokens) / l.rate * float64(time.Second)))
+	return false, wait
+}
+
+// tokens returns the number of tokens in the given bucket at
+// the given time.
+func (l *Limiter) tokens(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.updated).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// sweep removes all the buckets that are full, which behave
+// in the same way as new buckets.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.tokens(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
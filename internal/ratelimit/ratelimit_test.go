@@ -0,0 +1,117 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ratelimit_test
+
+import (
+	"time"
+
+	jujutesting "github.com/juju/testing"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/ratelimit"
+)
+
+type suite struct {
+	jujutesting.IsolationSuite
+	now time.Time
+}
+
+var _ = gc.Suite(&suite{})
+
+func (s *suite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.now = time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.PatchValue(ratelimit.TimeNow, func() time.Time {
+		return s.now
+	})
+}
+
+func (s *suite) TestBurst(c *gc.C) {
+	l := ratelimit.New(ratelimit.Limit{
+		Rate:  2,
+		Burst: 3,
+	})
+	for i := 0; i < 3; i++ {
+		ok, wait := l.Allow("bob")
+		c.Assert(ok, gc.Equals, true)
+		c.Assert(wait, gc.Equals, time.Duration(0))
+	}
+	ok, wait := l.Allow("bob")
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait, gc.Equals, 500*time.Millisecond)
+
+	// Other keys have their own buckets.
+	ok, _ = l.Allow("alice")
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *suite) TestRefill(c *gc.C) {
+	l := ratelimit.New(ratelimit.Limit{
+		Rate:  2,
+		Burst: 2,
+	})
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("bob")
+		c.Assert(ok, gc.Equals, true)
+	}
+	s.now = s.now.Add(250 * time.Millisecond)
+	ok, wait := l.Allow("bob")
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait, gc.Equals, 250*time.Millisecond)
+
+	s.now = s.now.Add(250 * time.Millisecond)
+	ok, _ = l.Allow("bob")
+	c.Assert(ok, gc.Equals, true)
+	ok, _ = l.Allow("bob")
+	c.Assert(ok, gc.Equals, false)
+
+	// The bucket never holds more than the burst size.
+	s.now = s.now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("bob")
+		c.Assert(ok, gc.Equals, true)
+	}
+	ok, _ = l.Allow("bob")
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *suite) TestZeroBurst(c *gc.C) {
+	l := ratelimit.New(ratelimit.Limit{
+		Rate: 0.1,
+	})
+	ok, _ := l.Allow("bob")
+	c.Assert(ok, gc.Equals, true)
+	ok, wait := l.Allow("bob")
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait, gc.Equals, 10*time.Second)
+}
+
+func (s *suite) TestNoLimit(c *gc.C) {
+	l := ratelimit.New(ratelimit.Limit{})
+	c.Assert(l, gc.IsNil)
+	for i := 0; i < 100; i++ {
+		ok, _ := l.Allow("bob")
+		c.Assert(ok, gc.Equals, true)
+	}
+}
+
+func (s *suite) TestSweep(c *gc.C) {
+	l := ratelimit.New(ratelimit.Limit{
+		Rate:  0.1,
+		Burst: 10,
+	})
+	l.Allow("bob")
+	for i := 0; i < 10; i++ {
+		l.Allow("alice")
+	}
+	c.Assert(ratelimit.NumBuckets(l), gc.Equals, 2)
+
+	// After a minute, bob's bucket is full again and can be
+	// forgotten, but alice's is not.
+	s.now = s.now.Add(61 * time.Second)
+	for i := 0; i < 5; i++ {
+		l.Allow("alice")
+	}
+	c.Assert(ratelimit.NumBuckets(l), gc.Equals, 1)
+}
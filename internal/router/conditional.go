@@ -0,0 +1,153 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package router // import "gopkg.in/juju/charmstore.v5-unstable/internal/router"
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+)
+
+// metaVary holds the request headers that can change a metadata
+// response, because they hold authentication credentials.
+const metaVary = "Authorization, Cookie, Macaroons"
+
+// Validator holds values that change whenever the metadata of an
+// entity may have changed. It is used to support HTTP conditional
+// requests for metadata.
+type Validator struct {
+	// Tag holds an opaque value that changes whenever the
+	// metadata changes. If it is empty, responses that include the
+	// metadata are sent without validators.
+	Tag string
+
+	// ModTime holds the time when the metadata was last changed,
+	// or the zero time if that is not known.
+	ModTime time.Time
+}
+
+// CacheableHandler may be implemented by a BulkIncludeHandler to
+// indicate whether its results can be validated with the validators
+// returned by Context.EntityValidator. Responses that include metadata
+// from handlers that do not implement CacheableHandler are sent without
+// validators.
+type CacheableHandler interface {
+	// Cacheable reports whether the results of the handler change
+	// only when the validator of the entity changes.
+	Cacheable() bool
+}
+
+// metaCacheable reports whether the response to the given metadata
+// request can be validated with entity validators. The request is
+// assumed to be for a /meta request, with the actual meta path in
+// req.URL.Path (e.g. /any, /metaname).
+func (r *Router) metaCacheable(req *http.Request) bool {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path == "" {
+		// The list of metadata names does not depend on the entity.
+		return false
+	}
+	includes := []string{path}
+	if path == "any" {
+		includes = req.Form["include"]
+	}
+	for _, include := range includes {
+		h, ok := r.MetaHandler(include).(CacheableHandler)
+		if !ok || !h.Cacheable() {
+			return false
+		}
+	}
+	return true
+}
+
+// metaValidator returns the validator for a response to the given
+// metadata request that includes the metadata for all the given
+// entities, each of which was requested with the respective element of
+// ids. It returns a zero Validator if the response cannot be validated.
+func (r *Router) metaValidator(req *http.Request, ids []string, rurls []*ResolvedURL) (Validator, error) {
+	if !r.metaCacheable(req) {
+		return Validator{}, nil
+	}
+	hash := sha256.New()
+	var modTime time.Time
+	knownModTime := true
+	for i, rurl := range rurls {
+		v, err := r.Context.EntityValidator(rurl)
+		if err != nil {
+			return Validator{}, errgo.Mask(err)
+		}
+		if v.Tag == "" {
+			return Validator{}, nil
+		}
+		fmt.Fprintf(hash, "%q %q\n", ids[i], v.Tag)
+		if v.ModTime.IsZero() {
+			knownModTime = false
+		} else if v.ModTime.After(modTime) {
+			modTime = v.ModTime
+		}
+	}
+	if !knownModTime {
+		modTime = time.Time{}
+	}
+	return Validator{
+		Tag:     fmt.Sprintf("%x", hash.Sum(nil)[:16]),
+		ModTime: modTime,
+	}, nil
+}
+
+// writeMetaResponse writes the response to a metadata GET request.
+// If v holds a tag, the response is sent with validators, and if
+// the request's preconditions show that the client already has the
+// response, a 304 (Not Modified) response is sent instead. The
+// caller is responsible for setting the Vary header.
+func writeMetaResponse(w http.ResponseWriter, req *http.Request, v Validator, resp interface{}) {
+	header := w.Header()
+	if v.Tag == "" {
+		httprequest.WriteJSON(w, http.StatusOK, resp)
+		return
+	}
+	etag := `"` + v.Tag + `"`
+	header.Set("ETag", etag)
+	if !v.ModTime.IsZero() {
+		header.Set("Last-Modified", v.ModTime.UTC().Format(http.TimeFormat))
+	}
+	// Make sure that caches check with us before reusing
+	// a response.
+	header.Set("Cache-Control", "no-cache")
+	if notModified(req, etag, v.ModTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	httprequest.WriteJSON(w, http.StatusOK, resp)
+}
+
+// notModified reports whether the If-None-Match or If-Modified-Since
+// headers of the given request show that the client already holds
+// the response with the given entity tag and modification time.
+// As specified by RFC 7232, If-Modified-Since is ignored when
+// If-None-Match is present.
+func notModified(req *http.Request, etag string, modTime time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(t)
+}
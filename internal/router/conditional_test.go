@@ -0,0 +1,230 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package router // import "gopkg.in/juju/charmstore.v5-unstable/internal/router"
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	jujutesting "github.com/juju/testing"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
+)
+
+type conditionalSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&conditionalSuite{})
+
+var conditionalModTime = time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+
+// newConditionalRouter returns a router with cacheable, volatile and
+// single metadata handlers. The validators of the entities are taken
+// from the given map, keyed by entity URL.
+func newConditionalRouter(validators map[string]Validator) *Router {
+	query := func(id *ResolvedURL, fields fieldset.Set, req *http.Request) (interface{}, error) {
+		return id.String(), nil
+	}
+	handleGet := func(doc interface{}, id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+		return doc, nil
+	}
+	single := func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+		return id.String(), nil
+	}
+	return New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"cacheable": NewFieldIncludeHandler(FieldIncludeHandlerParams{
+				Key:       0,
+				Query:     query,
+				HandleGet: handleGet,
+			}),
+			"volatile": NewFieldIncludeHandler(FieldIncludeHandlerParams{
+				Key:       0,
+				Query:     query,
+				HandleGet: handleGet,
+				Volatile:  true,
+			}),
+			"single": SingleIncludeHandler(single),
+		},
+	}, funcContext{
+		resolveURL: func(id *charm.URL) (*ResolvedURL, error) {
+			if id.Name == "missing" {
+				return nil, params.ErrNotFound
+			}
+			return alwaysResolveURL(id)
+		},
+		authorizeURL:        alwaysAuthorize,
+		willIncludeMetadata: func([]string) {},
+		entityValidator: func(id *ResolvedURL) (Validator, error) {
+			return validators[id.URL.String()], nil
+		},
+	})
+}
+
+func (s *conditionalSuite) TestValidatorHeaders(c *gc.C) {
+	r := newConditionalRouter(map[string]Validator{
+		"cs:~charmers/precise/wordpress-0": {
+			Tag:     "wordpress",
+			ModTime: conditionalModTime,
+		},
+		"cs:~charmers/precise/mysql-0": {
+			Tag: "mysql",
+		},
+	})
+	for i, test := range []struct {
+		about          string
+		url            string
+		expectETag     bool
+		expectModified bool
+	}{{
+		about:          "single cacheable metadata",
+		url:            "/wordpress/meta/cacheable",
+		expectETag:     true,
+		expectModified: true,
+	}, {
+		about:      "unknown modification time",
+		url:        "/mysql/meta/cacheable",
+		expectETag: true,
+	}, {
+		about: "volatile metadata",
+		url:   "/wordpress/meta/volatile",
+	}, {
+		about: "single include handler",
+		url:   "/wordpress/meta/single",
+	}, {
+		about:          "meta/any with cacheable metadata",
+		url:            "/wordpress/meta/any?include=cacheable",
+		expectETag:     true,
+		expectModified: true,
+	}, {
+		about:          "meta/any without includes",
+		url:            "/wordpress/meta/any",
+		expectETag:     true,
+		expectModified: true,
+	}, {
+		about: "meta/any with volatile metadata",
+		url:   "/wordpress/meta/any?include=cacheable&include=volatile",
+	}, {
+		about: "list of metadata names",
+		url:   "/wordpress/meta",
+	}, {
+		about:      "bulk cacheable metadata",
+		url:        "/meta/cacheable?id=wordpress&id=mysql",
+		expectETag: true,
+	}, {
+		about: "bulk metadata with a missing id",
+		url:   "/meta/cacheable?id=wordpress&id=missing",
+	}, {
+		about: "bulk volatile metadata",
+		url:   "/meta/volatile?id=wordpress",
+	}} {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: r,
+			URL:     test.url,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+		header := rec.Header()
+		c.Assert(header.Get("Vary"), gc.Equals, "Authorization, Cookie, Macaroons")
+		if !test.expectETag {
+			c.Assert(header.Get("ETag"), gc.Equals, "")
+			c.Assert(header.Get("Last-Modified"), gc.Equals, "")
+			continue
+		}
+		c.Assert(header.Get("ETag"), gc.Matches, `"[0-9a-f]{32}"`)
+		c.Assert(header.Get("Cache-Control"), gc.Equals, "no-cache")
+		if test.expectModified {
+			c.Assert(header.Get("Last-Modified"), gc.Equals, "Sat, 04 Mar 2017 05:06:07 GMT")
+		} else {
+			c.Assert(header.Get("Last-Modified"), gc.Equals, "")
+		}
+	}
+}
+
+func (s *conditionalSuite) TestConditionalRequests(c *gc.C) {
+	validators := map[string]Validator{
+		"cs:~charmers/precise/wordpress-0": {
+			Tag:     "wordpress",
+			ModTime: conditionalModTime,
+		},
+	}
+	r := newConditionalRouter(validators)
+	get := func(url string, header http.Header) *httptest.ResponseRecorder {
+		return httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: r,
+			URL:     url,
+			Header:  header,
+		})
+	}
+	for i, url := range []string{
+		"/wordpress/meta/cacheable",
+		"/wordpress/meta/any?include=cacheable",
+		"/meta/cacheable?id=wordpress",
+	} {
+		c.Logf("test %d: %s", i, url)
+		validators["cs:~charmers/precise/wordpress-0"] = Validator{
+			Tag:     "wordpress",
+			ModTime: conditionalModTime,
+		}
+		rec := get(url, nil)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		etag := rec.Header().Get("ETag")
+		c.Assert(etag, gc.Not(gc.Equals), "")
+
+		for j, test := range []struct {
+			header       http.Header
+			expectStatus int
+		}{{
+			header:       http.Header{"If-None-Match": {etag}},
+			expectStatus: http.StatusNotModified,
+		}, {
+			header:       http.Header{"If-None-Match": {`"other", W/` + etag}},
+			expectStatus: http.StatusNotModified,
+		}, {
+			header:       http.Header{"If-None-Match": {"*"}},
+			expectStatus: http.StatusNotModified,
+		}, {
+			header:       http.Header{"If-None-Match": {`"other"`}},
+			expectStatus: http.StatusOK,
+		}, {
+			header:       http.Header{"If-Modified-Since": {"Sat, 04 Mar 2017 05:06:07 GMT"}},
+			expectStatus: http.StatusNotModified,
+		}, {
+			header:       http.Header{"If-Modified-Since": {"Sat, 04 Mar 2017 05:06:06 GMT"}},
+			expectStatus: http.StatusOK,
+		}, {
+			header: http.Header{
+				"If-None-Match":     {`"other"`},
+				"If-Modified-Since": {"Sat, 04 Mar 2017 05:06:07 GMT"},
+			},
+			expectStatus: http.StatusOK,
+		}} {
+			c.Logf("test %d.%d: %v", i, j, test.header)
+			rec := get(url, test.header)
+			c.Assert(rec.Code, gc.Equals, test.expectStatus)
+			c.Assert(rec.Header().Get("ETag"), gc.Equals, etag)
+			if test.expectStatus == http.StatusNotModified {
+				c.Assert(rec.Body.Len(), gc.Equals, 0)
+			}
+		}
+
+		// When the entity changes, the old tag no longer matches.
+		validators["cs:~charmers/precise/wordpress-0"] = Validator{
+			Tag:     "wordpress-changed",
+			ModTime: conditionalModTime.Add(time.Minute),
+		}
+		rec = get(url, http.Header{"If-None-Match": {etag}})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		c.Assert(rec.Header().Get("ETag"), gc.Not(gc.Equals), etag)
+		rec = get(url, http.Header{"If-Modified-Since": {"Sat, 04 Mar 2017 05:06:07 GMT"}})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	}
+}
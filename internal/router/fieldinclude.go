@@ -11,11 +11,12 @@ import (
 	"gopkg.in/errgo.v1"
 
 	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
 )
 
 // A FieldQueryFunc is used to retrieve a metadata document for the given URL,
-// selecting only those fields specified in keys of the given selector.
-type FieldQueryFunc func(id *ResolvedURL, selector map[string]int, req *http.Request) (interface{}, error)
+// selecting only those fields in the given set.
+type FieldQueryFunc func(id *ResolvedURL, fields fieldset.Set, req *http.Request) (interface{}, error)
 
 // FieldUpdater records field changes made by a FieldUpdateFunc.
 type FieldUpdater struct {
@@ -71,7 +72,9 @@ type FieldIncludeHandlerParams struct {
 	Query FieldQueryFunc
 
 	// Fields specifies which fields are required by the given handler.
-	Fields []string
+	// All the handlers with the same key must use the same schema
+	// for their fields.
+	Fields fieldset.Set
 
 	// Handle actually returns the data from the document retrieved
 	// by Query, for GET requests.
@@ -88,6 +91,13 @@ type FieldIncludeHandlerParams struct {
 	// UpdateSearch is used to update the document in the search
 	// database for PUT requests.
 	UpdateSearch FieldUpdateSearchFunc
+
+	// Volatile specifies that the results of HandleGet may change
+	// even when the validator of the entity does not, for example
+	// because they depend on other documents or on the
+	// authenticated user. Responses that include them are sent
+	// without validators.
+	Volatile bool
 }
 
 // FieldIncludeHandler implements BulkIncludeHandler by
@@ -110,6 +120,11 @@ func (h *FieldIncludeHandler) Key() interface{} {
 	return h.P.Key
 }
 
+// Cacheable implements CacheableHandler.Cacheable.
+func (h *FieldIncludeHandler) Cacheable() bool {
+	return !h.P.Volatile
+}
+
 // HandlePut implements BulkIncludeHandler.HandlePut.
 func (h *FieldIncludeHandler) HandlePut(hs []BulkIncludeHandler, id *ResolvedURL, paths []string, values []*json.RawMessage, req *http.Request) []error {
 	updater := &FieldUpdater{
@@ -160,17 +175,15 @@ func (h *FieldIncludeHandler) HandlePut(hs []BulkIncludeHandler, id *ResolvedURL
 // HandleGet implements BulkIncludeHandler.HandleGet.
 func (h *FieldIncludeHandler) HandleGet(hs []BulkIncludeHandler, id *ResolvedURL, paths []string, flags url.Values, req *http.Request) ([]interface{}, error) {
 	funcs := make([]FieldGetFunc, len(hs))
-	selector := make(map[string]int)
+	var fields fieldset.Set
 	// Extract the handler functions and union all the fields.
 	for i, h := range hs {
 		h := h.(*FieldIncludeHandler)
 		funcs[i] = h.P.HandleGet
-		for _, field := range h.P.Fields {
-			selector[field] = 1
-		}
+		fields = fields.Union(h.P.Fields)
 	}
 	// Make the single query.
-	doc, err := h.P.Query(id, selector, req)
+	doc, err := h.P.Query(id, fields, req)
 	if err != nil {
 		// Note: preserve error cause from handlers.
 		return nil, errgo.Mask(err, errgo.Any)
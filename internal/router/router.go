@@ -241,6 +241,12 @@ type Context interface {
 	// fetches which may not require the metadata are made.
 	// This method should ignore any unrecognized names.
 	WillIncludeMetadata(includes []string)
+
+	// EntityValidator returns a validator for the metadata of the
+	// given entity. It is only called after AuthorizeEntity has
+	// succeeded for the entity. It may return a zero Validator
+	// if validators are not supported.
+	EntityValidator(id *ResolvedURL) (Validator, error)
 }
 
 // New returns a charm store router that will route requests to
@@ -371,18 +377,27 @@ func handlerKey(path string) (key, rest string) {
 func (r *Router) serveMeta(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
 	switch req.Method {
 	case "GET", "HEAD":
+		w.Header().Add("Vary", metaVary)
 		r.willIncludeMetadata(req)
 		rurl, err := r.Context.ResolveURL(id)
 		if err != nil {
 			// Note: preserve error cause from ResolveURL.
 			return errgo.Mask(err, errgo.Any)
 		}
+		// Obtain the validator before the metadata, so that
+		// any change made while the response is being built
+		// leaves the validator out of date rather than the
+		// response.
+		v, err := r.metaValidator(req, []string{id.String()}, []*ResolvedURL{rurl})
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
 		resp, err := r.serveMetaGet(rurl, req)
 		if err != nil {
 			// Note: preserve error causes from meta handlers.
 			return errgo.Mask(err, errgo.Any)
 		}
-		httprequest.WriteJSON(w, http.StatusOK, resp)
+		writeMetaResponse(w, req, v, resp)
 		return nil
 	case "PUT":
 		rurl, err := r.Context.ResolveURL(id)
@@ -570,11 +585,18 @@ func (r *Router) serveBulkMeta(w http.ResponseWriter, req *http.Request) error {
 			httprequest.WriteJSON(w, http.StatusOK, r.metaNames())
 			return nil
 		}
-		resp, err := r.serveBulkMetaGet(req)
+		// The response may be streamed, so it depends on the
+		// Accept header as well as on the credentials.
+		w.Header().Add("Vary", metaVary)
+		w.Header().Add("Vary", "Accept")
+		if AcceptsNDJSON(req) {
+			return r.serveBulkMetaStream(w, req)
+		}
+		resp, v, err := r.serveBulkMetaGet(req)
 		if err != nil {
 			return errgo.Mask(err, errgo.Any)
 		}
-		httprequest.WriteJSON(w, http.StatusOK, resp)
+		writeMetaResponse(w, req, v, resp)
 		return nil
 	case "PUT":
 		return r.serveBulkMetaPut(req)
@@ -584,11 +606,145 @@ func (r *Router) serveBulkMeta(w http.ResponseWriter, req *http.Request) error {
 }
 
 // serveBulkMetaGet serves the "bulk" metadata retrieval endpoint
-// that can return information on several ids at once.
+// that can return information on several ids at once. It also returns
+// the validator for the response.
 //
 // GET meta/$endpoint?id=$id0[&id=$id1...][$otherflags]
 // See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-metaendpoint
-func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, error) {
+func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, Validator, error) {
+	breq, err := r.parseBulkMetaRequest(req)
+	if err != nil {
+		// Note: preserve error cause from ResolveURLs.
+		return nil, Validator{}, errgo.Mask(err, errgo.Any)
+	}
+	// Obtain the validator before the metadata, as in serveMeta.
+	// When an id is not found, the response cannot be validated.
+	var v Validator
+	found := true
+	for _, rurl := range breq.rurls {
+		if rurl == nil {
+			found = false
+			break
+		}
+	}
+	if found {
+		v, err = r.metaValidator(req, breq.ids, breq.rurls)
+		if err != nil {
+			return nil, Validator{}, errgo.Mask(err)
+		}
+	}
+	result := make(map[string]interface{})
+	// omitted records whether any id has been omitted from the
+	// result. The response cannot be validated in that case,
+	// because the omitted entities might appear without any
+	// validator changing.
+	omitted := false
+	for i, rurl := range breq.rurls {
+		if rurl == nil {
+			// URLs not found will be omitted from the result.
+			// https://github.com/juju/charmstore/blob/v4/docs/API.md#bulk-requests-and-missing-metadata
+			omitted = true
+			continue
+		}
+		meta, err := r.serveMetaGet(rurl, req)
+		if cause := errgo.Cause(err); cause == params.ErrNotFound || cause == params.ErrMetadataNotFound || (breq.ignoreAuth && isAuthorizationError(cause)) {
+			// The relevant data does not exist, or it is not public and client
+			// asked not to authorize.
+			// https://github.com/juju/charmstore/blob/v4/docs/API.md#bulk-requests-and-missing-metadata
+			omitted = true
+			continue
+		}
+		if err != nil {
+			return nil, Validator{}, errgo.Mask(err)
+		}
+		result[breq.ids[i]] = meta
+	}
+	if omitted {
+		return result, Validator{}, nil
+	}
+	return result, v, nil
+}
+
+// serveBulkMetaStream serves a bulk metadata GET request as a stream
+// of newline-delimited JSON values, one for each requested id, in the
+// order that the ids were given. Errors for individual ids, including
+// ids that are not found, are written inline rather than failing the
+// whole request. As in the non-streamed response, results requiring
+// authorization are omitted when ignore-auth is set.
+//
+// GET meta/$endpoint?id=$id0[&id=$id1...][$otherflags]
+// Accept: application/x-ndjson
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#streamed-responses
+func (r *Router) serveBulkMetaStream(w http.ResponseWriter, req *http.Request) error {
+	breq, err := r.parseBulkMetaRequest(req)
+	if err != nil {
+		// Note: preserve error cause from ResolveURLs.
+		return errgo.Mask(err, errgo.Any)
+	}
+	// Authorize all the entities before the response is started,
+	// so that an error that the client can act on, such as a
+	// discharge-required error, can be returned as a normal
+	// response.
+	authErrs := make([]error, len(breq.rurls))
+	for i, rurl := range breq.rurls {
+		if rurl == nil {
+			continue
+		}
+		err := r.Context.AuthorizeEntity(rurl, req)
+		if err == nil {
+			continue
+		}
+		if _, ok := errgo.Cause(err).(*httpbakery.Error); ok && !breq.ignoreAuth {
+			return errgo.Mask(err, errgo.Any)
+		}
+		authErrs[i] = err
+	}
+	sw := NewStreamWriter(w)
+	for i, rurl := range breq.rurls {
+		id := breq.ids[i]
+		if rurl == nil {
+			err = sw.WriteError(id, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", id))
+		} else if aerr := authErrs[i]; aerr != nil {
+			if breq.ignoreAuth && isAuthorizationError(errgo.Cause(aerr)) {
+				continue
+			}
+			err = sw.WriteError(id, aerr)
+		} else if meta, merr := r.serveMetaGet(rurl, req); merr == nil {
+			err = sw.WriteMeta(id, meta)
+		} else if breq.ignoreAuth && isAuthorizationError(errgo.Cause(merr)) {
+			continue
+		} else {
+			err = sw.WriteError(id, merr)
+		}
+		if err != nil {
+			// The response has already started, so there
+			// is no way to report the error to the client.
+			logger.Errorf("cannot write streamed metadata: %v", err)
+			return nil
+		}
+	}
+	return nil
+}
+
+// bulkMetaRequest holds a parsed bulk metadata GET request.
+type bulkMetaRequest struct {
+	// ids holds the ids as specified in the request.
+	ids []string
+
+	// rurls holds the resolved URL for each element of ids,
+	// or nil if the id was not found.
+	rurls []*ResolvedURL
+
+	// ignoreAuth holds whether results requiring
+	// authorization should be omitted.
+	ignoreAuth bool
+}
+
+// parseBulkMetaRequest parses the flags of the given bulk metadata
+// GET request and resolves its ids. The id and ignore-auth flags are
+// removed from req.Form so that they are not passed on to the
+// metadata handlers.
+func (r *Router) parseBulkMetaRequest(req *http.Request) (*bulkMetaRequest, error) {
 	ids := req.Form["id"]
 	if len(ids) == 0 {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no ids specified in meta request")
@@ -608,32 +764,16 @@ func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, error) {
 		}
 		urls[i] = url
 	}
-
 	rurls, err := r.Context.ResolveURLs(urls)
 	if err != nil {
 		// Note: preserve error cause from resolveURL.
 		return nil, errgo.Mask(err, errgo.Any)
 	}
-	result := make(map[string]interface{})
-	for i, rurl := range rurls {
-		if rurl == nil {
-			// URLs not found will be omitted from the result.
-			// https://github.com/juju/charmstore/blob/v4/docs/API.md#bulk-requests-and-missing-metadata
-			continue
-		}
-		meta, err := r.serveMetaGet(rurl, req)
-		if cause := errgo.Cause(err); cause == params.ErrNotFound || cause == params.ErrMetadataNotFound || (ignoreAuth && isAuthorizationError(cause)) {
-			// The relevant data does not exist, or it is not public and client
-			// asked not to authorize.
-			// https://github.com/juju/charmstore/blob/v4/docs/API.md#bulk-requests-and-missing-metadata
-			continue
-		}
-		if err != nil {
-			return nil, errgo.Mask(err)
-		}
-		result[ids[i]] = meta
-	}
-	return result, nil
+	return &bulkMetaRequest{
+		ids:        ids,
+		rurls:      rurls,
+		ignoreAuth: ignoreAuth,
+	}, nil
 }
 
 // ParseBool returns the boolean value represented by the string.
@@ -26,6 +26,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
 
 	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
 )
 
 type RouterSuite struct {
@@ -1184,6 +1185,7 @@ type funcContext struct {
 	resolveURL          func(id *charm.URL) (*ResolvedURL, error)
 	authorizeURL        func(id *ResolvedURL, req *http.Request) error
 	willIncludeMetadata func([]string)
+	entityValidator     func(id *ResolvedURL) (Validator, error)
 }
 
 func (ctxt funcContext) ResolveURL(id *charm.URL) (*ResolvedURL, error) {
@@ -1210,6 +1212,13 @@ func (ctxt funcContext) AuthorizeEntity(id *ResolvedURL, req *http.Request) erro
 	return ctxt.authorizeURL(id, req)
 }
 
+func (ctxt funcContext) EntityValidator(id *ResolvedURL) (Validator, error) {
+	if ctxt.entityValidator == nil {
+		return Validator{}, nil
+	}
+	return ctxt.entityValidator(id)
+}
+
 var parseBoolTests = []struct {
 	value  string
 	result bool
@@ -1267,7 +1276,7 @@ func (s *RouterSuite) TestHTTPRequestPassedThroughToMeta(c *gc.C) {
 	testReq, err := http.NewRequest("GET", "/wordpress/meta/foo", nil)
 	c.Assert(err, gc.Equals, nil)
 	doneQuery := false
-	query := func(id *ResolvedURL, selector map[string]int, req *http.Request) (interface{}, error) {
+	query := func(id *ResolvedURL, fields fieldset.Set, req *http.Request) (interface{}, error) {
 		if req != testReq {
 			return nil, fmt.Errorf("unexpected request found in Query")
 		}
@@ -1298,7 +1307,7 @@ func (s *RouterSuite) TestHTTPRequestPassedThroughToMeta(c *gc.C) {
 			"foo": NewFieldIncludeHandler(FieldIncludeHandlerParams{
 				Key:       0,
 				Query:     query,
-				Fields:    []string{"foo"},
+				Fields:    testFields.Set("foo"),
 				HandleGet: handleGet,
 				HandlePut: handlePut,
 				Update:    update,
@@ -2590,6 +2599,10 @@ func (b byJSON) Len() int {
 	return len(b)
 }
 
+// testFields holds the schema of the fields used by the
+// field include handlers in the tests.
+var testFields = fieldset.NewSchema("foo", "field1", "field2", "field3", "field4", "field5", "item1", "item2")
+
 // fieldSelectHandler returns a BulkIncludeHandler that returns
 // information about the call for testing purposes.
 // When the GET handler is invoked, it returns a fieldSelectHandleGetInfo value
@@ -2600,11 +2613,11 @@ func (b byJSON) Len() int {
 // a fieldSelectHandlePutInfo value holding the parameters that were
 // provided.
 func fieldSelectHandler(handlerId string, key interface{}, fields ...string) BulkIncludeHandler {
-	query := func(id *ResolvedURL, selector map[string]int, req *http.Request) (interface{}, error) {
+	query := func(id *ResolvedURL, set fieldset.Set, req *http.Request) (interface{}, error) {
 		atomic.AddInt32(&queryCount, 1)
 		return fieldSelectQueryInfo{
 			Id:       id,
-			Selector: selector,
+			Selector: testFields.Selector(set),
 		}, nil
 	}
 	handleGet := func(doc interface{}, id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -2658,7 +2671,7 @@ func fieldSelectHandler(handlerId string, key interface{}, fields ...string) Bul
 	return NewFieldIncludeHandler(FieldIncludeHandlerParams{
 		Key:       key,
 		Query:     query,
-		Fields:    fields,
+		Fields:    testFields.Set(fields...),
 		HandleGet: handleGet,
 		HandlePut: handlePut,
 		Update:    update,
@@ -0,0 +1,112 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package router // import "gopkg.in/juju/charmstore.v5-unstable/internal/router"
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+)
+
+// NDJSONContentType holds the media type of streamed responses,
+// which hold one JSON value on each line.
+const NDJSONContentType = "application/x-ndjson"
+
+// AcceptsNDJSON reports whether the client has asked for a streamed
+// response by including NDJSONContentType in the Accept header of the
+// given request.
+func AcceptsNDJSON(req *http.Request) bool {
+	for _, accept := range req.Header["Accept"] {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaType))
+			if err == nil && mediaType == NDJSONContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StreamResult holds a single line of a streamed response.
+type StreamResult struct {
+	// Id holds the id of the entity that the result refers to.
+	// It is empty when the error does not apply to any
+	// specific entity.
+	Id string `json:",omitempty"`
+
+	// Meta holds the metadata for the entity.
+	Meta interface{} `json:",omitempty"`
+
+	// Error holds the error encountered when retrieving
+	// the metadata for the entity, if any.
+	Error *params.Error `json:",omitempty"`
+}
+
+// StreamWriter writes a streamed response, one StreamResult at a
+// time. Each result is flushed to the client as soon as it has been
+// written.
+type StreamWriter struct {
+	w       http.ResponseWriter
+	encoder *json.Encoder
+}
+
+// NewStreamWriter returns a StreamWriter that writes to w. It sends
+// the response header immediately, so any errors found after it has
+// been called must be reported with StreamWriter.WriteError, and
+// errors writing the response can only be logged.
+func NewStreamWriter(w http.ResponseWriter) *StreamWriter {
+	w.Header().Set("Content-Type", NDJSONContentType)
+	w.WriteHeader(http.StatusOK)
+	return &StreamWriter{
+		w:       w,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// WriteMeta writes the metadata for the entity with the given id.
+func (sw *StreamWriter) WriteMeta(id string, meta interface{}) error {
+	return sw.write(StreamResult{
+		Id:   id,
+		Meta: meta,
+	})
+}
+
+// WriteError writes the error encountered when retrieving the metadata
+// for the entity with the given id, which may be empty.
+func (sw *StreamWriter) WriteError(id string, err error) error {
+	return sw.write(StreamResult{
+		Id:    id,
+		Error: streamErrorBody(err),
+	})
+}
+
+func (sw *StreamWriter) write(r StreamResult) error {
+	if err := sw.encoder.Encode(r); err != nil {
+		return errgo.Notef(err, "cannot write response")
+	}
+	if f, ok := sw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// streamErrorBody returns the body of an error that is written as part
+// of a streamed response. Bakery errors cannot be discharged at that
+// point, so they are reported as authorization errors. Callers should
+// authorize requests before starting the response where possible, so
+// that bakery errors can be returned normally.
+func streamErrorBody(err error) *params.Error {
+	if _, ok := errgo.Cause(err).(*httpbakery.Error); ok {
+		return &params.Error{
+			Message: err.Error(),
+			Code:    params.ErrUnauthorized,
+		}
+	}
+	return errorResponseBody(err)
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package router // import "gopkg.in/juju/charmstore.v5-unstable/internal/router"
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
+)
+
+type streamSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&streamSuite{})
+
+var acceptsNDJSONTests = []struct {
+	accept []string
+	expect bool
+}{{
+	expect: false,
+}, {
+	accept: []string{"application/json"},
+	expect: false,
+}, {
+	accept: []string{"application/x-ndjson"},
+	expect: true,
+}, {
+	accept: []string{"application/json, application/x-ndjson;q=0.5"},
+	expect: true,
+}, {
+	accept: []string{"text/plain", "application/x-ndjson"},
+	expect: true,
+}, {
+	accept: []string{"application/x-ndjson-other"},
+	expect: false,
+}}
+
+func (s *streamSuite) TestAcceptsNDJSON(c *gc.C) {
+	for i, test := range acceptsNDJSONTests {
+		c.Logf("test %d: %q", i, test.accept)
+		req := &http.Request{
+			Header: http.Header{},
+		}
+		if test.accept != nil {
+			req.Header["Accept"] = test.accept
+		}
+		c.Assert(AcceptsNDJSON(req), gc.Equals, test.expect)
+	}
+}
+
+// newStreamRouter returns a router with a single "name" metadata
+// handler that returns the name of the entity. Entities named
+// "missing" are not found, entities named "secret" cannot be read,
+// entities named "restricted" require a discharge and the metadata
+// of entities named "broken" cannot be retrieved.
+func newStreamRouter() *Router {
+	return New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"name": NewFieldIncludeHandler(FieldIncludeHandlerParams{
+				Key: 0,
+				Query: func(id *ResolvedURL, fields fieldset.Set, req *http.Request) (interface{}, error) {
+					if id.URL.Name == "broken" {
+						return nil, errgo.New("broken entity")
+					}
+					return id.URL.Name, nil
+				},
+				HandleGet: func(doc interface{}, id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+					return doc, nil
+				},
+			}),
+		},
+	}, funcContext{
+		resolveURL: func(id *charm.URL) (*ResolvedURL, error) {
+			if id.Name == "missing" {
+				return nil, params.ErrNotFound
+			}
+			return alwaysResolveURL(id)
+		},
+		authorizeURL: func(id *ResolvedURL, req *http.Request) error {
+			if id.URL.Name == "secret" {
+				return errgo.WithCausef(nil, params.ErrUnauthorized, "secret entity")
+			}
+			if id.URL.Name == "restricted" {
+				return &httpbakery.Error{
+					Code:    httpbakery.ErrDischargeRequired,
+					Message: "restricted entity",
+				}
+			}
+			return nil
+		},
+		willIncludeMetadata: func([]string) {},
+	})
+}
+
+var streamBulkMetaTests = []struct {
+	about  string
+	url    string
+	expect []StreamResult
+}{{
+	about: "all found",
+	url:   "/meta/name?id=wordpress&id=mysql",
+	expect: []StreamResult{{
+		Id:   "wordpress",
+		Meta: "wordpress",
+	}, {
+		Id:   "mysql",
+		Meta: "mysql",
+	}},
+}, {
+	about: "errors are written inline",
+	url:   "/meta/name?id=wordpress&id=missing&id=secret&id=broken&id=mysql",
+	expect: []StreamResult{{
+		Id:   "wordpress",
+		Meta: "wordpress",
+	}, {
+		Id: "missing",
+		Error: &params.Error{
+			Message: "no matching charm or bundle for missing",
+			Code:    params.ErrNotFound,
+		},
+	}, {
+		Id: "secret",
+		Error: &params.Error{
+			Message: "secret entity",
+			Code:    params.ErrUnauthorized,
+		},
+	}, {
+		Id: "broken",
+		Error: &params.Error{
+			Message: "broken entity",
+		},
+	}, {
+		Id:   "mysql",
+		Meta: "mysql",
+	}},
+}, {
+	about: "unauthorized results omitted with ignore-auth",
+	url:   "/meta/name?id=secret&id=wordpress&id=restricted&ignore-auth=1",
+	expect: []StreamResult{{
+		Id:   "wordpress",
+		Meta: "wordpress",
+	}},
+}}
+
+func (s *streamSuite) TestStreamBulkMeta(c *gc.C) {
+	r := newStreamRouter()
+	for i, test := range streamBulkMetaTests {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: r,
+			URL:     test.url,
+			Header:  http.Header{"Accept": {NDJSONContentType}},
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, NDJSONContentType)
+		c.Assert(rec.Header()["Vary"], jc.DeepEquals, []string{"Authorization, Cookie, Macaroons", "Accept"})
+		c.Assert(rec.Header().Get("ETag"), gc.Equals, "")
+		c.Assert(decodeStreamResults(c, rec.Body.Bytes()), jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *streamSuite) TestStreamBulkMetaBadRequest(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      newStreamRouter(),
+		URL:          "/meta/name",
+		Header:       http.Header{"Accept": {NDJSONContentType}},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: "no ids specified in meta request",
+			Code:    params.ErrBadRequest,
+		},
+	})
+}
+
+func (s *streamSuite) TestStreamBulkMetaDischargeRequired(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: newStreamRouter(),
+		URL:     "/meta/name?id=wordpress&id=restricted",
+		Header:  http.Header{"Accept": {NDJSONContentType}},
+	})
+	c.Assert(rec.Code, gc.Not(gc.Equals), http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Not(gc.Equals), NDJSONContentType)
+	var body httpbakery.Error
+	err := json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(body.Code, gc.Equals, httpbakery.ErrDischargeRequired)
+	c.Assert(body.Message, gc.Equals, "restricted entity")
+}
+
+// decodeStreamResults decodes the newline-delimited results
+// in the given streamed response body.
+func decodeStreamResults(c *gc.C, body []byte) []StreamResult {
+	var results []StreamResult
+	for _, line := range bytes.Split(bytes.TrimSuffix(body, []byte("\n")), []byte("\n")) {
+		var r StreamResult
+		err := json.Unmarshal(line, &r)
+		c.Assert(err, gc.Equals, nil, gc.Commentf("line %q", line))
+		results = append(results, r)
+	}
+	return results
+}
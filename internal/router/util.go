@@ -23,6 +23,10 @@ var logger = loggo.GetLogger("charmstore.internal.router")
 // WriteError can be used to write an error response.
 var WriteError = errorToResp.WriteError
 
+// ErrTooManyRequests is the error code used when a request is
+// rejected because of a rate limit.
+const ErrTooManyRequests params.ErrorCode = "too many requests"
+
 // JSONHandler represents a handler that returns a JSON value.
 // The provided header can be used to set response headers.
 type JSONHandler func(http.Header, *http.Request) (interface{}, error)
@@ -91,6 +95,8 @@ func errorToResp1(err error) (int, interface{}) {
 		status = http.StatusMethodNotAllowed
 	case params.ErrServiceUnavailable:
 		status = http.StatusServiceUnavailable
+	case ErrTooManyRequests:
+		status = http.StatusTooManyRequests
 	}
 	return status, errorBody
 }
@@ -4,6 +4,8 @@
 package storetesting // import "gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
 
 import (
+	"time"
+
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/juju/charm.v6-unstable"
@@ -163,5 +165,9 @@ func NormalizeBaseEntity(be *mongodoc.BaseEntity) *mongodoc.BaseEntity {
 	if len(be1.ChannelResources) == 0 {
 		be1.ChannelResources = nil
 	}
+	// The update count and time change with every update,
+	// so they are not compared.
+	be1.UpdateCount = 0
+	be1.UpdateTime = time.Time{}
 	return &be1
 }
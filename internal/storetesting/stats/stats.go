@@ -34,6 +34,29 @@ func CheckCounterSum(c *gc.C, store *charmstore.Store, key []string, prefix bool
 	c.Errorf("counter sum for %#v is %d, want %d", key, sum, expected)
 }
 
+// CheckUniqueCount checks that unique client counts are properly
+// collected. It retries a few times as they are generally collected
+// in background.
+func CheckUniqueCount(c *gc.C, store *charmstore.Store, key []string, prefix bool, expected int64) {
+	var count int64
+	for retry := 0; retry < 10; retry++ {
+		time.Sleep(100 * time.Millisecond)
+		req := charmstore.CounterRequest{
+			Key:    key,
+			Prefix: prefix,
+		}
+		cs, err := store.UniqueCounters(&req)
+		c.Assert(err, gc.Equals, nil)
+		if count = cs[0].Count; count == expected {
+			if expected == 0 && retry < 2 {
+				continue // Wait a bit to make sure.
+			}
+			return
+		}
+	}
+	c.Errorf("unique count for %#v is %d, want %d", key, count, expected)
+}
+
 // CheckSearchTotalDownloads checks that the search index is properly updated.
 // It retries a few times as they are generally updated in background.
 func CheckSearchTotalDownloads(c *gc.C, store *charmstore.Store, id *charm.URL, expected int64) {
@@ -0,0 +1,205 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package textdiff implements line-based differences between
+// text files in unified diff format.
+package textdiff // import "gopkg.in/juju/charmstore.v5-unstable/internal/textdiff"
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Unified returns the differences between oldText and newText in
+// unified diff format, labelling the two files with oldName and newName
+// and including the given number of lines of context around each
+// change. It returns the empty string if the two texts hold the same
+// lines.
+//
+// The lines that differ between the two texts are compared using an
+// amount of memory proportional to the product of their numbers of
+// lines. When that product exceeds maxCompareCells, the lines are not
+// compared and all of them are reported as removed from the old text
+// and added to the new text.
+func Unified(oldName, newName, oldText, newText string, context int) string {
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+	var buf bytes.Buffer
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Find the end of the hunk, merging changes that are
+		// separated by no more than twice the context.
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			j := end
+			for j < len(ops) && ops[j].kind == ' ' {
+				j++
+			}
+			if j == len(ops) || j-end > 2*context {
+				break
+			}
+			end = j
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		stop := end + context
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+		}
+		writeHunk(&buf, ops[start:stop])
+		i = stop
+	}
+	return buf.String()
+}
+
+// maxCompareCells holds the maximum size of the table used to find the
+// longest common subsequence of the lines that differ between two
+// texts.
+const maxCompareCells = 1 << 20
+
+// op holds a single line of a diff.
+type op struct {
+	// kind holds ' ' for a common line, '-' for a line
+	// only in the old text and '+' for a line only in the new text.
+	kind byte
+
+	// oldLine and newLine hold the zero-based indexes of the
+	// line in the old and new texts respectively at the point
+	// this op applies.
+	oldLine, newLine int
+
+	text string
+}
+
+func writeHunk(buf *bytes.Buffer, ops []op) {
+	oldCount, newCount := 0, 0
+	for _, o := range ops {
+		if o.kind != '+' {
+			oldCount++
+		}
+		if o.kind != '-' {
+			newCount++
+		}
+	}
+	fmt.Fprintf(buf, "@@ -%s +%s @@\n",
+		hunkRange(ops[0].oldLine, oldCount),
+		hunkRange(ops[0].newLine, newCount),
+	)
+	for _, o := range ops {
+		buf.WriteByte(o.kind)
+		buf.WriteString(o.text)
+		buf.WriteByte('\n')
+	}
+}
+
+// hunkRange returns the range of lines in a hunk header
+// in the same format as GNU diff.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// diffLines returns the sequence of operations that transforms
+// the lines in a into the lines in b, using the longest common
+// subsequence of the two. If finding the longest common subsequence
+// would need a table larger than maxCompareCells, the lines that
+// differ are all reported as removed and then added.
+func diffLines(a, b []string) []op {
+	// Trim the common prefix and suffix so that
+	// the quadratic part of the algorithm runs on as
+	// little data as possible.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	ops := make([]op, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, op{' ', i, i, a[i]})
+	}
+	if int64(len(ma)+1)*int64(len(mb)+1) > maxCompareCells {
+		for i, line := range ma {
+			ops = append(ops, op{'-', prefix + i, prefix, line})
+		}
+		for j, line := range mb {
+			ops = append(ops, op{'+', prefix + len(ma), prefix + j, line})
+		}
+	} else {
+		ops = appendLCSOps(ops, ma, mb, prefix)
+	}
+	for k := 0; k < suffix; k++ {
+		ops = append(ops, op{' ', len(a) - suffix + k, len(b) - suffix + k, a[len(a)-suffix+k]})
+	}
+	return ops
+}
+
+// appendLCSOps appends to ops the operations that transform the lines
+// in a into the lines in b, using their longest common subsequence,
+// and returns the result. The lines of a and b are numbered from
+// offset.
+func appendLCSOps(ops []op, a, b []string, offset int) []op {
+	// lcs[i][j] holds the length of the longest common
+	// subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, op{' ', offset + i, offset + j, a[i]})
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, op{'-', offset + i, offset + j, a[i]})
+			i++
+		default:
+			ops = append(ops, op{'+', offset + i, offset + j, b[j]})
+			j++
+		}
+	}
+	return ops
+}
+
+// splitLines splits s into lines. A final newline
+// does not start a new line.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
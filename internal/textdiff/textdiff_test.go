@@ -0,0 +1,108 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package textdiff_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/textdiff"
+)
+
+type suite struct{}
+
+var _ = gc.Suite(&suite{})
+
+var unifiedTests = []struct {
+	about   string
+	old     string
+	new     string
+	context int
+	expect  string
+}{{
+	about:   "identical texts",
+	old:     "a\nb\n",
+	new:     "a\nb\n",
+	context: 3,
+	expect:  "",
+}, {
+	about:   "empty old text",
+	old:     "",
+	new:     "x\n",
+	context: 3,
+	expect:  "--- old\n+++ new\n@@ -0,0 +1 @@\n+x\n",
+}, {
+	about:   "empty new text",
+	old:     "x\ny\n",
+	new:     "",
+	context: 3,
+	expect:  "--- old\n+++ new\n@@ -1,2 +0,0 @@\n-x\n-y\n",
+}, {
+	about:   "single line removed",
+	old:     "1\n2\n3\n",
+	new:     "1\n3\n",
+	context: 3,
+	expect:  "--- old\n+++ new\n@@ -1,3 +1,2 @@\n 1\n-2\n 3\n",
+}, {
+	about:   "nearby changes are merged into one hunk",
+	old:     "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n",
+	new:     "a\nB\nc\nd\ne\nf\ng\nh\nI\nj\nk\n",
+	context: 3,
+	expect:  "--- old\n+++ new\n@@ -1,10 +1,11 @@\n a\n-b\n+B\n c\n d\n e\n f\n g\n h\n-i\n+I\n j\n+k\n",
+}, {
+	about:   "distant changes are in separate hunks",
+	old:     "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+	new:     "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10x\n",
+	context: 1,
+	expect:  "--- old\n+++ new\n@@ -1 +1,2 @@\n+0\n 1\n@@ -9,2 +10,2 @@\n 9\n-10\n+10x\n",
+}, {
+	about:   "missing final newline",
+	old:     "a\nb",
+	new:     "a\nc",
+	context: 3,
+	expect:  "--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n",
+}}
+
+func (*suite) TestUnified(c *gc.C) {
+	for i, test := range unifiedTests {
+		c.Logf("test %d: %s", i, test.about)
+		c.Assert(textdiff.Unified("old", "new", test.old, test.new, test.context), gc.Equals, test.expect)
+	}
+}
+
+func (*suite) TestUnifiedLargeChange(c *gc.C) {
+	// When the changed parts of the texts are too large to compare
+	// line by line, they are reported as entirely replaced, even
+	// though they share a line.
+	const n = 1100
+	var oldText, newText, expect bytes.Buffer
+	expect.WriteString("--- old\n+++ new\n@@ -1,1102 +1,1102 @@\n first\n")
+	oldText.WriteString("first\n")
+	newText.WriteString("first\n")
+	for i := 0; i < n; i++ {
+		line := fmt.Sprintf("old%d", i)
+		if i == n/2 {
+			line = "common"
+		}
+		fmt.Fprintf(&oldText, "%s\n", line)
+		fmt.Fprintf(&expect, "-%s\n", line)
+	}
+	for i := 0; i < n; i++ {
+		line := fmt.Sprintf("new%d", i)
+		if i == n/2 {
+			line = "common"
+		}
+		fmt.Fprintf(&newText, "%s\n", line)
+		fmt.Fprintf(&expect, "+%s\n", line)
+	}
+	oldText.WriteString("last\n")
+	newText.WriteString("last\n")
+	expect.WriteString(" last\n")
+	diff := textdiff.Unified("old", "new", oldText.String(), newText.String(), 3)
+	c.Assert(diff, gc.Equals, expect.String())
+	c.Assert(strings.Count(diff, "\n-common\n"), gc.Equals, 1)
+}
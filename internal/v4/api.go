@@ -62,6 +62,10 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer rh.Close()
 	rh.Router.Monitor.Reset(req.Method, "v4")
 	defer rh.Router.Monitor.Done()
+	if err := rh.LimitRate(w, req); err != nil {
+		router.WriteError(w, err)
+		return
+	}
 	rh.ServeHTTP(w, req)
 }
 
@@ -74,14 +78,7 @@ func NewAPIHandler(pool *charmstore.Pool, config charmstore.ServerParams, rootPa
 }
 
 // The v4 resolvedURL function also requires SupportedSeries.
-var requiredEntityFields = func() map[string]int {
-	fields := make(map[string]int)
-	for f := range v5.RequiredEntityFields {
-		fields[f] = 1
-	}
-	fields["supportedseries"] = 1
-	return fields
-}()
+var requiredEntityFields = v5.RequiredEntityFields.Union(mongodoc.EntityFields.Set("supportedseries"))
 
 // NewReqHandler returns an instance of a *ReqHandler
 // suitable for handling the given HTTP request. After use, the ReqHandler.Close
@@ -129,12 +126,13 @@ func newReqHandler() ReqHandler {
 	handlers := v5.RouterHandlers(h.ReqHandler)
 	handlers.Global["search"] = router.HandleJSON(h.serveSearch)
 	handlers.Meta["bundle-metadata"] = h.EntityHandler(h.metaBundleMetadata, "bundledata")
-	handlers.Meta["charm-related"] = h.EntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces")
+	handlers.Meta["charm-related"] = h.VolatileEntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces")
 	handlers.Meta["charm-metadata"] = h.EntityHandler(h.metaCharmMetadata, "charmmeta")
 	handlers.Meta["revision-info"] = router.SingleIncludeHandler(h.metaRevisionInfo)
 	handlers.Meta["archive-size"] = h.EntityHandler(h.metaArchiveSize, "prev5blobsize")
 	handlers.Meta["hash"] = h.EntityHandler(h.metaHash, "prev5blobhash")
 	handlers.Meta["hash256"] = h.EntityHandler(h.metaHash256, "prev5blobhash256")
+	handlers.Meta["perm"] = h.PermHandler(permResponse)
 	handlers.Id["expand-id"] = resolveId(authId(h.serveExpandId))
 	handlers.Id["archive"] = h.serveArchive(handlers.Id["archive"])
 	handlers.Id["archive/"] = resolveId(authId(h.serveArchiveFile))
@@ -149,6 +147,22 @@ func newReqHandler() ReqHandler {
 	delete(handlers.Meta, "can-write")
 	delete(handlers.Global, "upload")
 	delete(handlers.Global, "upload/")
+	delete(handlers.Meta, "release-notes")
+	delete(handlers.Id, "changelog")
+	delete(handlers.Id, "diff/")
+	delete(handlers.Id, "oci/")
+	delete(handlers.Global, "audit")
+	delete(handlers.Global, "audit/verify")
+	delete(handlers.Global, "tokens")
+	delete(handlers.Global, "tokens/")
+	delete(handlers.Global, "groups")
+	delete(handlers.Global, "groups/")
+	delete(handlers.Global, "orgs")
+	delete(handlers.Global, "orgs/")
+	delete(handlers.Id, "transfer")
+	delete(handlers.Global, "stats/metrics")
+	delete(handlers.Global, "stats/top")
+	delete(handlers.Meta, "audit")
 
 	h.Router = router.New(handlers, h)
 	return h
@@ -178,7 +192,7 @@ func (h ReqHandler) ResolveURLs(urls []*charm.URL) ([]*router.ResolvedURL, error
 // It's defined as a separate function so it can be more
 // easily unit-tested.
 func resolveURL(cache *entitycache.Cache, url *charm.URL) (*router.ResolvedURL, error) {
-	entity, err := cache.Entity(url, charmstore.FieldSelector("supportedseries"))
+	entity, err := cache.Entity(url, mongodoc.EntityFields.Set("supportedseries"))
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
@@ -305,6 +319,17 @@ func (h ReqHandler) metaHash256(entity *mongodoc.Entity, id *router.ResolvedURL,
 	}, nil
 }
 
+// GET id/meta/perm
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetaperm
+//
+// The fine-grained permissions are not reported in v4.
+func permResponse(acl mongodoc.ACL) interface{} {
+	return params.PermResponse{
+		Read:  acl.Read,
+		Write: acl.Write,
+	}
+}
+
 // GET id/expand-id
 // https://docs.google.com/a/canonical.com/document/d/1TgRA7jW_mmXoKH3JiwBbtPvQu7WiM6XMrz1wSrhTMXw/edit#bookmark=id.4xdnvxphb2si
 func (h ReqHandler) serveExpandId(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
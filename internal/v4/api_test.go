@@ -1097,12 +1097,20 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 	})
 }
 
-// assertChannelACLs asserts that the ChannelACLs field of the base entity with the
-// given URL are as given.
+// assertChannelACLs asserts that the read and write ACLs in the
+// ChannelACLs field of the base entity with the given URL are as given.
+// The other ACLs are not visible in v4.
 func (s *APISuite) assertChannelACLs(c *gc.C, url string, acls map[params.Channel]mongodoc.ACL) {
 	e, err := s.store.FindBaseEntity(charm.MustParseURL(url), nil)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(e.ChannelACLs, jc.DeepEquals, acls)
+	obtained := make(map[params.Channel]mongodoc.ACL)
+	for ch, acl := range e.ChannelACLs {
+		obtained[ch] = mongodoc.ACL{
+			Read:  acl.Read,
+			Write: acl.Write,
+		}
+	}
+	c.Assert(obtained, jc.DeepEquals, acls)
 }
 
 func (s *APISuite) TestMetaPermPutUnauthorized(c *gc.C) {
@@ -3013,7 +3021,8 @@ var promulgateTests = []struct {
 	},
 	expectBaseEntities: []*mongodoc.BaseEntity{
 		storetesting.NewBaseEntity("~charmers/wordpress").WithACLs(params.StableChannel, mongodoc.ACL{
-			Write: []string{v5.PromulgatorsGroup},
+			Write:   []string{v5.PromulgatorsGroup},
+			Publish: []string{v5.PromulgatorsGroup},
 		}).WithPromulgated(true).Build(),
 	},
 	expectPromulgate: true,
@@ -3147,7 +3156,8 @@ var promulgateTests = []struct {
 	},
 	expectBaseEntities: []*mongodoc.BaseEntity{
 		storetesting.NewBaseEntity("~charmers/wordpress").WithACLs(params.StableChannel, mongodoc.ACL{
-			Write: []string{v5.PromulgatorsGroup},
+			Write:   []string{v5.PromulgatorsGroup},
+			Publish: []string{v5.PromulgatorsGroup},
 		}).WithPromulgated(true).Build(),
 	},
 	expectPromulgate: true,
@@ -3170,7 +3180,8 @@ var promulgateTests = []struct {
 	},
 	expectBaseEntities: []*mongodoc.BaseEntity{
 		storetesting.NewBaseEntity("~charmers/wordpress").WithACLs(params.StableChannel, mongodoc.ACL{
-			Write: []string{v5.PromulgatorsGroup},
+			Write:   []string{v5.PromulgatorsGroup},
+			Publish: []string{v5.PromulgatorsGroup},
 		}).WithPromulgated(true).Build(),
 	},
 	expectPromulgate: true,
@@ -26,7 +26,7 @@ func (h ReqHandler) metaCharmRelated(entity *mongodoc.Entity, id *router.Resolve
 	if len(entity.CharmProvidedInterfaces)+len(entity.CharmRequiredInterfaces) == 0 {
 		return &params.RelatedResponse{}, nil
 	}
-	fields := charmstore.FieldSelector(
+	fields := mongodoc.EntityFields.Set(
 		"supportedseries",
 		"charmrequiredinterfaces",
 		"charmprovidedinterfaces",
@@ -7,8 +7,10 @@ import (
 	"archive/zip"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -34,7 +36,9 @@ import (
 	"gopkg.in/juju/charmstore.v5-unstable/internal/cache"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/entitycache"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/fieldset"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/oidc"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
 )
 
@@ -69,6 +73,20 @@ type Handler struct {
 	idmClient *idmclient.Client
 	rootPath  string
 
+	// oidc holds the verifier used to authenticate requests
+	// with OpenID Connect ID tokens. It is nil if OpenID
+	// Connect authentication is not configured.
+	oidc *oidc.Verifier
+
+	// oidcGroupPrefix holds the prefix added to the names of
+	// the groups asserted by ID tokens.
+	oidcGroupPrefix string
+
+	// trustedProxies holds the networks of the proxies whose
+	// X-Forwarded-For headers are trusted to hold the address
+	// of the client.
+	trustedProxies []*net.IPNet
+
 	// searchCache is a cache of search results keyed on the query
 	// parameters of the search. It should only be used for searches
 	// from unauthenticated users.
@@ -97,8 +115,33 @@ type ReqHandler struct {
 	// has been done on this request.
 	auth Authorization
 
+	// remoteAddr holds the network address of the client
+	// that sent the request, for use in audit entries.
+	remoteAddr string
+
 	// cache holds the per-request entity cache.
 	Cache *entitycache.Cache
+
+	// rateLimitKind holds the kind of the request for the
+	// purposes of rate limiting.
+	rateLimitKind charmstore.RequestKind
+
+	// rateLimitPending holds whether the request has yet to be
+	// charged to the rate limit of an authorized user.
+	rateLimitPending bool
+
+	// rateLimitAddr holds the client address that the
+	// request is charged to.
+	rateLimitAddr string
+
+	// rateLimitHeader holds the response header, so that
+	// Retry-After can be set when the request is throttled.
+	rateLimitHeader http.Header
+
+	// requestedSeries holds the series in the id of an archive
+	// download request, before it was resolved, so that it can
+	// be recorded in the download statistics.
+	requestedSeries string
 }
 
 const (
@@ -131,6 +174,29 @@ func New(pool *charmstore.Pool, config charmstore.ServerParams, rootPath string)
 		}
 		h.idmClient = idmClient
 	}
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	h.trustedProxies = trustedProxies
+	if config.OIDCIssuer != "" {
+		v, err := oidc.NewVerifier(oidc.Params{
+			Issuer:        config.OIDCIssuer,
+			ClientID:      config.OIDCClientID,
+			JWKSURL:       config.OIDCJWKSURL,
+			Keys:          []byte(config.OIDCKeys),
+			UsernameClaim: config.OIDCUsernameClaim,
+			GroupsClaim:   config.OIDCGroupsClaim,
+		})
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot initialize OpenID Connect verifier")
+		}
+		h.oidc = v
+		h.oidcGroupPrefix, err = oidcGroupPrefix(config)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
 	return h, nil
 }
 
@@ -139,7 +205,7 @@ func (h *Handler) Close() {
 }
 
 var (
-	RequiredEntityFields = charmstore.FieldSelector(
+	RequiredEntityFields = mongodoc.EntityFields.Set(
 		"baseurl",
 		"user",
 		"name",
@@ -149,7 +215,7 @@ var (
 		"promulgated-url",
 		"published",
 	)
-	RequiredBaseEntityFields = charmstore.FieldSelector(
+	RequiredBaseEntityFields = mongodoc.BaseEntityFields.Set(
 		"user",
 		"name",
 		"channelacls",
@@ -166,11 +232,11 @@ type StoreWithChannel struct {
 }
 
 func (s *StoreWithChannel) FindBestEntity(url *charm.URL, fields map[string]int) (*mongodoc.Entity, error) {
-	return s.Store.FindBestEntity(url, s.Channel, fields)
+	return s.Store.CachedFindBestEntity(url, s.Channel, fields)
 }
 
 func (s *StoreWithChannel) FindBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc.BaseEntity, error) {
-	return s.Store.FindBaseEntity(url, fields)
+	return s.Store.CachedFindBaseEntity(url, fields)
 }
 
 // NewReqHandler returns an instance of a *ReqHandler
@@ -202,6 +268,7 @@ func (h *Handler) NewReqHandler(req *http.Request) (*ReqHandler, error) {
 		Store:   store,
 		Channel: params.Channel(req.Form.Get("channel")),
 	}
+	rh.remoteAddr = req.RemoteAddr
 	rh.Cache = entitycache.New(rh.Store)
 	rh.Cache.AddEntityFields(RequiredEntityFields)
 	rh.Cache.AddBaseEntityFields(RequiredBaseEntityFields)
@@ -217,19 +284,29 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 	authId := h.AuthIdHandler
 	return &router.Handlers{
 		Global: map[string]http.Handler{
+			"audit":                router.HandleJSON(h.serveAudit),
+			"audit/verify":         router.HandleJSON(h.serveAuditVerify),
 			"changes/published":    router.HandleJSON(h.serveChangesPublished),
 			"debug":                http.HandlerFunc(h.serveDebug),
 			"debug/pprof/":         newPprofHandler(h),
 			"debug/status":         router.HandleJSON(h.serveDebugStatus),
-			"list":                 router.HandleJSON(h.serveList),
+			"groups":               router.HandleJSON(h.serveGroups),
+			"groups/":              router.HandleErrors(h.serveGroup),
+			"list":                 router.HandleErrors(h.serveList),
 			"log":                  router.HandleErrors(h.serveLog),
 			"logout":               http.HandlerFunc(logout),
+			"orgs":                 router.HandleJSON(h.serveOrgs),
+			"orgs/":                router.HandleErrors(h.serveOrg),
 			"search":               router.HandleJSON(h.serveSearch),
 			"search/interesting":   http.HandlerFunc(h.serveSearchInteresting),
 			"set-auth-cookie":      router.HandleErrors(h.serveSetAuthCookie),
 			"stats/":               router.NotFoundHandler(),
-			"stats/counter/":       router.HandleJSON(h.serveStatsCounter),
+			"stats/counter/":       router.HandleErrors(h.serveStatsCounter),
+			"stats/metrics":        router.HandleErrors(h.serveStatsMetrics),
+			"stats/top":            router.HandleJSON(h.serveStatsTop),
 			"stats/update":         router.HandleErrors(h.serveStatsUpdate),
+			"tokens":               router.HandleJSON(h.serveTokens),
+			"tokens/":              router.HandleErrors(h.serveToken),
 			"macaroon":             router.HandleJSON(h.serveMacaroon),
 			"delegatable-macaroon": router.HandleJSON(h.serveDelegatableMacaroon),
 			"whoami":               router.HandleJSON(h.serveWhoAmI),
@@ -239,27 +316,32 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 		Id: map[string]router.IdHandler{
 			"archive":     h.serveArchive,
 			"archive/":    resolveId(authId(h.serveArchiveFile), "blobhash", "blobhash"),
+			"changelog":   resolveId(authId(h.serveChangelog)),
 			"diagram.svg": resolveId(authId(h.serveDiagram), "bundledata"),
+			"diff/":       resolveId(authId(h.serveDiff), diffEntityFields...),
 			"expand-id":   resolveId(authId(h.serveExpandId)),
 			"icon.svg":    resolveId(authId(h.serveIcon), "contents", "blobhash"),
+			"oci/":        reqBodyReadHandler(resolveId(h.uploadAuthIdHandler(h.serveOCI), "charmmeta")),
 			"publish":     resolveId(h.servePublish),
 			"promulgate":  resolveId(h.servePromulgate),
 			"readme":      resolveId(authId(h.serveReadMe), "contents", "blobhash"),
-			"resource/":   reqBodyReadHandler(resolveId(authId(h.serveResources), "charmmeta")),
+			"resource/":   reqBodyReadHandler(resolveId(h.uploadAuthIdHandler(h.serveResources), "charmmeta")),
+			"transfer":    resolveId(h.serveTransfer),
 		},
 		Meta: map[string]router.BulkIncludeHandler{
 			"archive-size":         h.EntityHandler(h.metaArchiveSize, "size"),
 			"archive-upload-time":  h.EntityHandler(h.metaArchiveUploadTime, "uploadtime"),
+			"audit":                router.SingleIncludeHandler(h.metaAudit),
 			"bundle-machine-count": h.EntityHandler(h.metaBundleMachineCount, "bundlemachinecount"),
 			"bundle-metadata":      h.EntityHandler(h.metaBundleMetadata, "bundledata"),
-			"bundles-containing":   h.EntityHandler(h.metaBundlesContaining),
+			"bundles-containing":   h.VolatileEntityHandler(h.metaBundlesContaining),
 			"bundle-unit-count":    h.EntityHandler(h.metaBundleUnitCount, "bundleunitcount"),
 			"published":            h.EntityHandler(h.metaPublished, "published"),
 			"charm-actions":        h.EntityHandler(h.metaCharmActions, "charmactions"),
 			"charm-config":         h.EntityHandler(h.metaCharmConfig, "charmconfig"),
 			"charm-metadata":       h.EntityHandler(h.metaCharmMetadata, "charmmeta"),
 			"charm-metrics":        h.EntityHandler(h.metaCharmMetrics, "charmmetrics"),
-			"charm-related":        h.EntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces"),
+			"charm-related":        h.VolatileEntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces"),
 			"common-info": h.puttableBaseEntityHandler(
 				h.metaCommonInfo,
 				h.putMetaCommonInfo,
@@ -280,6 +362,11 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 				h.putMetaExtraInfoWithKey,
 				"extrainfo",
 			),
+			"release-notes": h.puttableEntityHandler(
+				h.metaReleaseNotes,
+				h.putMetaReleaseNotes,
+				"releasenotes",
+			),
 			"hash":             h.EntityHandler(h.metaHash, "blobhash"),
 			"hash256":          h.EntityHandler(h.metaHash256, "blobhash256"),
 			"id":               h.EntityHandler(h.metaId, "_id"),
@@ -289,15 +376,15 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"id-series":        h.EntityHandler(h.metaIdSeries, "_id"),
 			"manifest":         h.EntityHandler(h.metaManifest, "blobhash"),
 			"owner":            h.EntityHandler(h.metaOwner, "_id"),
-			"perm":             h.puttableBaseEntityHandler(h.metaPerm, h.putMetaPerm, "channelacls"),
+			"perm":             h.PermHandler(permResponse),
 			"perm/":            h.puttableBaseEntityHandler(h.metaPermWithKey, h.putMetaPermWithKey, "channelacls"),
 			"promulgated":      h.baseEntityHandler(h.metaPromulgated, "promulgated"),
 			"can-ingest":       h.baseEntityHandler(h.metaCanIngest, "noingest"),
-			"can-write":        h.baseEntityHandler(h.metaCanWrite),
-			"resources":        h.EntityHandler(h.metaResources, "charmmeta"),
-			"resources/":       h.EntityHandler(h.metaResourcesSingle, "charmmeta"),
+			"can-write":        volatile(h.baseEntityHandler(h.metaCanWrite)),
+			"resources":        h.VolatileEntityHandler(h.metaResources, "charmmeta"),
+			"resources/":       h.VolatileEntityHandler(h.metaResourcesSingle, "charmmeta"),
 			"revision-info":    router.SingleIncludeHandler(h.metaRevisionInfo),
-			"stats":            h.EntityHandler(h.metaStats, "supportedseries"),
+			"stats":            h.VolatileEntityHandler(h.metaStats, "supportedseries"),
 			"supported-series": h.EntityHandler(h.metaSupportedSeries, "supportedseries"),
 			"tags":             h.EntityHandler(h.metaTags, "charmmeta", "bundledata"),
 			"terms":            h.EntityHandler(h.metaTerms, "charmmeta"),
@@ -328,6 +415,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer rh.Close()
 	rh.Router.Monitor.Reset(req.Method, "v5")
 	defer rh.Router.Monitor.Done()
+	if err := rh.LimitRate(w, req); err != nil {
+		router.WriteError(w, err)
+		return
+	}
 	rh.ServeHTTP(w, req)
 }
 
@@ -350,6 +441,7 @@ func NewAPIHandler(pool *charmstore.Pool, config charmstore.ServerParams, rootPa
 // Close closes the ReqHandler. This should always be called when the
 // ReqHandler is done with.
 func (h *ReqHandler) Close() {
+	h.chargeRateForAddr()
 	h.Store.Close()
 	h.Cache.Close()
 	h.Reset()
@@ -363,6 +455,12 @@ func (h *ReqHandler) Reset() {
 	h.Handler = nil
 	h.Cache = nil
 	h.auth = Authorization{}
+	h.remoteAddr = ""
+	h.rateLimitKind = charmstore.ReadRequest
+	h.rateLimitPending = false
+	h.rateLimitAddr = ""
+	h.rateLimitHeader = nil
+	h.requestedSeries = ""
 }
 
 // ResolveURL implements router.Context.ResolveURL.
@@ -386,34 +484,68 @@ func (h *ReqHandler) ResolveURLs(urls []*charm.URL) ([]*router.ResolvedURL, erro
 
 // WillIncludeMetadata implements router.Context.WillIncludeMetadata.
 func (h *ReqHandler) WillIncludeMetadata(includes []string) {
+	// Metadata responses are sent with validators, so fetch the
+	// fields needed by EntityValidator too.
+	h.Cache.AddEntityFields(validatorEntityFields)
+	h.Cache.AddBaseEntityFields(validatorBaseEntityFields)
 	for _, inc := range includes {
 		// Find what handler will be used for the include
 		// and prime the cache so that it will preemptively fetch
 		// any fields involved.
 		fi, ok := h.Router.MetaHandler(inc).(*router.FieldIncludeHandler)
-		if !ok || len(fi.P.Fields) == 0 {
+		if !ok || fi.P.Fields == 0 {
 			continue
 		}
-		fields := make(map[string]int)
-		for _, f := range fi.P.Fields {
-			fields[f] = 1
-		}
 		switch fi.P.Key.(type) {
 		case entityHandlerKey:
-			h.Cache.AddEntityFields(fields)
+			h.Cache.AddEntityFields(fi.P.Fields)
 		case baseEntityHandlerKey:
-			h.Cache.AddBaseEntityFields(fields)
+			h.Cache.AddBaseEntityFields(fi.P.Fields)
 		}
 	}
 }
 
+var (
+	validatorEntityFields     = mongodoc.EntityFields.Set("uploadtime")
+	validatorBaseEntityFields = mongodoc.BaseEntityFields.Set("updatecount", "updatetime")
+)
+
+// EntityValidator implements router.Context.EntityValidator. The
+// validator changes whenever the entity is replaced or its base entity
+// update count changes, which happens when the base entity or any of
+// its entities are changed.
+func (h *ReqHandler) EntityValidator(id *router.ResolvedURL) (router.Validator, error) {
+	entity, err := h.Cache.Entity(&id.URL, validatorEntityFields)
+	if err != nil {
+		return router.Validator{}, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, validatorBaseEntityFields)
+	if err != nil {
+		return router.Validator{}, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	modTime := baseEntity.UpdateTime
+	if entity.UploadTime.After(modTime) {
+		modTime = entity.UploadTime
+	}
+	return router.Validator{
+		Tag: fmt.Sprintf("%s %s %d %d %d",
+			&id.URL,
+			id.PreferredSeries,
+			id.PromulgatedRevision,
+			entity.UploadTime.UnixNano(),
+			baseEntity.UpdateCount,
+		),
+		ModTime: modTime,
+	}, nil
+}
+
 // resolveURL implements URL resolving for the ReqHandler.
 // It's defined as a separate function so it can be more
 // easily unit-tested.
 func resolveURL(cache *entitycache.Cache, url *charm.URL) (*router.ResolvedURL, error) {
 	// We've added promulgated-url as a required field, so
 	// we'll always get it from the Entity result.
-	entity, err := cache.Entity(url, nil)
+	entity, err := cache.Entity(url, 0)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
@@ -430,7 +562,7 @@ func resolveURL(cache *entitycache.Cache, url *charm.URL) (*router.ResolvedURL,
 	// URL, it will hit the cached base entity.
 	// We don't actually care if it succeeds or fails, so we ignore
 	// the result.
-	cache.BaseEntity(entity.BaseURL, nil)
+	cache.BaseEntity(entity.BaseURL, 0)
 	return rurl, nil
 }
 
@@ -444,6 +576,21 @@ func (h *ReqHandler) EntityHandler(f EntityHandlerFunc, fields ...string) router
 	return h.puttableEntityHandler(f, nil, fields...)
 }
 
+// VolatileEntityHandler is like EntityHandler except that the results
+// of f may change even when the entity does not, so responses that
+// include them are sent without validators.
+func (h *ReqHandler) VolatileEntityHandler(f EntityHandlerFunc, fields ...string) router.BulkIncludeHandler {
+	return volatile(h.EntityHandler(f, fields...))
+}
+
+// volatile marks the given handler, which must have been created by
+// router.NewFieldIncludeHandler, as volatile.
+func volatile(h router.BulkIncludeHandler) router.BulkIncludeHandler {
+	fi := h.(*router.FieldIncludeHandler)
+	fi.P.Volatile = true
+	return fi
+}
+
 type entityHandlerKey struct{}
 
 func (h *ReqHandler) puttableEntityHandler(get EntityHandlerFunc, handlePut router.FieldPutFunc, fields ...string) router.BulkIncludeHandler {
@@ -455,7 +602,7 @@ func (h *ReqHandler) puttableEntityHandler(get EntityHandlerFunc, handlePut rout
 	return router.NewFieldIncludeHandler(router.FieldIncludeHandlerParams{
 		Key:          entityHandlerKey{},
 		Query:        h.entityQuery,
-		Fields:       fields,
+		Fields:       mongodoc.EntityFields.Set(fields...),
 		HandleGet:    handleGet,
 		HandlePut:    handlePut,
 		Update:       h.updateEntity,
@@ -480,7 +627,7 @@ func (h *ReqHandler) puttableBaseEntityHandler(get baseEntityHandlerFunc, handle
 	return router.NewFieldIncludeHandler(router.FieldIncludeHandlerParams{
 		Key:          baseEntityHandlerKey{},
 		Query:        h.baseEntityQuery,
-		Fields:       fields,
+		Fields:       mongodoc.BaseEntityFields.Set(fields...),
 		HandleGet:    handleGet,
 		HandlePut:    handlePut,
 		Update:       h.updateBaseEntity,
@@ -549,7 +696,7 @@ func (h *ReqHandler) updateSearchBase(id *router.ResolvedURL, fields map[string]
 	return nil
 }
 
-func (h *ReqHandler) baseEntityQuery(id *router.ResolvedURL, fields map[string]int, req *http.Request) (interface{}, error) {
+func (h *ReqHandler) baseEntityQuery(id *router.ResolvedURL, fields fieldset.Set, req *http.Request) (interface{}, error) {
 	val, err := h.Cache.BaseEntity(&id.URL, fields)
 	if errgo.Cause(err) == params.ErrNotFound {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", id)
@@ -560,8 +707,8 @@ func (h *ReqHandler) baseEntityQuery(id *router.ResolvedURL, fields map[string]i
 	return val, nil
 }
 
-func (h *ReqHandler) entityQuery(id *router.ResolvedURL, selector map[string]int, req *http.Request) (interface{}, error) {
-	val, err := h.Cache.Entity(&id.URL, selector)
+func (h *ReqHandler) entityQuery(id *router.ResolvedURL, fields fieldset.Set, req *http.Request) (interface{}, error) {
+	val, err := h.Cache.Entity(&id.URL, fields)
 	if errgo.Cause(err) == params.ErrNotFound {
 		logger.Infof("entity %#v not found: %#v", id, err)
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", id)
@@ -795,8 +942,12 @@ func (h *ReqHandler) metaStats(entity *mongodoc.Entity, id *router.ResolvedURL,
 			countsAllRevisions.LastMonth += countsAllRevisionsSeries.LastMonth
 		}
 	}
+	breakdown, err := router.ParseBool(flags.Get("breakdown"))
+	if err != nil {
+		return nil, badRequestf(err, "invalid breakdown parameter")
+	}
 	// Return the response.
-	return &params.StatsResponse{
+	resp := &params.StatsResponse{
 		ArchiveDownloadCount: counts.Total,
 		ArchiveDownload: params.StatsCount{
 			Total: counts.Total,
@@ -810,7 +961,28 @@ func (h *ReqHandler) metaStats(entity *mongodoc.Entity, id *router.ResolvedURL,
 			Week:  countsAllRevisions.LastWeek,
 			Month: countsAllRevisions.LastMonth,
 		},
-	}, nil
+	}
+	unique, err := router.ParseBool(flags.Get("unique"))
+	if err != nil {
+		return nil, badRequestf(err, "invalid unique parameter")
+	}
+	if !breakdown && !unique {
+		return resp, nil
+	}
+	result := &StatsResponse{
+		StatsResponse: *resp,
+	}
+	if breakdown {
+		if result, err = h.statsBreakdown(resp, &id.URL); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if unique {
+		if err := h.statsUnique(result, &id.URL); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return result, nil
 }
 
 // GET id/meta/revision-info
@@ -826,7 +998,7 @@ func (h *ReqHandler) metaRevisionInfo(id *router.ResolvedURL, path string, flags
 		q = q.Sort("-revision")
 	}
 	var response params.RevisionInfoResponse
-	iter := h.Cache.Iter(q, nil)
+	iter := h.Cache.Iter(q, 0)
 	for iter.Next() {
 		e := iter.Entity()
 		rurl := charmstore.EntityResolvedURL(e)
@@ -953,12 +1125,12 @@ func (h *ReqHandler) putMetaExtraInfo(id *router.ResolvedURL, path string, val *
 			return err
 		}
 	}
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("extrainfo"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
 	for key, val := range fields {
-		if val == nil {
-			updater.UpdateField("extrainfo."+key, nil, nil)
-		} else {
-			updater.UpdateField("extrainfo."+key, *val, nil)
-		}
+		updateInfoField(updater, audit.OpSetExtraInfo, id, "extrainfo", entity.ExtraInfo, key, val)
 	}
 	return nil
 }
@@ -972,13 +1144,11 @@ func (h *ReqHandler) putMetaExtraInfoWithKey(id *router.ResolvedURL, path string
 	if err := checkExtraInfoKey(key, "extra-info"); err != nil {
 		return err
 	}
-	// If the user puts null, we treat that as if they want to
-	// delete the field.
-	if val == nil || bytes.Equal(*val, nullBytes) {
-		updater.UpdateField("extrainfo."+key, nil, nil)
-	} else {
-		updater.UpdateField("extrainfo."+key, *val, nil)
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("extrainfo"))
+	if err != nil {
+		return errgo.Mask(err)
 	}
+	updateInfoField(updater, audit.OpSetExtraInfo, id, "extrainfo", entity.ExtraInfo, key, val)
 	return nil
 }
 
@@ -1020,12 +1190,12 @@ func (h *ReqHandler) putMetaCommonInfo(id *router.ResolvedURL, path string, val
 			return err
 		}
 	}
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, mongodoc.BaseEntityFields.Set("commoninfo"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
 	for key, val := range fields {
-		if val == nil {
-			updater.UpdateField("commoninfo."+key, nil, nil)
-		} else {
-			updater.UpdateField("commoninfo."+key, *val, nil)
-		}
+		updateInfoField(updater, audit.OpSetCommonInfo, id, "commoninfo", baseEntity.CommonInfo, key, val)
 	}
 	return nil
 }
@@ -1037,16 +1207,35 @@ func (h *ReqHandler) putMetaCommonInfoWithKey(id *router.ResolvedURL, path strin
 	if err := checkExtraInfoKey(key, "common-info"); err != nil {
 		return err
 	}
-	// If the user puts null, we treat that as if they want to
-	// delete the field.
-	if val == nil || bytes.Equal(*val, nullBytes) {
-		updater.UpdateField("commoninfo."+key, nil, nil)
-	} else {
-		updater.UpdateField("commoninfo."+key, *val, nil)
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, mongodoc.BaseEntityFields.Set("commoninfo"))
+	if err != nil {
+		return errgo.Mask(err)
 	}
+	updateInfoField(updater, audit.OpSetCommonInfo, id, "commoninfo", baseEntity.CommonInfo, key, val)
 	return nil
 }
 
+// updateInfoField requests that the given key within the given
+// extra-info or common-info field is set to val, recording the
+// change with an audit entry with the given operation. The current
+// map holds the existing values of the field. If val is nil or
+// holds null, the key is removed.
+func updateInfoField(updater *router.FieldUpdater, op audit.Operation, id *router.ResolvedURL, field string, current map[string][]byte, key string, val *json.RawMessage) {
+	var oldVal, newVal interface{}
+	if data, ok := current[key]; ok {
+		oldVal = json.RawMessage(data)
+	}
+	if val != nil && !bytes.Equal(*val, nullBytes) {
+		newVal = *val
+	}
+	updater.UpdateField(field+"."+key, newVal, &audit.Entry{
+		Op:       op,
+		Entity:   &id.URL,
+		OldValue: map[string]interface{}{key: oldVal},
+		NewValue: map[string]interface{}{key: newVal},
+	})
+}
+
 func checkExtraInfoKey(key string, field string) error {
 	if strings.ContainsAny(key, "./$") {
 		return errgo.WithCausef(nil, params.ErrBadRequest, "bad key for "+field)
@@ -1056,22 +1245,44 @@ func checkExtraInfoKey(key string, field string) error {
 
 // GET id/meta/perm
 // https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetaperm
-func (h *ReqHandler) metaPerm(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
-	ch, err := h.entityChannel(id)
-	if err != nil {
-		return nil, errgo.Mask(err)
+//
+// PermHandler returns the handler for the meta/perm endpoint, which
+// uses resp to form the response to a GET request from the ACL of the
+// requested entity's channel. It allows older API versions to report
+// only the permissions that they know about.
+func (h *ReqHandler) PermHandler(resp func(acl mongodoc.ACL) interface{}) router.BulkIncludeHandler {
+	get := func(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+		ch, err := h.entityChannel(id)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return resp(entity.ChannelACLs[ch]), nil
+	}
+	return h.puttableBaseEntityHandler(get, h.putMetaPerm, "channelacls")
+}
+
+// permResponse returns the response to a meta/perm request
+// for an entity with the given ACL.
+func permResponse(acl mongodoc.ACL) interface{} {
+	return PermResponse{
+		PermResponse: params.PermResponse{
+			Read:  acl.Read,
+			Write: acl.Write,
+		},
+		Upload:  acl.Upload,
+		Publish: acl.Publish,
+		SetPerm: acl.SetPerm,
+		Delete:  acl.Delete,
 	}
-	acls := entity.ChannelACLs[ch]
-	return params.PermResponse{
-		Read:  acls.Read,
-		Write: acls.Write,
-	}, nil
 }
 
 // PUT id/meta/perm
 // https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idmeta
 func (h *ReqHandler) putMetaPerm(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
-	var perms params.PermRequest
+	if err := h.AuthorizeEntityForOp(id, req, OpSetPerm); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var perms PermRequest
 	if err := json.Unmarshal(*val, &perms); err != nil {
 		return errgo.Mask(err)
 	}
@@ -1080,20 +1291,32 @@ func (h *ReqHandler) putMetaPerm(id *router.ResolvedURL, path string, val *json.
 		return errgo.Mask(err)
 	}
 	// TODO use only one UpdateField operation?
-	updater.UpdateField(string("channelacls."+ch+".read"), perms.Read, &audit.Entry{
-		Op:     audit.OpSetPerm,
-		Entity: &id.URL,
-		ACL: &audit.ACL{
-			Read: perms.Read,
-		},
-	})
-	updater.UpdateField(string("channelacls."+ch+".write"), perms.Write, &audit.Entry{
-		Op:     audit.OpSetPerm,
-		Entity: &id.URL,
-		ACL: &audit.ACL{
-			Write: perms.Write,
-		},
-	})
+	setPerm(updater, id, ch, "read", perms.Read)
+	// Fine-grained permissions that are not specified are derived
+	// from the write permission, so that a change made by a client
+	// that only knows about read and write permissions takes
+	// effect for all operations.
+	fineGrained := []struct {
+		key   string
+		perms []string
+	}{
+		{"upload", perms.Upload},
+		{"publish", perms.Publish},
+		{"set-perm", perms.SetPerm},
+		{"delete", perms.Delete},
+	}
+	writeKeys := []string{"write"}
+	for _, p := range fineGrained {
+		if p.perms == nil {
+			writeKeys = append(writeKeys, p.key)
+		}
+	}
+	setPerms(updater, id, ch, writeKeys, perms.Write)
+	for _, p := range fineGrained {
+		if p.perms != nil {
+			setPerm(updater, id, ch, p.key, p.perms)
+		}
+	}
 	updater.UpdateSearch()
 	return nil
 }
@@ -1133,19 +1356,23 @@ func (h *ReqHandler) metaPermWithKey(entity *mongodoc.BaseEntity, id *router.Res
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	acls := entity.ChannelACLs[ch]
-	switch path {
-	case "/read":
-		return acls.Read, nil
-	case "/write":
-		return acls.Write, nil
+	perms, ok := aclPerm(entity.ChannelACLs[ch], strings.TrimPrefix(path, "/"))
+	if !ok {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "unknown permission")
 	}
-	return nil, errgo.WithCausef(nil, params.ErrNotFound, "unknown permission")
+	return perms, nil
 }
 
 // PUT id/meta/perm/key
 // https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idmetapermkey
 func (h *ReqHandler) putMetaPermWithKey(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	key := strings.TrimPrefix(path, "/")
+	if _, ok := aclPerm(mongodoc.ACL{}, key); !ok {
+		return errgo.WithCausef(nil, params.ErrNotFound, "unknown permission")
+	}
+	if err := h.AuthorizeEntityForOp(id, req, OpSetPerm); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
 	ch, err := h.entityChannel(id)
 	if err != nil {
 		return errgo.Mask(err)
@@ -1154,34 +1381,24 @@ func (h *ReqHandler) putMetaPermWithKey(id *router.ResolvedURL, path string, val
 	if err := json.Unmarshal(*val, &perms); err != nil {
 		return errgo.Mask(err)
 	}
-	switch path {
-	case "/read":
-		updater.UpdateField(string("channelacls."+ch+".read"), perms, &audit.Entry{
-			Op:     audit.OpSetPerm,
-			Entity: &id.URL,
-			ACL: &audit.ACL{
-				Read: perms,
-			},
-		})
+	if key == "write" {
+		// Setting the write permission also sets the permissions
+		// derived from it. Clients can set those separately
+		// afterwards.
+		setPerms(updater, id, ch, append([]string{key}, writeDerivedPerms...), perms)
+	} else {
+		setPerm(updater, id, ch, key, perms)
+	}
+	if key == "read" {
 		updater.UpdateSearch()
-		return nil
-	case "/write":
-		updater.UpdateField(string("channelacls."+ch+".write"), perms, &audit.Entry{
-			Op:     audit.OpSetPerm,
-			Entity: &id.URL,
-			ACL: &audit.ACL{
-				Write: perms,
-			},
-		})
-		return nil
 	}
-	return errgo.WithCausef(nil, params.ErrNotFound, "unknown permission")
+	return nil
 }
 
 // GET id/meta/published
 // https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetapublished
 func (h *ReqHandler) metaPublished(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
-	baseEntity, err := h.Cache.BaseEntity(entity.URL, charmstore.FieldSelector("channelentities"))
+	baseEntity, err := h.Cache.BaseEntity(entity.URL, mongodoc.BaseEntityFields.Set("channelentities"))
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -1257,7 +1474,7 @@ func (h *ReqHandler) serveChangesPublished(_ http.Header, r *http.Request) (inte
 	query := h.Store.DB.Entities().
 		Find(findQuery).
 		Sort("-uploadtime")
-	iter := h.Cache.Iter(query, charmstore.FieldSelector("uploadtime"))
+	iter := h.Cache.Iter(query, mongodoc.EntityFields.Set("uploadtime"))
 
 	results := []params.Published{}
 	var count int
@@ -1310,6 +1527,9 @@ func (h *ReqHandler) serveDelegatableMacaroon(_ http.Header, req *http.Request)
 		if err != nil {
 			return nil, errgo.Mask(err, errgo.Any)
 		}
+		if auth.AuthMethod == authMethodOIDC {
+			return nil, errgo.WithCausef(nil, params.ErrForbidden, "delegatable macaroon is not obtainable using an ID token")
+		}
 		if auth.User == nil {
 			return nil, errgo.WithCausef(nil, params.ErrForbidden, "delegatable macaroon is not obtainable using admin credentials")
 		}
@@ -1356,12 +1576,22 @@ func (h *ReqHandler) serveDelegatableMacaroon(_ http.Header, req *http.Request)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
+	if auth.AuthMethod == authMethodOIDC {
+		// The macaroon would declare the user without the groups
+		// asserted by the ID token.
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "delegatable macaroon is not obtainable using an ID token")
+	}
 	if auth.User == nil {
 		if !auth.Admin {
 			return nil, errgo.WithCausef(nil, params.ErrForbidden, "delegatable macaroon cannot be obtained for public entities")
 		}
 		return nil, errgo.WithCausef(nil, params.ErrForbidden, "delegatable macaroon is not obtainable using admin credentials (admin %v)", auth.Admin)
 	}
+	if auth.Token != nil {
+		// The macaroon would not be restricted to the
+		// scope of the token.
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "delegatable macaroon is not obtainable using an access token")
+	}
 
 	longTermBakery := h.Store.BakeryWithPolicy(mgostorage.Policy{
 		ExpiryDuration:   1e6 * time.Hour,     // 116 years...
@@ -1393,7 +1623,7 @@ func (h *ReqHandler) serveWhoAmI(_ http.Header, req *http.Request) (interface{},
 	if auth.Admin {
 		return nil, errgo.WithCausef(nil, params.ErrForbidden, "admin credentials used")
 	}
-	groups, err := auth.User.Groups()
+	groups, err := h.UserGroups(auth)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
@@ -1435,13 +1665,14 @@ func (h *ReqHandler) servePromulgate(id *router.ResolvedURL, w http.ResponseWrit
 	}
 
 	if promulgate.Promulgated {
-		// Set write permissions to promulgators only, so that
-		// the user cannot just publish newer promulgated
+		// Set write and publish permissions to promulgators only,
+		// so that the user cannot just publish newer promulgated
 		// versions of the charm or bundle. Promulgators are
 		// responsible of reviewing and publishing subsequent
 		// revisions of this entity.
 		if err := h.updateBaseEntity(id, map[string]interface{}{
-			"channelacls.stable.write": []string{PromulgatorsGroup},
+			"channelacls.stable.write":   []string{PromulgatorsGroup},
+			"channelacls.stable.publish": []string{PromulgatorsGroup},
 		}, nil); err != nil {
 			return errgo.Notef(err, "cannot set permissions for %q", id)
 		}
@@ -1471,7 +1702,7 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 
 	// Retrieve the requested action from the request body.
 	var publish struct {
-		params.PublishRequest `httprequest:",body"`
+		PublishRequest `httprequest:",body"`
 	}
 	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &publish); err != nil {
 		return badRequestf(err, "cannot unmarshal publish request body")
@@ -1493,12 +1724,12 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 	}
 
 	// Retrieve the base entity so that we can check permissions.
-	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls"))
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, mongodoc.BaseEntityFields.Set("channelacls"))
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
 
-	// Authorize the operation. Users must have write permissions on the ACLs
+	// Authorize the operation. Users must have publish permissions on the ACLs
 	// on all the channels being published to.
 	acls := make([]mongodoc.ACL, 0, len(chans))
 	for _, c := range chans {
@@ -1509,21 +1740,74 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 		acls:             acls,
 		entityIds:        []*router.ResolvedURL{id},
 		ignoreEntityACLs: true, // acls holds all the ACLs we care about.
-		ops:              []string{OpWrite},
+		ops:              []string{OpPublish},
+		publishChannels:  chans,
 	}); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 
+	// Build the audit entries before publishing so that
+	// they record the previously published entities.
+	entries, err := h.publishAuditEntries(id, chans)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+
 	if err := h.Store.Publish(id, publish.Resources, chans...); err != nil {
 		if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
 			return errgo.WithCausef(err, params.ErrBadRequest, "")
 		}
 		return errgo.NoteMask(err, "cannot publish charm or bundle", errgo.Is(params.ErrNotFound))
 	}
-	// TODO add publish audit
+	h.processEntries(entries)
+
+	// Set the release notes only when the entity has actually
+	// been published.
+	if err := h.setReleaseNotes(id, publish.ReleaseNotes); err != nil {
+		return errgo.Mask(err)
+	}
 	return nil
 }
 
+// publishAuditEntries returns the audit entries recording the
+// publication of the given entity to the given channels. The old
+// value of each entry holds the entities, keyed by series, that were
+// previously published to the channel for the series supported by the
+// entity.
+func (h *ReqHandler) publishAuditEntries(id *router.ResolvedURL, chans []params.Channel) ([]audit.Entry, error) {
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("series", "supportedseries"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, mongodoc.BaseEntityFields.Set("channelentities"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	series := entity.SupportedSeries
+	if len(series) == 0 {
+		series = []string{entity.Series}
+	}
+	entries := make([]audit.Entry, len(chans))
+	for i, c := range chans {
+		entries[i] = audit.Entry{
+			Op:       audit.OpPublish,
+			Entity:   &id.URL,
+			Channel:  string(c),
+			NewValue: &id.URL,
+		}
+		old := make(map[string]*charm.URL)
+		for _, s := range series {
+			if u := baseEntity.ChannelEntities[c][s]; u != nil {
+				old[s] = u
+			}
+		}
+		if len(old) > 0 {
+			entries[i].OldValue = old
+		}
+	}
+	return entries, nil
+}
+
 // serveSetAuthCookie sets the provided macaroon slice as a cookie on the
 // client.
 func (h *ReqHandler) serveSetAuthCookie(w http.ResponseWriter, req *http.Request) error {
@@ -1570,6 +1854,31 @@ func (h *ReqHandler) AuthIdHandler(f ResolvedIdHandler) ResolvedIdHandler {
 	}
 }
 
+// uploadAuthIdHandler is like AuthIdHandler except that it is used for
+// endpoints that upload content for an entity, such as resources.
+// Requests that add content are authorized with OpUpload and DELETE
+// requests with OpDelete, as for the entity archive.
+func (h *ReqHandler) uploadAuthIdHandler(f ResolvedIdHandler) ResolvedIdHandler {
+	return func(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+		var op string
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS":
+			op = OpReadWithNoTerms
+		case "DELETE":
+			op = OpDelete
+		default:
+			op = OpUpload
+		}
+		if err := h.AuthorizeEntityForOp(id, req, op); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if err := f(id, w, req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return nil
+	}
+}
+
 // ResolvedIdHandler returns an id handler that uses h.Router.Context.ResolveURL
 // to resolves any entity ids before calling f with the resolved id.
 //
@@ -1579,7 +1888,7 @@ func (h *ReqHandler) AuthIdHandler(f ResolvedIdHandler) ResolvedIdHandler {
 // Note that it only accesses h.Router.Context when the returned
 // handler is called.
 func (h *ReqHandler) ResolvedIdHandler(f ResolvedIdHandler, cacheFields ...string) router.IdHandler {
-	fields := charmstore.FieldSelector(cacheFields...)
+	fields := mongodoc.EntityFields.Set(cacheFields...)
 	return func(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
 		h.Cache.AddEntityFields(fields)
 		rid, err := h.Router.Context.ResolveURL(id)
@@ -1607,15 +1916,18 @@ func reqBodyReadHandler(f router.IdHandler) router.IdHandler {
 var testAddAuditCallback func(e audit.Entry)
 
 // addAudit delegates an audit entry to the store to record an audit log after
-// it has set correctly the user doing the action.
+// it has set correctly the user doing the action, the address of the
+// requester and the authentication method used.
 func (h *ReqHandler) addAudit(e audit.Entry) {
-	if h.auth.User == nil && !h.auth.Admin {
+	if h.auth.Username == "" && !h.auth.Admin {
 		panic("No auth set in ReqHandler")
 	}
 	e.User = h.auth.Username
 	if h.auth.Admin && e.User == "" {
 		e.User = "admin"
 	}
+	e.RemoteAddr = h.remoteAddr
+	e.AuthMethod = h.auth.AuthMethod
 	h.Store.AddAudit(e)
 	if testAddAuditCallback != nil {
 		testAddAuditCallback(e)
@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strconv"
 	"strings"
@@ -377,16 +378,28 @@ var metaEndpoints = []metaEndpoint{{
 		if err != nil {
 			return nil, err
 		}
-		return params.PermResponse{
-			Read:  acls.Read,
-			Write: acls.Write,
+		return v5.PermResponse{
+			PermResponse: params.PermResponse{
+				Read:  acls.Read,
+				Write: acls.Write,
+			},
+			Upload:  acls.Upload,
+			Publish: acls.Publish,
+			SetPerm: acls.SetPerm,
+			Delete:  acls.Delete,
 		}, nil
 	},
 	checkURL: newResolvedURL("~bob/utopic/wordpress-2", -1),
 	assertCheckData: func(c *gc.C, data interface{}) {
-		c.Assert(data, gc.DeepEquals, params.PermResponse{
-			Read:  []string{params.Everyone},
-			Write: []string{"bob"},
+		c.Assert(data, jc.DeepEquals, v5.PermResponse{
+			PermResponse: params.PermResponse{
+				Read:  []string{params.Everyone},
+				Write: []string{"bob"},
+			},
+			Upload:  []string{"bob"},
+			Publish: []string{"bob"},
+			SetPerm: []string{"bob"},
+			Delete:  []string{"bob"},
 		})
 	},
 }, {
@@ -413,6 +426,27 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data, gc.DeepEquals, params.CanWriteResponse{false})
 	},
+}, {
+	name: "audit",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		// The audit log is only visible to users that can write
+		// to the entity.
+		if url.URL.User != "charmers" {
+			return nil, nil
+		}
+		return store.AuditEntries(charmstore.AuditQuery{
+			Entity: &url.URL,
+		})
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		// The test entities have had their extra-info and
+		// common-info set, most recent first.
+		entries := data.([]audit.Entry)
+		c.Assert(entries, gc.HasLen, 2)
+		c.Assert(entries[0].Op, gc.Equals, audit.OpSetCommonInfo)
+		c.Assert(entries[1].Op, gc.Equals, audit.OpSetExtraInfo)
+	},
 }, {
 	name: "tags",
 	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
@@ -576,7 +610,7 @@ var metaEndpoints = []metaEndpoint{{
 		if err != nil {
 			return resources, err
 		}
-		results := make([]params.Resource, 0, len(resources))
+		results := make([]v5.Resource, 0, len(resources))
 		for _, res := range resources {
 			r, err := v5.FromResourceDoc(res, entity.CharmMeta.Resources)
 			if err != nil {
@@ -589,29 +623,38 @@ var metaEndpoints = []metaEndpoint{{
 	exclusive: charmOnly,
 	checkURL:  newResolvedURL("cs:~charmers/utopic/starsay-17", 17),
 	assertCheckData: func(c *gc.C, data interface{}) {
-		c.Assert(data, jc.DeepEquals, []params.Resource{{
-			Name:        "for-install",
-			Type:        "file",
-			Path:        "initial.tgz",
-			Revision:    0,
-			Fingerprint: rawHash(hashOfString("for-install content")),
-			Size:        int64(len("for-install content")),
-			Description: "get things started",
+		c.Assert(data, jc.DeepEquals, []v5.Resource{{
+			Resource: params.Resource{
+				Name:        "for-install",
+				Type:        "file",
+				Path:        "initial.tgz",
+				Revision:    0,
+				Fingerprint: rawHash(hashOfString("for-install content")),
+				Size:        int64(len("for-install content")),
+				Description: "get things started",
+			},
+			SHA256: hash256OfString("for-install content"),
 		}, {
-			Name:        "for-store",
-			Type:        "file",
-			Path:        "dummy.tgz",
-			Revision:    0,
-			Fingerprint: rawHash(hashOfString("for-store content")),
-			Size:        int64(len("for-store content")),
-			Description: "One line that is useful when operators need to push it.",
+			Resource: params.Resource{
+				Name:        "for-store",
+				Type:        "file",
+				Path:        "dummy.tgz",
+				Revision:    0,
+				Fingerprint: rawHash(hashOfString("for-store content")),
+				Size:        int64(len("for-store content")),
+				Description: "One line that is useful when operators need to push it.",
+			},
+			SHA256: hash256OfString("for-store content"),
 		}, {
-			Name:        "for-upload",
-			Type:        "file",
-			Path:        "config.xml",
-			Fingerprint: rawHash(hashOfString("for-upload content")),
-			Size:        int64(len("for-upload content")),
-			Description: "Who uses xml anymore?",
+			Resource: params.Resource{
+				Name:        "for-upload",
+				Type:        "file",
+				Path:        "config.xml",
+				Fingerprint: rawHash(hashOfString("for-upload content")),
+				Size:        int64(len("for-upload content")),
+				Description: "Who uses xml anymore?",
+			},
+			SHA256: hash256OfString("for-upload content"),
 		}})
 	},
 }, {
@@ -620,26 +663,32 @@ var metaEndpoints = []metaEndpoint{{
 		if url.URL.Name != "starsay" {
 			return nil, nil
 		}
-		return &params.Resource{
-			Name:        "for-install",
-			Type:        "file",
-			Path:        "initial.tgz",
-			Description: "get things started",
-			Revision:    0,
-			Fingerprint: rawHash(hashOfString("for-install content")),
-			Size:        int64(len("for-install content")),
+		return &v5.Resource{
+			Resource: params.Resource{
+				Name:        "for-install",
+				Type:        "file",
+				Path:        "initial.tgz",
+				Description: "get things started",
+				Revision:    0,
+				Fingerprint: rawHash(hashOfString("for-install content")),
+				Size:        int64(len("for-install content")),
+			},
+			SHA256: hash256OfString("for-install content"),
 		}, nil
 	},
 	checkURL: newResolvedURL("cs:~charmers/utopic/starsay-17", 17),
 	assertCheckData: func(c *gc.C, data interface{}) {
-		c.Assert(data, jc.DeepEquals, &params.Resource{
-			Name:        "for-install",
-			Type:        "file",
-			Path:        "initial.tgz",
-			Description: "get things started",
-			Revision:    0,
-			Fingerprint: rawHash(hashOfString("for-install content")),
-			Size:        int64(len("for-install content")),
+		c.Assert(data, jc.DeepEquals, &v5.Resource{
+			Resource: params.Resource{
+				Name:        "for-install",
+				Type:        "file",
+				Path:        "initial.tgz",
+				Description: "get things started",
+				Revision:    0,
+				Fingerprint: rawHash(hashOfString("for-install content")),
+				Size:        int64(len("for-install content")),
+			},
+			SHA256: hash256OfString("for-install content"),
 		})
 	},
 }, {
@@ -663,6 +712,17 @@ var metaEndpoints = []metaEndpoint{{
 			}},
 		})
 	},
+}, {
+	name: "release-notes",
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		return &v5.ReleaseNotesResponse{
+			ReleaseNotes: entity.ReleaseNotes,
+		}
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.ReleaseNotesResponse{})
+	},
 }}
 
 // TestEndpointGet tries to ensure that the endpoint
@@ -935,54 +995,80 @@ func (s *APISuite) TestMetaPublished(c *gc.C) {
 }
 
 func (s *APISuite) TestMetaPermAudit(c *gc.C) {
-	var calledEntities []audit.Entry
-	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
-		calledEntities = append(calledEntities, e)
-	})
+	calledEntities := s.recordAuditEntries(c)
 	s.idmServer.SetDefaultUser("bob")
 
 	url := newResolvedURL("~bob/precise/wordpress-23", 23)
 	s.addPublicCharmFromRepo(c, "wordpress", url)
 	s.assertPut(c, "precise/wordpress-23/meta/perm/read", []string{"charlie"})
-	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+	c.Assert(*calledEntities, jc.DeepEquals, []audit.Entry{{
 		User: "bob",
 		Op:   audit.OpSetPerm,
 		ACL: &audit.ACL{
 			Read: []string{"charlie"},
 		},
-		Entity: charm.MustParseURL("~bob/precise/wordpress-23"),
+		Entity:     charm.MustParseURL("~bob/precise/wordpress-23"),
+		Channel:    "stable",
+		AuthMethod: "macaroon",
 	}})
-	calledEntities = []audit.Entry{}
+	*calledEntities = []audit.Entry{}
 
 	s.assertPutAsAdmin(c, "precise/wordpress-23/meta/perm/write", []string{"bob", "foo"})
-	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+	c.Assert(*calledEntities, jc.DeepEquals, []audit.Entry{{
 		User: "admin",
 		Op:   audit.OpSetPerm,
 		ACL: &audit.ACL{
-			Write: []string{"bob", "foo"},
-		},
-		Entity: charm.MustParseURL("~bob/precise/wordpress-23"),
+			Write:   []string{"bob", "foo"},
+			Upload:  []string{"bob", "foo"},
+			Publish: []string{"bob", "foo"},
+			SetPerm: []string{"bob", "foo"},
+			Delete:  []string{"bob", "foo"},
+		},
+		Entity:     charm.MustParseURL("~bob/precise/wordpress-23"),
+		Channel:    "stable",
+		AuthMethod: "basic",
 	}})
-	calledEntities = []audit.Entry{}
+	*calledEntities = []audit.Entry{}
 
 	s.assertPut(c, "precise/wordpress-23/meta/perm", params.PermRequest{
 		Read:  []string{"a"},
 		Write: []string{"b", "c"},
 	})
-	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+	c.Assert(*calledEntities, jc.DeepEquals, []audit.Entry{{
 		User: "bob",
 		Op:   audit.OpSetPerm,
 		ACL: &audit.ACL{
 			Read: []string{"a"},
 		},
-		Entity: charm.MustParseURL("~bob/precise/wordpress-23"),
+		Entity:     charm.MustParseURL("~bob/precise/wordpress-23"),
+		Channel:    "stable",
+		AuthMethod: "macaroon",
 	}, {
 		User: "bob",
 		Op:   audit.OpSetPerm,
 		ACL: &audit.ACL{
-			Write: []string{"b", "c"},
+			Write:   []string{"b", "c"},
+			Upload:  []string{"b", "c"},
+			Publish: []string{"b", "c"},
+			SetPerm: []string{"b", "c"},
+			Delete:  []string{"b", "c"},
+		},
+		Entity:     charm.MustParseURL("~bob/precise/wordpress-23"),
+		Channel:    "stable",
+		AuthMethod: "macaroon",
+	}})
+	*calledEntities = []audit.Entry{}
+
+	s.assertPutAsAdmin(c, "precise/wordpress-23/meta/perm/publish", []string{"charmers"})
+	c.Assert(*calledEntities, jc.DeepEquals, []audit.Entry{{
+		User: "admin",
+		Op:   audit.OpSetPerm,
+		ACL: &audit.ACL{
+			Publish: []string{"charmers"},
 		},
-		Entity: charm.MustParseURL("~bob/precise/wordpress-23"),
+		Entity:     charm.MustParseURL("~bob/precise/wordpress-23"),
+		Channel:    "stable",
+		AuthMethod: "basic",
 	}})
 }
 
@@ -1019,10 +1105,10 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 		c.Assert(err, gc.Equals, nil)
 	}
 	s.doAsUser("charmers", func() {
-		s.assertGet(c, "wordpress/meta/perm?channel=unpublished", params.PermResponse{
+		s.assertGet(c, "wordpress/meta/perm?channel=unpublished", derivedPermResponse(params.PermResponse{
 			Read:  []string{"charmers"},
 			Write: []string{"charmers"},
-		})
+		}))
 	})
 	s.assertChannelACLs(c, "precise/wordpress-23", map[params.Channel]mongodoc.ACL{
 		params.UnpublishedChannel: {
@@ -1067,10 +1153,10 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 				Handler: s.srv,
 				Do:      bakeryDo(nil),
 				URL:     storeURL(u + "/meta/perm"),
-				ExpectBody: params.PermResponse{
+				ExpectBody: derivedPermResponse(params.PermResponse{
 					Read:  []string{"bob"},
 					Write: []string{"admin"},
-				},
+				}),
 			})
 		}
 	})
@@ -1117,20 +1203,20 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 			Handler: s.srv,
 			Do:      bakeryDo(nil),
 			URL:     storeURL("precise/wordpress-23/meta/perm"),
-			ExpectBody: params.PermResponse{
+			ExpectBody: derivedPermResponse(params.PermResponse{
 				Read:  []string{"bob", "charlie"},
 				Write: []string{"charmers"},
-			},
+			}),
 		})
 		// The other revisions should still see the old ACLs.
 		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
 			Handler: s.srv,
 			Do:      bakeryDo(nil),
 			URL:     storeURL("precise/wordpress-24/meta/perm"),
-			ExpectBody: params.PermResponse{
+			ExpectBody: derivedPermResponse(params.PermResponse{
 				Read:  []string{"bob"},
 				Write: []string{"admin"},
-			},
+			}),
 		})
 	})
 
@@ -1170,10 +1256,10 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 			Handler: s.srv,
 			Do:      bakeryDo(nil),
 			URL:     storeURL("~charmers/trusty/wordpress-1/meta/perm"),
-			ExpectBody: params.PermResponse{
+			ExpectBody: derivedPermResponse(params.PermResponse{
 				Read:  []string{"charmers"},
 				Write: []string{"doris"},
-			},
+			}),
 		})
 	})
 
@@ -1183,10 +1269,10 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 			Handler: s.srv,
 			Do:      bakeryDo(nil),
 			URL:     storeURL("precise/wordpress-24/meta/perm"),
-			ExpectBody: params.PermResponse{
+			ExpectBody: derivedPermResponse(params.PermResponse{
 				Read:  []string{"bob"},
 				Write: []string{"admin"},
-			},
+			}),
 		})
 
 		// The edge-channel entity should still see the edge ACLS.
@@ -1194,10 +1280,10 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 			Handler: s.srv,
 			Do:      bakeryDo(nil),
 			URL:     storeURL("precise/wordpress-23/meta/perm"),
-			ExpectBody: params.PermResponse{
+			ExpectBody: derivedPermResponse(params.PermResponse{
 				Read:  []string{"bob", "charlie"},
 				Write: []string{"charmers"},
-			},
+			}),
 		})
 	})
 
@@ -1255,10 +1341,10 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 	})
 
 	s.doAsUser("bob", func() {
-		s.assertGet(c, "wordpress/meta/perm", params.PermResponse{
+		s.assertGet(c, "wordpress/meta/perm", derivedPermResponse(params.PermResponse{
 			Read:  []string{"bob", params.Everyone},
 			Write: []string{"doris"},
-		})
+		}))
 		s.assertGet(c, "wordpress/meta/perm/read", []string{"bob", params.Everyone})
 	})
 	s.assertChannelACLs(c, "precise/wordpress-23", map[params.Channel]mongodoc.ACL{
@@ -1416,14 +1502,14 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 	// Similarly, we should be able to specify a channel on read
 	// to read a different channel.
 	s.doAsUser("bob", func() {
-		s.assertGet(c, "trusty/wordpress/meta/perm?channel=unpublished", params.PermResponse{
+		s.assertGet(c, "trusty/wordpress/meta/perm?channel=unpublished", derivedPermResponse(params.PermResponse{
 			Read:  []string{"bob"},
 			Write: []string{"admin"},
-		})
-		s.assertGet(c, "wordpress/meta/perm?channel=edge", params.PermResponse{
+		}))
+		s.assertGet(c, "wordpress/meta/perm?channel=edge", derivedPermResponse(params.PermResponse{
 			Read:  []string{"bob", "charlie"},
 			Write: []string{"charmers"},
-		})
+		}))
 	})
 
 	// We can't write to a channel that the charm's not in.
@@ -1468,6 +1554,32 @@ func (s *APISuite) TestMetaPerm(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestMetaPermFineGrained(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~bob/precise/wordpress-23", 23))
+
+	// Setting the write permission sets the permissions derived from it.
+	s.assertPutAsAdmin(c, "~bob/precise/wordpress-23/meta/perm/write", []string{"bob", "alice"})
+	s.assertGet(c, "~bob/precise/wordpress-23/meta/perm", derivedPermResponse(params.PermResponse{
+		Read:  []string{params.Everyone},
+		Write: []string{"bob", "alice"},
+	}))
+
+	// The fine-grained permissions can then be changed individually.
+	s.assertPutAsAdmin(c, "~bob/precise/wordpress-23/meta/perm/publish", []string{"charmers"})
+	s.assertPutAsAdmin(c, "~bob/precise/wordpress-23/meta/perm/delete", []string{})
+	s.assertGet(c, "~bob/precise/wordpress-23/meta/perm/publish", []string{"charmers"})
+	e, err := s.store.FindBaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.ChannelACLs[params.StableChannel], jc.DeepEquals, mongodoc.ACL{
+		Read:    []string{params.Everyone},
+		Write:   []string{"bob", "alice"},
+		Upload:  []string{"bob", "alice"},
+		Publish: []string{"charmers"},
+		SetPerm: []string{"bob", "alice"},
+		Delete:  []string{},
+	})
+}
+
 func (s *APISuite) TestMetaPermPutUnauthorized(c *gc.C) {
 	id := "precise/wordpress-23"
 	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/"+id, 23))
@@ -1555,6 +1667,67 @@ func (s *APISuite) TestMetaCanWriteWithAnotherMeta(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestMetaConditionalRequests(c *gc.C) {
+	id, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-23", 23))
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		h := basicAuthHeader(testUsername, testPassword)
+		for k, v := range header {
+			h[k] = v
+		}
+		return httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL(path),
+			Header:  h,
+		})
+	}
+	rec := get("~charmers/precise/wordpress-23/meta/extra-info", nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	etag := rec.Header().Get("ETag")
+	c.Assert(etag, gc.Not(gc.Equals), "")
+	lastModified := rec.Header().Get("Last-Modified")
+	c.Assert(lastModified, gc.Not(gc.Equals), "")
+	c.Assert(rec.Header().Get("Vary"), gc.Equals, "Authorization, Cookie, Macaroons")
+
+	// The metadata has not changed.
+	rec = get("~charmers/precise/wordpress-23/meta/extra-info", http.Header{"If-None-Match": {etag}})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), gc.Equals, 0)
+	rec = get("~charmers/precise/wordpress-23/meta/extra-info", http.Header{"If-Modified-Since": {lastModified}})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+
+	// Volatile metadata is sent without validators.
+	rec = get("~charmers/precise/wordpress-23/meta/any?include=extra-info&include=stats", nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("ETag"), gc.Equals, "")
+
+	// Changing the entity changes the tag.
+	s.assertPutAsAdmin(c, "~charmers/precise/wordpress-23/meta/extra-info/foo", "bar")
+	rec = get("~charmers/precise/wordpress-23/meta/extra-info", http.Header{"If-None-Match": {etag}})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), gc.Matches, `\{"foo":"bar"\}\n?`)
+	newETag := rec.Header().Get("ETag")
+	c.Assert(newETag, gc.Not(gc.Equals), etag)
+
+	// Changing the base entity changes the tag too.
+	err := s.store.SetPerms(&id.URL, "stable.read", "charmers")
+	c.Assert(err, gc.Equals, nil)
+	rec = get("~charmers/precise/wordpress-23/meta/extra-info", http.Header{"If-None-Match": {newETag}})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	newETag = rec.Header().Get("ETag")
+
+	// Authorization is checked before the tag.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("~charmers/precise/wordpress-23/meta/extra-info"),
+		Header:       http.Header{"If-None-Match": {newETag}},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
 func (s *APISuite) TestMetaCanWriteDifferentStableAPIPerms(c *gc.C) {
 	id, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~bob/precise/wordpress-23", 23))
 	err := s.store.SetPerms(&id.URL, "stable.write", "charmers")
@@ -3292,6 +3465,21 @@ var publishAuthorizationTests = []struct {
 		},
 	},
 	channels: []params.Channel{"edge"},
+}, {
+	about: "write permission does not allow publishing",
+	acls: map[params.Channel]mongodoc.ACL{
+		params.UnpublishedChannel: {
+			Read:    []string{"bob"},
+			Publish: []string{"bob"},
+		},
+		params.EdgeChannel: {
+			Read:    []string{"bob"},
+			Write:   []string{"bob"},
+			Publish: []string{"alice"},
+		},
+	},
+	channels:    []params.Channel{"edge"},
+	expectError: true,
 }, {
 	about: "publish on channels without access",
 	acls: map[params.Channel]mongodoc.ACL{
@@ -3339,6 +3527,15 @@ func (s *APISuite) TestPublishAuthorization(c *gc.C) {
 			c.Assert(err, gc.Equals, nil)
 			err = s.store.SetPerms(&id.URL, string(ch)+".write", acl.Write...)
 			c.Assert(err, gc.Equals, nil)
+			// The publish permission defaults to the write
+			// permission, as it does when a client that only
+			// knows about read and write permissions sets them.
+			publish := acl.Publish
+			if publish == nil {
+				publish = acl.Write
+			}
+			err = s.store.SetPerms(&id.URL, string(ch)+".publish", publish...)
+			c.Assert(err, gc.Equals, nil)
 		}
 		if test.expectError {
 			httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
@@ -3436,14 +3633,17 @@ func (s *APISuite) TestPublishSuccess(c *gc.C) {
 		Handler: s.srv,
 		URL:     storeURL("~bob/precise/wordpress/meta/resources?channel=edge"),
 		Do:      bakeryDo(nil),
-		ExpectBody: []params.Resource{{
-			Name:        "someResource",
-			Type:        "file",
-			Path:        "someResource-file",
-			Description: "someResource description",
-			Revision:    1,
-			Fingerprint: rawHash(hashOfString("stuff 1")),
-			Size:        int64(len("stuff 1")),
+		ExpectBody: []v5.Resource{{
+			Resource: params.Resource{
+				Name:        "someResource",
+				Type:        "file",
+				Path:        "someResource-file",
+				Description: "someResource description",
+				Revision:    1,
+				Fingerprint: rawHash(hashOfString("stuff 1")),
+				Size:        int64(len("stuff 1")),
+			},
+			SHA256: hash256OfString("stuff 1"),
 		}},
 	})
 }
@@ -3818,7 +4018,8 @@ var promulgateTests = []struct {
 	},
 	expectBaseEntities: []*mongodoc.BaseEntity{
 		storetesting.NewBaseEntity("~charmers/wordpress").WithACLs(params.StableChannel, mongodoc.ACL{
-			Write: []string{v5.PromulgatorsGroup},
+			Write:   []string{v5.PromulgatorsGroup},
+			Publish: []string{v5.PromulgatorsGroup},
 		}).WithPromulgated(true).Build(),
 	},
 	expectPromulgate: true,
@@ -3952,7 +4153,8 @@ var promulgateTests = []struct {
 	},
 	expectBaseEntities: []*mongodoc.BaseEntity{
 		storetesting.NewBaseEntity("~charmers/wordpress").WithACLs(params.StableChannel, mongodoc.ACL{
-			Write: []string{v5.PromulgatorsGroup},
+			Write:   []string{v5.PromulgatorsGroup},
+			Publish: []string{v5.PromulgatorsGroup},
 		}).WithPromulgated(true).Build(),
 	},
 	expectPromulgate: true,
@@ -3975,7 +4177,8 @@ var promulgateTests = []struct {
 	},
 	expectBaseEntities: []*mongodoc.BaseEntity{
 		storetesting.NewBaseEntity("~charmers/wordpress").WithACLs(params.StableChannel, mongodoc.ACL{
-			Write: []string{v5.PromulgatorsGroup},
+			Write:   []string{v5.PromulgatorsGroup},
+			Publish: []string{v5.PromulgatorsGroup},
 		}).WithPromulgated(true).Build(),
 	},
 	expectPromulgate: true,
@@ -4042,10 +4245,7 @@ func (s *APISuite) TestPromulgate(c *gc.C) {
 			test.method = "PUT"
 		}
 
-		var calledEntities []audit.Entry
-		s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
-			calledEntities = append(calledEntities, e)
-		})
+		calledEntities := s.recordAuditEntries(c)
 
 		p := httptesting.JSONCallParams{
 			Handler: s.srv,
@@ -4084,18 +4284,21 @@ func (s *APISuite) TestPromulgate(c *gc.C) {
 			ref.Revision = 0
 
 			e := audit.Entry{
-				User:   test.expectAuditUser,
-				Op:     audit.OpUnpromulgate,
-				Entity: ref,
+				User:       test.expectAuditUser,
+				Op:         audit.OpUnpromulgate,
+				Entity:     ref,
+				AuthMethod: "macaroon",
 			}
 			if test.expectPromulgate {
 				e.Op = audit.OpPromulgate
 			}
-			c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{e})
+			if test.username != "" {
+				e.AuthMethod = "basic"
+			}
+			c.Assert(*calledEntities, jc.DeepEquals, []audit.Entry{e})
 		} else {
-			c.Assert(len(calledEntities), gc.Equals, 0)
+			c.Assert(len(*calledEntities), gc.Equals, 0)
 		}
-		calledEntities = nil
 	}
 }
 
@@ -4259,12 +4462,32 @@ func (s *APISuite) TestLogout(c *gc.C) {
 	})
 }
 
-// assertChannelACLs asserts that the ChannelACLs field of the base entity with the
-// given URL are as given.
+// assertChannelACLs asserts that the read and write ACLs in the
+// ChannelACLs field of the base entity with the given URL are as given.
 func (s *APISuite) assertChannelACLs(c *gc.C, url string, acls map[params.Channel]mongodoc.ACL) {
 	e, err := s.store.FindBaseEntity(charm.MustParseURL(url), nil)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(e.ChannelACLs, jc.DeepEquals, acls)
+	obtained := make(map[params.Channel]mongodoc.ACL)
+	for ch, acl := range e.ChannelACLs {
+		obtained[ch] = mongodoc.ACL{
+			Read:  acl.Read,
+			Write: acl.Write,
+		}
+	}
+	c.Assert(obtained, jc.DeepEquals, acls)
+}
+
+// derivedPermResponse returns the meta/perm response for an entity
+// whose fine-grained permissions have all been derived from the
+// write permission in r.
+func derivedPermResponse(r params.PermResponse) v5.PermResponse {
+	return v5.PermResponse{
+		PermResponse: r,
+		Upload:       r.Write,
+		Publish:      r.Write,
+		SetPerm:      r.Write,
+		Delete:       r.Write,
+	}
 }
 
 // entityACLs returns the ACLs that apply to the entity with the given URL.
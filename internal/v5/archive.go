@@ -20,6 +20,7 @@ import (
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 	"gopkg.in/mgo.v2/bson"
 
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
@@ -45,6 +46,7 @@ func (h *ReqHandler) serveArchive(id *charm.URL, w http.ResponseWriter, req *htt
 	case "DELETE":
 		return resolveId(h.serveDeleteArchive)(id, w, req)
 	case "GET":
+		h.requestedSeries = id.Series
 		return resolveId(h.serveGetArchive)(id, w, req)
 	case "POST", "PUT":
 		// Make sure we consume the full request body, before responding.
@@ -59,7 +61,7 @@ func (h *ReqHandler) serveArchive(id *charm.URL, w http.ResponseWriter, req *htt
 
 		// Add "noingest" so that we don't need to fetch the base entity
 		// twice in the common case when uploading a charm.
-		h.Cache.AddBaseEntityFields(charmstore.FieldSelector("noingest"))
+		h.Cache.AddBaseEntityFields(mongodoc.BaseEntityFields.Set("noingest"))
 
 		if err := h.authorizeUpload(id, req); err != nil {
 			return errgo.Mask(err, errgo.Any)
@@ -72,33 +74,82 @@ func (h *ReqHandler) serveArchive(id *charm.URL, w http.ResponseWriter, req *htt
 	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
 }
 
+// newEntityUsers returns the users that may create new base entities
+// in the namespace of the given user. When the namespace is owned by
+// an organisation, only the members of the organisation with an
+// appropriate role can create them.
+func (h *ReqHandler) newEntityUsers(user string) ([]string, error) {
+	org, err := h.Store.Org(user)
+	switch {
+	case err == nil:
+		return org.UsersWithRole(mongodoc.OrgAdmin, mongodoc.OrgUploader), nil
+	case errgo.Cause(err) == params.ErrNotFound:
+		return []string{user}, nil
+	default:
+		return nil, errgo.Notef(err, "cannot retrieve organisation for authorization")
+	}
+}
+
 func (h *ReqHandler) authorizeUpload(id *charm.URL, req *http.Request) error {
 	if id.User == "" {
 		return badRequestf(nil, "user not specified in entity upload URL %q", id)
 	}
-	baseEntity, err := h.Cache.BaseEntity(id, charmstore.FieldSelector("channelacls"))
+	baseEntity, err := h.Cache.BaseEntity(id, mongodoc.BaseEntityFields.Set("channelacls"))
 	if err != nil && errgo.Cause(err) != params.ErrNotFound {
 		return errgo.Notef(err, "cannot retrieve entity %q for authorization", id)
 	}
-	var acl mongodoc.ACL
-	if err == nil {
-		acl = baseEntity.ChannelACLs[params.UnpublishedChannel]
-	} else {
-		// The base entity does not currently exist, so we default to
-		// assuming write permissions for the entity user.
-		acl = mongodoc.ACL{
-			Write: []string{id.User},
+	if err != nil {
+		baseEntity = nil
+	}
+	var newEntityUsers []string
+	if baseEntity == nil {
+		newEntityUsers, err = h.newEntityUsers(id.User)
+		if err != nil {
+			return errgo.Mask(err)
 		}
 	}
+	// channelACL returns the ACL for the given channel. When the
+	// base entity does not currently exist, we default to assuming
+	// upload and publish permissions for the namespace owner.
+	channelACL := func(ch params.Channel) mongodoc.ACL {
+		if baseEntity == nil {
+			return mongodoc.ACL{
+				Upload:  newEntityUsers,
+				Publish: newEntityUsers,
+			}
+		}
+		return baseEntity.ChannelACLs[ch]
+	}
 	// Note that we pass no entity ids to authorize, because
 	// we haven't got a resolved URL at this point. At some
 	// point in the future, we may want to be able to allow
 	// is-entity first-party caveats to be allowed when uploading
 	// at which point we will need to rethink this a little.
 	if _, err := h.authorize(authorizeParams{
-		req:  req,
-		acls: []mongodoc.ACL{acl},
-		ops:  []string{OpWrite},
+		req:     req,
+		acls:    []mongodoc.ACL{channelACL(params.UnpublishedChannel)},
+		ops:     []string{OpUpload},
+		baseIds: []*charm.URL{id},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	// A PUT request can also publish the entity, in which case
+	// the user must also be allowed to publish to all the channels.
+	if req.Method != "PUT" || len(req.Form["channel"]) == 0 {
+		return nil
+	}
+	var chans []params.Channel
+	var acls []mongodoc.ACL
+	for _, c := range req.Form["channel"] {
+		chans = append(chans, params.Channel(c))
+		acls = append(acls, channelACL(params.Channel(c)))
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:             req,
+		acls:            acls,
+		ops:             []string{OpPublish},
+		baseIds:         []*charm.URL{id},
+		publishChannels: chans,
 	}); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
@@ -128,7 +179,7 @@ func (h *ReqHandler) SendEntityArchive(id *router.ResolvedURL, w http.ResponseWr
 	header.Set("Content-Disposition", "attachment; filename="+id.PreferredURL().Name+".zip")
 
 	if StatsEnabled(req) {
-		h.Store.IncrementDownloadCountsAsync(id)
+		h.Store.IncrementDownloadCountsAsync(id, h.downloadInfo(id, req))
 	}
 	// TODO(rog) should we set connection=close here?
 	// See https://codereview.appspot.com/5958045
@@ -136,12 +187,16 @@ func (h *ReqHandler) SendEntityArchive(id *router.ResolvedURL, w http.ResponseWr
 }
 
 func (h *ReqHandler) serveDeleteArchive(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
-	if err := h.AuthorizeEntityForOp(id, req, OpWrite); err != nil {
+	if err := h.AuthorizeEntityForOp(id, req, OpDelete); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 	if err := h.Store.DeleteEntity(id); err != nil {
 		return errgo.NoteMask(err, fmt.Sprintf("cannot delete %q", id.PreferredURL()), errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
 	}
+	h.addAudit(audit.Entry{
+		Op:     audit.OpDeleteEntity,
+		Entity: &id.URL,
+	})
 	h.Store.IncCounterAsync(charmstore.EntityStatsKey(&id.URL, params.StatsArchiveDelete))
 	return nil
 }
@@ -202,14 +257,21 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 			errgo.Is(params.ErrInvalidEntity),
 		)
 	}
+	h.addAudit(audit.Entry{
+		Op:     audit.OpUploadEntity,
+		Entity: &rid.URL,
+	})
+	if err := h.setReleaseNotes(rid, req.Form.Get("release-notes")); err != nil {
+		return errgo.Mask(err)
+	}
 	if ingesting, _ := router.ParseBool(req.Form.Get("ingest")); !ingesting {
 		// Find the base entity before trying to update its noingest status
 		// as if this isn't the first upload of the entity, the base entity
 		// will already be cached, so we won't need any more round trips
 		// to mongo than usual.
-		baseEntity, err := h.Cache.BaseEntity(&rid.URL, charmstore.FieldSelector("noingest"))
+		baseEntity, err := h.Cache.BaseEntity(&rid.URL, mongodoc.BaseEntityFields.Set("noingest"))
 		if err != nil || !baseEntity.NoIngest {
-			if err := h.Store.DB.BaseEntities().UpdateId(mongodoc.BaseURL(&rid.URL), bson.D{{
+			if err := h.Store.UpdateBaseEntity(rid, bson.D{{
 				"$set", bson.D{{
 					"noingest", true,
 				}},
@@ -292,6 +354,21 @@ func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *
 			errgo.Is(params.ErrInvalidEntity),
 		)
 	}
+	h.addAudit(audit.Entry{
+		Op:     audit.OpUploadEntity,
+		Entity: &rid.URL,
+	})
+	for _, c := range chans {
+		h.addAudit(audit.Entry{
+			Op:       audit.OpPublish,
+			Entity:   &rid.URL,
+			Channel:  string(c),
+			NewValue: &rid.URL,
+		})
+	}
+	if err := h.setReleaseNotes(rid, req.Form.Get("release-notes")); err != nil {
+		return errgo.Mask(err)
+	}
 	return httprequest.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
 		Id:            &rid.URL,
 		PromulgatedId: rid.PromulgatedURL(),
@@ -379,7 +456,7 @@ func setArchiveCacheControl(h http.Header, isPublic bool) {
 // to give to a newly uploaded charm with the given id.
 // It returns -1 if the charm is not promulgated.
 func (h *ReqHandler) getNewPromulgatedRevision(id *charm.URL) (int, error) {
-	baseEntity, err := h.Cache.BaseEntity(id, charmstore.FieldSelector("promulgated"))
+	baseEntity, err := h.Cache.BaseEntity(id, mongodoc.BaseEntityFields.Set("promulgated"))
 	if err != nil && errgo.Cause(err) != params.ErrNotFound {
 		return 0, errgo.Mask(err)
 	}
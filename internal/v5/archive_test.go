@@ -185,6 +185,145 @@ func (s *ArchiveSuite) TestGetCountersDisabled(c *gc.C) {
 	stats.CheckCounterSum(c, s.store, key, false, 0)
 }
 
+func (s *ArchiveSuite) TestGetCountersByDimension(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	id := newResolvedURL("~who/utopic/mysql-42", -1)
+	ch := storetesting.NewCharm(nil)
+	s.addPublicCharm(c, ch, id)
+
+	// Download the charm archive reporting the client version
+	// in the User-Agent header.
+	s.assertArchiveDownload(
+		c,
+		"",
+		&httptesting.DoRequestParams{
+			URL: storeURL("~who/utopic/mysql-42/archive"),
+			Header: http.Header{
+				"User-Agent": {"Juju/2.2.1 (linux)"},
+			},
+		},
+		ch.Bytes(),
+	)
+	// Download it again reporting the client version in the
+	// dedicated header, which takes precedence.
+	s.assertArchiveDownload(
+		c,
+		"",
+		&httptesting.DoRequestParams{
+			URL: storeURL("~who/mysql/archive"),
+			Header: http.Header{
+				"User-Agent":           {"Juju/2.2.1 (linux)"},
+				v5.ClientVersionHeader: {"2.3-beta1"},
+			},
+		},
+		ch.Bytes(),
+	)
+	// Download it again reporting client versions that are later
+	// than any known version, which are recorded under their major
+	// version, or as unknown when the major version is not known.
+	for _, v := range []string{"2.99999.1", "99.1"} {
+		s.assertArchiveDownload(
+			c,
+			"",
+			&httptesting.DoRequestParams{
+				URL: storeURL("~who/mysql/archive"),
+				Header: http.Header{
+					v5.ClientVersionHeader: {v},
+				},
+			},
+			ch.Bytes(),
+		)
+	}
+
+	key := []string{charmstore.StatsArchiveDownloadChannel, "utopic", "mysql", "who", "stable", "42"}
+	stats.CheckCounterSum(c, s.store, key, false, 4)
+	// When the series is not requested, the series of the
+	// resolved entity is recorded.
+	key = []string{charmstore.StatsArchiveDownloadSeries, "utopic", "mysql", "who", "utopic", "42"}
+	stats.CheckCounterSum(c, s.store, key, false, 4)
+	// Only the major and minor numbers of the client version are
+	// recorded.
+	key = []string{charmstore.StatsArchiveDownloadClientVersion, "utopic", "mysql", "who", "2.2", "42"}
+	stats.CheckCounterSum(c, s.store, key, false, 1)
+	key = []string{charmstore.StatsArchiveDownloadClientVersion, "utopic", "mysql", "who", "2.3", "42"}
+	stats.CheckCounterSum(c, s.store, key, false, 1)
+	key = []string{charmstore.StatsArchiveDownloadClientVersion, "utopic", "mysql", "who", "2.x", "42"}
+	stats.CheckCounterSum(c, s.store, key, false, 1)
+	key = []string{charmstore.StatsArchiveDownloadClientVersion, "utopic", "mysql", "who", charmstore.StatsUnknownValue, "42"}
+	stats.CheckCounterSum(c, s.store, key, false, 1)
+
+	// The counts are available from meta/stats.
+	one := params.StatsCount{Total: 1, Day: 1, Week: 1, Month: 1}
+	four := params.StatsCount{Total: 4, Day: 4, Week: 4, Month: 4}
+	s.assertGet(c, "~who/utopic/mysql-42/meta/stats?breakdown=1&refresh=1", v5.StatsResponse{
+		StatsResponse: params.StatsResponse{
+			ArchiveDownloadCount:        4,
+			ArchiveDownload:             four,
+			ArchiveDownloadAllRevisions: four,
+		},
+		ArchiveDownloadByChannel: map[string]params.StatsCount{
+			"stable": four,
+		},
+		ArchiveDownloadBySeries: map[string]params.StatsCount{
+			"utopic": four,
+		},
+		ArchiveDownloadByClientVersion: map[string]params.StatsCount{
+			"2.2":                        one,
+			"2.3":                        one,
+			"2.x":                        one,
+			charmstore.StatsUnknownValue: one,
+		},
+	})
+}
+
+func (s *ArchiveSuite) TestGetCountsUniqueClients(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	id := newResolvedURL("~who/utopic/mysql-42", -1)
+	ch := storetesting.NewCharm(nil)
+	s.addPublicCharm(c, ch, id)
+
+	// Download the charm archive twice for the same model and
+	// once for another model.
+	for _, uuid := range []string{"model-1", "model-1", "model-2"} {
+		s.assertArchiveDownload(
+			c,
+			"",
+			&httptesting.DoRequestParams{
+				URL: storeURL("~who/utopic/mysql-42/archive"),
+				Header: http.Header{
+					v5.ModelUUIDHeader: {uuid},
+				},
+			},
+			ch.Bytes(),
+		)
+	}
+	key := []string{params.StatsArchiveDownload, "utopic", "mysql", "who", "42"}
+	stats.CheckCounterSum(c, s.store, key, false, 3)
+	stats.CheckUniqueCount(c, s.store, key, false, 2)
+
+	// The unique client counts are available from meta/stats.
+	two := params.StatsCount{Total: 2, Day: 2, Week: 2, Month: 2}
+	three := params.StatsCount{Total: 3, Day: 3, Week: 3, Month: 3}
+	s.assertGet(c, "~who/utopic/mysql-42/meta/stats?unique=1&refresh=1", v5.StatsResponse{
+		StatsResponse: params.StatsResponse{
+			ArchiveDownloadCount:        3,
+			ArchiveDownload:             three,
+			ArchiveDownloadAllRevisions: three,
+		},
+		ArchiveUniqueDownload:             &two,
+		ArchiveUniqueDownloadAllRevisions: &two,
+	})
+
+	// And from stats/counter.
+	s.assertGet(c, "stats/counter/archive-download:utopic:mysql:who:*?unique=1", []params.Statistic{{
+		Count: 2,
+	}})
+}
+
 var archivePostErrorsTests = []struct {
 	about           string
 	url             string
@@ -1575,6 +1714,10 @@ func hashOfString(s string) string {
 	return hashOfBytes([]byte(s))
 }
 
+func hash256OfString(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
 func rawHash(hash string) []byte {
 	bytes, err := hex.DecodeString(hash)
 	if err != nil {
@@ -0,0 +1,130 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"net/http"
+	"net/url"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+const (
+	// defaultAuditLimit holds the number of audit entries
+	// returned when no limit is specified.
+	defaultAuditLimit = 100
+
+	// maxAuditLimit holds the maximum number of audit entries
+	// that can be returned by a single request.
+	maxAuditLimit = 1000
+)
+
+// GET /audit[?entity=id][&user=user][&op=op][&start=date][&stop=date][&limit=n][&skip=n]
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-audit
+func (h *ReqHandler) serveAudit(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	q, err := auditQueryFromForm(req.Form)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if v := req.Form.Get("entity"); v != "" {
+		q.Entity, err = charm.ParseURL(v)
+		if err != nil {
+			return nil, badRequestf(err, "invalid entity value")
+		}
+		if q.Entity.User == "" {
+			// Audit entries always refer to the fully qualified
+			// entity id, and we cannot resolve promulgated ids
+			// of entities that may since have been deleted.
+			return nil, badRequestf(nil, "entity %q does not specify a user", v)
+		}
+	}
+	entries, err := h.Store.AuditEntries(q)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return entries, nil
+}
+
+// GET /audit/verify
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-auditverify
+func (h *ReqHandler) serveAuditVerify(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	v, err := h.Store.VerifyAuditLog()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return v, nil
+}
+
+// GET id/meta/audit[?user=user][&op=op][&start=date][&stop=date][&limit=n][&skip=n]
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetaaudit
+func (h *ReqHandler) metaAudit(id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if err := h.AuthorizeEntityForOp(id, req, OpWrite); err != nil {
+		if errgo.Cause(err) == params.ErrUnauthorized {
+			// Only users that can write to the entity can see
+			// its audit log. Report no metadata rather than an
+			// error so that the endpoint can be used in bulk requests.
+			return nil, nil
+		}
+		return nil, errgo.Mask(err, isDischargeRequiredError)
+	}
+	q, err := auditQueryFromForm(flags)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	// Report the history of the entity as a whole rather than
+	// just the requested revision.
+	q.Entity = mongodoc.BaseURL(&id.URL)
+	entries, err := h.Store.AuditEntries(q)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return entries, nil
+}
+
+// auditQueryFromForm returns the audit query specified by the
+// user, op, start, stop, limit and skip values in the given form.
+func auditQueryFromForm(form url.Values) (charmstore.AuditQuery, error) {
+	start, stop, err := parseDateRange(form)
+	if err != nil {
+		return charmstore.AuditQuery{}, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	limit, err := intValue(form.Get("limit"), 1, defaultAuditLimit)
+	if err != nil {
+		return charmstore.AuditQuery{}, badRequestf(err, "invalid limit value")
+	}
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+	skip, err := intValue(form.Get("skip"), 0, 0)
+	if err != nil {
+		return charmstore.AuditQuery{}, badRequestf(err, "invalid skip value")
+	}
+	return charmstore.AuditQuery{
+		User:  form.Get("user"),
+		Op:    audit.Operation(form.Get("op")),
+		Start: start,
+		Stop:  stop,
+		Skip:  skip,
+		Limit: limit,
+	}, nil
+}
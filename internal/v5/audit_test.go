@@ -0,0 +1,524 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+// recordAuditEntries arranges for all audit entries added by the
+// server to be appended to the returned slice. The remote address
+// of each entry depends on the test server, so it is checked to be
+// present and then cleared so that entries can be compared directly.
+func (s *commonSuite) recordAuditEntries(c *gc.C) *[]audit.Entry {
+	var entries []audit.Entry
+	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
+		c.Check(e.RemoteAddr, gc.Not(gc.Equals), "")
+		e.RemoteAddr = ""
+		entries = append(entries, e)
+	})
+	return &entries
+}
+
+func (s *ArchiveSuite) TestPostArchiveAudit(c *gc.C) {
+	entries := s.recordAuditEntries(c)
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.assertUploadCharm(c, "POST", id, "wordpress", nil)
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "admin",
+		Op:         audit.OpUploadEntity,
+		Entity:     &id.URL,
+		AuthMethod: "basic",
+	}})
+}
+
+func (s *ArchiveSuite) TestPutArchiveAudit(c *gc.C) {
+	entries := s.recordAuditEntries(c)
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.assertUploadCharm(c, "PUT", id, "wordpress", []params.Channel{params.EdgeChannel})
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "admin",
+		Op:         audit.OpUploadEntity,
+		Entity:     &id.URL,
+		AuthMethod: "basic",
+	}, {
+		User:       "admin",
+		Op:         audit.OpPublish,
+		Entity:     &id.URL,
+		Channel:    "edge",
+		NewValue:   &id.URL,
+		AuthMethod: "basic",
+	}})
+}
+
+func (s *ArchiveSuite) TestDeleteArchiveAudit(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-43", -1))
+
+	entries := s.recordAuditEntries(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Do:      s.bakeryDoAsUser("charmers"),
+		URL:     storeURL(id.URL.Path() + "/archive"),
+		Method:  "DELETE",
+	})
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "charmers",
+		Op:         audit.OpDeleteEntity,
+		Entity:     &id.URL,
+		AuthMethod: "macaroon",
+	}})
+}
+
+func (s *APISuite) TestPublishAudit(c *gc.C) {
+	id0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id0, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	s.setPublic(c, id0)
+	id1 := newResolvedURL("~charmers/precise/wordpress-1", -1)
+	err = s.store.AddCharmWithArchive(id1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	entries := s.recordAuditEntries(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(id1.URL.Path() + "/publish"),
+		Do:      s.bakeryDoAsUser("charmers"),
+		JSONBody: v5.PublishRequest{
+			PublishRequest: params.PublishRequest{
+				Channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+			},
+			ReleaseNotes: "new stuff",
+		},
+	})
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:    "charmers",
+		Op:      audit.OpPublish,
+		Entity:  &id1.URL,
+		Channel: "stable",
+		OldValue: map[string]*charm.URL{
+			"precise": &id0.URL,
+		},
+		NewValue:   &id1.URL,
+		AuthMethod: "macaroon",
+	}, {
+		User:       "charmers",
+		Op:         audit.OpPublish,
+		Entity:     &id1.URL,
+		Channel:    "edge",
+		NewValue:   &id1.URL,
+		AuthMethod: "macaroon",
+	}, {
+		User:       "charmers",
+		Op:         audit.OpSetReleaseNotes,
+		Entity:     &id1.URL,
+		NewValue:   "new stuff",
+		AuthMethod: "macaroon",
+	}})
+}
+
+func (s *APISuite) TestMetaInfoAudit(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("~bob/precise/wordpress-23", 23)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+
+	entries := s.recordAuditEntries(c)
+	s.assertPut(c, "precise/wordpress-23/meta/extra-info/foo", "bar")
+	s.assertPut(c, "precise/wordpress-23/meta/extra-info", map[string]interface{}{
+		"foo": "baz",
+	})
+	s.assertPut(c, "precise/wordpress-23/meta/common-info/foo", nil)
+	s.assertPut(c, "precise/wordpress-23/meta/release-notes", v5.ReleaseNotesRequest{
+		ReleaseNotes: "some notes",
+	})
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:   "bob",
+		Op:     audit.OpSetExtraInfo,
+		Entity: &id.URL,
+		OldValue: map[string]interface{}{
+			"foo": nil,
+		},
+		NewValue: map[string]interface{}{
+			"foo": json.RawMessage(`"bar"`),
+		},
+		AuthMethod: "macaroon",
+	}, {
+		User:   "bob",
+		Op:     audit.OpSetExtraInfo,
+		Entity: &id.URL,
+		OldValue: map[string]interface{}{
+			"foo": json.RawMessage(`"bar"`),
+		},
+		NewValue: map[string]interface{}{
+			"foo": json.RawMessage(`"baz"`),
+		},
+		AuthMethod: "macaroon",
+	}, {
+		User:   "bob",
+		Op:     audit.OpSetCommonInfo,
+		Entity: &id.URL,
+		OldValue: map[string]interface{}{
+			"foo": nil,
+		},
+		NewValue: map[string]interface{}{
+			"foo": nil,
+		},
+		AuthMethod: "macaroon",
+	}, {
+		User:       "bob",
+		Op:         audit.OpSetReleaseNotes,
+		Entity:     &id.URL,
+		NewValue:   "some notes",
+		AuthMethod: "macaroon",
+	}})
+}
+
+func (s *APISuite) TestCreateUploadAudit(c *gc.C) {
+	entries := s.recordAuditEntries(c)
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "POST",
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("upload"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	var uploadResp params.NewUploadResponse
+	err := json.Unmarshal(resp.Body.Bytes(), &uploadResp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "bob",
+		Op:         audit.OpCreateUpload,
+		NewValue:   uploadResp.UploadId,
+		AuthMethod: "macaroon",
+	}})
+}
+
+func (s *ResourceSuite) TestResourceAudit(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id)
+
+	entries := s.recordAuditEntries(c)
+	content := "some content"
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		Body:    strings.NewReader(content),
+		URL:     storeURL(fmt.Sprintf("%s/resource/someResource?hash=%s", id.URL.Path(), hashOfString(content))),
+		ExpectBody: params.ResourceUploadResponse{
+			Revision: 1,
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		URL:     storeURL(id.URL.Path() + "/resource/someResource/1"),
+		Do:      s.bakeryDoAsUser("charmers"),
+	})
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "charmers",
+		Op:         audit.OpUploadResource,
+		Entity:     &id.URL,
+		Resource:   "someResource/1",
+		AuthMethod: "macaroon",
+	}, {
+		User:       "charmers",
+		Op:         audit.OpDeleteResource,
+		Entity:     &id.URL,
+		Resource:   "someResource/1",
+		AuthMethod: "macaroon",
+	}})
+}
+
+func (s *ResourceSuite) TestOCIUploadBlobAudit(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addOCIImageCharm(c, id)
+
+	entries := s.recordAuditEntries(c)
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(fmt.Sprintf("%s/oci/image/blobs/%s?hash=%s", id.URL.Path(), ociDigest(ociLayer), hashOfString(ociLayer))),
+		Body:    strings.NewReader(ociLayer),
+		Do:      s.bakeryDoAsUser("charmers"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusCreated, gc.Commentf("body: %s", resp.Body.String()))
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "charmers",
+		Op:         audit.OpUploadOCIBlob,
+		Entity:     &id.URL,
+		Resource:   "image",
+		NewValue:   ociDigest(ociLayer),
+		AuthMethod: "macaroon",
+	}})
+}
+
+// getAudit returns the audit entries returned by a GET request
+// to the given path made with admin credentials.
+func (s *commonSuite) getAudit(c *gc.C, path string) []audit.Entry {
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL(path),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	var entries []audit.Entry
+	err := json.Unmarshal(resp.Body.Bytes(), &entries)
+	c.Assert(err, gc.Equals, nil)
+	return entries
+}
+
+// auditOps returns the users and operations of the given entries,
+// in the form "user:op".
+func auditOps(entries []audit.Entry) []string {
+	ops := make([]string, len(entries))
+	for i, e := range entries {
+		ops[i] = e.User + ":" + string(e.Op)
+	}
+	return ops
+}
+
+var getAuditTests = []struct {
+	about     string
+	query     string
+	expectOps []string
+}{{
+	about:     "all entries",
+	expectOps: []string{"admin:set-perm", "bob:set-extra-info", "bob:upload-resource"},
+}, {
+	about:     "filter by user",
+	query:     "?user=bob",
+	expectOps: []string{"bob:set-extra-info", "bob:upload-resource"},
+}, {
+	about:     "filter by operation",
+	query:     "?op=set-perm",
+	expectOps: []string{"admin:set-perm"},
+}, {
+	about:     "filter by entity",
+	query:     "?entity=~bob/precise/wordpress-23",
+	expectOps: []string{"admin:set-perm", "bob:set-extra-info"},
+}, {
+	about:     "filter by entity base URL",
+	query:     "?entity=~bob/wordpress",
+	expectOps: []string{"admin:set-perm", "bob:set-extra-info", "bob:upload-resource"},
+}, {
+	about:     "pagination",
+	query:     "?limit=1&skip=1",
+	expectOps: []string{"bob:set-extra-info"},
+}, {
+	about:     "date range",
+	query:     "?start=2000-01-01&stop=2000-01-02",
+	expectOps: []string{},
+}}
+
+func (s *APISuite) TestGetAudit(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("~bob/precise/wordpress-23", 23)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+	id1 := newResolvedURL("~bob/precise/wordpress-24", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id1)
+	content := "some content"
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		Body:    strings.NewReader(content),
+		URL:     storeURL(fmt.Sprintf("%s/resource/someResource?hash=%s", id1.URL.Path(), hashOfString(content))),
+		ExpectBody: params.ResourceUploadResponse{
+			Revision: 1,
+		},
+		Do: bakeryDo(nil),
+	})
+	s.assertPut(c, "precise/wordpress-23/meta/extra-info/foo", "bar")
+	s.assertPutAsAdmin(c, "precise/wordpress-23/meta/perm/read", []string{"everyone"})
+
+	for i, test := range getAuditTests {
+		c.Logf("test %d: %s", i, test.about)
+		entries := s.getAudit(c, "audit"+test.query)
+		c.Assert(auditOps(entries), jc.DeepEquals, test.expectOps)
+	}
+
+	// Check that the entry details are returned.
+	entries := s.getAudit(c, "audit?op=set-extra-info")
+	c.Assert(entries, gc.HasLen, 1)
+	c.Assert(entries[0].Entity, jc.DeepEquals, &id.URL)
+	c.Assert(entries[0].AuthMethod, gc.Equals, "macaroon")
+	c.Assert(entries[0].RemoteAddr, gc.Not(gc.Equals), "")
+	c.Assert(entries[0].NewValue, jc.DeepEquals, map[string]interface{}{"foo": "bar"})
+}
+
+var getAuditErrorsTests = []struct {
+	about         string
+	query         string
+	expectMessage string
+}{{
+	about:         "invalid entity",
+	query:         "?entity=bad:wolf",
+	expectMessage: `invalid entity value: .*`,
+}, {
+	about:         "entity without user",
+	query:         "?entity=wordpress",
+	expectMessage: `entity "wordpress" does not specify a user`,
+}, {
+	about:         "invalid limit",
+	query:         "?limit=0",
+	expectMessage: `invalid limit value: value must be >= 1`,
+}, {
+	about:         "invalid skip",
+	query:         "?skip=foo",
+	expectMessage: `invalid skip value: value must be a number`,
+}, {
+	about:         "invalid start",
+	query:         "?start=yesterday",
+	expectMessage: `invalid 'start' value "yesterday": .*`,
+}}
+
+func (s *APISuite) TestGetAuditErrors(c *gc.C) {
+	for i, test := range getAuditErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:  s.srv,
+			URL:      storeURL("audit" + test.query),
+			Username: testUsername,
+			Password: testPassword,
+		})
+		c.Assert(resp.Code, gc.Equals, http.StatusBadRequest, gc.Commentf("body: %s", resp.Body.String()))
+		var perr params.Error
+		err := json.Unmarshal(resp.Body.Bytes(), &perr)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(perr.Code, gc.Equals, params.ErrBadRequest)
+		c.Assert(perr.Message, gc.Matches, test.expectMessage)
+	}
+}
+
+func (s *APISuite) TestGetAuditAdminOnly(c *gc.C) {
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL:          storeURL("audit"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   []audit.Entry{},
+	})
+}
+
+func (s *APISuite) TestMetaAudit(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("~bob/precise/wordpress-23", 23)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+	s.assertPut(c, "precise/wordpress-23/meta/extra-info/foo", "bar")
+	s.assertPut(c, "precise/wordpress-23/meta/common-info/foo", "bar")
+
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/precise/wordpress-23/meta/audit?op=set-extra-info"),
+		Do:      bakeryDo(nil),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	var entries []audit.Entry
+	err := json.Unmarshal(resp.Body.Bytes(), &entries)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(auditOps(entries), jc.DeepEquals, []string{"bob:set-extra-info"})
+
+	// Users without write access to the entity cannot see its audit log.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/precise/wordpress-23/meta/audit"),
+		Do:           s.bakeryDoAsUser("alice"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: params.ErrMetadataNotFound.Error(),
+		},
+	})
+}
+
+func (s *APISuite) TestMetaAuditIncludesAllRevisions(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~bob/precise/wordpress-23", 23))
+	s.assertPut(c, "precise/wordpress-23/meta/extra-info/foo", "bar")
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~bob/precise/wordpress-24", 24))
+	s.assertPut(c, "precise/wordpress-24/meta/extra-info/foo", "baz")
+
+	// The audit log of either revision holds the history of the
+	// entity as a whole.
+	for _, rev := range []string{"23", "24"} {
+		resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("~bob/precise/wordpress-" + rev + "/meta/audit?op=set-extra-info"),
+			Do:      bakeryDo(nil),
+		})
+		c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+		var entries []audit.Entry
+		err := json.Unmarshal(resp.Body.Bytes(), &entries)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entries, gc.HasLen, 2)
+		c.Assert(entries[0].Entity.String(), gc.Equals, "cs:~bob/precise/wordpress-24")
+		c.Assert(entries[1].Entity.String(), gc.Equals, "cs:~bob/precise/wordpress-23")
+	}
+}
+
+func (s *APISuite) TestAuditVerify(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("~bob/precise/wordpress-23", 23)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+	s.assertPut(c, "precise/wordpress-23/meta/extra-info/foo", "bar")
+	s.assertPut(c, "precise/wordpress-23/meta/common-info/foo", "bar")
+	_, err := s.store.LinkAuditLog()
+	c.Assert(err, gc.Equals, nil)
+	entries := s.getAudit(c, "audit")
+	c.Assert(entries, gc.HasLen, 2)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("audit/verify"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: audit.Verification{
+			Entries:  2,
+			LastSeq:  2,
+			LastHash: entries[0].Hash,
+		},
+	})
+
+	err = s.store.DB.Audit().Update(bson.D{{"seq", 1}}, bson.D{{"$set", bson.D{{"user", "alice"}}}})
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("audit/verify"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: audit.Verification{
+			Entries:  2,
+			LastSeq:  2,
+			LastHash: entries[0].Hash,
+			Breaks: []audit.Break{{
+				Seq:    1,
+				Reason: "entry has been modified",
+			}},
+		},
+	})
+}
+
+func (s *APISuite) TestAuditVerifyAdminOnly(c *gc.C) {
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL:          storeURL("audit/verify"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   audit.Verification{},
+	})
+}
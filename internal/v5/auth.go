@@ -12,6 +12,7 @@ import (
 
 	"github.com/juju/idmclient"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
@@ -29,8 +30,29 @@ type Authorization struct {
 	Admin    bool
 	User     *idmclient.User
 	Username string
+
+	// AuthMethod holds the method used to authenticate
+	// the request, one of the authMethod constants.
+	AuthMethod string
+
+	// Token holds the access token used to authenticate
+	// the request, if any.
+	Token *mongodoc.AccessToken
+
+	// Groups holds the groups that the user is a member of when
+	// they are asserted by the credentials used to authenticate
+	// the request, such as an OpenID Connect ID token, rather
+	// than obtained from the identity manager.
+	Groups []string
 }
 
+const (
+	authMethodBasic    = "basic"
+	authMethodMacaroon = "macaroon"
+	authMethodToken    = "token"
+	authMethodOIDC     = "oidc"
+)
+
 const (
 	PromulgatorsGroup = "charmers"
 
@@ -54,6 +76,21 @@ const (
 
 	// OpWrite indicates an operation that changes something in the charmstore.
 	OpWrite = "write"
+
+	// OpUpload is the operation of uploading a new revision
+	// of an entity.
+	OpUpload = "upload"
+
+	// OpPublish is the operation of publishing an entity
+	// to a channel.
+	OpPublish = "publish"
+
+	// OpSetPerm is the operation of changing the permissions
+	// of an entity.
+	OpSetPerm = "set-perm"
+
+	// OpDelete is the operation of deleting an entity.
+	OpDelete = "delete"
 )
 
 // authnCheckableOps holds the set of operations that
@@ -61,6 +98,10 @@ const (
 var authnCheckableOps = []string{
 	OpReadWithNoTerms,
 	OpWrite,
+	OpUpload,
+	OpPublish,
+	OpSetPerm,
+	OpDelete,
 }
 
 // timeNow is defined as a variable so that it can be overridden in tests.
@@ -101,6 +142,27 @@ func (h *ReqHandler) Authenticate(req *http.Request) (Authorization, error) {
 	})
 }
 
+// authenticateForOp is like Authenticate except that it checks that
+// the request's credentials allow the given operation. It is used
+// by endpoints that do not act on any entity but that should be
+// usable with access tokens allowing the operation.
+func (h *ReqHandler) authenticateForOp(req *http.Request, op string) (Authorization, error) {
+	everyone := []string{params.Everyone}
+	return h.authorize(authorizeParams{
+		req: req,
+		acls: []mongodoc.ACL{{
+			Read:    everyone,
+			Write:   everyone,
+			Upload:  everyone,
+			Publish: everyone,
+			SetPerm: everyone,
+			Delete:  everyone,
+		}},
+		ops:           []string{op},
+		authnRequired: true,
+	})
+}
+
 // AuthorizeEntityForOp is a convenience method that calls authorize to check
 // that that the given request is authorized to perform the given operation
 // on the entity with the given id.
@@ -159,6 +221,16 @@ type authorizeParams struct {
 	// authenticated even if the ACLs are open to everyone.
 	// This automatically applies to non-read requests.
 	authnRequired bool
+
+	// baseIds holds the base ids of any entities being accessed
+	// that are not in entityIds, such as an entity being uploaded.
+	// It is only used to check the scope of access tokens.
+	baseIds []*charm.URL
+
+	// publishChannels holds the channels that the request
+	// publishes to. It is only used to check the scope of
+	// access tokens.
+	publishChannels []params.Channel
 }
 
 // authorize checks that the current user is authorized to perform
@@ -169,6 +241,11 @@ type authorizeParams struct {
 // - by checking that the request header's HTTP basic auth credentials match
 //   the auth credentials stored in the API handler;
 //
+// - by checking that the request header holds a valid access token;
+//
+// - by checking that the request header holds a valid OpenID Connect
+//   ID token;
+//
 // - by checking that there is a valid macaroon in the request's cookies.
 // A params.ErrUnauthorized error is returned if superuser credentials fail;
 // otherwise a macaroon is minted and a httpbakery discharge-required
@@ -220,18 +297,36 @@ func (h *ReqHandler) authorize(p authorizeParams) (Authorization, error) {
 		// No need to authenticate if the ACL is open to everyone and we're
 		// just trying to read something that won't require terms to be agreed to.
 		// TODO return Username: "everyone" here?
+		// Any credentials are not checked, so the request
+		// is treated as anonymous.
+		if err := h.limitRateForAddr(); err != nil {
+			return Authorization{}, errgo.Mask(err, errgo.Is(router.ErrTooManyRequests))
+		}
 		return Authorization{}, nil
 	}
 	auth, verr := h.checkRequest(p)
 	if verr == nil {
+		if err := h.limitRateForAuth(auth); err != nil {
+			return Authorization{}, errgo.Mask(err, errgo.Is(router.ErrTooManyRequests))
+		}
 		// The request is OK. Now check that the user associated with
 		// the verified macaroons is part of the ACL.
-		if err := set.check(auth, p.ops); err != nil {
+		if err := set.check(auth, p.ops, h.allow); err != nil {
 			return Authorization{}, errgo.WithCausef(err, params.ErrUnauthorized, "")
 		}
+		if auth.Token != nil {
+			if err := checkAccessTokenScope(auth.Token, p); err != nil {
+				return Authorization{}, errgo.WithCausef(err, params.ErrUnauthorized, "")
+			}
+		}
 		h.auth = auth
 		return auth, nil
 	}
+	// The request has no valid credentials, so charge it
+	// to its client address.
+	if err := h.limitRateForAddr(); err != nil {
+		return Authorization{}, errgo.Mask(err, errgo.Is(router.ErrTooManyRequests))
+	}
 	if _, ok := errgo.Cause(verr).(*bakery.VerificationError); !ok {
 		return Authorization{}, errgo.Mask(verr, errgo.Is(params.ErrUnauthorized), isDischargeRequiredError)
 	}
@@ -279,7 +374,7 @@ func (h *ReqHandler) verifyOps(ops []string, entityIds []*router.ResolvedURL) (a
 			}
 			authnRequired = true
 			opsMap[op] = true
-		case OpWrite:
+		case OpWrite, OpUpload, OpPublish, OpSetPerm, OpDelete:
 			authnRequired = true
 			opsMap[op] = true
 		case OpReadWithNoTerms:
@@ -355,12 +450,21 @@ var errActiveTimeExpired = errgo.New("active time expired")
 // valued authorization is returned. It also checks any first party
 // caveats. It does not check ACLs.
 func (h *ReqHandler) checkRequest(p authorizeParams) (Authorization, error) {
+	if value, ok := accessTokenFromRequest(p.req); ok {
+		return h.checkAccessToken(value)
+	}
+	if value, ok := h.oidcTokenFromRequest(p.req); ok {
+		return h.checkOIDCToken(value)
+	}
 	user, passwd, err := parseCredentials(p.req)
 	if err == nil {
 		if user != h.Handler.config.AuthUsername || passwd != h.Handler.config.AuthPassword {
 			return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid user name or password")
 		}
-		return Authorization{Admin: true}, nil
+		return Authorization{
+			Admin:      true,
+			AuthMethod: authMethodBasic,
+		}, nil
 	}
 	bk := h.Store.Bakery
 	if errgo.Cause(err) != errNoCreds || bk == nil || h.Handler.config.IdentityLocation == "" {
@@ -399,9 +503,10 @@ func (h *ReqHandler) checkRequest(p authorizeParams) (Authorization, error) {
 			return Authorization{}, errgo.Notef(err, "cannot get user name for identity")
 		}
 		return Authorization{
-			Admin:    false,
-			User:     user,
-			Username: username,
+			Admin:      false,
+			User:       user,
+			Username:   username,
+			AuthMethod: authMethodMacaroon,
 		}, nil
 	}
 	verr, ok := errgo.Cause(err).(*bakery.VerificationError)
@@ -439,7 +544,7 @@ func (h *ReqHandler) entityACLs(id *router.ResolvedURL) (mongodoc.ACL, error) {
 	if err != nil {
 		return mongodoc.ACL{}, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls"))
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, mongodoc.BaseEntityFields.Set("channelacls"))
 	if err != nil {
 		return mongodoc.ACL{}, errgo.Notef(err, "cannot retrieve base entity %q for authorization", id)
 	}
@@ -456,7 +561,7 @@ func (h *ReqHandler) entitiesRequiredTerms(ids []*router.ResolvedURL) ([]string,
 			// Bundles cannot have terms.
 			continue
 		}
-		entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("charmmeta"))
+		entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("charmmeta"))
 		if err != nil {
 			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 		}
@@ -551,7 +656,7 @@ func (h *ReqHandler) entityChannel(id *router.ResolvedURL) (params.Channel, erro
 	if h.Store.Channel != params.NoChannel {
 		return h.Store.Channel, nil
 	}
-	entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("published"))
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("published"))
 	if err != nil {
 		if errgo.Cause(err) == params.ErrNotFound {
 			return params.NoChannel, errgo.WithCausef(nil, params.ErrNotFound, "entity %q not found", id)
@@ -671,17 +776,17 @@ func (s *aclSet) add(acl mongodoc.ACL) {
 // is allowed to perform all the given operations with respect
 // to all the ACLs in the set. It uses the allow function to check
 // individual ACL membership.
-func (s *aclSet) check(auth Authorization, ops []string) error {
+func (s *aclSet) check(auth Authorization, ops []string, allow func(Authorization, []string) (bool, error)) error {
 	if auth.Admin {
 		return nil
 	}
-	if auth.User == nil {
+	if auth.Username == "" {
 		return errgo.New("no authenticated identity")
 	}
 	logger.Infof("check username %q; ops %q; acls: %#v", auth.Username, ops, s.acls)
 	for _, acl := range s.acls {
 		for _, op := range ops {
-			ok, err := auth.User.Allow(aclForOp(acl, op))
+			ok, err := allow(auth, aclForOp(acl, op))
 			if err != nil {
 				return errgo.Mask(err)
 			}
@@ -700,6 +805,14 @@ func aclForOp(acls mongodoc.ACL, op string) []string {
 		return acls.Read
 	case OpWrite:
 		return acls.Write
+	case OpUpload:
+		return acls.Upload
+	case OpPublish:
+		return acls.Publish
+	case OpSetPerm:
+		return acls.SetPerm
+	case OpDelete:
+		return acls.Delete
 	}
 	// Fail safe if we don't understand the operation.
 	return nil
@@ -714,19 +827,105 @@ func isPublicACL(acl []string) bool {
 	return false
 }
 
-type noGroupCache struct{}
+// allow reports whether the user with the given authorization is a
+// member of the given ACL. When the store has a group provider, it
+// is used to find out which groups the user is a member of; otherwise
+// the groups asserted by the user's credentials are used, or group
+// membership is checked by the identity manager. Members of an
+// organisation are also treated as members of a group with the
+// organisation's name.
+func (h *ReqHandler) allow(auth Authorization, acl []string) (bool, error) {
+	if ok, err := h.allowGroups(auth, acl); ok || err != nil {
+		return ok, err
+	}
+	orgs, err := h.Store.UserOrgs(auth.Username)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	for _, name := range acl {
+		if containsString(orgs, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (h *ReqHandler) allowGroups(auth Authorization, acl []string) (bool, error) {
+	if gp := h.Store.GroupProvider(); gp != nil {
+		return groupPermChecker{gp}.Allow(auth.Username, acl)
+	}
+	if auth.User == nil {
+		return groupPermChecker{staticGroups(auth.Groups)}.Allow(auth.Username, acl)
+	}
+	return auth.User.Allow(acl)
+}
+
+// UserGroups returns the groups that the user with the given
+// authorization is a member of, including the organisations
+// that the user is a member of.
+func (h *ReqHandler) UserGroups(auth Authorization) ([]string, error) {
+	groups, err := h.userGroups(auth)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	orgs, err := h.Store.UserOrgs(auth.Username)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(orgs) == 0 {
+		return groups, nil
+	}
+	// Copy the groups so that any cached slice is not modified.
+	allGroups := make([]string, len(groups), len(groups)+len(orgs))
+	copy(allGroups, groups)
+	for _, org := range orgs {
+		if !containsString(allGroups, org) {
+			allGroups = append(allGroups, org)
+		}
+	}
+	return allGroups, nil
+}
+
+func (h *ReqHandler) userGroups(auth Authorization) ([]string, error) {
+	if gp := h.Store.GroupProvider(); gp != nil {
+		return gp.Groups(auth.Username)
+	}
+	if auth.User == nil {
+		return auth.Groups, nil
+	}
+	return auth.User.Groups()
+}
 
-func (noGroupCache) Groups(username string) ([]string, error) {
-	return nil, nil
+// staticGroups is a group provider that reports the
+// same groups for any user.
+type staticGroups []string
+
+func (g staticGroups) Groups(username string) ([]string, error) {
+	return g, nil
 }
 
-type noGroupsPermChecker struct{}
+// groupPermChecker checks ACL membership using the
+// groups reported by a group provider.
+type groupPermChecker struct {
+	groups charmstore.GroupProvider
+}
 
-func (noGroupsPermChecker) Allow(username string, acl []string) (bool, error) {
+func (c groupPermChecker) Allow(username string, acl []string) (bool, error) {
 	for _, name := range acl {
 		if name == username || name == params.Everyone {
 			return true, nil
 		}
 	}
+	groups, err := c.groups.Groups(username)
+	if err != nil {
+		return false, errgo.Notef(err, "cannot get groups for %q", username)
+	}
+	for _, name := range acl {
+		for _, g := range groups {
+			if name == g {
+				return true, nil
+			}
+		}
+	}
 	return false, nil
 }
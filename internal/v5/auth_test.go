@@ -637,9 +637,9 @@ var uploadEntityAuthorizationTests = []struct {
 	// promulgated holds whether the corresponding promulgated entity must be
 	// already present in the charm store before performing the upload.
 	promulgated bool
-	// writeAcls can be used to set customized write ACLs for the published
+	// uploadAcls can be used to set customized upload ACLs for the published
 	// entity before performing the upload. If empty, default ACLs are used.
-	writeAcls []string
+	uploadAcls []string
 	// expectStatus is the expected HTTP response status.
 	// Defaults to 200 status OK.
 	expectStatus int
@@ -711,7 +711,7 @@ var uploadEntityAuthorizationTests = []struct {
 	about:        "unauthorized: entity no permissions",
 	username:     "picard",
 	id:           "~picard/wily/django",
-	writeAcls:    []string{"kirk"},
+	uploadAcls:   []string{"kirk"},
 	expectStatus: http.StatusUnauthorized,
 	expectBody: params.Error{
 		Code:    params.ErrUnauthorized,
@@ -734,7 +734,7 @@ func (s *authSuite) TestUploadEntityAuthorization(c *gc.C) {
 		}
 
 		// Add a pre-existing entity if required.
-		if test.promulgated || len(test.writeAcls) != 0 {
+		if test.promulgated || len(test.uploadAcls) != 0 {
 			id := charm.MustParseURL(test.id).WithRevision(0)
 			revision := -1
 			if test.promulgated {
@@ -742,8 +742,8 @@ func (s *authSuite) TestUploadEntityAuthorization(c *gc.C) {
 			}
 			rurl := newResolvedURL(id.String(), revision)
 			s.store.AddCharmWithArchive(rurl, storetesting.Charms.CharmArchive(c.MkDir(), "mysql"))
-			if len(test.writeAcls) != 0 {
-				s.store.SetPerms(&rurl.URL, "unpublished.write", test.writeAcls...)
+			if len(test.uploadAcls) != 0 {
+				s.store.SetPerms(&rurl.URL, "unpublished.upload", test.uploadAcls...)
 			}
 		}
 
@@ -0,0 +1,164 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// ReleaseNotesResponse holds the response to a GET
+// id/meta/release-notes request.
+type ReleaseNotesResponse struct {
+	// ReleaseNotes holds the markdown-formatted release
+	// notes for the entity revision.
+	ReleaseNotes string
+}
+
+// ReleaseNotesRequest holds the body of a PUT
+// id/meta/release-notes request.
+type ReleaseNotesRequest struct {
+	ReleaseNotes string
+}
+
+// PublishRequest holds the body of a PUT id/publish request.
+// It extends params.PublishRequest with optional release notes
+// that will be associated with the published entity.
+type PublishRequest struct {
+	params.PublishRequest
+	ReleaseNotes string `json:",omitempty"`
+}
+
+// ChangelogEntry holds the release notes for one revision
+// in the response to a GET id/changelog request.
+type ChangelogEntry struct {
+	Id           *charm.URL
+	UploadTime   time.Time
+	ReleaseNotes string `json:",omitempty"`
+}
+
+// GET id/meta/release-notes
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetarelease-notes
+func (h *ReqHandler) metaReleaseNotes(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	return &ReleaseNotesResponse{
+		ReleaseNotes: entity.ReleaseNotes,
+	}, nil
+}
+
+// PUT id/meta/release-notes
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idmetarelease-notes
+func (h *ReqHandler) putMetaReleaseNotes(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	var notes ReleaseNotesRequest
+	if err := json.Unmarshal(*val, &notes); err != nil {
+		return badRequestf(err, "cannot unmarshal release notes")
+	}
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("releasenotes"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	e := releaseNotesAuditEntry(id, entity.ReleaseNotes, notes.ReleaseNotes)
+	if notes.ReleaseNotes == "" {
+		updater.UpdateField("releasenotes", nil, e)
+	} else {
+		updater.UpdateField("releasenotes", notes.ReleaseNotes, e)
+	}
+	updater.UpdateSearch()
+	return nil
+}
+
+// setReleaseNotes sets the release notes of the entity with the given id
+// and updates its search record so that they can be searched for. It
+// does nothing if notes is empty.
+func (h *ReqHandler) setReleaseNotes(id *router.ResolvedURL, notes string) error {
+	if notes == "" {
+		return nil
+	}
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("releasenotes"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := h.Store.UpdateEntity(id, bson.D{{"$set", bson.D{{"releasenotes", notes}}}}); err != nil {
+		return errgo.Notef(err, "cannot set release notes")
+	}
+	h.addAudit(*releaseNotesAuditEntry(id, entity.ReleaseNotes, notes))
+	if err := h.Store.UpdateSearch(id); err != nil {
+		return errgo.Notef(err, "cannot update search record")
+	}
+	return nil
+}
+
+// releaseNotesAuditEntry returns an audit entry recording a change
+// to the release notes of the entity with the given id.
+func releaseNotesAuditEntry(id *router.ResolvedURL, oldNotes, newNotes string) *audit.Entry {
+	e := &audit.Entry{
+		Op:     audit.OpSetReleaseNotes,
+		Entity: &id.URL,
+	}
+	// Leave unset values out of the entry rather than
+	// recording empty strings.
+	if oldNotes != "" {
+		e.OldValue = oldNotes
+	}
+	if newNotes != "" {
+		e.NewValue = newNotes
+	}
+	return e
+}
+
+// GET id/changelog
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idchangelog
+func (h *ReqHandler) serveChangelog(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	ch, err := h.entityChannel(id)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseURL := id.PreferredURL()
+	baseURL.Revision = -1
+	baseURL.Series = ""
+	q := h.Store.EntitiesQuery(baseURL)
+	if id.PromulgatedRevision != -1 {
+		q = q.Sort("-promulgated-revision", "-series")
+	} else {
+		q = q.Sort("-revision", "-series")
+	}
+	entries := []ChangelogEntry{}
+	iter := h.Cache.Iter(q, mongodoc.EntityFields.Set("uploadtime", "releasenotes", "published"))
+	for iter.Next() {
+		e := iter.Entity()
+		if ch != params.UnpublishedChannel && !e.Published[ch] {
+			// The entity has never been part of the history
+			// of the requested channel.
+			continue
+		}
+		rurl := charmstore.EntityResolvedURL(e)
+		if err := h.AuthorizeEntityForOp(rurl, req, OpReadWithNoTerms); err != nil {
+			continue
+		}
+		entries = append(entries, ChangelogEntry{
+			Id:           e.PreferredURL(id.PromulgatedRevision != -1),
+			UploadTime:   e.UploadTime.UTC(),
+			ReleaseNotes: e.ReleaseNotes,
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return errgo.Notef(err, "iteration failed")
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, entries)
+}
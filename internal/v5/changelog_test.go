@@ -0,0 +1,195 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestPutReleaseNotes(c *gc.C) {
+	id, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", -1))
+	s.assertGet(c, "~charmers/precise/wordpress-0/meta/release-notes", &v5.ReleaseNotesResponse{})
+
+	s.assertPutAsAdmin(c, "~charmers/precise/wordpress-0/meta/release-notes", &v5.ReleaseNotesRequest{
+		ReleaseNotes: "* fixed the *thing*",
+	})
+	s.assertGet(c, "~charmers/precise/wordpress-0/meta/release-notes", &v5.ReleaseNotesResponse{
+		ReleaseNotes: "* fixed the *thing*",
+	})
+	e, err := s.store.FindEntity(id, charmstore.FieldSelector("releasenotes"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.ReleaseNotes, gc.Equals, "* fixed the *thing*")
+
+	// Putting empty release notes removes them.
+	s.assertPutAsAdmin(c, "~charmers/precise/wordpress-0/meta/release-notes", &v5.ReleaseNotesRequest{})
+	s.assertGet(c, "~charmers/precise/wordpress-0/meta/release-notes", &v5.ReleaseNotesResponse{})
+}
+
+func (s *APISuite) TestPutReleaseNotesUnauthorized(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", -1))
+	s.doAsUser("bob", func() {
+		s.assertPutIsUnauthorized(c, "~charmers/precise/wordpress-0/meta/release-notes", &v5.ReleaseNotesRequest{
+			ReleaseNotes: "notes",
+		}, `access denied for user "bob"`)
+	})
+}
+
+func (s *APISuite) TestPublishWithReleaseNotes(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(id.URL.Path() + "/publish"),
+		JSONBody: v5.PublishRequest{
+			PublishRequest: params.PublishRequest{
+				Channels: []params.Channel{params.StableChannel},
+			},
+			ReleaseNotes: "first stable release",
+		},
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: &params.PublishResponse{
+			Id: charm.MustParseURL("~charmers/precise/wordpress-0"),
+		},
+	})
+	s.assertGet(c, "~charmers/precise/wordpress-0/meta/release-notes", &v5.ReleaseNotesResponse{
+		ReleaseNotes: "first stable release",
+	})
+}
+
+func (s *APISuite) TestFailedPublishDoesNotSetReleaseNotes(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(id.URL.Path() + "/publish"),
+		JSONBody: v5.PublishRequest{
+			PublishRequest: params.PublishRequest{
+				Channels: []params.Channel{params.StableChannel},
+				// The charm has no such resource, so
+				// the publish fails.
+				Resources: map[string]int{"nonexistent": 0},
+			},
+			ReleaseNotes: "never published",
+		},
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Not(gc.Equals), http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	e, err := s.store.FindEntity(id, charmstore.FieldSelector("releasenotes"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.ReleaseNotes, gc.Equals, "")
+}
+
+func (s *APISuite) TestUploadWithReleaseNotes(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("wordpress")
+	blob, hashSum := getBlob(ch)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL("~charmers/precise/wordpress/archive?hash=" + hashSum + "&release-notes=" + url.QueryEscape("initial upload")),
+		Method:        "POST",
+		ContentLength: int64(blob.Len()),
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:     blob,
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~charmers/precise/wordpress-0"),
+		},
+	})
+	e, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1), charmstore.FieldSelector("releasenotes"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.ReleaseNotes, gc.Equals, "initial upload")
+}
+
+func (s *APISuite) TestChangelog(c *gc.C) {
+	var ids []*router.ResolvedURL
+	for i, notes := range []string{"first", "", "third"} {
+		id := newResolvedURL(fmt.Sprintf("~charmers/precise/wordpress-%d", i), -1)
+		err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		if notes != "" {
+			err = s.store.UpdateEntity(id, bson.D{{"$set", bson.D{{"releasenotes", notes}}}})
+			c.Assert(err, gc.Equals, nil)
+		}
+		ids = append(ids, id)
+	}
+	// Only revisions 0 and 2 are published to the stable channel.
+	s.setPublic(c, ids[0])
+	s.setPublic(c, ids[2])
+
+	uploadTime := func(id *router.ResolvedURL) time.Time {
+		e, err := s.store.FindEntity(id, charmstore.FieldSelector("uploadtime"))
+		c.Assert(err, gc.Equals, nil)
+		return e.UploadTime.UTC()
+	}
+
+	s.assertGet(c, "~charmers/wordpress/changelog", []v5.ChangelogEntry{{
+		Id:           &ids[2].URL,
+		UploadTime:   uploadTime(ids[2]),
+		ReleaseNotes: "third",
+	}, {
+		Id:           &ids[0].URL,
+		UploadTime:   uploadTime(ids[0]),
+		ReleaseNotes: "first",
+	}})
+
+	// All revisions are in the history of the unpublished channel.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/wordpress/changelog?channel=unpublished"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: []v5.ChangelogEntry{{
+			Id:           &ids[2].URL,
+			UploadTime:   uploadTime(ids[2]),
+			ReleaseNotes: "third",
+		}, {
+			Id:         &ids[1].URL,
+			UploadTime: uploadTime(ids[1]),
+		}, {
+			Id:           &ids[0].URL,
+			UploadTime:   uploadTime(ids[0]),
+			ReleaseNotes: "first",
+		}},
+	})
+}
+
+func (s *APISuite) TestChangelogMethodNotAllowed(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", -1))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL("~charmers/wordpress/changelog"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusMethodNotAllowed,
+		ExpectBody: params.Error{
+			Code:    params.ErrMethodNotAllowed,
+			Message: "POST not allowed",
+		},
+	})
+}
@@ -30,6 +30,7 @@ import (
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/oidc/oidctest"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
@@ -80,6 +81,10 @@ type commonSuite struct {
 	// is only non-nil when enableIdentity is true.
 	idmServer *idmtest.Server
 
+	// oidcIssuer holds the stand-in OpenID Connect issuer. It
+	// is only non-nil when enableOIDC is true.
+	oidcIssuer *oidctest.Issuer
+
 	dischargeTerms  func(cav, arg string) ([]checkers.Caveat, error)
 	termsDischarger *bakerytest.Discharger
 	enableTerms     bool
@@ -96,6 +101,15 @@ type commonSuite struct {
 	// started with Elastic Search enabled.
 	enableES bool
 
+	// enableLocalGroups holds whether the charmstore server will
+	// be started with groups managed by the charm store itself
+	// rather than by the identity service.
+	enableLocalGroups bool
+
+	// enableOIDC holds whether the charmstore server will
+	// be started accepting ID tokens issued by oidcIssuer.
+	enableOIDC bool
+
 	// maxMgoSessions specifies the value that will be given
 	// to config.MaxMgoSessions when calling charmstore.NewServer.
 	maxMgoSessions int
@@ -130,6 +144,9 @@ func (s *commonSuite) SetUpTest(c *gc.C) {
 	if s.enableIdentity {
 		s.idmServer = idmtest.NewServer()
 	}
+	if s.enableOIDC {
+		s.oidcIssuer = oidctest.NewIssuer("charmstore")
+	}
 	s.startServer(c)
 }
 
@@ -145,6 +162,9 @@ func (s *commonSuite) TearDownTest(c *gc.C) {
 	if s.idmServer != nil {
 		s.idmServer.Close()
 	}
+	if s.oidcIssuer != nil {
+		s.oidcIssuer.Close()
+	}
 	if s.termsDischarger != nil {
 		s.termsDischarger.Close()
 	}
@@ -181,6 +201,13 @@ func (s *commonSuite) startServer(c *gc.C) {
 		MinUploadPartSize: 10,
 		NewBlobBackend:    s.newBlobBackend,
 	}
+	if s.enableLocalGroups {
+		config.NewGroupProvider = charmstore.NewMongoGroupProvider
+	}
+	if s.enableOIDC {
+		config.OIDCIssuer = s.oidcIssuer.URL
+		config.OIDCClientID = s.oidcIssuer.ClientID
+	}
 	keyring := httpbakery.NewPublicKeyRing(nil, nil)
 	keyring.AllowInsecure()
 	if s.enableIdentity {
@@ -477,7 +504,7 @@ func (s *commonSuite) doAsUser(user string, f func()) {
 // charm with the given id.
 func (s *commonSuite) uploadResource(c *gc.C, id *router.ResolvedURL, name string, content string) {
 	hash := hashOfString(content)
-	_, err := s.store.UploadResource(id, name, strings.NewReader(content), hash, int64(len(content)))
+	_, err := s.store.UploadResource(id, name, strings.NewReader(content), hash, int64(len(content)), nil)
 	c.Assert(err, gc.Equals, nil)
 }
 
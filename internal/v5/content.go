@@ -18,7 +18,6 @@ import (
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 	"gopkg.in/juju/jujusvg.v2"
 
-	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
 )
@@ -29,7 +28,7 @@ func (h *ReqHandler) serveDiagram(id *router.ResolvedURL, w http.ResponseWriter,
 	if id.URL.Series != "bundle" {
 		return errgo.WithCausef(nil, params.ErrNotFound, "diagrams not supported for charms")
 	}
-	entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("bundledata"))
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("bundledata"))
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
@@ -72,7 +71,7 @@ var allowedReadMe = map[string]bool{
 // GET id/readme
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idreadme
 func (h *ReqHandler) serveReadMe(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
-	entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("contents", "blobhash"))
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("contents", "blobhash"))
 	if err != nil {
 		return errgo.NoteMask(err, "cannot get README", errgo.Is(params.ErrNotFound))
 	}
@@ -98,7 +97,7 @@ func (h *ReqHandler) serveIcon(id *router.ResolvedURL, w http.ResponseWriter, re
 	if id.URL.Series == "bundle" {
 		return errgo.WithCausef(nil, params.ErrNotFound, "icons not supported for bundles")
 	}
-	entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("contents", "blobhash"))
+	entity, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("contents", "blobhash"))
 	if err != nil {
 		return errgo.NoteMask(err, "cannot get icon", errgo.Is(params.ErrNotFound))
 	}
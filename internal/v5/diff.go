@@ -0,0 +1,341 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/textdiff"
+)
+
+// maxTextDiffSize holds the maximum size of a file for which
+// a text diff will be included in a diff response.
+const maxTextDiffSize = 64 * 1024
+
+// textDiffContext holds the number of lines of context included
+// around each change in a text diff.
+const textDiffContext = 3
+
+// diffEntityFields holds the entity fields required
+// to compute the differences between two entities.
+var diffEntityFields = []string{
+	"blobhash",
+	"size",
+	"charmmeta",
+	"charmconfig",
+	"charmactions",
+}
+
+// DiffResponse holds the response to a GET id/diff/other-id request.
+// All differences are reported as changes from the entity with
+// Id to the entity with OtherId.
+type DiffResponse struct {
+	// Id and OtherId hold the resolved ids of the two entities.
+	Id      *charm.URL
+	OtherId *charm.URL
+
+	// Added holds the files that are only present in
+	// the archive of OtherId.
+	Added []params.ManifestFile
+
+	// Removed holds the files that are only present in
+	// the archive of Id.
+	Removed []params.ManifestFile
+
+	// Modified holds the files that are present in both
+	// archives but have different contents.
+	Modified []FileDiff
+
+	// Metadata, Config and Actions hold the differences between
+	// the charm metadata, configuration options and actions of the
+	// two entities. They are omitted when there are no differences.
+	Metadata *StructDiff `json:",omitempty"`
+	Config   *StructDiff `json:",omitempty"`
+	Actions  *StructDiff `json:",omitempty"`
+}
+
+// FileDiff holds information about a file that has been modified.
+type FileDiff struct {
+	Name    string
+	OldSize int64
+	NewSize int64
+
+	// Diff holds the changes to the file in unified diff
+	// format. It is only provided for small text files.
+	Diff string `json:",omitempty"`
+}
+
+// StructDiff holds the differences between two structured documents,
+// keyed by the name of the top level fields in the documents.
+type StructDiff struct {
+	Added   map[string]interface{} `json:",omitempty"`
+	Removed map[string]interface{} `json:",omitempty"`
+	Changed map[string]ValueChange `json:",omitempty"`
+}
+
+// ValueChange holds the old and new values of a field that has changed.
+type ValueChange struct {
+	Old interface{}
+	New interface{}
+}
+
+// GET id/diff/other-id
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-iddiffother-id
+func (h *ReqHandler) serveDiff(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	otherURL, err := charm.ParseURL(strings.TrimPrefix(req.URL.Path, "/"))
+	if err != nil {
+		return badRequestf(err, "invalid other id")
+	}
+	otherId, err := h.ResolveURL(otherURL)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := h.AuthorizeEntityForOp(otherId, req, OpReadWithNoTerms); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	fields := mongodoc.EntityFields.Set(diffEntityFields...)
+	entity, err := h.Cache.Entity(&id.URL, fields)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	otherEntity, err := h.Cache.Entity(&otherId.URL, fields)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	resp, err := h.diffEntities(entity, otherEntity)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp.Id = id.PreferredURL()
+	resp.OtherId = otherId.PreferredURL()
+	return httprequest.WriteJSON(w, http.StatusOK, resp)
+}
+
+// diffEntities returns the differences between the old and new entities.
+func (h *ReqHandler) diffEntities(old, new *mongodoc.Entity) (*DiffResponse, error) {
+	oldZip, oldCloser, err := h.openArchiveZip(old)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer oldCloser.Close()
+	newZip, newCloser, err := h.openArchiveZip(new)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer newCloser.Close()
+
+	resp := &DiffResponse{
+		Added:    []params.ManifestFile{},
+		Removed:  []params.ManifestFile{},
+		Modified: []FileDiff{},
+	}
+	oldFiles := zipFiles(oldZip)
+	newFiles := zipFiles(newZip)
+	for _, f := range oldZip.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		nf, ok := newFiles[f.Name]
+		if !ok {
+			resp.Removed = append(resp.Removed, params.ManifestFile{
+				Name: f.Name,
+				Size: f.FileInfo().Size(),
+			})
+			continue
+		}
+		if f.CRC32 == nf.CRC32 && f.UncompressedSize64 == nf.UncompressedSize64 {
+			continue
+		}
+		fd := FileDiff{
+			Name:    f.Name,
+			OldSize: f.FileInfo().Size(),
+			NewSize: nf.FileInfo().Size(),
+		}
+		if fd.OldSize <= maxTextDiffSize && fd.NewSize <= maxTextDiffSize {
+			fd.Diff, err = diffZipFiles(f, nf)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		resp.Modified = append(resp.Modified, fd)
+	}
+	for _, f := range newZip.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if _, ok := oldFiles[f.Name]; !ok {
+			resp.Added = append(resp.Added, params.ManifestFile{
+				Name: f.Name,
+				Size: f.FileInfo().Size(),
+			})
+		}
+	}
+	if resp.Metadata, err = diffStructs(old.CharmMeta, new.CharmMeta); err != nil {
+		return nil, errgo.Notef(err, "cannot compare charm metadata")
+	}
+	var oldOptions, newOptions map[string]charm.Option
+	if old.CharmConfig != nil {
+		oldOptions = old.CharmConfig.Options
+	}
+	if new.CharmConfig != nil {
+		newOptions = new.CharmConfig.Options
+	}
+	if resp.Config, err = diffStructs(oldOptions, newOptions); err != nil {
+		return nil, errgo.Notef(err, "cannot compare charm config")
+	}
+	var oldActions, newActions map[string]charm.ActionSpec
+	if old.CharmActions != nil {
+		oldActions = old.CharmActions.ActionSpecs
+	}
+	if new.CharmActions != nil {
+		newActions = new.CharmActions.ActionSpecs
+	}
+	if resp.Actions, err = diffStructs(oldActions, newActions); err != nil {
+		return nil, errgo.Notef(err, "cannot compare charm actions")
+	}
+	return resp, nil
+}
+
+// openArchiveZip opens the archive blob of the given entity
+// as a zip file. The returned closer must be closed after use.
+func (h *ReqHandler) openArchiveZip(entity *mongodoc.Entity) (*zip.Reader, io.Closer, error) {
+	r, size, err := h.Store.BlobStore.Open(entity.BlobHash, nil)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot open archive data for %s", entity.URL)
+	}
+	zipReader, err := zip.NewReader(charmstore.ReaderAtSeeker(r), size)
+	if err != nil {
+		r.Close()
+		return nil, nil, errgo.Notef(err, "cannot read archive data for %s", entity.URL)
+	}
+	return zipReader, r, nil
+}
+
+// zipFiles returns a map from file name to file
+// for all the regular files in the given zip archive.
+func zipFiles(r *zip.Reader) map[string]*zip.File {
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		files[f.Name] = f
+	}
+	return files
+}
+
+// diffZipFiles returns the differences between the two files
+// in unified diff format. It returns the empty string if either
+// of the files does not hold text.
+func diffZipFiles(old, new *zip.File) (string, error) {
+	oldData, err := readZipFile(old)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	newData, err := readZipFile(new)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if !isText(oldData) || !isText(newData) {
+		return "", nil
+	}
+	return textdiff.Unified("a/"+old.Name, "b/"+new.Name, string(oldData), string(newData), textDiffContext), nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open %q", f.Name)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read %q", f.Name)
+	}
+	return data, nil
+}
+
+// isText reports whether the given data looks like text.
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) == -1
+}
+
+// diffStructs returns the differences between the top level fields
+// of the JSON representations of old and new. It returns nil
+// if there are no differences.
+func diffStructs(old, new interface{}) (*StructDiff, error) {
+	oldFields, err := jsonFields(old)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	newFields, err := jsonFields(new)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var d StructDiff
+	for name, oldVal := range oldFields {
+		newVal, ok := newFields[name]
+		if !ok {
+			if d.Removed == nil {
+				d.Removed = make(map[string]interface{})
+			}
+			d.Removed[name] = oldVal
+			continue
+		}
+		if !reflect.DeepEqual(oldVal, newVal) {
+			if d.Changed == nil {
+				d.Changed = make(map[string]ValueChange)
+			}
+			d.Changed[name] = ValueChange{
+				Old: oldVal,
+				New: newVal,
+			}
+		}
+	}
+	for name, newVal := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			if d.Added == nil {
+				d.Added = make(map[string]interface{})
+			}
+			d.Added[name] = newVal
+		}
+	}
+	if d.Added == nil && d.Removed == nil && d.Changed == nil {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+// jsonFields returns the top level fields of the JSON
+// representation of v.
+func jsonFields(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal %T", v)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal %T", v)
+	}
+	return fields, nil
+}
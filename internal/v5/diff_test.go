@@ -0,0 +1,126 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestDiff(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "old summary",
+	}), newResolvedURL("~charmers/precise/wordpress-0", -1))
+	newCharm := storetesting.NewCharm(&charm.Meta{
+		Name:    "wordpress",
+		Summary: "new summary",
+	}).WithMetrics(&charm.Metrics{
+		Metrics: map[string]charm.Metric{
+			"pings": {Type: "gauge", Description: "Number of pings."},
+		},
+	})
+	s.addPublicCharm(c, newCharm, newResolvedURL("~charmers/precise/wordpress-1", -1))
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Do:      bakeryDo(nil),
+		URL:     storeURL("~charmers/precise/wordpress-0/diff/~charmers/precise/wordpress-1"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var resp v5.DiffResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.Equals, nil)
+
+	c.Assert(resp.Id, jc.DeepEquals, charm.MustParseURL("~charmers/precise/wordpress-0"))
+	c.Assert(resp.OtherId, jc.DeepEquals, charm.MustParseURL("~charmers/precise/wordpress-1"))
+	c.Assert(resp.Removed, gc.HasLen, 0)
+	c.Assert(resp.Added, gc.HasLen, 1)
+	c.Assert(resp.Added[0].Name, gc.Equals, "metrics.yaml")
+	c.Assert(resp.Modified, gc.HasLen, 1)
+	c.Assert(resp.Modified[0].Name, gc.Equals, "metadata.yaml")
+	c.Assert(resp.Modified[0].Diff, gc.Matches, `(?s)--- a/metadata.yaml\n\+\+\+ b/metadata.yaml\n.*-.*old summary\n\+.*new summary\n.*`)
+	c.Assert(resp.Metadata, jc.DeepEquals, &v5.StructDiff{
+		Changed: map[string]v5.ValueChange{
+			"Summary": {
+				Old: "old summary",
+				New: "new summary",
+			},
+		},
+	})
+	c.Assert(resp.Config, gc.IsNil)
+	c.Assert(resp.Actions, gc.IsNil)
+}
+
+func (s *APISuite) TestDiffConfigAndActions(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "dummy", newResolvedURL("~charmers/precise/dummy-0", -1))
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Do:      bakeryDo(nil),
+		URL:     storeURL("~charmers/precise/wordpress-0/diff/~charmers/precise/dummy-0"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var resp v5.DiffResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.Equals, nil)
+
+	// The two charms have no configuration options or actions
+	// in common.
+	dummy := storetesting.Charms.CharmDir("dummy")
+	c.Assert(resp.Config, gc.NotNil)
+	c.Assert(resp.Config.Removed, gc.HasLen, 1)
+	c.Assert(resp.Config.Removed["blog-title"], gc.NotNil)
+	c.Assert(resp.Config.Changed, gc.HasLen, 0)
+	c.Assert(resp.Config.Added, gc.HasLen, len(dummy.Config().Options))
+	c.Assert(resp.Actions, gc.NotNil)
+	c.Assert(resp.Actions.Added, gc.HasLen, len(dummy.Actions().ActionSpecs))
+	c.Assert(resp.Metadata.Changed["Name"], jc.DeepEquals, v5.ValueChange{
+		Old: "wordpress",
+		New: "dummy",
+	})
+}
+
+func (s *APISuite) TestDiffOtherIdNotFound(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", -1))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Do:           bakeryDo(nil),
+		URL:          storeURL("~charmers/precise/wordpress-0/diff/~charmers/precise/wordpress-5"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `no matching charm or bundle for cs:~charmers/precise/wordpress-5`,
+		},
+	})
+}
+
+func (s *APISuite) TestDiffInvalidOtherId(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", -1))
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Do:      bakeryDo(nil),
+		URL:     storeURL("~charmers/precise/wordpress-0/diff/bad:id"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest, gc.Commentf("body: %s", rec.Body.String()))
+}
+
+func (s *APISuite) TestDiffOtherIdUnauthorized(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", -1))
+	err := s.store.AddCharmWithArchive(newResolvedURL("~charmers/precise/wordpress-1", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	s.doAsUser("bob", func() {
+		s.assertGetIsUnauthorized(c, "~charmers/precise/wordpress-0/diff/~charmers/precise/wordpress-1", `access denied for user "bob"`)
+	})
+}
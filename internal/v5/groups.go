@@ -0,0 +1,181 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// Group holds a group of users managed by the charm store.
+type Group struct {
+	Name    string
+	Members []string
+}
+
+// GroupRequest holds the body of a PUT /groups/name request.
+type GroupRequest struct {
+	Members []string
+}
+
+// GET /groups
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-groups
+func (h *ReqHandler) serveGroups(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	groups, err := h.Store.Groups()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := make([]Group, len(groups))
+	for i := range groups {
+		resp[i] = groupInfo(&groups[i])
+	}
+	return resp, nil
+}
+
+// GET /groups/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-groupsname
+//
+// PUT /groups/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-groupsname
+//
+// DELETE /groups/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-groupsname
+//
+// PUT /groups/name/members/user
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-groupsnamemembersuser
+//
+// DELETE /groups/name/members/user
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-groupsnamemembersuser
+func (h *ReqHandler) serveGroup(w http.ResponseWriter, req *http.Request) error {
+	if err := h.authenticateAdmin(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	name := parts[0]
+	if err := validateGroupMember(name); err != nil {
+		return errgo.WithCausef(nil, params.ErrNotFound, "not found")
+	}
+	switch {
+	case len(parts) == 1:
+		return h.serveGroupMembers(w, req, name)
+	case len(parts) == 3 && parts[1] == "members":
+		return h.serveGroupMember(req, name, parts[2])
+	}
+	return errgo.WithCausef(nil, params.ErrNotFound, "not found")
+}
+
+// serveGroupMembers serves requests on the group with the given name.
+func (h *ReqHandler) serveGroupMembers(w http.ResponseWriter, req *http.Request, name string) error {
+	switch req.Method {
+	case "GET":
+		group, err := h.Store.Group(name)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return httprequest.WriteJSON(w, http.StatusOK, groupInfo(group))
+	case "PUT":
+		var p struct {
+			GroupRequest `httprequest:",body"`
+		}
+		if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &p); err != nil {
+			return badRequestf(err, "cannot unmarshal group request")
+		}
+		for _, m := range p.Members {
+			if err := validateGroupMember(m); err != nil {
+				return badRequestf(err, "invalid group member")
+			}
+		}
+		if err := h.Store.SetGroupMembers(name, p.Members); err != nil {
+			return errgo.Mask(err)
+		}
+		h.addAudit(audit.Entry{
+			Op: audit.OpSetGroup,
+			NewValue: groupInfo(&mongodoc.Group{
+				Name:    name,
+				Members: p.Members,
+			}),
+		})
+		return nil
+	case "DELETE":
+		group, err := h.Store.Group(name)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		if err := h.Store.RemoveGroup(name); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		h.addAudit(audit.Entry{
+			Op:       audit.OpRemoveGroup,
+			OldValue: groupInfo(group),
+		})
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+}
+
+// serveGroupMember serves requests that add or remove the given user
+// to or from the group with the given name.
+func (h *ReqHandler) serveGroupMember(req *http.Request, name, user string) error {
+	if err := validateGroupMember(user); err != nil {
+		return badRequestf(err, "invalid group member")
+	}
+	var err error
+	switch req.Method {
+	case "PUT":
+		err = h.Store.AddGroupMember(name, user)
+	case "DELETE":
+		err = h.Store.RemoveGroupMember(name, user)
+	default:
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	group, err := h.Store.Group(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	h.addAudit(audit.Entry{
+		Op:       audit.OpSetGroup,
+		NewValue: groupInfo(group),
+	})
+	return nil
+}
+
+// validateGroupMember checks that the given name can be used as the
+// name of a group or of a group member.
+func validateGroupMember(name string) error {
+	switch {
+	case name == "":
+		return errgo.New("empty name")
+	case name == params.Everyone:
+		return errgo.Newf("%q cannot be used", params.Everyone)
+	}
+	return nil
+}
+
+// groupInfo returns the public information about the given group.
+func groupInfo(group *mongodoc.Group) Group {
+	members := group.Members
+	if members == nil {
+		members = []string{}
+	}
+	return Group{
+		Name:    group.Name,
+		Members: members,
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+type groupsSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&groupsSuite{})
+
+func (s *groupsSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.enableLocalGroups = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *groupsSuite) TestManageGroups(c *gc.C) {
+	entries := s.recordAuditEntries(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("groups"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: []v5.Group{},
+	})
+
+	// Set the members of a new group.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("groups/team-x"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.GroupRequest{
+			Members: []string{"bob", "alice"},
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("groups/team-x"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: v5.Group{
+			Name:    "team-x",
+			Members: []string{"bob", "alice"},
+		},
+	})
+
+	// Add and remove individual members.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("groups/team-x/members/charlie"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("groups/team-x/members/bob"),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("groups"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: []v5.Group{{
+			Name:    "team-x",
+			Members: []string{"alice", "charlie"},
+		}},
+	})
+
+	// Remove the group.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("groups/team-x"),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("groups/team-x"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `group "team-x" not found`,
+		},
+	})
+
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User: "admin",
+		Op:   audit.OpSetGroup,
+		NewValue: v5.Group{
+			Name:    "team-x",
+			Members: []string{"bob", "alice"},
+		},
+		AuthMethod: "basic",
+	}, {
+		User: "admin",
+		Op:   audit.OpSetGroup,
+		NewValue: v5.Group{
+			Name:    "team-x",
+			Members: []string{"bob", "alice", "charlie"},
+		},
+		AuthMethod: "basic",
+	}, {
+		User: "admin",
+		Op:   audit.OpSetGroup,
+		NewValue: v5.Group{
+			Name:    "team-x",
+			Members: []string{"alice", "charlie"},
+		},
+		AuthMethod: "basic",
+	}, {
+		User: "admin",
+		Op:   audit.OpRemoveGroup,
+		OldValue: v5.Group{
+			Name:    "team-x",
+			Members: []string{"alice", "charlie"},
+		},
+		AuthMethod: "basic",
+	}})
+}
+
+var invalidGroupRequestTests = []struct {
+	about        string
+	method       string
+	path         string
+	body         interface{}
+	expectStatus int
+	expectError  params.Error
+}{{
+	about:        "reserved group name",
+	method:       "PUT",
+	path:         "groups/everyone",
+	body:         v5.GroupRequest{},
+	expectStatus: http.StatusNotFound,
+	expectError: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
+}, {
+	about:        "reserved member name",
+	method:       "PUT",
+	path:         "groups/team-x",
+	body:         v5.GroupRequest{Members: []string{"bob", "everyone"}},
+	expectStatus: http.StatusBadRequest,
+	expectError: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid group member: "everyone" cannot be used`,
+	},
+}, {
+	about:        "unknown subresource",
+	method:       "GET",
+	path:         "groups/team-x/owners",
+	expectStatus: http.StatusNotFound,
+	expectError: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
+}, {
+	about:        "remove member of unknown group",
+	method:       "DELETE",
+	path:         "groups/team-y/members/bob",
+	expectStatus: http.StatusNotFound,
+	expectError: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `group "team-y" not found`,
+	},
+}, {
+	about:        "method not allowed",
+	method:       "POST",
+	path:         "groups/team-x",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectError: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "POST not allowed",
+	},
+}}
+
+func (s *groupsSuite) TestInvalidGroupRequests(c *gc.C) {
+	for i, test := range invalidGroupRequestTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       test.method,
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectError,
+		})
+	}
+}
+
+func (s *groupsSuite) TestGroupEndpointsRequireAdmin(c *gc.C) {
+	for _, path := range []string{"groups", "groups/team-x", "groups/team-x/members/bob"} {
+		c.Logf("path %s", path)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL(path),
+			Do:      s.bakeryDoAsUser("bob"),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+	}
+}
+
+func (s *groupsSuite) TestGroupsUsedInACLs(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(nil), id)
+	s.setPerms(c, map[string][]string{
+		"~charmers/precise/wordpress-0": {"team-x"},
+	})
+
+	// Bob is not yet a member of the group.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/meta/id"),
+		Do:      s.bakeryDoAsUser("bob"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("groups/team-x/members/bob"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+	})
+
+	// Group membership is taken from the charm store rather than
+	// from the identity service.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("whoami"),
+		Do:      s.bakeryDoAsUser("bob"),
+		ExpectBody: params.WhoAmIResponse{
+			User:   "bob",
+			Groups: []string{"team-x"},
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/meta/id"),
+		Do:      s.bakeryDoAsUser("bob"),
+		ExpectBody: params.IdResponse{
+			Id:       charm.MustParseURL("~charmers/precise/wordpress-0"),
+			User:     "charmers",
+			Series:   "precise",
+			Name:     "wordpress",
+			Revision: 0,
+		},
+	})
+}
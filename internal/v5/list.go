@@ -6,43 +6,98 @@ package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
 import (
 	"net/http"
 
+	"github.com/juju/httprequest"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/entitycache"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
 )
 
 // GET list[?filter=value…][&include=meta][&sort=field[+dir]]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-list
-func (h *ReqHandler) serveList(_ http.Header, req *http.Request) (interface{}, error) {
+func (h *ReqHandler) serveList(w http.ResponseWriter, req *http.Request) error {
 	sp, err := ParseSearchParams(req)
 	sp.AutoComplete = false
 	if err != nil {
-		return "", err
+		return err
 	}
 	h.WillIncludeMetadata(sp.Include)
 
 	lq, err := h.Store.ListQuery(sp)
 	if err != nil {
-		return nil, badRequestf(err, "")
+		return badRequestf(err, "")
+	}
+	// The response may be streamed, so it depends on the Accept
+	// header.
+	w.Header().Add("Vary", "Accept")
+	if router.AcceptsNDJSON(req) {
+		return h.streamList(w, req, lq, sp.Include)
 	}
 	var results []*mongodoc.Entity
-	iter := h.Cache.CustomIter(entityCacheListQuery{lq}, nil)
+	iter := h.Cache.CustomIter(entityCacheListQuery{lq}, 0)
 	for iter.Next() {
 		results = append(results, iter.Entity())
 	}
-	if iter.Err() != nil {
-		return nil, errgo.Notef(err, "error listing charms and bundles")
+	if err := iter.Err(); err != nil {
+		return errgo.Notef(err, "error listing charms and bundles")
 	}
 	r, err := h.getMetadataForEntities(results, sp.Include, req, nil)
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot get metadata")
+		return errgo.Notef(err, "cannot get metadata")
 	}
-	return params.ListResponse{
+	httprequest.WriteJSON(w, http.StatusOK, params.ListResponse{
 		Results: r,
-	}, nil
+	})
+	return nil
+}
+
+// streamList writes the results of the given list query as
+// newline-delimited JSON values, each one written as soon as its
+// entity is produced by the entity cache. Errors retrieving the
+// metadata of an entity are written inline, and entities that are not
+// readable by the current user are omitted.
+//
+// GET list[?filter=value…][&include=meta][&sort=field[+dir]]
+// Accept: application/x-ndjson
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#streamed-responses
+func (h *ReqHandler) streamList(w http.ResponseWriter, req *http.Request, lq *charmstore.ListQuery, includes []string) error {
+	if err := h.checkIncludes(includes); err != nil {
+		return errgo.Notef(err, "cannot get metadata")
+	}
+	sw := router.NewStreamWriter(w)
+	iter := h.Cache.CustomIter(entityCacheListQuery{lq}, 0)
+	for iter.Next() {
+		e := iter.Entity()
+		id := e.PreferredURL(true).String()
+		meta, err := h.getMetadataForEntity(e, includes, req)
+		if err == errMetadataUnauthorized {
+			continue
+		}
+		if err != nil {
+			logger.Errorf("cannot retrieve metadata for %v: %v", id, err)
+			err = sw.WriteError(id, err)
+		} else {
+			err = sw.WriteMeta(id, meta)
+		}
+		if err != nil {
+			// The response has already started, so there
+			// is no way to report the error to the client.
+			iter.Close()
+			logger.Errorf("cannot write streamed list: %v", err)
+			return nil
+		}
+	}
+	if err := iter.Err(); err != nil {
+		// The response has already started, so report the
+		// error as the last result.
+		if err := sw.WriteError("", errgo.Notef(err, "error listing charms and bundles")); err != nil {
+			logger.Errorf("cannot write streamed list: %v", err)
+		}
+	}
+	return nil
 }
 
 type entityCacheListQuery struct {
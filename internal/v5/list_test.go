@@ -6,6 +6,7 @@ package v5_test
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"sort"
 	"strings"
@@ -303,6 +304,57 @@ func (s *ListSuite) TestListIncludeError(c *gc.C) {
 	c.Assert(tw.Log(), jc.LogMatches, []string{"cannot retrieve metadata for cs:precise/wordpress-23: cannot open archive data for cs:precise/wordpress-23: .*"})
 }
 
+func (s *ListSuite) TestStreamedList(c *gc.C) {
+	// Update the entity to hold an invalid hash, so that
+	// its manifest cannot be retrieved.
+	err := s.store.UpdateEntity(newResolvedURL("~charmers/precise/wordpress-23", 23), bson.D{{
+		"$set", bson.D{{
+			"blobhash", hashOfString("nope"),
+		}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("list?type=charm&include=manifest"),
+		Header:  http.Header{"Accept": {"application/x-ndjson"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/x-ndjson")
+
+	// Each result is on its own line. The error for cs:wordpress
+	// is included inline, and cs:riak is omitted because it is
+	// not visible to "everyone".
+	results := make(map[string]router.StreamResult)
+	dec := json.NewDecoder(rec.Body)
+	for {
+		var r router.StreamResult
+		err := dec.Decode(&r)
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, gc.Equals, nil)
+		results[r.Id] = r
+	}
+	c.Assert(results, gc.HasLen, len(exportTestCharms)-1)
+	for name, id := range exportTestCharms {
+		r, ok := results[id.PreferredURL().String()]
+		if name == "riak" {
+			c.Assert(ok, gc.Equals, false)
+			continue
+		}
+		c.Assert(ok, gc.Equals, true, gc.Commentf("charm %s", name))
+		if name == "wordpress" {
+			c.Assert(r.Meta, gc.IsNil)
+			c.Assert(r.Error, gc.NotNil)
+			c.Assert(r.Error.Message, gc.Matches, "cannot open archive data for cs:precise/wordpress-23: .*")
+			continue
+		}
+		c.Assert(r.Error, gc.IsNil)
+		c.Assert(r.Meta, gc.NotNil)
+	}
+}
+
 func (s *ListSuite) TestSortingList(c *gc.C) {
 	tests := []struct {
 		about   string
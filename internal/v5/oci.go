@@ -0,0 +1,156 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// ociDigestHeader holds the name of the HTTP header used by the OCI
+// distribution API to report the digest of returned content.
+const ociDigestHeader = "Docker-Content-Digest"
+
+// GET id/oci/name/manifests/reference
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idociresourcemanifestsreference
+//
+// GET id/oci/name/blobs/digest
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idociresourceblobsdigest
+//
+// PUT id/oci/name/blobs/digest
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idociresourceblobsdigesthashsha384
+func (h *ReqHandler) serveOCI(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	name, kind, ref := parts[0], parts[1], parts[2]
+	if id.URL.Series == "bundle" {
+		return errgo.WithCausef(nil, params.ErrNotFound, "no OCI image resource %q", name)
+	}
+	e, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("charmmeta"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if r, ok := e.CharmMeta.Resources[name]; !ok || !charmstore.IsOCIImageResource(r) {
+		return errgo.WithCausef(nil, params.ErrNotFound, "no OCI image resource %q", name)
+	}
+	switch kind {
+	case "manifests":
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+		}
+		return h.serveOCIManifest(id, name, ref, w, req)
+	case "blobs":
+		switch req.Method {
+		case "GET", "HEAD":
+			return h.serveOCIBlob(id, ref, w, req)
+		case "PUT":
+			return h.serveUploadOCIBlob(id, name, ref, w, req)
+		}
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	return errgo.WithCausef(nil, params.ErrNotFound, "")
+}
+
+// serveOCIManifest serves the manifest of the named OCI image resource.
+// The reference may be a manifest digest, a resource revision number or
+// "latest", which refers to the revision of the resource associated
+// with the entity in the current channel.
+func (h *ReqHandler) serveOCIManifest(id *router.ResolvedURL, name, ref string, w http.ResponseWriter, req *http.Request) error {
+	var r *mongodoc.Resource
+	var err error
+	if strings.HasPrefix(ref, "sha256:") {
+		r, err = h.Store.ResolveOCIManifest(id, name, ref)
+	} else {
+		revision := -1
+		if ref != "latest" {
+			revision, err = strconv.Atoi(ref)
+			if err != nil || revision < 0 {
+				return errgo.WithCausef(nil, params.ErrNotFound, "manifest %q not found", ref)
+			}
+		}
+		var ch params.Channel
+		ch, err = h.entityChannel(id)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		r, err = h.Store.ResolveResource(id, name, revision, ch)
+	}
+	if errgo.Cause(err) == params.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "manifest %q not found", ref)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	blob, err := h.Store.OpenResourceBlob(r)
+	if err != nil {
+		return errgo.Notef(err, "cannot open resource blob")
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return errgo.Notef(err, "cannot read manifest")
+	}
+	m, err := charmstore.ParseOCIManifest(data)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	header := w.Header()
+	setArchiveCacheControl(header, h.isPublic(id))
+	header.Set("Content-Type", m.MediaType)
+	header.Set(ociDigestHeader, "sha256:"+r.BlobHash256)
+	serveContent(w, req, int64(len(data)), bytes.NewReader(data))
+	return nil
+}
+
+// serveOCIBlob serves the OCI blob with the given digest.
+func (h *ReqHandler) serveOCIBlob(id *router.ResolvedURL, digest string, w http.ResponseWriter, req *http.Request) error {
+	blob, err := h.Store.OpenOCIBlob(id, digest)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	defer blob.Close()
+	header := w.Header()
+	setArchiveCacheControl(header, h.isPublic(id))
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set(ociDigestHeader, digest)
+	serveContent(w, req, blob.Size, blob)
+	return nil
+}
+
+// serveUploadOCIBlob uploads an OCI blob with the given digest
+// for use by the manifests of the named OCI image resource.
+func (h *ReqHandler) serveUploadOCIBlob(id *router.ResolvedURL, name, digest string, w http.ResponseWriter, req *http.Request) error {
+	hash := req.Form.Get("hash")
+	if hash == "" {
+		return badRequestf(nil, "hash parameter not specified")
+	}
+	if req.ContentLength == -1 {
+		return badRequestf(nil, "Content-Length not specified")
+	}
+	if err := h.Store.UploadOCIBlob(id, name, digest, req.Body, hash, req.ContentLength); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrNotFound))
+	}
+	h.addAudit(audit.Entry{
+		Op:       audit.OpUploadOCIBlob,
+		Entity:   &id.URL,
+		Resource: name,
+		NewValue: digest,
+	})
+	w.Header().Set(ociDigestHeader, digest)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+const (
+	ociConfig = `{"architecture":"amd64","os":"linux"}`
+	ociLayer  = "layer content"
+)
+
+// ociManifest returns an OCI image manifest referring to
+// ociConfig and ociLayer.
+func ociManifest() string {
+	return fmt.Sprintf(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":%d},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":%q,"size":%d}]}`,
+		ociDigest(ociConfig), len(ociConfig),
+		ociDigest(ociLayer), len(ociLayer),
+	)
+}
+
+func ociDigest(s string) string {
+	return "sha256:" + hash256OfString(s)
+}
+
+// addOCIImageCharm adds a charm with an OCI image resource
+// named "image" and a file resource named "someResource".
+func (s *ResourceSuite) addOCIImageCharm(c *gc.C, id *router.ResolvedURL) {
+	ociType, err := resource.ParseType("oci-image")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.AddCharmWithArchive(id, storetesting.NewCharm(&charm.Meta{
+		Resources: map[string]resource.Meta{
+			"image": {
+				Name:        "image",
+				Type:        ociType,
+				Description: "the workload image",
+			},
+			"someResource": {
+				Name: "someResource",
+				Type: resource.TypeFile,
+				Path: "1.zip",
+			},
+		},
+	}))
+	c.Assert(err, gc.Equals, nil)
+}
+
+// uploadOCIImage uploads the blobs and manifest of the OCI image resource
+// named "image" associated with the given id.
+func (s *ResourceSuite) uploadOCIImage(c *gc.C, id *router.ResolvedURL) {
+	for _, content := range []string{ociConfig, ociLayer} {
+		err := s.store.UploadOCIBlob(id, "image", ociDigest(content), strings.NewReader(content), hashOfString(content), int64(len(content)))
+		c.Assert(err, gc.Equals, nil)
+	}
+	s.uploadResource(c, id, "image", ociManifest())
+}
+
+// publishOCIImageCharm adds a charm with an OCI image resource,
+// uploads its resources and publishes it to the stable channel.
+func (s *ResourceSuite) publishOCIImageCharm(c *gc.C, id *router.ResolvedURL) {
+	s.addOCIImageCharm(c, id)
+	s.uploadOCIImage(c, id)
+	s.uploadResource(c, id, "someResource", "some content")
+	s.setPublicWithResources(c, id, map[string]int{
+		"image":        0,
+		"someResource": 0,
+	})
+}
+
+func (s *ResourceSuite) TestOCIGetManifest(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.publishOCIImageCharm(c, id)
+
+	for _, ref := range []string{"latest", "0", ociDigest(ociManifest())} {
+		c.Logf("reference %q", ref)
+		resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL(id.URL.Path() + "/oci/image/manifests/" + ref),
+		})
+		c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+		c.Assert(resp.Body.String(), gc.Equals, ociManifest())
+		c.Assert(resp.Header().Get("Content-Type"), gc.Equals, "application/vnd.oci.image.manifest.v1+json")
+		c.Assert(resp.Header().Get("Docker-Content-Digest"), gc.Equals, ociDigest(ociManifest()))
+		assertCacheControl(c, resp.Header(), true)
+	}
+}
+
+func (s *ResourceSuite) TestOCIGetManifestNotFound(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.publishOCIImageCharm(c, id)
+
+	for _, ref := range []string{"1", "-1", "foo", ociDigest("other")} {
+		c.Logf("reference %q", ref)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(id.URL.Path() + "/oci/image/manifests/" + ref),
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody: params.Error{
+				Code:    params.ErrNotFound,
+				Message: fmt.Sprintf("manifest %q not found", ref),
+			},
+		})
+	}
+}
+
+func (s *ResourceSuite) TestOCIGetBlob(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.publishOCIImageCharm(c, id)
+
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id.URL.Path() + "/oci/image/blobs/" + ociDigest(ociLayer)),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	c.Assert(resp.Body.String(), gc.Equals, ociLayer)
+	c.Assert(resp.Header().Get("Docker-Content-Digest"), gc.Equals, ociDigest(ociLayer))
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(id.URL.Path() + "/oci/image/blobs/" + ociDigest("other")),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: fmt.Sprintf("blob %q not found", ociDigest("other")),
+		},
+	})
+}
+
+func (s *ResourceSuite) TestOCIUploadBlob(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addOCIImageCharm(c, id)
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(fmt.Sprintf("%s/oci/image/blobs/%s?hash=%s", id.URL.Path(), ociDigest(ociLayer), hashOfString(ociLayer))),
+		Body:    strings.NewReader(ociLayer),
+		Do:      s.bakeryDoAsUser("charmers"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusCreated, gc.Commentf("body: %s", resp.Body.String()))
+	c.Assert(resp.Header().Get("Docker-Content-Digest"), gc.Equals, ociDigest(ociLayer))
+
+	blob, err := s.store.OpenOCIBlob(id, ociDigest(ociLayer))
+	c.Assert(err, gc.Equals, nil)
+	defer blob.Close()
+	c.Assert(blob.Size, gc.Equals, int64(len(ociLayer)))
+}
+
+func (s *ResourceSuite) TestOCIUploadBlobDigestMismatch(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addOCIImageCharm(c, id)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL(fmt.Sprintf("%s/oci/image/blobs/%s?hash=%s", id.URL.Path(), ociDigest("other"), hashOfString(ociLayer))),
+		Body:         strings.NewReader(ociLayer),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: fmt.Sprintf("digest mismatch (got %q want %q)", ociDigest(ociLayer), ociDigest("other")),
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+}
+
+func (s *ResourceSuite) TestOCIUploadBlobUnauthorized(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addOCIImageCharm(c, id)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL(fmt.Sprintf("%s/oci/image/blobs/%s?hash=%s", id.URL.Path(), ociDigest(ociLayer), hashOfString(ociLayer))),
+		Body:         strings.NewReader(ociLayer),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+		Do: s.bakeryDoAsUser("bob"),
+	})
+}
+
+func (s *ResourceSuite) TestOCIUploadManifestWithMissingBlob(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addOCIImageCharm(c, id)
+	err := s.store.UploadOCIBlob(id, "image", ociDigest(ociConfig), strings.NewReader(ociConfig), hashOfString(ociConfig), int64(len(ociConfig)))
+	c.Assert(err, gc.Equals, nil)
+
+	manifest := ociManifest()
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL(fmt.Sprintf("%s/resource/image?hash=%s", id.URL.Path(), hashOfString(manifest))),
+		Body:         strings.NewReader(manifest),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: fmt.Sprintf("blob %q referred to by manifest has not been uploaded", ociDigest(ociLayer)),
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+}
+
+func (s *ResourceSuite) TestOCINotOCIImageResource(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addOCIImageCharm(c, id)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(id.URL.Path() + "/oci/someResource/manifests/latest"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `no OCI image resource "someResource"`,
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+}
+
+func (s *ResourceSuite) TestOCIPrivateCharm(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addOCIImageCharm(c, id)
+	s.uploadOCIImage(c, id)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(id.URL.Path() + "/oci/image/blobs/" + ociDigest(ociLayer)),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+		Do: s.bakeryDoAsUser("bob"),
+	})
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id.URL.Path() + "/oci/image/manifests/0"),
+		Do:      s.bakeryDoAsUser("charmers"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	c.Assert(resp.Body.String(), gc.Equals, ociManifest())
+	assertCacheControl(c, resp.Header(), false)
+}
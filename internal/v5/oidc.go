@@ -0,0 +1,78 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/juju/names.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/oidc"
+)
+
+// oidcTokenFromRequest returns the OpenID Connect ID token held in the
+// Authorization header of the given request, if any. Access tokens,
+// which are also sent as bearer tokens, are distinguished by their
+// prefix. No ID token is returned when the charm store has not been
+// configured to accept them.
+func (h *ReqHandler) oidcTokenFromRequest(req *http.Request) (string, bool) {
+	if h.Handler.oidc == nil {
+		return "", false
+	}
+	parts := strings.Fields(req.Header.Get("Authorization"))
+	if len(parts) != 2 || parts[0] != "Bearer" || strings.HasPrefix(parts[1], charmstore.AccessTokenPrefix) {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// checkOIDCToken returns the authorization granted by the given
+// OpenID Connect ID token. The user and groups are taken from the
+// claims of the token rather than from the identity manager.
+//
+// The user name claimed by the token is used directly as the charm
+// store user name, so it shares the namespace of the users known to
+// the identity manager: the issuer must only assert names that belong
+// to the same person there. Names that are not valid charm store user
+// names are rejected. The groups claimed by the token are prefixed so
+// that they have a namespace of their own.
+func (h *ReqHandler) checkOIDCToken(token string) (Authorization, error) {
+	ident, err := h.Handler.oidc.Verify(token)
+	if err != nil {
+		if errgo.Cause(err) == oidc.ErrInvalidToken {
+			return Authorization{}, errgo.WithCausef(err, params.ErrUnauthorized, "invalid ID token")
+		}
+		return Authorization{}, errgo.Notef(err, "cannot verify ID token")
+	}
+	if ident.Username == params.Everyone || !names.IsValidUser(ident.Username) {
+		return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid ID token: invalid user name %q", ident.Username)
+	}
+	groups := make([]string, len(ident.Groups))
+	for i, g := range ident.Groups {
+		groups[i] = h.Handler.oidcGroupPrefix + g
+	}
+	return Authorization{
+		Username:   ident.Username,
+		Groups:     groups,
+		AuthMethod: authMethodOIDC,
+	}, nil
+}
+
+// oidcGroupPrefix returns the prefix added to the names of the groups
+// asserted by ID tokens with the given server configuration.
+func oidcGroupPrefix(config charmstore.ServerParams) (string, error) {
+	if config.OIDCGroupPrefix != "" {
+		return config.OIDCGroupPrefix, nil
+	}
+	u, err := url.Parse(config.OIDCIssuer)
+	if err != nil || u.Host == "" {
+		return "", errgo.Newf("invalid OpenID Connect issuer %q", config.OIDCIssuer)
+	}
+	return u.Hostname() + ":", nil
+}
@@ -0,0 +1,352 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// Org holds an organisation, which owns the namespace with the same
+// name as the organisation.
+type Org struct {
+	Name    string
+	Members []OrgMember
+
+	// DefaultACL holds the ACL given to all the channels of
+	// new base entities created in the organisation's namespace.
+	DefaultACL PermResponse
+}
+
+// OrgMember holds a member of an organisation and their role,
+// which is one of "admin", "uploader" or "member".
+type OrgMember struct {
+	User string
+	Role string
+}
+
+// OrgRequest holds the body of a PUT /orgs/name request.
+type OrgRequest struct {
+	Members []OrgMember
+
+	// DefaultACL holds the ACL given to new base entities created
+	// in the organisation's namespace. A read permission that is
+	// not specified defaults to the organisation's name, which
+	// allows access to all its members; other permissions default
+	// to the members with the admin or uploader role.
+	DefaultACL PermRequest
+}
+
+// OrgMemberRequest holds the body of a PUT /orgs/name/members/user
+// request.
+type OrgMemberRequest struct {
+	Role string
+}
+
+// GET /orgs
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-orgs
+func (h *ReqHandler) serveOrgs(_ http.Header, req *http.Request) (interface{}, error) {
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	auth, err := h.Authenticate(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var orgs []mongodoc.Org
+	if auth.Admin {
+		orgs, err = h.Store.Orgs()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	} else {
+		names, err := h.Store.UserOrgs(auth.Username)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for _, name := range names {
+			org, err := h.Store.Org(name)
+			if err != nil {
+				if errgo.Cause(err) == params.ErrNotFound {
+					// The organisation has been removed since
+					// the user's organisations were cached.
+					continue
+				}
+				return nil, errgo.Mask(err)
+			}
+			orgs = append(orgs, *org)
+		}
+	}
+	resp := make([]Org, len(orgs))
+	for i := range orgs {
+		resp[i] = orgInfo(&orgs[i])
+	}
+	return resp, nil
+}
+
+// GET /orgs/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-orgsname
+//
+// PUT /orgs/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-orgsname
+//
+// DELETE /orgs/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-orgsname
+//
+// PUT /orgs/name/default-acl
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-orgsnamedefault-acl
+//
+// PUT /orgs/name/members/user
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-orgsnamemembersuser
+//
+// DELETE /orgs/name/members/user
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-orgsnamemembersuser
+func (h *ReqHandler) serveOrg(w http.ResponseWriter, req *http.Request) error {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	name := parts[0]
+	if err := validateOrgName(name); err != nil {
+		return errgo.WithCausef(nil, params.ErrNotFound, "not found")
+	}
+	switch {
+	case len(parts) == 1:
+		return h.serveOrgInfo(w, req, name)
+	case len(parts) == 2 && parts[1] == "default-acl":
+		return h.serveOrgDefaultACL(req, name)
+	case len(parts) == 3 && parts[1] == "members":
+		return h.serveOrgMember(req, name, parts[2])
+	}
+	return errgo.WithCausef(nil, params.ErrNotFound, "not found")
+}
+
+// serveOrgInfo serves requests on the organisation with the given name.
+func (h *ReqHandler) serveOrgInfo(w http.ResponseWriter, req *http.Request, name string) error {
+	switch req.Method {
+	case "GET":
+		org, err := h.authorizeOrg(req, name, mongodoc.OrgAdmin, mongodoc.OrgUploader, mongodoc.OrgMemberRole)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return httprequest.WriteJSON(w, http.StatusOK, orgInfo(org))
+	case "PUT":
+		if err := h.authenticateAdmin(req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		var p struct {
+			OrgRequest `httprequest:",body"`
+		}
+		if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &p); err != nil {
+			return badRequestf(err, "cannot unmarshal organisation request")
+		}
+		org := &mongodoc.Org{
+			Name:       name,
+			Members:    make([]mongodoc.OrgMember, 0, len(p.Members)),
+			DefaultACL: permRequestACL(p.DefaultACL),
+		}
+		seen := make(map[string]bool)
+		for _, m := range p.Members {
+			member, err := orgMember(m.User, m.Role)
+			if err != nil {
+				return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+			}
+			if seen[m.User] {
+				return badRequestf(nil, "duplicate organisation member %q", m.User)
+			}
+			seen[m.User] = true
+			org.Members = append(org.Members, member)
+		}
+		if err := h.Store.SetOrg(org); err != nil {
+			return errgo.Mask(err)
+		}
+		h.addAudit(audit.Entry{
+			Op:       audit.OpSetOrg,
+			NewValue: orgInfo(org),
+		})
+		return nil
+	case "DELETE":
+		if err := h.authenticateAdmin(req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		org, err := h.Store.Org(name)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		if err := h.Store.RemoveOrg(name); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		h.addAudit(audit.Entry{
+			Op:       audit.OpRemoveOrg,
+			OldValue: orgInfo(org),
+		})
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+}
+
+// serveOrgDefaultACL serves requests that set the default ACL of the
+// organisation with the given name.
+func (h *ReqHandler) serveOrgDefaultACL(req *http.Request, name string) error {
+	if req.Method != "PUT" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if _, err := h.authorizeOrg(req, name, mongodoc.OrgAdmin); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var p struct {
+		PermRequest `httprequest:",body"`
+	}
+	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &p); err != nil {
+		return badRequestf(err, "cannot unmarshal default ACL")
+	}
+	if err := h.Store.SetOrgDefaultACL(name, permRequestACL(p.PermRequest)); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return h.auditOrg(name)
+}
+
+// serveOrgMember serves requests that add or remove the given user
+// to or from the organisation with the given name.
+func (h *ReqHandler) serveOrgMember(req *http.Request, name, user string) error {
+	if _, err := h.authorizeOrg(req, name, mongodoc.OrgAdmin); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	switch req.Method {
+	case "PUT":
+		var p struct {
+			OrgMemberRequest `httprequest:",body"`
+		}
+		if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &p); err != nil {
+			return badRequestf(err, "cannot unmarshal organisation member request")
+		}
+		member, err := orgMember(user, p.Role)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		if err := h.Store.SetOrgMember(name, member.User, member.Role); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+	case "DELETE":
+		if err := h.Store.RemoveOrgMember(name, user); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+	default:
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	return h.auditOrg(name)
+}
+
+// authorizeOrg checks that the given request is authorized by the
+// charm store admin or by a member of the organisation with the
+// given name that has one of the given roles, and returns the
+// organisation. Whether the organisation exists is only revealed to
+// the charm store admin.
+func (h *ReqHandler) authorizeOrg(req *http.Request, name string, roles ...mongodoc.OrgRole) (*mongodoc.Org, error) {
+	org, err := h.Store.Org(name)
+	if errgo.Cause(err) == params.ErrNotFound {
+		if err := h.authenticateAdmin(req); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if _, err := h.authorize(authorizeParams{
+		req: req,
+		ops: []string{OpWrite},
+		acls: []mongodoc.ACL{{
+			Write: org.UsersWithRole(roles...),
+		}},
+	}); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return org, nil
+}
+
+// auditOrg records an audit entry holding the current state of the
+// organisation with the given name.
+func (h *ReqHandler) auditOrg(name string) error {
+	org, err := h.Store.Org(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	h.addAudit(audit.Entry{
+		Op:       audit.OpSetOrg,
+		NewValue: orgInfo(org),
+	})
+	return nil
+}
+
+// validateOrgName checks that the given name can be used as the name
+// of an organisation, and hence of a namespace.
+func validateOrgName(name string) error {
+	if name == "" || name == params.Everyone || strings.Contains(name, "/") {
+		return errgo.Newf("invalid organisation name %q", name)
+	}
+	if _, err := charm.ParseURL("~" + name + "/name"); err != nil {
+		return errgo.Newf("invalid organisation name %q", name)
+	}
+	return nil
+}
+
+// orgMember returns an organisation member with the given user and
+// role. If either is invalid, it returns an error with a
+// params.ErrBadRequest cause.
+func orgMember(user, role string) (mongodoc.OrgMember, error) {
+	if err := validateGroupMember(user); err != nil {
+		return mongodoc.OrgMember{}, badRequestf(err, "invalid organisation member")
+	}
+	if !mongodoc.ValidOrgRoles[mongodoc.OrgRole(role)] {
+		return mongodoc.OrgMember{}, badRequestf(nil, "invalid role %q for organisation member %q", role, user)
+	}
+	return mongodoc.OrgMember{
+		User: user,
+		Role: mongodoc.OrgRole(role),
+	}, nil
+}
+
+// permRequestACL returns the ACL specified by the given request.
+func permRequestACL(p PermRequest) mongodoc.ACL {
+	return mongodoc.ACL{
+		Read:    p.Read,
+		Write:   p.Write,
+		Upload:  p.Upload,
+		Publish: p.Publish,
+		SetPerm: p.SetPerm,
+		Delete:  p.Delete,
+	}
+}
+
+// orgInfo returns the public information about the given organisation.
+func orgInfo(org *mongodoc.Org) Org {
+	members := make([]OrgMember, len(org.Members))
+	for i, m := range org.Members {
+		members[i] = OrgMember{
+			User: m.User,
+			Role: string(m.Role),
+		}
+	}
+	acl := charmstore.OrgDefaultACL(org)
+	return Org{
+		Name:    org.Name,
+		Members: members,
+		DefaultACL: PermResponse{
+			PermResponse: params.PermResponse{
+				Read:  acl.Read,
+				Write: acl.Write,
+			},
+			Upload:  acl.Upload,
+			Publish: acl.Publish,
+			SetPerm: acl.SetPerm,
+			Delete:  acl.Delete,
+		},
+	}
+}
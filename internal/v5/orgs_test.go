@@ -0,0 +1,412 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+type orgsSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&orgsSuite{})
+
+func (s *orgsSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+// createOrg creates the acme organisation with bob as its admin,
+// alice as an uploader and carol as a member.
+func (s *orgsSuite) createOrg(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("orgs/acme"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.OrgRequest{
+			Members: []v5.OrgMember{
+				{User: "bob", Role: "admin"},
+				{User: "alice", Role: "uploader"},
+				{User: "carol", Role: "member"},
+			},
+		},
+	})
+}
+
+// defaultOrgACL returns the default ACL of the acme organisation
+// when its default ACL sets only the given read permission (or none
+// if read is nil) and uploaders holds its admin and uploader members.
+func defaultOrgACL(read []string, uploaders ...string) v5.PermResponse {
+	if len(read) == 0 {
+		read = []string{"acme"}
+	}
+	return v5.PermResponse{
+		PermResponse: params.PermResponse{
+			Read:  read,
+			Write: uploaders,
+		},
+		Upload:  uploaders,
+		Publish: uploaders,
+		SetPerm: uploaders,
+		Delete:  uploaders,
+	}
+}
+
+func (s *orgsSuite) TestManageOrgs(c *gc.C) {
+	entries := s.recordAuditEntries(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("orgs"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: []v5.Org{},
+	})
+	s.createOrg(c)
+
+	// The organisation admin can manage its members.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("orgs/acme/members/dave"),
+		Method:   "PUT",
+		Do:       s.bakeryDoAsUser("bob"),
+		JSONBody: v5.OrgMemberRequest{Role: "uploader"},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("orgs/acme/members/carol"),
+		Method:  "DELETE",
+		Do:      s.bakeryDoAsUser("bob"),
+	})
+
+	// ... and its default ACL.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("orgs/acme/default-acl"),
+		Method:  "PUT",
+		Do:      s.bakeryDoAsUser("bob"),
+		JSONBody: v5.PermRequest{
+			PermRequest: params.PermRequest{
+				Read: []string{params.Everyone},
+			},
+		},
+	})
+	expectOrg := v5.Org{
+		Name: "acme",
+		Members: []v5.OrgMember{
+			{User: "bob", Role: "admin"},
+			{User: "alice", Role: "uploader"},
+			{User: "dave", Role: "uploader"},
+		},
+		DefaultACL: defaultOrgACL([]string{params.Everyone}, "bob", "alice", "dave"),
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("orgs/acme"),
+		Do:         s.bakeryDoAsUser("alice"),
+		ExpectBody: expectOrg,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("orgs"),
+		Do:         s.bakeryDoAsUser("dave"),
+		ExpectBody: []v5.Org{expectOrg},
+	})
+
+	// Only the charm store admin can remove the organisation.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("orgs/acme"),
+		Method:  "DELETE",
+		Do:      s.bakeryDoAsUser("bob"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("orgs/acme"),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("orgs/acme"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `organisation "acme" not found`,
+		},
+	})
+
+	created := v5.Org{
+		Name: "acme",
+		Members: []v5.OrgMember{
+			{User: "bob", Role: "admin"},
+			{User: "alice", Role: "uploader"},
+			{User: "carol", Role: "member"},
+		},
+		DefaultACL: defaultOrgACL(nil, "bob", "alice"),
+	}
+	withDave := v5.Org{
+		Name:       "acme",
+		Members:    append(created.Members[:3:3], v5.OrgMember{User: "dave", Role: "uploader"}),
+		DefaultACL: defaultOrgACL(nil, "bob", "alice", "dave"),
+	}
+	withoutCarol := v5.Org{
+		Name:       "acme",
+		Members:    expectOrg.Members,
+		DefaultACL: defaultOrgACL(nil, "bob", "alice", "dave"),
+	}
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "admin",
+		Op:         audit.OpSetOrg,
+		NewValue:   created,
+		AuthMethod: "basic",
+	}, {
+		User:       "bob",
+		Op:         audit.OpSetOrg,
+		NewValue:   withDave,
+		AuthMethod: "macaroon",
+	}, {
+		User:       "bob",
+		Op:         audit.OpSetOrg,
+		NewValue:   withoutCarol,
+		AuthMethod: "macaroon",
+	}, {
+		User:       "bob",
+		Op:         audit.OpSetOrg,
+		NewValue:   expectOrg,
+		AuthMethod: "macaroon",
+	}, {
+		User:       "admin",
+		Op:         audit.OpRemoveOrg,
+		OldValue:   expectOrg,
+		AuthMethod: "basic",
+	}})
+}
+
+var invalidOrgRequestTests = []struct {
+	about        string
+	method       string
+	path         string
+	body         interface{}
+	expectStatus int
+	expectError  params.Error
+}{{
+	about:  "invalid role",
+	method: "PUT",
+	path:   "orgs/acme",
+	body: v5.OrgRequest{
+		Members: []v5.OrgMember{{User: "bob", Role: "owner"}},
+	},
+	expectStatus: http.StatusBadRequest,
+	expectError: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid role "owner" for organisation member "bob"`,
+	},
+}, {
+	about:  "duplicate member",
+	method: "PUT",
+	path:   "orgs/acme",
+	body: v5.OrgRequest{
+		Members: []v5.OrgMember{
+			{User: "bob", Role: "admin"},
+			{User: "bob", Role: "member"},
+		},
+	},
+	expectStatus: http.StatusBadRequest,
+	expectError: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `duplicate organisation member "bob"`,
+	},
+}, {
+	about:  "invalid member",
+	method: "PUT",
+	path:   "orgs/acme",
+	body: v5.OrgRequest{
+		Members: []v5.OrgMember{{User: params.Everyone, Role: "member"}},
+	},
+	expectStatus: http.StatusBadRequest,
+	expectError: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid organisation member: "everyone" cannot be used`,
+	},
+}, {
+	about:        "invalid organisation name",
+	method:       "GET",
+	path:         "orgs/everyone",
+	expectStatus: http.StatusNotFound,
+	expectError: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
+}, {
+	about:        "unknown endpoint",
+	method:       "GET",
+	path:         "orgs/acme/foo",
+	expectStatus: http.StatusNotFound,
+	expectError: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
+}, {
+	about:        "member of unknown organisation",
+	method:       "DELETE",
+	path:         "orgs/widgets/members/bob",
+	expectStatus: http.StatusNotFound,
+	expectError: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `organisation "widgets" not found`,
+	},
+}, {
+	about:        "method not allowed",
+	method:       "POST",
+	path:         "orgs/acme",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectError: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "POST not allowed",
+	},
+}}
+
+func (s *orgsSuite) TestInvalidOrgRequests(c *gc.C) {
+	for i, test := range invalidOrgRequestTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       test.method,
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectError,
+		})
+	}
+}
+
+func (s *orgsSuite) TestOrgAccess(c *gc.C) {
+	s.createOrg(c)
+	for i, test := range []struct {
+		user   string
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"dave", "GET", "orgs/acme", nil},
+		{"dave", "GET", "orgs/widgets", nil},
+		{"carol", "PUT", "orgs/acme/members/dave", v5.OrgMemberRequest{Role: "member"}},
+		{"alice", "PUT", "orgs/acme/default-acl", v5.PermRequest{}},
+		{"bob", "PUT", "orgs/acme", v5.OrgRequest{}},
+		{"bob", "DELETE", "orgs/acme", nil},
+	} {
+		c.Logf("test %d: %s %s as %s", i, test.method, test.path, test.user)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:  s.srv,
+			URL:      storeURL(test.path),
+			Method:   test.method,
+			Do:       s.bakeryDoAsUser(test.user),
+			JSONBody: test.body,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+	}
+
+	// Non-members see no organisations.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("orgs"),
+		Do:         s.bakeryDoAsUser("dave"),
+		ExpectBody: []v5.Org{},
+	})
+
+	// Members are treated as members of a group named after
+	// the organisation.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("whoami"),
+		Do:      s.bakeryDoAsUser("carol"),
+		ExpectBody: params.WhoAmIResponse{
+			User:   "carol",
+			Groups: []string{"acme"},
+		},
+	})
+}
+
+func (s *orgsSuite) uploadCharm(c *gc.C, id, charmName, user string) *httptest.ResponseRecorder {
+	body, hash, size := archiveInfo(c, charmName)
+	defer body.Close()
+	return httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:       s.srv,
+		Do:            s.bakeryDoAsUser(user),
+		URL:           storeURL(id + "/archive?hash=" + hash),
+		Method:        "POST",
+		ContentLength: size,
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body: body,
+	})
+}
+
+func (s *orgsSuite) TestUploadToOrgNamespace(c *gc.C) {
+	s.createOrg(c)
+
+	// Members without the admin or uploader role cannot create
+	// new entities in the namespace, and neither can other users,
+	// even those in a group with the namespace's name.
+	rec := s.uploadCharm(c, "~acme/precise/wordpress", "wordpress", "carol")
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+	s.idmServer.AddUser("dave", "acme")
+	rec = s.uploadCharm(c, "~acme/precise/wordpress", "wordpress", "dave")
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+
+	rec = s.uploadCharm(c, "~acme/precise/wordpress", "wordpress", "alice")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+
+	// The new base entity is given the organisation's default ACL,
+	// which allows all members to read it but only admins and
+	// uploaders to change it or upload new revisions.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~acme/wordpress/meta/perm?channel=unpublished"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: defaultOrgACL(nil, "bob", "alice"),
+	})
+	rec = s.uploadCharm(c, "~acme/precise/wordpress", "mysql", "carol")
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+	rec = s.uploadCharm(c, "~acme/precise/wordpress", "mysql", "alice")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~acme/precise/wordpress-1/meta/id?channel=unpublished"),
+		Do:      s.bakeryDoAsUser("carol"),
+		ExpectBody: params.IdResponse{
+			Id:       charm.MustParseURL("~acme/precise/wordpress-1"),
+			User:     "acme",
+			Series:   "precise",
+			Name:     "wordpress",
+			Revision: 1,
+		},
+	})
+
+	// Namespaces that are not owned by an organisation are
+	// unaffected.
+	rec = s.uploadCharm(c, "~dave/precise/wordpress", "wordpress", "dave")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+}
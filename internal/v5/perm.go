@@ -0,0 +1,108 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"strings"
+
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// PermResponse holds the response to a GET id/meta/perm request.
+// It extends params.PermResponse with the users and groups that
+// are allowed to perform specific write operations.
+type PermResponse struct {
+	params.PermResponse
+	Upload  []string
+	Publish []string
+	SetPerm []string
+	Delete  []string
+}
+
+// PermRequest holds the body of a PUT id/meta/perm request.
+// It extends params.PermRequest with the users and groups that
+// are allowed to perform specific write operations. Unlike Read
+// and Write, a nil value leaves the corresponding permission
+// unchanged.
+type PermRequest struct {
+	params.PermRequest
+	Upload  []string `json:",omitempty"`
+	Publish []string `json:",omitempty"`
+	SetPerm []string `json:",omitempty"`
+	Delete  []string `json:",omitempty"`
+}
+
+// aclPerm returns the users and groups in the given ACL that hold
+// the permission with the given key, as used in id/meta/perm/key
+// requests. It reports whether the key is valid.
+func aclPerm(acl mongodoc.ACL, key string) ([]string, bool) {
+	switch key {
+	case "read":
+		return acl.Read, true
+	case "write":
+		return acl.Write, true
+	case "upload":
+		return acl.Upload, true
+	case "publish":
+		return acl.Publish, true
+	case "set-perm":
+		return acl.SetPerm, true
+	case "delete":
+		return acl.Delete, true
+	}
+	return nil, false
+}
+
+// setPerm requests that the permission with the given key in the
+// ACL for the given channel is set to perms, recording the change
+// with an audit entry. The key must be valid according to aclPerm.
+func setPerm(updater *router.FieldUpdater, id *router.ResolvedURL, ch params.Channel, key string, perms []string) {
+	setPerms(updater, id, ch, []string{key}, perms)
+}
+
+// writeDerivedPerms holds the keys of the permissions that are
+// derived from the write permission when a client that only knows
+// about read and write permissions sets it.
+var writeDerivedPerms = []string{"upload", "publish", "set-perm", "delete"}
+
+// setPerms is like setPerm except that it sets all the permissions
+// with the given keys to perms, recording the change with a single
+// audit entry.
+func setPerms(updater *router.FieldUpdater, id *router.ResolvedURL, ch params.Channel, keys []string, perms []string) {
+	acl := new(audit.ACL)
+	entry := &audit.Entry{
+		Op:      audit.OpSetPerm,
+		Entity:  &id.URL,
+		Channel: string(ch),
+		ACL:     acl,
+	}
+	for i, key := range keys {
+		switch key {
+		case "read":
+			acl.Read = perms
+		case "write":
+			acl.Write = perms
+		case "upload":
+			acl.Upload = perms
+		case "publish":
+			acl.Publish = perms
+		case "set-perm":
+			acl.SetPerm = perms
+		case "delete":
+			acl.Delete = perms
+		}
+		field := "channelacls." + string(ch) + "." + strings.Replace(key, "-", "", -1)
+		if i < len(keys)-1 {
+			updater.UpdateField(field, perms, nil)
+		} else {
+			// Record the whole change in the entry
+			// for the last field.
+			updater.UpdateField(field, perms, entry)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/monitoring"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// LimitRate applies the rate limits to the given request. Requests
+// without credentials are charged to their client address
+// immediately. Requests with credentials are charged to the user
+// when they are first authorized, or to their client address if
+// their credentials turn out to be invalid or are never checked.
+// Requests with the administrator's credentials are not limited.
+//
+// If the request is not allowed, the returned error has a
+// router.ErrTooManyRequests cause and the Retry-After header
+// is set on w.
+func (h *ReqHandler) LimitRate(w http.ResponseWriter, req *http.Request) error {
+	h.rateLimitKind = requestKind(req)
+	h.rateLimitHeader = w.Header()
+	h.rateLimitAddr = clientAddr(req, h.Handler.trustedProxies)
+	if h.isAdminRequest(req) {
+		return nil
+	}
+	h.rateLimitPending = true
+	if hasCredentials(req) {
+		return nil
+	}
+	return h.limitRateForAddr()
+}
+
+// limitRateForAuth charges the request to the user in the given
+// authorization, if it has not already been charged.
+func (h *ReqHandler) limitRateForAuth(auth Authorization) error {
+	if !h.rateLimitPending || auth.Admin || auth.Username == "" {
+		return nil
+	}
+	h.rateLimitPending = false
+	return h.limit("user", "user:"+auth.Username)
+}
+
+// limitRateForAddr charges the request to its client address, if it
+// has not already been charged.
+func (h *ReqHandler) limitRateForAddr() error {
+	if !h.rateLimitPending {
+		return nil
+	}
+	h.rateLimitPending = false
+	return h.limitAddr()
+}
+
+// chargeRateForAddr charges a request that has been served without
+// being charged, because its credentials were never checked, to its
+// client address, so that sending credentials does not avoid the
+// limits. The request cannot be refused at this point, but later
+// requests from the same address are.
+func (h *ReqHandler) chargeRateForAddr() {
+	if !h.rateLimitPending {
+		return
+	}
+	h.rateLimitPending = false
+	h.Handler.Pool.RateLimiter(h.rateLimitKind).Allow("ip:" + h.rateLimitAddr)
+}
+
+// hasCredentials reports whether the given request holds any
+// credentials, valid or not.
+func hasCredentials(req *http.Request) bool {
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Macaroons") != "" {
+		return true
+	}
+	for _, cookie := range req.Cookies() {
+		if strings.HasPrefix(cookie.Name, "macaroon-") {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminRequest reports whether the given request holds the
+// administrator's basic authentication credentials.
+func (h *ReqHandler) isAdminRequest(req *http.Request) bool {
+	user, passwd, err := parseCredentials(req)
+	if err != nil || h.Handler.config.AuthUsername == "" {
+		return false
+	}
+	return user == h.Handler.config.AuthUsername && passwd == h.Handler.config.AuthPassword
+}
+
+// limitAddr applies the rate limit to the client address
+// of the request.
+func (h *ReqHandler) limitAddr() error {
+	return h.limit("ip", "ip:"+h.rateLimitAddr)
+}
+
+// limit charges the request to the given key. The keyType is used
+// to label the throttled requests metric.
+func (h *ReqHandler) limit(keyType, key string) error {
+	ok, wait := h.Handler.Pool.RateLimiter(h.rateLimitKind).Allow(key)
+	if ok {
+		return nil
+	}
+	monitoring.RecordThrottledRequest(h.rateLimitKind.String(), keyType)
+	secs := int((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	h.rateLimitHeader.Set("Retry-After", fmt.Sprint(secs))
+	return errgo.WithCausef(nil, router.ErrTooManyRequests, "%s rate limit exceeded", h.rateLimitKind)
+}
+
+// requestKind returns the kind of the given request for the
+// purposes of rate limiting.
+func requestKind(req *http.Request) charmstore.RequestKind {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		return charmstore.WriteRequest
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, part := range parts {
+		if part == "meta" {
+			break
+		}
+		if i > 0 && (part == "archive" || part == "resource") {
+			return charmstore.DownloadRequest
+		}
+	}
+	return charmstore.ReadRequest
+}
+
+// clientAddr returns the address of the client that sent the given
+// request, without its port. When the request comes from one of the
+// given trusted proxies, the address is taken from the
+// X-Forwarded-For header instead: it is the last address added to
+// the header by a trusted proxy that is not itself a trusted proxy.
+func clientAddr(req *http.Request, trustedProxies []*net.IPNet) string {
+	addr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		addr = req.RemoteAddr
+	}
+	if !isTrustedProxy(addr, trustedProxies) {
+		return addr
+	}
+	var hops []string
+	for _, h := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Nothing before a malformed address can be trusted.
+			break
+		}
+		addr = hop
+		if !isTrustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return addr
+}
+
+// isTrustedProxy reports whether the given address is one of
+// the given trusted proxies.
+func isTrustedProxy(addr string, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses the given trusted proxy addresses,
+// each of which may be an IP address or a CIDR network.
+func parseTrustedProxies(addrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if strings.Contains(addr, "/") {
+			_, n, err := net.ParseCIDR(addr)
+			if err != nil {
+				return nil, errgo.Newf("invalid trusted proxy %q", addr)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, errgo.Newf("invalid trusted proxy %q", addr)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits, bits),
+		})
+	}
+	return nets, nil
+}
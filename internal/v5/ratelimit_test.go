@@ -0,0 +1,205 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/ratelimit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+type rateLimitSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&rateLimitSuite{})
+
+func (s *rateLimitSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.enableOIDC = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *rateLimitSuite) SetUpTest(c *gc.C) {
+	s.commonSuite.SetUpTest(c)
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/precise/wordpress-0", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~bob/precise/private-0", -1))
+	s.setPerms(c, map[string][]string{
+		"~bob/precise/private-0": {"bob", "alice"},
+	})
+}
+
+// limitedServer returns a server that shares the suite's database
+// with the given limits applied. The returned server must be closed
+// after use.
+func (s *rateLimitSuite) limitedServer(c *gc.C, read, write, download ratelimit.Limit) *charmstore.Server {
+	config := s.srvParams
+	config.ReadRateLimit = read
+	config.WriteRateLimit = write
+	config.DownloadRateLimit = download
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	return srv
+}
+
+// slowLimit allows a burst of requests, after which a request is
+// only allowed every 100 seconds.
+func slowLimit(burst int) ratelimit.Limit {
+	return ratelimit.Limit{
+		Rate:  0.01,
+		Burst: burst,
+	}
+}
+
+func (s *rateLimitSuite) assertAllowed(c *gc.C, h http.Handler, method, url string, header http.Header) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		Method:  method,
+		URL:     url,
+		Header:  header,
+	})
+	c.Assert(rec.Code, gc.Not(gc.Equals), http.StatusTooManyRequests, gc.Commentf("%s %s", method, url))
+}
+
+func (s *rateLimitSuite) assertThrottled(c *gc.C, h http.Handler, method, url string, header http.Header, kind string) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      h,
+		Method:       method,
+		URL:          url,
+		Header:       header,
+		ExpectStatus: http.StatusTooManyRequests,
+		ExpectHeader: http.Header{
+			"Retry-After": {"100"},
+		},
+		ExpectBody: params.Error{
+			Code:    router.ErrTooManyRequests,
+			Message: kind + " rate limit exceeded",
+		},
+	})
+}
+
+func (s *rateLimitSuite) TestReadLimitByAddress(c *gc.C) {
+	srv := s.limitedServer(c, slowLimit(2), ratelimit.Limit{}, ratelimit.Limit{})
+	defer srv.Close()
+	url := storeURL("~charmers/precise/wordpress-0/meta/id-name")
+	s.assertAllowed(c, srv, "GET", url, nil)
+	s.assertAllowed(c, srv, "GET", url, nil)
+	s.assertThrottled(c, srv, "GET", url, nil, "read")
+}
+
+func (s *rateLimitSuite) TestSeparateBudgets(c *gc.C) {
+	srv := s.limitedServer(c, slowLimit(1), slowLimit(1), slowLimit(1))
+	defer srv.Close()
+	metaURL := storeURL("~charmers/precise/wordpress-0/meta/id-name")
+	archiveURL := storeURL("~charmers/precise/wordpress-0/archive")
+	writeURL := storeURL("~charmers/precise/wordpress-0/meta/extra-info/foo")
+
+	s.assertAllowed(c, srv, "GET", metaURL, nil)
+	s.assertThrottled(c, srv, "GET", metaURL, nil, "read")
+
+	s.assertAllowed(c, srv, "GET", archiveURL, nil)
+	s.assertThrottled(c, srv, "GET", archiveURL, nil, "download")
+
+	s.assertAllowed(c, srv, "PUT", writeURL, nil)
+	s.assertThrottled(c, srv, "PUT", writeURL, nil, "write")
+}
+
+// fromAddr returns a handler that serves requests with h as if
+// they were sent from the given client address.
+func fromAddr(h http.Handler, addr string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.RemoteAddr = addr + ":1234"
+		h.ServeHTTP(w, req)
+	})
+}
+
+func (s *rateLimitSuite) TestLimitByUser(c *gc.C) {
+	srv := s.limitedServer(c, slowLimit(1), ratelimit.Limit{}, ratelimit.Limit{})
+	defer srv.Close()
+	url := storeURL("~bob/precise/private-0/meta/id-name")
+	bob := tokenHeader(s.oidcIssuer.Token("bob"))
+	s.assertAllowed(c, fromAddr(srv, "10.0.0.1"), "GET", url, bob)
+	// The user's budget applies from any address.
+	s.assertThrottled(c, fromAddr(srv, "10.0.0.2"), "GET", url, bob, "read")
+
+	// Other users and anonymous clients have their own budgets.
+	s.assertAllowed(c, fromAddr(srv, "10.0.0.3"), "GET", url, tokenHeader(s.oidcIssuer.Token("alice")))
+	s.assertAllowed(c, fromAddr(srv, "10.0.0.4"), "GET", storeURL("~charmers/precise/wordpress-0/meta/id-name"), nil)
+}
+
+func (s *rateLimitSuite) TestUserNotLimitedByAddress(c *gc.C) {
+	srv := s.limitedServer(c, slowLimit(1), ratelimit.Limit{}, ratelimit.Limit{})
+	defer srv.Close()
+	url := storeURL("~bob/precise/private-0/meta/id-name")
+	h := fromAddr(srv, "10.0.0.1")
+	s.assertAllowed(c, h, "GET", url, tokenHeader(s.oidcIssuer.Token("bob")))
+	s.assertAllowed(c, h, "GET", url, tokenHeader(s.oidcIssuer.Token("alice")))
+
+	// Authorized requests do not use up the address's budget.
+	publicURL := storeURL("~charmers/precise/wordpress-0/meta/id-name")
+	s.assertAllowed(c, h, "GET", publicURL, nil)
+	s.assertThrottled(c, h, "GET", publicURL, nil, "read")
+}
+
+func (s *rateLimitSuite) TestTrustedProxy(c *gc.C) {
+	config := s.srvParams
+	config.ReadRateLimit = slowLimit(1)
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+	url := storeURL("~charmers/precise/wordpress-0/meta/id-name")
+	header := http.Header{
+		"X-Forwarded-For": {"192.168.0.1"},
+	}
+	// Requests forwarded by trusted proxies are charged to the
+	// address of the client that they were forwarded for.
+	s.assertAllowed(c, fromAddr(srv, "10.0.0.1"), "GET", url, header)
+	s.assertThrottled(c, fromAddr(srv, "10.0.0.2"), "GET", url, header, "read")
+
+	// The header is ignored from other addresses.
+	s.assertAllowed(c, fromAddr(srv, "192.168.5.5"), "GET", url, header)
+}
+
+func (s *rateLimitSuite) TestInvalidCredentialsLimitedByAddress(c *gc.C) {
+	srv := s.limitedServer(c, slowLimit(1), ratelimit.Limit{}, ratelimit.Limit{})
+	defer srv.Close()
+	url := storeURL("~charmers/precise/wordpress-0/meta/id-name")
+	for i, header := range []http.Header{
+		{"Authorization": {"Bearer junk"}},
+		{"Macaroons": {"junk"}},
+		basicAuthHeader(testUsername, "wrong"),
+	} {
+		c.Logf("test %d: %v", i, header)
+		h := fromAddr(srv, fmt.Sprintf("10.0.1.%d", i))
+		s.assertAllowed(c, h, "GET", url, header)
+		s.assertThrottled(c, h, "GET", url, header, "read")
+	}
+}
+
+func (s *rateLimitSuite) TestAdminNotLimited(c *gc.C) {
+	srv := s.limitedServer(c, slowLimit(1), slowLimit(1), slowLimit(1))
+	defer srv.Close()
+	header := basicAuthHeader(testUsername, testPassword)
+	for i := 0; i < 3; i++ {
+		s.assertAllowed(c, srv, "GET", storeURL("~bob/precise/private-0/meta/id-name"), header)
+		s.assertAllowed(c, srv, "GET", storeURL("~bob/precise/private-0/archive"), header)
+	}
+}
+
+func (s *rateLimitSuite) TestNotLimitedByDefault(c *gc.C) {
+	url := storeURL("~charmers/precise/wordpress-0/meta/id-name")
+	for i := 0; i < 10; i++ {
+		s.assertAllowed(c, s.srv, "GET", url, nil)
+	}
+}
@@ -29,7 +29,7 @@ func (h *ReqHandler) metaCharmRelated(entity *mongodoc.Entity, id *router.Resolv
 	if len(entity.CharmProvidedInterfaces)+len(entity.CharmRequiredInterfaces) == 0 {
 		return &params.RelatedResponse{}, nil
 	}
-	fields := charmstore.FieldSelector(
+	fields := mongodoc.EntityFields.Set(
 		"supportedseries",
 		"charmrequiredinterfaces",
 		"charmprovidedinterfaces",
@@ -174,7 +174,7 @@ func (h *ReqHandler) metaBundlesContaining(entity *mongodoc.Entity, id *router.R
 
 	// Retrieve the bundles containing the resulting charm id.
 	q := h.Store.DB.Entities().Find(bson.D{{"bundlecharms", &searchId}})
-	iter := h.Cache.Iter(q, charmstore.FieldSelector("bundlecharms", "promulgated-url"))
+	iter := h.Cache.Iter(q, mongodoc.EntityFields.Set("bundlecharms", "promulgated-url"))
 	entities, err := allEntities(iter)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot retrieve the related bundles")
@@ -258,10 +258,8 @@ func (h *ReqHandler) metaBundlesContaining(entity *mongodoc.Entity, id *router.R
 }
 
 func (h *ReqHandler) getMetadataForEntities(entities []*mongodoc.Entity, includes []string, req *http.Request, includeEntity func(*mongodoc.Entity) bool) ([]params.EntityResult, error) {
-	for _, inc := range includes {
-		if h.Router.MetaHandler(inc) == nil {
-			return nil, errgo.Newf("unrecognized metadata name %q", inc)
-		}
+	if err := h.checkIncludes(includes); err != nil {
+		return nil, errgo.Mask(err)
 	}
 	response := make([]params.EntityResult, 0, len(entities))
 	for _, e := range entities {
@@ -287,6 +285,17 @@ func (h *ReqHandler) getMetadataForEntities(entities []*mongodoc.Entity, include
 	return response, nil
 }
 
+// checkIncludes checks that all the given metadata names are
+// recognized.
+func (h *ReqHandler) checkIncludes(includes []string) error {
+	for _, inc := range includes {
+		if h.Router.MetaHandler(inc) == nil {
+			return errgo.Newf("unrecognized metadata name %q", inc)
+		}
+	}
+	return nil
+}
+
 var errMetadataUnauthorized = errgo.Newf("metadata unauthorized")
 
 func (h *ReqHandler) getMetadataForEntity(e *mongodoc.Entity, includes []string, req *http.Request) (map[string]interface{}, error) {
@@ -5,6 +5,7 @@ package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
 
 import (
 	"encoding/hex"
+	"fmt"
 	"net/http"
 	"net/url"
 	"path"
@@ -16,6 +17,7 @@ import (
 	"gopkg.in/juju/charm.v6-unstable/resource"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
@@ -26,15 +28,19 @@ import (
 //
 // GET  id/resource/name[/revision]
 // https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idresourcesnamerevision
+//
+// DELETE id/resource/name/revision
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-idresourcenamerevision
 func (h *ReqHandler) serveResources(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
 	// Resources are "published" using "POST id/publish" so we don't
 	// support PUT here.
-	// TODO(ericsnow) Support DELETE to remove a resource (like serveArchive)?
 	switch req.Method {
 	case "GET":
 		return h.serveDownloadResource(id, w, req)
 	case "POST":
 		return h.serveUploadResource(id, w, req)
+	case "DELETE":
+		return h.serveDeleteResource(id, w, req)
 	default:
 		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
 	}
@@ -84,7 +90,7 @@ func (h *ReqHandler) serveUploadResource(id *router.ResolvedURL, w http.Response
 	if uploadId == "" && req.ContentLength == -1 {
 		return badRequestf(nil, "Content-Length not specified")
 	}
-	e, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("charmmeta"))
+	e, err := h.Cache.Entity(&id.URL, mongodoc.EntityFields.Set("charmmeta"))
 	if err != nil {
 		// Should never happen, as the entity will have been cached
 		// when the charm URL was resolved.
@@ -94,7 +100,7 @@ func (h *ReqHandler) serveUploadResource(id *router.ResolvedURL, w http.Response
 	if !ok {
 		return errgo.WithCausef(nil, params.ErrForbidden, "resource %q not found in charm metadata", name)
 	}
-	if r.Type != resource.TypeFile {
+	if r.Type != resource.TypeFile && !charmstore.IsOCIImageResource(r) {
 		return errgo.WithCausef(nil, params.ErrForbidden, "non-file resource types not supported")
 	}
 	if filename := req.Form.Get("filename"); filename != "" {
@@ -105,20 +111,61 @@ func (h *ReqHandler) serveUploadResource(id *router.ResolvedURL, w http.Response
 			}
 		}
 	}
+	info := &charmstore.ResourceUploadInfo{
+		Uploader:    h.auth.Username,
+		Description: req.Form.Get("description"),
+	}
+	if h.auth.Admin && info.Uploader == "" {
+		info.Uploader = "admin"
+	}
+	for _, kv := range req.Form["metadata"] {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return badRequestf(nil, "invalid metadata %q: expected key=value", kv)
+		}
+		if info.Metadata == nil {
+			info.Metadata = make(map[string]string)
+		}
+		info.Metadata[kv[:i]] = kv[i+1:]
+	}
 	var rdoc *mongodoc.Resource
 	if uploadId != "" {
-		rdoc, err = h.Store.AddResourceWithUploadId(id, name, uploadId)
+		rdoc, err = h.Store.AddResourceWithUploadId(id, name, uploadId, info)
 	} else {
-		rdoc, err = h.Store.UploadResource(id, name, req.Body, hash, req.ContentLength)
+		rdoc, err = h.Store.UploadResource(id, name, req.Body, hash, req.ContentLength, info)
 	}
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
 	}
+	h.addAudit(audit.Entry{
+		Op:       audit.OpUploadResource,
+		Entity:   &id.URL,
+		Resource: fmt.Sprintf("%s/%d", name, rdoc.Revision),
+	})
 	return httprequest.WriteJSON(w, http.StatusOK, &params.ResourceUploadResponse{
 		Revision: rdoc.Revision,
 	})
 }
 
+func (h *ReqHandler) serveDeleteResource(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	rid, err := parseResourceId(strings.TrimPrefix(req.URL.Path, "/"))
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrNotFound, "")
+	}
+	if rid.Revision == -1 {
+		return badRequestf(nil, "revision not specified")
+	}
+	if err := h.Store.DeleteResource(id, rid.Name, rid.Revision); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
+	}
+	h.addAudit(audit.Entry{
+		Op:       audit.OpDeleteResource,
+		Entity:   &id.URL,
+		Resource: fmt.Sprintf("%s/%d", rid.Name, rid.Revision),
+	})
+	return nil
+}
+
 // GET id/meta/resource
 // https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetaresources
 func (h *ReqHandler) metaResources(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -133,7 +180,7 @@ func (h *ReqHandler) metaResources(entity *mongodoc.Entity, id *router.ResolvedU
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	results := make([]params.Resource, len(resources))
+	results := make([]Resource, len(resources))
 	for i, res := range resources {
 		result, err := fromResourceDoc(res, entity.CharmMeta.Resources)
 		if err != nil {
@@ -196,17 +243,42 @@ func (h *ReqHandler) metaResourcesSingle0(entity *mongodoc.Entity, id *router.Re
 	return result, nil
 }
 
-func fromResourceDoc(doc *mongodoc.Resource, resources map[string]resource.Meta) (*params.Resource, error) {
+// Resource holds the information about a resource revision
+// returned by the meta/resources endpoints.
+type Resource struct {
+	params.Resource
+
+	// SHA256 holds the SHA256 hash of the resource content,
+	// in hexadecimal format.
+	SHA256 string `json:",omitempty"`
+
+	// Uploader holds the name of the user that uploaded
+	// the resource revision.
+	Uploader string `json:",omitempty"`
+
+	// RevisionDescription holds the description of this
+	// revision provided when it was uploaded. The Description
+	// field holds the description from the charm metadata.
+	RevisionDescription string `json:",omitempty"`
+
+	// Metadata holds any key/value metadata provided when
+	// the revision was uploaded.
+	Metadata map[string]string `json:",omitempty"`
+}
+
+func fromResourceDoc(doc *mongodoc.Resource, resources map[string]resource.Meta) (*Resource, error) {
 	meta, ok := resources[doc.Name]
 	if !ok {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "resource %q not found in charm", doc.Name)
 	}
-	r := &params.Resource{
-		Name:        doc.Name,
-		Revision:    -1,
-		Type:        meta.Type.String(),
-		Path:        meta.Path,
-		Description: meta.Description,
+	r := &Resource{
+		Resource: params.Resource{
+			Name:        doc.Name,
+			Revision:    -1,
+			Type:        meta.Type.String(),
+			Path:        meta.Path,
+			Description: meta.Description,
+		},
 	}
 	if doc.BlobHash == "" {
 		// No hash implies that there is no file (the entry
@@ -221,6 +293,10 @@ func fromResourceDoc(doc *mongodoc.Resource, resources map[string]resource.Meta)
 	r.Size = doc.Size
 	r.Fingerprint = rawHash
 	r.Revision = doc.Revision
+	r.SHA256 = doc.BlobHash256
+	r.Uploader = doc.Uploader
+	r.RevisionDescription = doc.Description
+	r.Metadata = doc.Metadata
 	return r, nil
 }
 
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/juju/testing/httptesting"
@@ -21,6 +22,7 @@ import (
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
 )
 
 type ResourceSuite struct {
@@ -74,6 +76,71 @@ func (s *ResourceSuite) TestPost(c *gc.C) {
 	c.Assert(string(data), gc.Equals, content)
 }
 
+func (s *ResourceSuite) TestPostWithMetadata(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id)
+	content := "some content"
+	hash := fmt.Sprintf("%x", sha512.Sum384([]byte(content)))
+	query := url.Values{
+		"hash":        {hash},
+		"description": {"fix the frobnicator"},
+		"metadata":    {"arch=amd64", "build=1=2"},
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		Body:         strings.NewReader(content),
+		URL:          storeURL(fmt.Sprintf("%s/resource/someResource?%s", id.URL.Path(), query.Encode())),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: params.ResourceUploadResponse{
+			Revision: 1,
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL(id.URL.Path() + "/meta/resources/someResource/1"),
+		ExpectBody: v5.Resource{
+			Resource: params.Resource{
+				Name:        "someResource",
+				Type:        "file",
+				Path:        "someResource-file",
+				Description: "someResource description",
+				Revision:    1,
+				Fingerprint: rawHash(hashOfString(content)),
+				Size:        int64(len(content)),
+			},
+			SHA256:              hash256OfString(content),
+			Uploader:            "charmers",
+			RevisionDescription: "fix the frobnicator",
+			Metadata: map[string]string{
+				"arch":  "amd64",
+				"build": "1=2",
+			},
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+}
+
+func (s *ResourceSuite) TestPostWithInvalidMetadata(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id)
+	content := "some content"
+	hash := fmt.Sprintf("%x", sha512.Sum384([]byte(content)))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		Body:         strings.NewReader(content),
+		URL:          storeURL(fmt.Sprintf("%s/resource/someResource?hash=%s&metadata=arch", id.URL.Path(), hash)),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid metadata "arch": expected key=value`,
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+}
+
 func (s *ResourceSuite) TestMultipartPost(c *gc.C) {
 	// Create the upload.
 	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
@@ -218,6 +285,134 @@ func (s *ResourceSuite) TestGet(c *gc.C) {
 	assertCacheControl(c, resp.Header(), true)
 }
 
+func (s *ResourceSuite) TestDelete(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	s.addPublicCharm(c, storetesting.NewCharm(meta), id)
+	s.uploadResource(c, id, "someResource", "some content")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		URL:     storeURL(id.URL.Path() + "/resource/someResource/1"),
+		Do:      s.bakeryDoAsUser("charmers"),
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "GET",
+		URL:          storeURL(id.URL.Path() + "/resource/someResource/1?channel=unpublished"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `cs:~charmers/precise/wordpress-0 has no "someResource/1" resource`,
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+}
+
+func (s *ResourceSuite) TestDeletePublished(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	s.addPublicCharm(c, storetesting.NewCharm(meta), id)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL(id.URL.Path() + "/resource/someResource/0"),
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `cannot delete "cs:~charmers/wordpress" resource "someResource/0" because it is published in channels [stable]`,
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+}
+
+func (s *ResourceSuite) TestDeleteWithoutRevision(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	s.addPublicCharm(c, storetesting.NewCharm(meta), id)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL(id.URL.Path() + "/resource/someResource"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `revision not specified`,
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+	})
+}
+
+func (s *ResourceSuite) TestDeleteUnauthorized(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	s.addPublicCharm(c, storetesting.NewCharm(meta), id)
+	s.uploadResource(c, id, "someResource", "some content")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL(id.URL.Path() + "/resource/someResource/1"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+		Do: s.bakeryDoAsUser("bob"),
+	})
+}
+
+func (s *ResourceSuite) TestUploadAndDeletePermissions(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	s.addPublicCharm(c, storetesting.NewCharm(meta), id)
+	// Give bob the upload permission only, leaving
+	// the write permission with charmers.
+	for _, ch := range []params.Channel{params.UnpublishedChannel, params.StableChannel} {
+		err := s.store.SetPerms(&id.URL, string(ch)+".upload", "bob")
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	content := "some content"
+	hash := fmt.Sprintf("%x", sha512.Sum384([]byte(content)))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		Body:    strings.NewReader(content),
+		URL:     storeURL(fmt.Sprintf("%s/resource/someResource?hash=%s&filename=foo.zip", id.URL.Path(), hash)),
+		ExpectBody: params.ResourceUploadResponse{
+			Revision: 1,
+		},
+		Do: s.bakeryDoAsUser("bob"),
+	})
+
+	// Deleting the resource requires the delete permission.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL(id.URL.Path() + "/resource/someResource/1"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+		Do: s.bakeryDoAsUser("bob"),
+	})
+	for _, ch := range []params.Channel{params.UnpublishedChannel, params.StableChannel} {
+		err := s.store.SetPerms(&id.URL, string(ch)+".delete", "bob")
+		c.Assert(err, gc.Equals, nil)
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		URL:     storeURL(id.URL.Path() + "/resource/someResource/1"),
+		Do:      s.bakeryDoAsUser("bob"),
+	})
+}
+
 func (s *ResourceSuite) TestInvalidMethod(c *gc.C) {
 	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
 	s.addPublicCharm(c, storetesting.NewCharm(nil), id)
@@ -519,22 +714,28 @@ func (s *ResourceSuite) TestMetaResources(c *gc.C) {
 		Handler:      s.srv,
 		URL:          storeURL(id.URL.Path() + "/meta/resources"),
 		ExpectStatus: http.StatusOK,
-		ExpectBody: []params.Resource{{
-			Name:        "resource1",
-			Type:        "file",
-			Path:        "resource1-file",
-			Description: "resource1 description",
-			Revision:    0,
-			Fingerprint: rawHash(hashOfString("resource1 content")),
-			Size:        int64(len("resource1 content")),
+		ExpectBody: []v5.Resource{{
+			Resource: params.Resource{
+				Name:        "resource1",
+				Type:        "file",
+				Path:        "resource1-file",
+				Description: "resource1 description",
+				Revision:    0,
+				Fingerprint: rawHash(hashOfString("resource1 content")),
+				Size:        int64(len("resource1 content")),
+			},
+			SHA256: hash256OfString("resource1 content"),
 		}, {
-			Name:        "resource2",
-			Type:        "file",
-			Path:        "resource2-file",
-			Description: "resource2 description",
-			Revision:    0,
-			Fingerprint: rawHash(hashOfString("resource2 content")),
-			Size:        int64(len("resource2 content")),
+			Resource: params.Resource{
+				Name:        "resource2",
+				Type:        "file",
+				Path:        "resource2-file",
+				Description: "resource2 description",
+				Revision:    0,
+				Fingerprint: rawHash(hashOfString("resource2 content")),
+				Size:        int64(len("resource2 content")),
+			},
+			SHA256: hash256OfString("resource2 content"),
 		}},
 	})
 }
@@ -636,14 +837,17 @@ func (s *ResourceSuite) TestMetaResourcesSingleResourceWithRevision(c *gc.C) {
 	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
 		Handler: s.srv,
 		URL:     storeURL(id.URL.Path() + "/meta/resources/someResource/0"),
-		ExpectBody: params.Resource{
-			Name:        "someResource",
-			Type:        "file",
-			Path:        "someResource-file",
-			Description: "someResource description",
-			Revision:    0,
-			Fingerprint: rawHash(hashOfString("someResource content")),
-			Size:        int64(len("someResource content")),
+		ExpectBody: v5.Resource{
+			Resource: params.Resource{
+				Name:        "someResource",
+				Type:        "file",
+				Path:        "someResource-file",
+				Description: "someResource description",
+				Revision:    0,
+				Fingerprint: rawHash(hashOfString("someResource content")),
+				Size:        int64(len("someResource content")),
+			},
+			SHA256: hash256OfString("someResource content"),
 		},
 		Do: s.bakeryDoAsUser("charmers"),
 	})
@@ -676,14 +880,17 @@ func (s *ResourceSuite) TestMetaResourcesSingleResourceWithRevisionNotInCharm(c
 	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
 		Handler: s.srv,
 		URL:     storeURL(id.URL.Path() + "/meta/resources/someResource/1"),
-		ExpectBody: params.Resource{
-			Name:        "someResource",
-			Type:        "file",
-			Path:        "someResource-file",
-			Description: "someResource description",
-			Revision:    1,
-			Fingerprint: rawHash(hashOfString("a new version")),
-			Size:        int64(len("a new version")),
+		ExpectBody: v5.Resource{
+			Resource: params.Resource{
+				Name:        "someResource",
+				Type:        "file",
+				Path:        "someResource-file",
+				Description: "someResource description",
+				Revision:    1,
+				Fingerprint: rawHash(hashOfString("a new version")),
+				Size:        int64(len("a new version")),
+			},
+			SHA256: hash256OfString("a new version"),
 		},
 		Do: s.bakeryDoAsUser("charmers"),
 	})
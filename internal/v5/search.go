@@ -31,9 +31,9 @@ func (h *ReqHandler) serveSearch(_ http.Header, req *http.Request) (interface{},
 		logger.Infof("authorization failed on search request, granting no privileges: %v", err)
 	}
 	sp.Admin = auth.Admin
-	if auth.User != nil {
+	if auth.Username != "" {
 		sp.Groups = append(sp.Groups, auth.Username)
-		groups, err := auth.User.Groups()
+		groups, err := h.UserGroups(auth)
 		if err != nil {
 			logger.Infof("cannot get groups for user %q, assuming no groups: %v", auth.Username, err)
 		}
@@ -4,21 +4,104 @@
 package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/juju/httprequest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
 )
 
 const dateFormat = "2006-01-02"
 
+// StatsResponse holds the result of an id/meta/stats GET request
+// when the breakdown or unique flags are set.
+type StatsResponse struct {
+	params.StatsResponse
+
+	// ArchiveDownloadByChannel, ArchiveDownloadBySeries and
+	// ArchiveDownloadByClientVersion hold the download counts for
+	// all revisions of the entity, keyed by the channel the entity
+	// was resolved in, the series requested by the client and the
+	// version of the client respectively. They are only set when
+	// the breakdown flag is set.
+	ArchiveDownloadByChannel       map[string]params.StatsCount `json:",omitempty"`
+	ArchiveDownloadBySeries        map[string]params.StatsCount `json:",omitempty"`
+	ArchiveDownloadByClientVersion map[string]params.StatsCount `json:",omitempty"`
+
+	// ArchiveUniqueDownload and ArchiveUniqueDownloadAllRevisions
+	// hold the estimated number of distinct clients that downloaded
+	// the entity revision and any revision of the entity
+	// respectively. They are only set when the unique flag is set.
+	ArchiveUniqueDownload             *params.StatsCount `json:",omitempty"`
+	ArchiveUniqueDownloadAllRevisions *params.StatsCount `json:",omitempty"`
+}
+
+// StatsTopResponse holds the result of a stats/top GET request.
+type StatsTopResponse struct {
+	Results []StatsTopResult
+}
+
+// StatsTopResult holds a charm or bundle in a StatsTopResponse.
+type StatsTopResult struct {
+	// Id holds the id of the latest stable revision of the
+	// charm or bundle.
+	Id *charm.URL
+
+	// Downloads holds the downloads of all revisions of the charm
+	// or bundle in the requested period.
+	Downloads int64
+
+	// PreviousDownloads holds the downloads of all revisions of the
+	// charm or bundle in the period before the requested period.
+	PreviousDownloads int64
+}
+
+// ModelUUIDHeader holds the name of the HTTP header that clients can
+// use to report the UUID of the model that an archive is downloaded
+// for. When present, it identifies the client in the unique client
+// counts instead of the client address.
+const ModelUUIDHeader = "Juju-Model-UUID"
+
+// ClientVersionHeader holds the name of the HTTP header that clients
+// can use to report their version when downloading archives. If it is
+// not present, the version is taken from a "Juju/version" product in
+// the User-Agent header.
+const ClientVersionHeader = "Juju-Client-Version"
+
+// clientVersionPattern matches the major and minor numbers of a
+// client version, which are recorded in the download statistics.
+var clientVersionPattern = regexp.MustCompile(`^([0-9]+)\.([0-9]+)`)
+
+// clientVersionMaxMinor holds the highest known minor version for each
+// known major version of the Juju client. Later minor versions are
+// recorded under their major version, and versions with other major
+// numbers are recorded as unknown, so that clients cannot create
+// arbitrarily many statistics keys.
+var clientVersionMaxMinor = map[int]int{
+	1: 25,
+	2: 9,
+	3: 6,
+}
+
 // parseDateRange parses a date range as specified in an http
 // request. The returned times will be zero if not specified.
 func parseDateRange(form url.Values) (start, stop time.Time, err error) {
@@ -41,9 +124,26 @@ func parseDateRange(form url.Values) (start, stop time.Time, err error) {
 	return
 }
 
-// GET stats/counter/key[:key]...?[by=unit]&start=date][&stop=date][&list=1]
+// GET stats/counter/key[:key]...?[by=unit]&start=date][&stop=date][&list=1][&unique=1][&format=csv]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-statscounter
-func (h *ReqHandler) serveStatsCounter(_ http.Header, r *http.Request) (interface{}, error) {
+func (h *ReqHandler) serveStatsCounter(w http.ResponseWriter, r *http.Request) error {
+	format := r.Form.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		return badRequestf(nil, "invalid 'format' value %q", format)
+	}
+	items, err := h.statsCounter(r)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if format == "csv" {
+		return writeStatisticsCSV(w, items)
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, items)
+}
+
+// statsCounter returns the statistics requested by the given
+// stats/counter request.
+func (h *ReqHandler) statsCounter(r *http.Request) ([]params.Statistic, error) {
 	base := strings.TrimPrefix(r.URL.Path, "/")
 	if strings.Index(base, "/") > 0 {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "invalid key")
@@ -59,6 +159,10 @@ func (h *ReqHandler) serveStatsCounter(_ http.Header, r *http.Request) (interfac
 		by = charmstore.ByDay
 	case "week":
 		by = charmstore.ByWeek
+	case "hour":
+		by = charmstore.ByHour
+	case "month":
+		by = charmstore.ByMonth
 	default:
 		return nil, badRequestf(nil, "invalid 'by' value %q", v)
 	}
@@ -79,7 +183,19 @@ func (h *ReqHandler) serveStatsCounter(_ http.Header, r *http.Request) (interfac
 			return nil, errgo.WithCausef(nil, params.ErrForbidden, "unknown key")
 		}
 	}
-	entries, err := h.Store.Counters(&req)
+	unique, err := router.ParseBool(r.Form.Get("unique"))
+	if err != nil {
+		return nil, badRequestf(err, "invalid unique parameter")
+	}
+	var entries []charmstore.Counter
+	if unique {
+		if req.By == charmstore.ByHour {
+			return nil, badRequestf(nil, "unique counts are not available by hour")
+		}
+		entries, err = h.Store.UniqueCounters(&req)
+	} else {
+		entries, err = h.Store.Counters(&req)
+	}
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot query counters")
 	}
@@ -105,7 +221,11 @@ func (h *ReqHandler) serveStatsCounter(_ http.Header, r *http.Request) (interfac
 			Count: entry.Count,
 		}
 		if !entry.Time.IsZero() {
-			stat.Date = entry.Time.Format("2006-01-02")
+			if req.By == charmstore.ByHour {
+				stat.Date = entry.Time.Format(time.RFC3339)
+			} else {
+				stat.Date = entry.Time.Format("2006-01-02")
+			}
 		}
 		items = append(items, stat)
 	}
@@ -113,6 +233,295 @@ func (h *ReqHandler) serveStatsCounter(_ http.Header, r *http.Request) (interfac
 	return items, nil
 }
 
+// writeStatisticsCSV writes the given statistics to w as CSV,
+// with a header row.
+func writeStatisticsCSV(w http.ResponseWriter, items []params.Statistic) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "date", "count"})
+	for _, item := range items {
+		cw.Write([]string{item.Key, item.Date, strconv.FormatInt(item.Count, 10)})
+	}
+	cw.Flush()
+	return errgo.Mask(cw.Error())
+}
+
+// statsTopPeriods holds the periods that can be specified in a
+// stats/top request.
+var statsTopPeriods = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+}
+
+const (
+	// defaultStatsTopLimit holds the default number of charms and
+	// bundles returned by a stats/top request.
+	defaultStatsTopLimit = 20
+
+	// maxStatsTopLimit holds the maximum number of charms and
+	// bundles returned by a stats/top request.
+	maxStatsTopLimit = 100
+)
+
+// maxStatsTopCandidates holds the maximum number of charms and bundles
+// that are looked up to find the results of a stats/top request. It
+// bounds the work done for requests by users who cannot read most of
+// the downloaded charms and bundles.
+var maxStatsTopCandidates = 1000
+
+// GET stats/top[?period=day|week|month][&mode=downloads|trending][&type=charm|bundle][&series=series][&limit=n]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-statstop
+func (h *ReqHandler) serveStatsTop(_ http.Header, req *http.Request) (interface{}, error) {
+	periodName := req.Form.Get("period")
+	if periodName == "" {
+		periodName = "week"
+	}
+	period, ok := statsTopPeriods[periodName]
+	if !ok {
+		return nil, badRequestf(nil, "invalid 'period' value %q", periodName)
+	}
+	mode := req.Form.Get("mode")
+	switch mode {
+	case "", "downloads", "trending":
+	default:
+		return nil, badRequestf(nil, "invalid 'mode' value %q", mode)
+	}
+	entityType := req.Form.Get("type")
+	switch entityType {
+	case "", "charm", "bundle":
+	default:
+		return nil, badRequestf(nil, "invalid 'type' value %q", entityType)
+	}
+	series := req.Form.Get("series")
+	limit, err := intValue(req.Form.Get("limit"), 1, defaultStatsTopLimit)
+	if err != nil {
+		return nil, badRequestf(err, "invalid limit value")
+	}
+	if limit > maxStatsTopLimit {
+		limit = maxStatsTopLimit
+	}
+	auth, err := h.Authenticate(req)
+	if err != nil {
+		logger.Infof("authorization failed on stats/top request, granting no privileges: %v", err)
+	}
+	trends, err := h.Store.ArchiveDownloadTrends(period)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get download trends")
+	}
+	if mode == "trending" {
+		// Rank by growth, ignoring the charms and bundles
+		// that are not growing. The cached slice must not
+		// be changed, so sort a copy.
+		growing := make([]charmstore.DownloadTrend, 0, len(trends))
+		for _, t := range trends {
+			if t.Growth() > 0 {
+				growing = append(growing, t)
+			}
+		}
+		sort.Stable(downloadTrendsByGrowth(growing))
+		trends = growing
+	}
+	results := make([]StatsTopResult, 0, limit)
+	candidates := 0
+	for _, t := range trends {
+		if len(results) == limit || candidates == maxStatsTopCandidates {
+			break
+		}
+		if mode != "trending" && t.Count == 0 {
+			break
+		}
+		if entityType != "" && (t.Id.Series == "bundle") != (entityType == "bundle") {
+			continue
+		}
+		if series != "" && t.Id.Series != "" && t.Id.Series != series {
+			continue
+		}
+		candidates++
+		id, err := h.statsTopEntity(t.Id, series, auth)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if id == nil {
+			continue
+		}
+		results = append(results, StatsTopResult{
+			Id:                id,
+			Downloads:         t.Count,
+			PreviousDownloads: t.PreviousCount,
+		})
+	}
+	return StatsTopResponse{
+		Results: results,
+	}, nil
+}
+
+// statsTopEntity returns the id of the latest stable revision of the
+// charm or bundle with the given id, or nil if there is none, it does
+// not support the given series or the authenticated user is not
+// allowed to read it.
+func (h *ReqHandler) statsTopEntity(id *charm.URL, series string, auth Authorization) (*charm.URL, error) {
+	entity, err := h.Store.FindBestEntity(id, params.StableChannel, charmstore.FieldSelector("supportedseries", "promulgated-url"))
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Notef(err, "cannot find %v", id)
+	}
+	if series != "" && entity.URL.Series == "" && !containsString(entity.SupportedSeries, series) {
+		return nil, nil
+	}
+	baseEntity, err := h.Cache.BaseEntity(entity.URL, mongodoc.BaseEntityFields.Set("channelacls"))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve base entity %q", entity.URL)
+	}
+	acl := baseEntity.ChannelACLs[params.StableChannel].Read
+	if !auth.Admin && !isPublicACL(acl) {
+		if auth.Username == "" {
+			return nil, nil
+		}
+		ok, err := h.allow(auth, acl)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if !ok {
+			return nil, nil
+		}
+	}
+	return entity.PreferredURL(true), nil
+}
+
+// downloadTrendsByGrowth sorts download trends with the fastest
+// growing first.
+type downloadTrendsByGrowth []charmstore.DownloadTrend
+
+func (s downloadTrendsByGrowth) Len() int           { return len(s) }
+func (s downloadTrendsByGrowth) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s downloadTrendsByGrowth) Less(i, j int) bool { return s[i].Growth() > s[j].Growth() }
+
+// defaultMetricsLimit holds the default number of charms and bundles
+// reported by the stats/metrics endpoint.
+const defaultMetricsLimit = 100
+
+// Options of the gauges reported by the stats/metrics endpoint.
+var (
+	entityDownloadsOpts = prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "stats",
+		Name:      "entity_downloads",
+		Help:      "The number of archive downloads of all revisions of the most downloaded charms and bundles.",
+	}
+	seriesDownloadsOpts = prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "stats",
+		Name:      "series_downloads",
+		Help:      "The number of archive downloads of each series.",
+	}
+)
+
+// GET stats/metrics[?limit=n]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-statsmetrics
+func (h *ReqHandler) serveStatsMetrics(w http.ResponseWriter, req *http.Request) error {
+	if err := h.authenticateAdmin(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	limit, err := intValue(req.Form.Get("limit"), 1, defaultMetricsLimit)
+	if err != nil {
+		return badRequestf(err, "invalid limit value")
+	}
+	totals, err := h.Store.ArchiveDownloadTotals()
+	if err != nil {
+		return errgo.Notef(err, "cannot get download totals")
+	}
+	entities := totals.Entities
+	if len(entities) > limit {
+		entities = entities[:limit]
+	}
+	// The values are totals that can go down when the
+	// reported charms and bundles change, so they are
+	// reported as gauges rather than counters.
+	entityDownloads := prometheus.NewGaugeVec(entityDownloadsOpts, []string{"id"})
+	for _, e := range entities {
+		entityDownloads.WithLabelValues(e.Id.String()).Set(float64(e.Count))
+	}
+	seriesDownloads := prometheus.NewGaugeVec(seriesDownloadsOpts, []string{"series"})
+	for s, count := range totals.Series {
+		seriesDownloads.WithLabelValues(s).Set(float64(count))
+	}
+	var families []*dto.MetricFamily
+	for _, g := range []struct {
+		opts prometheus.GaugeOpts
+		vec  *prometheus.GaugeVec
+	}{
+		{entityDownloadsOpts, entityDownloads},
+		{seriesDownloadsOpts, seriesDownloads},
+	} {
+		family, err := gaugeFamily(g.opts, g.vec)
+		if err != nil {
+			return errgo.Notef(err, "cannot collect metrics")
+		}
+		families = append(families, family)
+	}
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtText)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return errgo.Notef(err, "cannot encode metrics")
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err = w.Write(buf.Bytes())
+	return errgo.Mask(err)
+}
+
+// gaugeFamily returns the metric family holding all the gauges
+// collected from the given vector, ordered by their label values.
+func gaugeFamily(opts prometheus.GaugeOpts, vec *prometheus.GaugeVec) (*dto.MetricFamily, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	family := &dto.MetricFamily{
+		Name: proto.String(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)),
+		Help: proto.String(opts.Help),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	var err error
+	for m := range ch {
+		var metric dto.Metric
+		if werr := m.Write(&metric); werr != nil {
+			// Keep reading so that the collecting
+			// goroutine can finish.
+			err = werr
+			continue
+		}
+		family.Metric = append(family.Metric, &metric)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	sort.Sort(metricsByLabelValues(family.Metric))
+	return family, nil
+}
+
+type metricsByLabelValues []*dto.Metric
+
+func (m metricsByLabelValues) Len() int      { return len(m) }
+func (m metricsByLabelValues) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m metricsByLabelValues) Less(i, j int) bool {
+	li, lj := m[i].Label, m[j].Label
+	for k := 0; k < len(li) && k < len(lj); k++ {
+		if vi, vj := li[k].GetValue(), lj[k].GetValue(); vi != vj {
+			return vi < vj
+		}
+	}
+	return len(li) < len(lj)
+}
+
 // PUT stats/update
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#put-statsupdate
 func (h *ReqHandler) serveStatsUpdate(w http.ResponseWriter, r *http.Request) error {
@@ -174,3 +583,117 @@ func StatsEnabled(req *http.Request) bool {
 	req.ParseForm()
 	return req.Form.Get("stats") != "0"
 }
+
+// downloadInfo returns the information about the download of the
+// given id that is recorded in the download statistics.
+func (h *ReqHandler) downloadInfo(id *router.ResolvedURL, req *http.Request) *charmstore.DownloadInfo {
+	channel := h.Store.Channel
+	if channel == params.NoChannel {
+		// Ids are resolved in the stable channel by default.
+		channel = params.StableChannel
+	}
+	series := h.requestedSeries
+	if series == "" {
+		series = id.PreferredURL().Series
+	}
+	clientId := req.Header.Get(ModelUUIDHeader)
+	if clientId == "" {
+		clientId = clientAddr(req, h.Handler.trustedProxies)
+	}
+	return &charmstore.DownloadInfo{
+		Channel:       channel,
+		Series:        series,
+		ClientVersion: clientVersion(req),
+		ClientId:      clientId,
+	}
+}
+
+// clientVersion returns the major and minor version of the client
+// that sent the given request, or the empty string if it is not known.
+func clientVersion(req *http.Request) string {
+	if v := req.Header.Get(ClientVersionHeader); v != "" {
+		return knownClientVersion(v)
+	}
+	for _, product := range strings.Fields(req.UserAgent()) {
+		parts := strings.SplitN(product, "/", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "juju") {
+			return knownClientVersion(parts[1])
+		}
+	}
+	return ""
+}
+
+// knownClientVersion returns the major and minor numbers of the given
+// client version, or the major number followed by ".x" if the minor
+// version is later than any known one. It returns the empty string if
+// the major version is not known.
+func knownClientVersion(v string) string {
+	m := clientVersionPattern.FindStringSubmatch(v)
+	if m == nil {
+		return ""
+	}
+	major, err := strconv.Atoi(m[1])
+	if err != nil {
+		return ""
+	}
+	minor, err := strconv.Atoi(m[2])
+	if err != nil {
+		return ""
+	}
+	maxMinor, ok := clientVersionMaxMinor[major]
+	if !ok {
+		return ""
+	}
+	if minor > maxMinor {
+		return fmt.Sprintf("%d.x", major)
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
+
+// statsUnique sets the unique client counts in resp for the
+// entity with the given id.
+func (h *ReqHandler) statsUnique(resp *StatsResponse, id *charm.URL) error {
+	thisRevision, allRevisions, err := h.Store.ArchiveUniqueDownloadCounts(id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	thisRevisionCount, allRevisionsCount := statsCount(thisRevision), statsCount(allRevisions)
+	resp.ArchiveUniqueDownload = &thisRevisionCount
+	resp.ArchiveUniqueDownloadAllRevisions = &allRevisionsCount
+	return nil
+}
+
+// statsCount returns the given aggregated counts as a
+// params.StatsCount.
+func statsCount(c charmstore.AggregatedCounts) params.StatsCount {
+	return params.StatsCount{
+		Total: c.Total,
+		Day:   c.LastDay,
+		Week:  c.LastWeek,
+		Month: c.LastMonth,
+	}
+}
+
+// statsBreakdown returns resp with the download counts of the
+// entity with the given id broken down by channel, series and
+// client version.
+func (h *ReqHandler) statsBreakdown(resp *params.StatsResponse, id *charm.URL) (*StatsResponse, error) {
+	byKind := make(map[string]map[string]params.StatsCount)
+	for _, kind := range charmstore.DownloadDimensions {
+		counts, err := h.Store.ArchiveDownloadCountsBy(id, kind)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		m := make(map[string]params.StatsCount, len(counts))
+		for value, c := range counts {
+			m[value] = statsCount(c)
+		}
+		byKind[kind] = m
+	}
+	return &StatsResponse{
+		StatsResponse:                  *resp,
+		ArchiveDownloadByChannel:       byKind[charmstore.StatsArchiveDownloadChannel],
+		ArchiveDownloadBySeries:        byKind[charmstore.StatsArchiveDownloadSeries],
+		ArchiveDownloadByClientVersion: byKind[charmstore.StatsArchiveDownloadClientVersion],
+	}, nil
+}
@@ -617,6 +617,43 @@ func (s *StatsSuite) TestStatsCounterBy(c *gc.C) {
 			Date:  "2012-05-13",
 			Count: 3,
 		}},
+	}, {
+		request: charmstore.CounterRequest{
+			Key:    []string{"a"},
+			Prefix: false,
+			List:   false,
+			By:     charmstore.ByHour,
+		},
+		result: []params.Statistic{{
+			Date:  "2012-05-01T00:00:00Z",
+			Count: 1,
+		}, {
+			Date:  "2012-05-01T01:00:00Z",
+			Count: 1,
+		}, {
+			Date:  "2012-05-03T05:00:00Z",
+			Count: 1,
+		}},
+	}, {
+		request: charmstore.CounterRequest{
+			Key:    []string{"a"},
+			Prefix: true,
+			List:   true,
+			By:     charmstore.ByMonth,
+		},
+		result: []params.Statistic{{
+			Key:   "a:c:*",
+			Date:  "2012-05-01",
+			Count: 3,
+		}, {
+			Key:   "a:b",
+			Date:  "2012-05-01",
+			Count: 2,
+		}, {
+			Key:   "a:c",
+			Date:  "2012-05-01",
+			Count: 1,
+		}},
 	}}
 
 	for i, test := range tests {
@@ -639,6 +676,10 @@ func (s *StatsSuite) TestStatsCounterBy(c *gc.C) {
 			flags.Set("by", "day")
 		case charmstore.ByWeek:
 			flags.Set("by", "week")
+		case charmstore.ByHour:
+			flags.Set("by", "hour")
+		case charmstore.ByMonth:
+			flags.Set("by", "month")
 		}
 		if len(flags) > 0 {
 			url += "?" + flags.Encode()
@@ -652,6 +693,301 @@ func (s *StatsSuite) TestStatsCounterBy(c *gc.C) {
 	}
 }
 
+func (s *StatsSuite) TestStatsCounterCSV(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	t := time.Date(2012, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, key := range [][]string{{"a", "b"}, {"a", "b"}, {"a", "c"}} {
+		err := s.store.IncCounterAtTime(key, t)
+		c.Assert(err, gc.Equals, nil)
+	}
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("stats/counter/a:*?list=1&by=day&format=csv"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "text/csv; charset=utf-8")
+	c.Assert(rec.Body.String(), gc.Equals, `key,date,count
+a:b,2012-05-01,2
+a:c,2012-05-01,1
+`)
+}
+
+func (s *StatsSuite) TestStatsCounterInvalidFormat(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("stats/counter/a:*?format=xml"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid 'format' value "xml"`,
+		},
+	})
+}
+
+func (s *StatsSuite) TestStatsCounterUnique(c *gc.C) {
+	t := time.Date(2012, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, clientId := range []string{"client1", "client2", "client1"} {
+		err := s.store.IncUniqueAtTime([]string{"a", "b"}, clientId, t)
+		c.Assert(err, gc.Equals, nil)
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("stats/counter/a:*?unique=1&list=1&by=day"),
+		ExpectBody: []params.Statistic{{
+			Key:   "a:b",
+			Date:  "2012-05-01",
+			Count: 2,
+		}},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("stats/counter/a:*?unique=1&by=hour"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "unique counts are not available by hour",
+		},
+	})
+}
+
+func (s *StatsSuite) TestStatsTop(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/trusty/wordpress-1", 0))
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("~who/precise/mysql-0", -1))
+	s.addPublicCharmFromRepo(c, "multi-series", newResolvedURL("~who/multi-series-0", -1))
+	s.addPublicCharmFromRepo(c, "varnish", newResolvedURL("~bob/trusty/varnish-0", -1))
+	s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("~who/bundle/wordpress-simple-0", -1), true)
+	s.setPerms(c, map[string][]string{
+		"~bob/trusty/varnish": {"bob"},
+	})
+	now := time.Now()
+	for _, test := range []struct {
+		id       string
+		current  int
+		previous int
+	}{
+		{"~charmers/trusty/wordpress-1", 5, 10},
+		{"~who/precise/mysql-0", 3, 1},
+		{"~who/multi-series-0", 4, 0},
+		{"~bob/trusty/varnish-0", 10, 0},
+		{"~who/bundle/wordpress-simple-0", 2, 0},
+	} {
+		key := charmstore.EntityStatsKey(charm.MustParseURL(test.id), params.StatsArchiveDownload)
+		for i := 0; i < test.current; i++ {
+			err := s.store.IncCounterAtTime(key, now.Add(-time.Hour))
+			c.Assert(err, gc.Equals, nil)
+		}
+		for i := 0; i < test.previous; i++ {
+			err := s.store.IncCounterAtTime(key, now.Add(-8*24*time.Hour))
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+
+	for i, test := range []struct {
+		about      string
+		query      string
+		asAdmin    bool
+		expectBody v5.StatsTopResponse
+	}{{
+		about: "most downloaded this week",
+		query: "",
+		expectBody: v5.StatsTopResponse{
+			Results: []v5.StatsTopResult{{
+				Id:                charm.MustParseURL("cs:trusty/wordpress-0"),
+				Downloads:         5,
+				PreviousDownloads: 10,
+			}, {
+				Id:        charm.MustParseURL("cs:~who/multi-series-0"),
+				Downloads: 4,
+			}, {
+				Id:                charm.MustParseURL("cs:~who/precise/mysql-0"),
+				Downloads:         3,
+				PreviousDownloads: 1,
+			}, {
+				Id:        charm.MustParseURL("cs:~who/bundle/wordpress-simple-0"),
+				Downloads: 2,
+			}},
+		},
+	}, {
+		about:   "admin sees all entities",
+		query:   "?limit=2",
+		asAdmin: true,
+		expectBody: v5.StatsTopResponse{
+			Results: []v5.StatsTopResult{{
+				Id:        charm.MustParseURL("cs:~bob/trusty/varnish-0"),
+				Downloads: 10,
+			}, {
+				Id:                charm.MustParseURL("cs:trusty/wordpress-0"),
+				Downloads:         5,
+				PreviousDownloads: 10,
+			}},
+		},
+	}, {
+		about: "charms by series",
+		query: "?type=charm&series=trusty",
+		expectBody: v5.StatsTopResponse{
+			Results: []v5.StatsTopResult{{
+				Id:                charm.MustParseURL("cs:trusty/wordpress-0"),
+				Downloads:         5,
+				PreviousDownloads: 10,
+			}, {
+				Id:        charm.MustParseURL("cs:~who/multi-series-0"),
+				Downloads: 4,
+			}},
+		},
+	}, {
+		about: "bundles",
+		query: "?type=bundle",
+		expectBody: v5.StatsTopResponse{
+			Results: []v5.StatsTopResult{{
+				Id:        charm.MustParseURL("cs:~who/bundle/wordpress-simple-0"),
+				Downloads: 2,
+			}},
+		},
+	}, {
+		about: "trending",
+		query: "?mode=trending",
+		expectBody: v5.StatsTopResponse{
+			Results: []v5.StatsTopResult{{
+				Id:        charm.MustParseURL("cs:~who/multi-series-0"),
+				Downloads: 4,
+			}, {
+				Id:                charm.MustParseURL("cs:~who/precise/mysql-0"),
+				Downloads:         3,
+				PreviousDownloads: 1,
+			}, {
+				Id:        charm.MustParseURL("cs:~who/bundle/wordpress-simple-0"),
+				Downloads: 2,
+			}},
+		},
+	}, {
+		about: "most downloaded today",
+		query: "?period=day&limit=1",
+		expectBody: v5.StatsTopResponse{
+			Results: []v5.StatsTopResult{{
+				Id:        charm.MustParseURL("cs:trusty/wordpress-0"),
+				Downloads: 5,
+			}},
+		},
+	}} {
+		c.Logf("test %d: %s", i, test.about)
+		p := httptesting.JSONCallParams{
+			Handler:    s.srv,
+			URL:        storeURL("stats/top" + test.query),
+			ExpectBody: test.expectBody,
+		}
+		if test.asAdmin {
+			p.Username = testUsername
+			p.Password = testPassword
+		}
+		httptesting.AssertJSONCall(c, p)
+	}
+
+	// The number of charms and bundles looked up is bounded, even
+	// when they cannot be read.
+	s.PatchValue(v5.MaxStatsTopCandidates, 2)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("stats/top"),
+		ExpectBody: v5.StatsTopResponse{
+			Results: []v5.StatsTopResult{{
+				Id:                charm.MustParseURL("cs:trusty/wordpress-0"),
+				Downloads:         5,
+				PreviousDownloads: 10,
+			}},
+		},
+	})
+}
+
+func (s *StatsSuite) TestStatsTopBadRequest(c *gc.C) {
+	for _, test := range []struct {
+		query         string
+		expectMessage string
+	}{{
+		query:         "?period=year",
+		expectMessage: `invalid 'period' value "year"`,
+	}, {
+		query:         "?mode=popular",
+		expectMessage: `invalid 'mode' value "popular"`,
+	}, {
+		query:         "?type=app",
+		expectMessage: `invalid 'type' value "app"`,
+	}, {
+		query:         "?limit=0",
+		expectMessage: `invalid limit value: value must be >= 1`,
+	}} {
+		c.Logf("query %q", test.query)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL("stats/top" + test.query),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectMessage,
+			},
+		})
+	}
+}
+
+func (s *StatsSuite) TestStatsMetrics(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	now := time.Now()
+	for _, test := range []struct {
+		id string
+		n  int
+	}{
+		{"~charmers/trusty/wordpress-1", 3},
+		{"~charmers/trusty/wordpress-2", 1},
+		{"~who/precise/mysql-0", 2},
+	} {
+		id := charm.MustParseURL(test.id)
+		for _, key := range [][]string{
+			charmstore.EntityStatsKey(id, params.StatsArchiveDownload),
+			charmstore.DownloadDimensionStatsKey(id, charmstore.StatsArchiveDownloadSeries, id.Series),
+		} {
+			for i := 0; i < test.n; i++ {
+				err := s.store.IncCounterAtTime(key, now)
+				c.Assert(err, gc.Equals, nil)
+			}
+		}
+	}
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("stats/metrics?limit=2"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "text/plain; version=0.0.4")
+	c.Assert(rec.Body.String(), gc.Equals, `# HELP charmstore_stats_entity_downloads The number of archive downloads of all revisions of the most downloaded charms and bundles.
+# TYPE charmstore_stats_entity_downloads gauge
+charmstore_stats_entity_downloads{id="cs:~charmers/trusty/wordpress"} 4
+charmstore_stats_entity_downloads{id="cs:~who/precise/mysql"} 2
+# HELP charmstore_stats_series_downloads The number of archive downloads of each series.
+# TYPE charmstore_stats_series_downloads gauge
+charmstore_stats_series_downloads{series="precise"} 2
+charmstore_stats_series_downloads{series="trusty"} 4
+`)
+}
+
+func (s *StatsSuite) TestStatsMetricsUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("stats/metrics"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Message: "authentication failed: missing HTTP auth header",
+			Code:    params.ErrUnauthorized,
+		},
+	})
+}
+
 func (s *StatsSuite) TestStatsEnabled(c *gc.C) {
 	statsEnabled := func(url string) bool {
 		req, _ := http.NewRequest("GET", url, nil)
@@ -0,0 +1,355 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/httprequest"
+	"github.com/juju/idmclient"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// AccessTokenRequest holds the body of a POST /tokens request.
+type AccessTokenRequest struct {
+	// Description holds an optional description of the token.
+	Description string `json:",omitempty"`
+
+	// Entities holds the base entities that the token
+	// may be used with, for example "~bob/wordpress".
+	Entities []*charm.URL
+
+	// Ops holds the operations that the token allows: any of
+	// "read-no-terms", "write", "upload", "publish", "set-perm"
+	// and "delete".
+	Ops []string
+
+	// Channels holds the channels that the token allows
+	// the entities to be published to. Publishing also
+	// requires the "publish" operation.
+	Channels []params.Channel `json:",omitempty"`
+
+	// Expires holds the time the token expires. If it is
+	// omitted, the token does not expire.
+	Expires *time.Time `json:",omitempty"`
+}
+
+// AccessToken holds information about a personal access token.
+type AccessToken struct {
+	Id          string
+	User        string
+	Description string `json:",omitempty"`
+	Entities    []*charm.URL
+	Ops         []string
+	Channels    []params.Channel `json:",omitempty"`
+	Created     time.Time
+	Expires     *time.Time `json:",omitempty"`
+	LastUsed    *time.Time `json:",omitempty"`
+}
+
+// NewAccessTokenResponse holds the response to a POST /tokens request.
+type NewAccessTokenResponse struct {
+	AccessToken
+
+	// Token holds the secret token value. It is returned only
+	// when the token is created.
+	Token string
+}
+
+// tokenOps holds the operations that may be allowed
+// by an access token.
+var tokenOps = map[string]bool{
+	OpReadWithNoTerms: true,
+	OpWrite:           true,
+	OpUpload:          true,
+	OpPublish:         true,
+	OpSetPerm:         true,
+	OpDelete:          true,
+}
+
+// GET /tokens[?user=user]
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-tokens
+//
+// POST /tokens
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-tokens
+func (h *ReqHandler) serveTokens(_ http.Header, req *http.Request) (interface{}, error) {
+	auth, err := h.Authenticate(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	switch req.Method {
+	case "GET":
+		user := req.Form.Get("user")
+		if auth.Admin {
+			if user == "" {
+				return nil, badRequestf(nil, "user not specified")
+			}
+		} else if user == "" {
+			user = auth.Username
+		} else if user != auth.Username {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "cannot list access tokens of another user")
+		}
+		tokens, err := h.Store.AccessTokens(user)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		resp := make([]AccessToken, len(tokens))
+		for i := range tokens {
+			resp[i] = accessTokenInfo(&tokens[i])
+		}
+		return resp, nil
+	case "POST":
+		if auth.AuthMethod == authMethodOIDC {
+			return nil, errgo.WithCausef(nil, params.ErrForbidden, "access tokens cannot be created using an ID token")
+		}
+		if auth.User == nil {
+			return nil, errgo.WithCausef(nil, params.ErrForbidden, "access tokens cannot be created using admin credentials")
+		}
+		var p struct {
+			AccessTokenRequest `httprequest:",body"`
+		}
+		if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &p); err != nil {
+			return nil, badRequestf(err, "cannot unmarshal access token request")
+		}
+		tok, err := newAccessTokenDoc(auth.Username, &p.AccessTokenRequest)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		value, err := h.Store.NewAccessToken(tok)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		info := accessTokenInfo(tok)
+		h.addAudit(audit.Entry{
+			Op:       audit.OpCreateAccessToken,
+			NewValue: info,
+		})
+		return &NewAccessTokenResponse{
+			AccessToken: info,
+			Token:       value,
+		}, nil
+	}
+	return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+}
+
+// DELETE /tokens/id
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-tokensid
+func (h *ReqHandler) serveToken(w http.ResponseWriter, req *http.Request) error {
+	auth, err := h.Authenticate(req)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/")
+	if id == "" || strings.Contains(id, "/") {
+		return errgo.WithCausef(nil, params.ErrNotFound, "not found")
+	}
+	if req.Method != "DELETE" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	owner := auth.Username
+	if auth.Admin {
+		// Admin users may revoke any token.
+		owner = ""
+	}
+	tok, err := h.Store.RemoveAccessToken(id, owner)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	h.addAudit(audit.Entry{
+		Op:       audit.OpRevokeAccessToken,
+		OldValue: accessTokenInfo(tok),
+	})
+	return nil
+}
+
+// newAccessTokenDoc validates the given access token request and
+// returns the corresponding token for the given user.
+func newAccessTokenDoc(user string, r *AccessTokenRequest) (*mongodoc.AccessToken, error) {
+	if len(r.Entities) == 0 {
+		return nil, badRequestf(nil, "no entities specified")
+	}
+	if len(r.Ops) == 0 {
+		return nil, badRequestf(nil, "no operations specified")
+	}
+	tok := &mongodoc.AccessToken{
+		User:        user,
+		Description: r.Description,
+		Entities:    make([]*charm.URL, len(r.Entities)),
+		Ops:         r.Ops,
+		Channels:    r.Channels,
+	}
+	for i, id := range r.Entities {
+		if id == nil {
+			return nil, badRequestf(nil, "invalid entity")
+		}
+		if id.User == "" {
+			return nil, badRequestf(nil, "entity %q does not specify a user", id)
+		}
+		tok.Entities[i] = mongodoc.BaseURL(id)
+	}
+	canPublish := false
+	for _, op := range r.Ops {
+		if !tokenOps[op] {
+			return nil, badRequestf(nil, "invalid operation %q", op)
+		}
+		canPublish = canPublish || op == OpPublish
+	}
+	for _, c := range r.Channels {
+		if !params.ValidChannels[c] || c == params.UnpublishedChannel {
+			return nil, badRequestf(nil, "invalid channel %q", c)
+		}
+	}
+	if len(r.Channels) > 0 && !canPublish {
+		return nil, badRequestf(nil, "publishing requires the %q operation", OpPublish)
+	}
+	if r.Expires != nil {
+		if !r.Expires.After(time.Now()) {
+			return nil, badRequestf(nil, "expiry time is in the past")
+		}
+		tok.Expires = *r.Expires
+	}
+	return tok, nil
+}
+
+// accessTokenInfo returns the public information about the given token.
+func accessTokenInfo(tok *mongodoc.AccessToken) AccessToken {
+	info := AccessToken{
+		Id:          tok.Id,
+		User:        tok.User,
+		Description: tok.Description,
+		Entities:    tok.Entities,
+		Ops:         tok.Ops,
+		Channels:    tok.Channels,
+		Created:     tok.Created.UTC(),
+	}
+	if !tok.Expires.IsZero() {
+		t := tok.Expires.UTC()
+		info.Expires = &t
+	}
+	if !tok.LastUsed.IsZero() {
+		t := tok.LastUsed.UTC()
+		info.LastUsed = &t
+	}
+	return info
+}
+
+// accessTokenFromRequest returns the access token value held in
+// the Authorization header of the given request, and reports
+// whether it was found.
+func accessTokenFromRequest(req *http.Request) (string, bool) {
+	parts := strings.Fields(req.Header.Get("Authorization"))
+	if len(parts) != 2 || parts[0] != "Bearer" || !strings.HasPrefix(parts[1], charmstore.AccessTokenPrefix) {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// checkAccessToken returns the authorization granted by the access
+// token with the given value. The scope of the token is checked
+// separately by checkAccessTokenScope.
+func (h *ReqHandler) checkAccessToken(value string) (Authorization, error) {
+	if h.Handler.idmClient == nil {
+		return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "access tokens not supported")
+	}
+	tok, err := h.Store.AccessToken(value)
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid access token")
+		}
+		return Authorization{}, errgo.Mask(err)
+	}
+	ident, err := h.Handler.idmClient.DeclaredIdentity(map[string]string{
+		"username": tok.User,
+	})
+	if err != nil {
+		return Authorization{}, errgo.Notef(err, "cannot infer identity")
+	}
+	return Authorization{
+		User:       ident.(*idmclient.User),
+		Username:   tok.User,
+		AuthMethod: authMethodToken,
+		Token:      tok,
+	}, nil
+}
+
+// idlessTokenOps holds the operations that an access token may
+// allow on requests that do not refer to any entity. Uploading blobs
+// to /upload is needed before an entity with resources can be
+// uploaded, and does not expose anything outside the token's scope.
+var idlessTokenOps = map[string]bool{
+	OpUpload: true,
+}
+
+// checkAccessTokenScope checks that the given access token allows
+// the request with the given authorization parameters. Access tokens
+// may only be used for operations on the entities they specify, or
+// for operations in idlessTokenOps on requests that do not refer to
+// any entity.
+func checkAccessTokenScope(tok *mongodoc.AccessToken, p authorizeParams) error {
+	for _, op := range p.ops {
+		if !containsString(tok.Ops, op) {
+			return errgo.Newf("access token does not allow operation %q", op)
+		}
+	}
+	ids := make([]*charm.URL, 0, len(p.entityIds)+len(p.baseIds))
+	for _, id := range p.entityIds {
+		ids = append(ids, &id.URL)
+	}
+	ids = append(ids, p.baseIds...)
+	if len(ids) == 0 {
+		for _, op := range p.ops {
+			if !idlessTokenOps[op] {
+				return errgo.New("access token cannot be used for this request")
+			}
+		}
+		return nil
+	}
+	for _, id := range ids {
+		if !tokenAllowsEntity(tok, id) {
+			return errgo.Newf("access token does not allow access to %q", mongodoc.BaseURL(id))
+		}
+	}
+	for _, c := range p.publishChannels {
+		if !containsChannel(tok.Channels, c) {
+			return errgo.Newf("access token does not allow publishing to %q channel", c)
+		}
+	}
+	return nil
+}
+
+func tokenAllowsEntity(tok *mongodoc.AccessToken, id *charm.URL) bool {
+	baseURL := mongodoc.BaseURL(id)
+	for _, u := range tok.Entities {
+		if *u == *baseURL {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsChannel(chans []params.Channel, c params.Channel) bool {
+	for _, ch := range chans {
+		if ch == c {
+			return true
+		}
+	}
+	return false
+}
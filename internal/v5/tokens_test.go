@@ -0,0 +1,517 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+type tokensSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&tokensSuite{})
+
+func (s *tokensSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+// newToken creates an access token for the given user
+// with the given request parameters.
+func (s *tokensSuite) newToken(c *gc.C, user string, r v5.AccessTokenRequest) v5.NewAccessTokenResponse {
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("tokens"),
+		Method:   "POST",
+		Do:       s.bakeryDoAsUser(user),
+		JSONBody: r,
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	var tok v5.NewAccessTokenResponse
+	err := json.Unmarshal(resp.Body.Bytes(), &tok)
+	c.Assert(err, gc.Equals, nil)
+	return tok
+}
+
+// tokenHeader returns a header that authenticates
+// with the given access token.
+func tokenHeader(token string) http.Header {
+	return http.Header{
+		"Authorization": {"Bearer " + token},
+	}
+}
+
+func (s *tokensSuite) TestCreateAndListTokens(c *gc.C) {
+	entries := s.recordAuditEntries(c)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	tok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Description: "CI",
+		Entities:    []*charm.URL{charm.MustParseURL("~bob/wordpress"), charm.MustParseURL("~bob/trusty/mysql-3")},
+		Ops:         []string{v5.OpWrite},
+		Channels:    []params.Channel{params.EdgeChannel},
+		Expires:     &expires,
+	})
+	c.Assert(strings.HasPrefix(tok.Token, "cst_"), gc.Equals, true)
+	c.Assert(tok.Id, gc.Not(gc.Equals), "")
+	expect := v5.AccessToken{
+		Id:          tok.Id,
+		User:        "bob",
+		Description: "CI",
+		Entities:    []*charm.URL{charm.MustParseURL("~bob/wordpress"), charm.MustParseURL("~bob/mysql")},
+		Ops:         []string{v5.OpWrite},
+		Channels:    []params.Channel{params.EdgeChannel},
+		Created:     tok.Created,
+		Expires:     &expires,
+	}
+	c.Assert(tok.AccessToken, jc.DeepEquals, expect)
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "bob",
+		Op:         audit.OpCreateAccessToken,
+		NewValue:   expect,
+		AuthMethod: "macaroon",
+	}})
+
+	// Tokens created by other users are not listed.
+	s.newToken(c, "alice", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~alice/wordpress")},
+		Ops:      []string{v5.OpReadWithNoTerms},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("tokens"),
+		Do:         s.bakeryDoAsUser("bob"),
+		ExpectBody: []v5.AccessToken{expect},
+	})
+
+	// Admin users can list the tokens of any user.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("tokens?user=bob"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: []v5.AccessToken{expect},
+	})
+
+	// Other users cannot.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("tokens?user=bob"),
+		Do:           s.bakeryDoAsUser("alice"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "cannot list access tokens of another user",
+		},
+	})
+}
+
+var createTokenErrorsTests = []struct {
+	about         string
+	body          interface{}
+	expectMessage string
+}{{
+	about: "no entities",
+	body: v5.AccessTokenRequest{
+		Ops: []string{v5.OpWrite},
+	},
+	expectMessage: "no entities specified",
+}, {
+	about: "no operations",
+	body: v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+	},
+	expectMessage: "no operations specified",
+}, {
+	about: "entity without user",
+	body: v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("wordpress")},
+		Ops:      []string{v5.OpWrite},
+	},
+	expectMessage: `entity "cs:wordpress" does not specify a user`,
+}, {
+	about: "invalid operation",
+	body: v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpReadWithTerms},
+	},
+	expectMessage: `invalid operation "read-with-terms"`,
+}, {
+	about: "invalid channel",
+	body: v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpWrite},
+		Channels: []params.Channel{params.UnpublishedChannel},
+	},
+	expectMessage: `invalid channel "unpublished"`,
+}, {
+	about: "publishing without publish operation",
+	body: v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpReadWithNoTerms, v5.OpWrite},
+		Channels: []params.Channel{params.StableChannel},
+	},
+	expectMessage: `publishing requires the "publish" operation`,
+}, {
+	about: "expiry in the past",
+	body: map[string]interface{}{
+		"Entities": []string{"~bob/wordpress"},
+		"Ops":      []string{v5.OpWrite},
+		"Expires":  time.Now().Add(-time.Hour),
+	},
+	expectMessage: "expiry time is in the past",
+}, {
+	about: "invalid entity",
+	body: map[string]interface{}{
+		"Entities": []string{"bad:wolf"},
+		"Ops":      []string{v5.OpWrite},
+	},
+	expectMessage: `cannot unmarshal access token request: .*`,
+}}
+
+func (s *tokensSuite) TestCreateTokenErrors(c *gc.C) {
+	for i, test := range createTokenErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:  s.srv,
+			URL:      storeURL("tokens"),
+			Method:   "POST",
+			Do:       s.bakeryDoAsUser("bob"),
+			JSONBody: test.body,
+		})
+		c.Assert(resp.Code, gc.Equals, http.StatusBadRequest, gc.Commentf("body: %s", resp.Body.String()))
+		var perr params.Error
+		err := json.Unmarshal(resp.Body.Bytes(), &perr)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(perr.Code, gc.Equals, params.ErrBadRequest)
+		c.Assert(perr.Message, gc.Matches, test.expectMessage)
+	}
+}
+
+func (s *tokensSuite) TestCreateTokenAsAdmin(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("tokens"),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.AccessTokenRequest{
+			Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+			Ops:      []string{v5.OpWrite},
+		},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: "access tokens cannot be created using admin credentials",
+		},
+	})
+}
+
+func (s *tokensSuite) TestAccessTokenAuthorization(c *gc.C) {
+	wordpress := newResolvedURL("~bob/precise/wordpress-0", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", wordpress)
+	mysql := newResolvedURL("~bob/precise/mysql-0", -1)
+	s.addPublicCharmFromRepo(c, "mysql", mysql)
+	writeTok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpReadWithNoTerms, v5.OpWrite, v5.OpPublish},
+		Channels: []params.Channel{params.EdgeChannel},
+	}).Token
+	readTok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpReadWithNoTerms},
+	}).Token
+	// A token owned by a user without write access to wordpress.
+	aliceTok := s.newToken(c, "alice", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpWrite},
+	}).Token
+
+	tests := []struct {
+		about         string
+		token         string
+		method        string
+		path          string
+		body          interface{}
+		expectMessage string
+	}{{
+		about:  "write in scope",
+		token:  writeTok,
+		method: "PUT",
+		path:   "~bob/precise/wordpress-0/meta/extra-info/foo",
+		body:   "bar",
+	}, {
+		about:         "write to entity out of scope",
+		token:         writeTok,
+		method:        "PUT",
+		path:          "~bob/precise/mysql-0/meta/extra-info/foo",
+		body:          "bar",
+		expectMessage: `access token does not allow access to "cs:~bob/mysql"`,
+	}, {
+		about:         "write with read-only token",
+		token:         readTok,
+		method:        "PUT",
+		path:          "~bob/precise/wordpress-0/meta/extra-info/foo",
+		body:          "bar",
+		expectMessage: `access token does not allow operation "write"`,
+	}, {
+		about:         "delete with token that does not allow it",
+		token:         writeTok,
+		method:        "DELETE",
+		path:          "~bob/precise/wordpress-0/archive",
+		expectMessage: `access token does not allow operation "delete"`,
+	}, {
+		about:         "token does not extend user permissions",
+		token:         aliceTok,
+		method:        "PUT",
+		path:          "~bob/precise/wordpress-0/meta/extra-info/foo",
+		body:          "bar",
+		expectMessage: `access denied for user "alice"`,
+	}, {
+		about:  "publish to allowed channel",
+		token:  writeTok,
+		method: "PUT",
+		path:   "~bob/precise/wordpress-0/publish",
+		body: params.PublishRequest{
+			Channels: []params.Channel{params.EdgeChannel},
+		},
+	}, {
+		about:  "publish to disallowed channel",
+		token:  writeTok,
+		method: "PUT",
+		path:   "~bob/precise/wordpress-0/publish",
+		body: params.PublishRequest{
+			Channels: []params.Channel{params.StableChannel},
+		},
+		expectMessage: `access token does not allow publishing to "stable" channel`,
+	}, {
+		about:         "request not involving entities",
+		token:         writeTok,
+		method:        "GET",
+		path:          "whoami",
+		expectMessage: "access token cannot be used for this request",
+	}, {
+		about:         "tokens cannot create tokens",
+		token:         writeTok,
+		method:        "POST",
+		path:          "tokens",
+		body:          v5.AccessTokenRequest{},
+		expectMessage: "access token cannot be used for this request",
+	}, {
+		about:         "invalid token",
+		token:         "cst_bad",
+		method:        "PUT",
+		path:          "~bob/precise/wordpress-0/meta/extra-info/foo",
+		body:          "bar",
+		expectMessage: "invalid access token",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		p := httptesting.JSONCallParams{
+			Handler:  s.srv,
+			URL:      storeURL(test.path),
+			Method:   test.method,
+			Header:   tokenHeader(test.token),
+			JSONBody: test.body,
+		}
+		if test.expectMessage != "" {
+			p.ExpectStatus = http.StatusUnauthorized
+			p.ExpectBody = params.Error{
+				Code:    params.ErrUnauthorized,
+				Message: test.expectMessage,
+			}
+		}
+		httptesting.AssertJSONCall(c, p)
+	}
+}
+
+func (s *tokensSuite) TestAccessTokenUpload(c *gc.C) {
+	tok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpUpload},
+	}).Token
+	entries := s.recordAuditEntries(c)
+	header := tokenHeader(tok)
+	header.Set("Content-Type", "application/zip")
+	ch := storetesting.NewCharm(nil)
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/precise/wordpress/archive?hash=" + hashOfBytes(ch.Bytes())),
+		Method:  "POST",
+		Header:  header,
+		Body:    bytes.NewReader(ch.Bytes()),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "bob",
+		Op:         audit.OpUploadEntity,
+		Entity:     charm.MustParseURL("~bob/precise/wordpress-0"),
+		AuthMethod: "token",
+	}})
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/precise/mysql/archive?hash=" + hashOfBytes(ch.Bytes())),
+		Method:       "POST",
+		Header:       header,
+		Body:         bytes.NewReader(ch.Bytes()),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access token does not allow access to "cs:~bob/mysql"`,
+		},
+	})
+}
+
+func (s *tokensSuite) TestAccessTokenUploadBlob(c *gc.C) {
+	uploadTok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpUpload},
+	}).Token
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("upload"),
+		Method:  "POST",
+		Header:  tokenHeader(uploadTok),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	var uploadResp params.NewUploadResponse
+	err := json.Unmarshal(resp.Body.Bytes(), &uploadResp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(uploadResp.UploadId, gc.Not(gc.Equals), "")
+
+	readTok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpReadWithNoTerms},
+	}).Token
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("upload"),
+		Method:       "POST",
+		Header:       tokenHeader(readTok),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access token does not allow operation "upload"`,
+		},
+	})
+}
+
+func (s *tokensSuite) TestAccessTokenExpired(c *gc.C) {
+	id := newResolvedURL("~bob/precise/wordpress-0", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+	expires := time.Now().Add(time.Hour)
+	tok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpWrite},
+		Expires:  &expires,
+	}).Token
+	err := s.store.DB.AccessTokens().Update(nil, map[string]interface{}{
+		"$set": map[string]interface{}{"expires": time.Now().Add(-time.Minute)},
+	})
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/precise/wordpress-0/meta/extra-info/foo"),
+		Method:       "PUT",
+		Header:       tokenHeader(tok),
+		JSONBody:     "bar",
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "invalid access token",
+		},
+	})
+}
+
+func (s *tokensSuite) TestRevokeToken(c *gc.C) {
+	id := newResolvedURL("~bob/precise/wordpress-0", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+	tok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpWrite},
+	})
+	entries := s.recordAuditEntries(c)
+
+	// Other users cannot revoke the token.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("tokens/" + tok.Id),
+		Method:       "DELETE",
+		Do:           s.bakeryDoAsUser("alice"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `access token "` + tok.Id + `" not found`,
+		},
+	})
+
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("tokens/" + tok.Id),
+		Method:  "DELETE",
+		Do:      s.bakeryDoAsUser("bob"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "bob",
+		Op:         audit.OpRevokeAccessToken,
+		OldValue:   tok.AccessToken,
+		AuthMethod: "macaroon",
+	}})
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/precise/wordpress-0/meta/extra-info/foo"),
+		Method:       "PUT",
+		Header:       tokenHeader(tok.Token),
+		JSONBody:     "bar",
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "invalid access token",
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("tokens"),
+		Do:         s.bakeryDoAsUser("bob"),
+		ExpectBody: []v5.AccessToken{},
+	})
+}
+
+func (s *tokensSuite) TestRevokeTokenAsAdmin(c *gc.C) {
+	tok := s.newToken(c, "bob", v5.AccessTokenRequest{
+		Entities: []*charm.URL{charm.MustParseURL("~bob/wordpress")},
+		Ops:      []string{v5.OpWrite},
+	})
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("tokens/" + tok.Id),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.String()))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("tokens"),
+		Do:         s.bakeryDoAsUser("bob"),
+		ExpectBody: []v5.AccessToken{},
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"net/http"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// TransferRequest holds the body of a PUT id/transfer request.
+type TransferRequest struct {
+	// Owner holds the user or organisation that the charm or
+	// bundle will be transferred to.
+	Owner string
+}
+
+// TransferResponse holds the response to a PUT id/transfer request.
+type TransferResponse struct {
+	// Id holds the new base id of the charm or bundle.
+	Id *charm.URL
+}
+
+// PUT id/transfer
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idtransfer
+func (h *ReqHandler) serveTransfer(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "PUT" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	var transfer struct {
+		TransferRequest `httprequest:",body"`
+	}
+	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &transfer); err != nil {
+		return badRequestf(err, "cannot unmarshal transfer request body")
+	}
+	from := mongodoc.BaseURL(&id.URL)
+	if u, err := charm.ParseURL("~" + transfer.Owner + "/" + from.Name); err != nil || u.User != transfer.Owner || u.Series != "" {
+		return badRequestf(nil, "invalid owner %q", transfer.Owner)
+	}
+	if transfer.Owner == from.User {
+		return badRequestf(nil, "%s is already owned by %q", from, transfer.Owner)
+	}
+	to := *from
+	to.User = transfer.Owner
+
+	// The user must be allowed to change the permissions on all
+	// the channels of the charm or bundle, and to create new
+	// charms or bundles in the target namespace.
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, mongodoc.BaseEntityFields.Set("channelacls"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	acls := make([]mongodoc.ACL, 0, len(params.OrderedChannels))
+	for _, ch := range params.OrderedChannels {
+		acls = append(acls, baseEntity.ChannelACLs[ch])
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:              req,
+		acls:             acls,
+		entityIds:        []*router.ResolvedURL{id},
+		ignoreEntityACLs: true,
+		ops:              []string{OpSetPerm},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	users, err := h.newEntityUsers(to.User)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:     req,
+		acls:    []mongodoc.ACL{{Upload: users}},
+		ops:     []string{OpUpload},
+		baseIds: []*charm.URL{&to},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+
+	newId, err := h.Store.TransferBaseEntity(from, to.User)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot transfer charm or bundle", errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden), errgo.Is(params.ErrBadRequest))
+	}
+	h.addAudit(audit.Entry{
+		Op:       audit.OpTransferEntity,
+		Entity:   from,
+		NewValue: newId,
+	})
+	return httprequest.WriteJSON(w, http.StatusOK, &TransferResponse{
+		Id: newId,
+	})
+}
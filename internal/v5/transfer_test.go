@@ -0,0 +1,213 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+type transferSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&transferSuite{})
+
+func (s *transferSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *transferSuite) SetUpTest(c *gc.C) {
+	s.commonSuite.SetUpTest(c)
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~alice/precise/wordpress-0", -1))
+}
+
+func (s *transferSuite) TestTransferByOwner(c *gc.C) {
+	entries := s.recordAuditEntries(c)
+
+	// The owner cannot transfer to a namespace that they
+	// cannot upload to.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("~alice/wordpress/transfer"),
+		Method:   "PUT",
+		Do:       s.bakeryDoAsUser("alice"),
+		JSONBody: v5.TransferRequest{Owner: "team"},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+
+	err := s.store.SetOrg(&mongodoc.Org{
+		Name: "team",
+		Members: []mongodoc.OrgMember{{
+			User: "alice",
+			Role: mongodoc.OrgUploader,
+		}},
+	})
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~alice/precise/wordpress-0/transfer"),
+		Method:   "PUT",
+		Do:       s.bakeryDoAsUser("alice"),
+		JSONBody: v5.TransferRequest{Owner: "team"},
+		ExpectBody: v5.TransferResponse{
+			Id: charm.MustParseURL("~team/wordpress"),
+		},
+	})
+
+	// The old id resolves to the new one.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~alice/precise/wordpress-0/meta/id"),
+		ExpectBody: params.IdResponse{
+			Id:       charm.MustParseURL("~team/precise/wordpress-0"),
+			User:     "team",
+			Series:   "precise",
+			Name:     "wordpress",
+			Revision: 0,
+		},
+	})
+	c.Assert(*entries, jc.DeepEquals, []audit.Entry{{
+		User:       "alice",
+		Op:         audit.OpTransferEntity,
+		Entity:     charm.MustParseURL("~alice/wordpress"),
+		NewValue:   charm.MustParseURL("~team/wordpress"),
+		AuthMethod: "macaroon",
+	}})
+}
+
+func (s *transferSuite) TestTransferByAdmin(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~alice/wordpress/transfer"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.TransferRequest{Owner: "bob"},
+		ExpectBody: v5.TransferResponse{
+			Id: charm.MustParseURL("~bob/wordpress"),
+		},
+	})
+	// The old owner in the ACLs is replaced by the new owner.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~bob/wordpress/meta/perm/write"),
+		Do:         s.bakeryDoAsUser("bob"),
+		ExpectBody: []string{"bob"},
+	})
+}
+
+func (s *transferSuite) TestTransferNotOwner(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("~alice/wordpress/transfer"),
+		Method:   "PUT",
+		Do:       s.bakeryDoAsUser("bob"),
+		JSONBody: v5.TransferRequest{Owner: "bob"},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.String()))
+}
+
+var invalidTransferTests = []struct {
+	about        string
+	method       string
+	path         string
+	body         interface{}
+	expectStatus int
+	expectError  params.Error
+}{{
+	about:        "no owner",
+	method:       "PUT",
+	path:         "~alice/wordpress/transfer",
+	body:         v5.TransferRequest{},
+	expectStatus: http.StatusBadRequest,
+	expectError: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid owner ""`,
+	},
+}, {
+	about:        "invalid owner",
+	method:       "PUT",
+	path:         "~alice/wordpress/transfer",
+	body:         v5.TransferRequest{Owner: "bob/precise"},
+	expectStatus: http.StatusBadRequest,
+	expectError: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid owner "bob/precise"`,
+	},
+}, {
+	about:        "same owner",
+	method:       "PUT",
+	path:         "~alice/wordpress/transfer",
+	body:         v5.TransferRequest{Owner: "alice"},
+	expectStatus: http.StatusBadRequest,
+	expectError: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cs:~alice/wordpress is already owned by "alice"`,
+	},
+}, {
+	about:        "unknown entity",
+	method:       "PUT",
+	path:         "~alice/mysql/transfer",
+	body:         v5.TransferRequest{Owner: "bob"},
+	expectStatus: http.StatusNotFound,
+	expectError: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `no matching charm or bundle for cs:~alice/mysql`,
+	},
+}, {
+	about:        "method not allowed",
+	method:       "POST",
+	path:         "~alice/wordpress/transfer",
+	body:         v5.TransferRequest{Owner: "bob"},
+	expectStatus: http.StatusMethodNotAllowed,
+	expectError: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "POST not allowed",
+	},
+}}
+
+func (s *transferSuite) TestInvalidTransferRequests(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~bob/precise/wordpress-0", -1))
+	for i, test := range invalidTransferTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       test.method,
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectError,
+		})
+	}
+
+	// The target namespace must not already hold an entity
+	// with the same name.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~alice/wordpress/transfer"),
+		Method:       "PUT",
+		Username:     testUsername,
+		Password:     testPassword,
+		JSONBody:     v5.TransferRequest{Owner: "bob"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `cannot transfer charm or bundle: cannot transfer "cs:~alice/wordpress": "cs:~bob/wordpress" already exists`,
+		},
+	})
+}
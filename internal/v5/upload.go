@@ -16,6 +16,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
 )
 
@@ -26,7 +27,7 @@ const (
 
 // POST /upload?expiry=expiry-duration
 func (h *ReqHandler) serveUploadId(w http.ResponseWriter, req *http.Request) error {
-	_, err := h.Authenticate(req)
+	_, err := h.authenticateForOp(req, OpUpload)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
@@ -48,6 +49,10 @@ func (h *ReqHandler) serveUploadId(w http.ResponseWriter, req *http.Request) err
 		if err != nil {
 			return errgo.Mask(err)
 		}
+		h.addAudit(audit.Entry{
+			Op:       audit.OpCreateUpload,
+			NewValue: uploadId,
+		})
 		return httprequest.WriteJSON(w, http.StatusOK, &params.NewUploadResponse{
 			UploadId: uploadId,
 			// Match mongo's behaviour so we return an accurate time.
@@ -72,7 +77,7 @@ func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) e
 	// TODO: investigate using 100-Continue statuses to prevent
 	// unnecessary uploads.
 	defer io.Copy(ioutil.Discard, req.Body)
-	_, err := h.Authenticate(req)
+	_, err := h.authenticateForOp(req, OpUpload)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
@@ -18,6 +18,7 @@ import (
 	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/legacy"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/ratelimit"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/v4"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
 )
@@ -100,6 +101,16 @@ type ServerParams struct {
 	// write audit log entries.
 	AuditLogger *lumberjack.Logger
 
+	// AuditCheckpointKey optionally holds the key used to sign
+	// checkpoints of the audit log hash chain. If it is empty,
+	// no checkpoints are created or verified.
+	AuditCheckpointKey []byte
+
+	// AuditCheckpointInterval holds the number of audit log
+	// entries between signed checkpoints. If it's zero, a
+	// default value will be used.
+	AuditCheckpointInterval int
+
 	// RootKeyPolicy holds the default policy used when creating
 	// macaroon root keys.
 	RootKeyPolicy mgostorage.Policy
@@ -117,14 +128,88 @@ type ServerParams struct {
 	// If it's zero, a default value will be used.
 	MaxUploadParts int
 
+	// ResourceRetentionCount holds the number of unpublished
+	// revisions of each resource that are retained when the
+	// blobstore garbage collector runs. Older unpublished revisions
+	// are deleted so that their blobs can be reclaimed. Revisions
+	// published in any channel are always retained. If it's zero,
+	// no resource revisions are deleted.
+	ResourceRetentionCount int
+
 	// RunBlobStoreGC holds whether the server will run
 	// the blobstore garbage collector worker.
 	RunBlobStoreGC bool
 
+	// RunStatsCompaction holds whether the server will run
+	// the statistics compaction worker.
+	RunStatsCompaction bool
+
+	// StatsHourlyRetention holds the length of time that
+	// statistics counters are kept with hourly granularity
+	// before the statistics compaction worker rolls them up
+	// into daily counters. If it's zero, a default value will
+	// be used.
+	StatsHourlyRetention time.Duration
+
 	// NewBlobBackend returns a new blobstore backend
 	// that may use the given MongoDB database.
 	// If this is nil, a MongoDB backend will be used.
 	NewBlobBackend func(db *mgo.Database) blobstore.Backend
+
+	// NewGroupProvider returns the provider used to find out
+	// which groups users are members of, which may use the given
+	// MongoDB database. If this is nil, group membership is
+	// obtained from the identity manager.
+	NewGroupProvider func(db *mgo.Database) charmstore.GroupProvider
+
+	// GroupCacheMaxAge holds the maximum length of time that
+	// the groups of a user are cached for when NewGroupProvider
+	// is set. If it's zero, a default value will be used.
+	GroupCacheMaxAge time.Duration
+
+	// EntityCacheMaxAge holds the maximum length of time that
+	// entities are kept in the entity cache shared by all requests.
+	// Changes made by other servers using the same database are
+	// noticed within a few seconds. If it's zero, the shared
+	// entity cache is disabled.
+	EntityCacheMaxAge time.Duration
+
+	// OIDCIssuer holds the issuer identifier of an OpenID Connect
+	// provider whose ID tokens are accepted as bearer tokens
+	// to authenticate requests, for example
+	// https://accounts.example.com. If it is empty, OpenID
+	// Connect authentication is disabled.
+	OIDCIssuer string
+
+	// OIDCClientID holds the client identifier that ID tokens
+	// must be issued for.
+	OIDCClientID string
+
+	// OIDCJWKSURL holds the URL of the JSON Web Key Set used to
+	// verify ID tokens. If this and OIDCKeys are empty, it is
+	// discovered from the provider configuration of the issuer.
+	OIDCJWKSURL string
+
+	// OIDCKeys holds a JSON Web Key Set used to verify ID tokens.
+	// If it is set, keys are never fetched from the issuer.
+	OIDCKeys string
+
+	// OIDCUsernameClaim and OIDCGroupsClaim hold the ID token
+	// claims that hold the name of the user and the groups that
+	// the user is a member of. They default to "sub" and "groups".
+	OIDCUsernameClaim string
+	OIDCGroupsClaim   string
+
+	// ReadRateLimit, WriteRateLimit and DownloadRateLimit hold
+	// the rate limits applied to requests that read data, change
+	// data and download archives or resources respectively. Each
+	// authenticated user, or client IP address for unauthenticated
+	// requests, has its own budget. Requests with admin
+	// credentials are not limited. A zero limit disables
+	// rate limiting for that kind of request.
+	ReadRateLimit     ratelimit.Limit
+	WriteRateLimit    ratelimit.Limit
+	DownloadRateLimit ratelimit.Limit
 }
 
 // NewServer returns a new handler that handles charm store requests and stores
@@ -148,3 +233,10 @@ func NewServer(db *mgo.Database, es *elasticsearch.Database, idx string, config
 	}
 	return charmstore.NewServer(db, si, charmstore.ServerParams(config), newAPIs)
 }
+
+// NewMongoGroupProvider returns a group provider that uses the groups
+// managed by the charm store itself, which are stored in the given
+// database. It is suitable for use as ServerParams.NewGroupProvider.
+func NewMongoGroupProvider(db *mgo.Database) charmstore.GroupProvider {
+	return charmstore.NewMongoGroupProvider(db)
+}